@@ -13,22 +13,70 @@ import (
 
 const placeholder = "$"
 
-func (is InternalService) generateAccessTokens(user *entities.User) ([]entities.AccessToken, error) {
-	roles := user.Roles
+// accessTokenOptions describes how access tokens are issued.
+type accessTokenOptions struct {
+	SessionID string
+	ClientID  string
+	// Scopes limits the permissions to "microservice:method" pairs, nil
+	// grants every permission of the user roles
+	Scopes []string
+	// SingleToken issues one token for all roles even when
+	// LegacyPerRoleTokens is set
+	SingleToken bool
+	// ImpersonatorID marks the tokens as issued to this admin acting as the
+	// user
+	ImpersonatorID string
+	// Expiration overrides the access token lifetime when set
+	Expiration time.Duration
+}
+
+func (is InternalService) generateAccessTokens(user *entities.User, options accessTokenOptions) ([]entities.AccessToken, error) {
+	roles, err := is.userRoles(user)
+	if err != nil {
+		return nil, err
+	}
 	var tokenPermissions []entities.TokenPermission
 	var iTokenPermissions []interface{}
-	roles = append(roles, is.DefaultRole)
 
-	for _, role := range roles {
-		token, err := generateRandomToken(32)
-		if err != nil {
-			return nil, err
+	// Generate exp time
+	expiration := is.TokenExpirations.AccessToken
+	if options.Expiration != 0 {
+		expiration = options.Expiration
+	}
+	expiredAt := time.Now().Add(expiration).Unix()
+
+	scope := ""
+	if options.Scopes != nil {
+		scope = strings.Join(options.Scopes, " ")
+	}
+
+	// One token carries the permissions of all roles. Its rows keep the role
+	// they come from, so a role update only removes that part of the token.
+	singleToken := options.SingleToken || !is.LegacyPerRoleTokens
+
+	token, err := newAccessToken(options)
+	if err != nil {
+		return nil, err
+	}
+	for i, role := range roles {
+		if !singleToken && i > 0 {
+			token, err = newAccessToken(options)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		// Generate token permissions for each role
-		for _, permission := range role.Permissions {
-			// Generate exp time (adding one day to the current time)
-			expiredAt := time.Now().Add(is.TokenExpirations.AccessToken).Unix()
+		permissions := role.Permissions
+		if options.Scopes != nil {
+			permissions = nil
+			for _, permission := range role.Permissions {
+				permissions = append(permissions, scopePermissions(options.Scopes, permission)...)
+			}
+		}
+
+		for _, permission := range permissions {
+
 			requiredParams, err := is.replacePlaceholders(permission.RequiredParams, user)
 			if err != nil {
 				return nil, err
@@ -41,6 +89,10 @@ func (is InternalService) generateAccessTokens(user *entities.User) ([]entities.
 			tokenPermission := entities.TokenPermission{
 				Token:                      token,
 				UserID:                     user.InternalId,
+				SessionID:                  options.SessionID,
+				ClientID:                   options.ClientID,
+				Scope:                      scope,
+				ImpersonatorID:             options.ImpersonatorID,
 				Type:                       role.Type,
 				ExpiredAt:                  expiredAt,
 				RoleInternalID:             role.InternalID,
@@ -55,11 +107,57 @@ func (is InternalService) generateAccessTokens(user *entities.User) ([]entities.
 		}
 	}
 
-	err := is.TokenPermissionsRepository.SaveTokenPermissions(iTokenPermissions)
+	// A single token must exist even without permissions, since it still
+	// identifies the user (e.g. for userinfo). The row matches no method.
+	if singleToken && len(tokenPermissions) == 0 {
+		tokenPermission := entities.TokenPermission{
+			Token:          token,
+			UserID:         user.InternalId,
+			SessionID:      options.SessionID,
+			ClientID:       options.ClientID,
+			Scope:          scope,
+			ImpersonatorID: options.ImpersonatorID,
+			ExpiredAt:      expiredAt,
+		}
+
+		tokenPermissions = append(tokenPermissions, tokenPermission)
+		iTokenPermissions = append(iTokenPermissions, tokenPermission)
+	}
 
+	// The deny permissions of every role apply to every token, so a role
+	// cannot lift the denies of another. They are neither narrowed by scopes
+	// nor listed as access tokens.
+	denyPermissions, err := is.denyTokenPermissions(user, roles)
 	if err != nil {
 		return nil, err
 	}
+	var deniedTokens []string
+	for _, tokenPermission := range tokenPermissions {
+		if containsString(deniedTokens, tokenPermission.Token) {
+			continue
+		}
+		deniedTokens = append(deniedTokens, tokenPermission.Token)
+
+		for _, denyPermission := range denyPermissions {
+			denyPermission.Token = tokenPermission.Token
+			denyPermission.SessionID = options.SessionID
+			denyPermission.ClientID = options.ClientID
+			denyPermission.Scope = scope
+			denyPermission.ImpersonatorID = options.ImpersonatorID
+			denyPermission.ExpiredAt = expiredAt
+			iTokenPermissions = append(iTokenPermissions, denyPermission)
+		}
+	}
+
+	err = is.TokenPermissionsRepository.SaveTokenPermissions(iTokenPermissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if singleToken {
+		return []entities.AccessToken{{Token: token, ExpiredAt: expiredAt}}, nil
+	}
 
 	var accessTokens []entities.AccessToken
 
@@ -73,6 +171,52 @@ func (is InternalService) generateAccessTokens(user *entities.User) ([]entities.
 
 	return accessTokens, nil
 }
+
+// newAccessToken returns a random access token, marked as impersonated when
+// issued to an impersonator.
+func newAccessToken(options accessTokenOptions) (string, error) {
+	token, err := generateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	if options.ImpersonatorID != "" {
+		token = impersonationTokenPrefix + token
+	}
+
+	return token, nil
+}
+
+// denyTokenPermissions returns the deny permissions of the roles in the form
+// of token permissions without a token.
+func (is InternalService) denyTokenPermissions(user *entities.User, roles []entities.Role) ([]entities.TokenPermission, error) {
+	var tokenPermissions []entities.TokenPermission
+	for _, role := range roles {
+		for _, permission := range role.DenyPermissions {
+			requiredParams, err := is.replacePlaceholders(permission.RequiredParams, user)
+			if err != nil {
+				return nil, err
+			}
+			restrictedParams, err := is.replacePlaceholders(permission.RestrictedParams, user)
+			if err != nil {
+				return nil, err
+			}
+
+			tokenPermissions = append(tokenPermissions, entities.TokenPermission{
+				UserID:                     user.InternalId,
+				Type:                       role.Type,
+				RoleInternalID:             role.InternalID,
+				Deny:                       true,
+				PermissionMicroservice:     permission.Microservice,
+				PermissionMethod:           permission.Method,
+				PermissionRequiredParams:   requiredParams,
+				PermissionRestrictedParams: restrictedParams,
+			})
+		}
+	}
+
+	return tokenPermissions, nil
+}
+
 func (is InternalService) tokenPermissionExists(tokens []entities.AccessToken, tokenToSearch entities.AccessToken) bool {
 	for _, tokenPermission := range tokens {
 		if tokenPermission.Token == tokenToSearch.Token &&
@@ -89,7 +233,7 @@ func (is InternalService) tokenPermissionExists(tokens []entities.AccessToken, t
 func (is InternalService) replacePlaceholders(params []entities.Params, user *entities.User) ([]entities.Params, error) {
 	for i, param := range params {
 		for j, value := range param.Values {
-			if len(value) > 2 && value[:1] == placeholder {
+			if isPlaceholder(value) {
 				replace, err := getEntityValue(user, value[1:])
 				if err != nil {
 					return nil, err
@@ -121,7 +265,7 @@ func (is InternalService) checkHandler(data interface{}, meta interface{}) (inte
 		return nil, http.StatusInternalServerError, err
 	}
 
-	res, err := is.check(request)
+	res, err := is.check(request, methodCallIP)
 
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
@@ -138,34 +282,62 @@ func (is InternalService) checkHandler(data interface{}, meta interface{}) (inte
 	return NewOkResponse("Ok")
 }
 
-func (is InternalService) check(request Request) (bool, error) {
+func (is InternalService) check(request Request, ip string) (bool, error) {
 	data := request.Data.(map[string]interface{})
 	token, ok := data["token"].(string)
 	if !ok {
 		return false, errors.New("missed token")
 	}
 
-	if token == is.MasterToken {
-		return true, nil
+	serviceToken, err := is.findServiceToken(token)
+	if err != nil {
+		return false, err
+	}
+	if serviceToken != nil {
+		return serviceTokenAllows(serviceToken, request, ip), nil
+	}
+
+	if isAPIKey(token) {
+		return is.checkAPIKey(token, request, data)
 	}
 
-	tokens, err := is.TokenPermissionsRepository.FindTokenPermissions(
+	tokens, err := is.findTokenPermissions(
 		token,
 		request.Microservice,
 		request.Method,
 	)
 
-	if err != nil || len(tokens) == 0 {
+	if err != nil {
 		return false, err
 	}
 
-	return Validate(data, tokens), nil
+	allowed := len(tokens) > 0 && Validate(data, tokens)
+
+	if isImpersonationToken(token) {
+		is.auditImpersonatedCheck(token, tokens, request, allowed)
+	}
+
+	return allowed, nil
 }
 
+// Validate decides on the permissions of a token matching the method. Deny
+// permissions are evaluated first: a deny whose params hold for the request
+// refuses it whatever else matches. Otherwise at least one allow permission
+// must hold, and without one the request is refused.
 func Validate(data map[string]interface{}, tokens []entities.TokenPermission) bool {
+	for _, permission := range tokens {
+		if permission.Deny && permissionParamsHold(data, permission) {
+			return false
+		}
+	}
+
 	// Check if the token has permission to access the microservice and method
 	// At least one permission must be valid
 	for _, permission := range tokens {
+		if permission.Deny {
+			continue
+		}
+
 		// Validate required parameters
 		if !validateRequiredParams(data, permission.PermissionRequiredParams) {
 			continue
@@ -182,28 +354,16 @@ func Validate(data map[string]interface{}, tokens []entities.TokenPermission) bo
 	return false
 }
 
+// permissionParamsHold reports whether the request meets the required params
+// of the permission and none of its restricted params.
+func permissionParamsHold(data map[string]interface{}, permission entities.TokenPermission) bool {
+	return validateRequiredParams(data, permission.PermissionRequiredParams) &&
+		validateRestrictedParams(data, permission.PermissionRestrictedParams)
+}
+
 func validateRequiredParams(payload map[string]interface{}, requiredParams []entities.Params) bool {
 	for _, reqParam := range requiredParams {
-		pathParts := strings.Split(reqParam.Param, ".")
-		payloadParamValue, err := getNestedParam(payload, pathParts)
-		if err != nil || payloadParamValue == nil {
-			return false
-		}
-
-		// If the required param is set to All, then any value is accepted
-		if reqParam.All {
-			continue
-		}
-
-		// Check if the payload value matches one of the allowed values
-		isMatch := false
-		for _, value := range reqParam.Values {
-			if value == fmt.Sprintf("%v", payloadParamValue) {
-				isMatch = true
-				break
-			}
-		}
-		if !isMatch {
+		if !paramMatches(payload, reqParam, ParamMatchAll) {
 			return false
 		}
 	}
@@ -212,25 +372,10 @@ func validateRequiredParams(payload map[string]interface{}, requiredParams []ent
 
 func validateRestrictedParams(payload map[string]interface{}, restrictedParams []entities.Params) bool {
 	for _, resParam := range restrictedParams {
-		pathParts := strings.Split(resParam.Param, ".")
-		payloadParamValue, err := getNestedParam(payload, pathParts)
-		if err != nil {
-			// If restricted parameter not found in payload, it's fine
-			continue
-		}
-
-		if payloadParamValue != nil {
-			// If the restricted param is set to All, then any value is not accepted
-			if resParam.All {
-				return false
-			}
-
-			// Check if the payload value matches one of the restricted values
-			for _, value := range resParam.Values {
-				if value == fmt.Sprintf("%v", payloadParamValue) {
-					return false
-				}
-			}
+		// A restricted param rejects the request when its condition holds,
+		// e.g. when the value is present and equals one of the values
+		if paramMatches(payload, resParam, ParamMatchAny) {
+			return false
 		}
 	}
 	return true
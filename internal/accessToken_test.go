@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+func TestValidate(t *testing.T) {
+	ownedBy := func(userID string) []entities.Params {
+		return []entities.Params{{Param: "owner_id", Values: []string{userID}}}
+	}
+
+	tests := []struct {
+		name     string
+		data     map[string]interface{}
+		tokens   []entities.TokenPermission
+		expected bool
+	}{
+		{
+			name: "allow only",
+			data: map[string]interface{}{"owner_id": "user"},
+			tokens: []entities.TokenPermission{
+				{PermissionRequiredParams: ownedBy("user")},
+			},
+			expected: true,
+		},
+		{
+			name: "allow with params that do not hold",
+			data: map[string]interface{}{"owner_id": "other"},
+			tokens: []entities.TokenPermission{
+				{PermissionRequiredParams: ownedBy("user")},
+			},
+			expected: false,
+		},
+		{
+			name: "one of several allows holds",
+			data: map[string]interface{}{"owner_id": "other"},
+			tokens: []entities.TokenPermission{
+				{PermissionRequiredParams: ownedBy("user")},
+				{PermissionRequiredParams: ownedBy("other")},
+			},
+			expected: true,
+		},
+		{
+			name: "deny whose params hold",
+			data: map[string]interface{}{"owner_id": "other"},
+			tokens: []entities.TokenPermission{
+				{},
+				{Deny: true, PermissionRestrictedParams: ownedBy("user")},
+			},
+			expected: false,
+		},
+		{
+			name: "deny whose params do not hold",
+			data: map[string]interface{}{"owner_id": "user"},
+			tokens: []entities.TokenPermission{
+				{},
+				{Deny: true, PermissionRestrictedParams: ownedBy("user")},
+			},
+			expected: true,
+		},
+		{
+			name: "deny without params",
+			data: map[string]interface{}{"owner_id": "user"},
+			tokens: []entities.TokenPermission{
+				{},
+				{Deny: true},
+			},
+			expected: false,
+		},
+		{
+			name: "deny only",
+			data: map[string]interface{}{"owner_id": "user"},
+			tokens: []entities.TokenPermission{
+				{Deny: true, PermissionRequiredParams: ownedBy("other")},
+			},
+			expected: false,
+		},
+		{
+			name:     "no permissions",
+			data:     map[string]interface{}{},
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if allowed := Validate(test.data, test.tokens); allowed != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, allowed)
+			}
+		})
+	}
+}
+
+// newDenyTestService stores a user holding an editor role allowed to remove
+// documents, and an auditor role denying the removal of archived ones.
+func newDenyTestService(t *testing.T) (*InternalService, *testStorage, *entities.User) {
+	is, storage := newTestService(t)
+
+	user := entities.User{
+		InternalId: "user",
+		Email:      "user@example.com",
+		Roles: []entities.Role{
+			{
+				InternalID:  "editor-role",
+				Type:        "editor",
+				Permissions: []entities.Permission{{Microservice: "crud", Method: "delete"}},
+			},
+			{
+				InternalID: "auditor-role",
+				Type:       "auditor",
+				DenyPermissions: []entities.Permission{{Microservice: "crud", Method: "delete", RequiredParams: []entities.Params{
+					{Param: "archived", Values: []string{"true"}},
+				}}},
+			},
+		},
+	}
+	storage.insert("users", user)
+
+	return is, storage, &user
+}
+
+func TestCheckDenyFromAnotherRole(t *testing.T) {
+	is, _, user := newDenyTestService(t)
+
+	accessTokens, err := is.generateAccessTokens(user, accessTokenOptions{SessionID: "session"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accessTokens) != 1 {
+		t.Fatalf("expected a single token, got %+v", accessTokens)
+	}
+	token := accessTokens[0].Token
+
+	tests := []struct {
+		name     string
+		data     map[string]interface{}
+		expected bool
+	}{
+		{"deny holds", map[string]interface{}{"token": token, "archived": "true"}, false},
+		{"deny does not hold", map[string]interface{}{"token": token, "archived": "false"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allowed, err := is.check(Request{Microservice: "crud", Method: "delete", Data: test.data}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, allowed)
+			}
+		})
+	}
+}
+
+func TestCheckAPIKeyDeny(t *testing.T) {
+	is, storage, _ := newDenyTestService(t)
+
+	key := apiKeyPrefix + "key"
+	storage.insert("apiKeys", entities.APIKey{
+		ID:      "api-key",
+		Name:    "key",
+		KeyHash: hashToken(key),
+		UserID:  "user",
+		Scopes:  []string{"crud:delete"},
+	})
+
+	tests := []struct {
+		name     string
+		request  Request
+		expected bool
+	}{
+		{"deny holds", Request{Microservice: "crud", Method: "delete", Data: map[string]interface{}{"token": key, "archived": "true"}}, false},
+		{"deny does not hold", Request{Microservice: "crud", Method: "delete", Data: map[string]interface{}{"token": key, "archived": "false"}}, true},
+		{"outside the scopes", Request{Microservice: "crud", Method: "read", Data: map[string]interface{}{"token": key}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allowed, err := is.check(test.request, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, allowed)
+			}
+		})
+	}
+}
+
+func TestGenerateAccessTokens(t *testing.T) {
+	tests := []struct {
+		name           string
+		legacy         bool
+		options        accessTokenOptions
+		expectedTokens int
+	}{
+		{"single token", false, accessTokenOptions{}, 1},
+		{"single token requested in legacy mode", true, accessTokenOptions{SingleToken: true}, 1},
+		{"impersonated single token", false, accessTokenOptions{ImpersonatorID: "admin"}, 1},
+		{"token per role", true, accessTokenOptions{}, 2},
+		{"scopes without permissions", false, accessTokenOptions{Scopes: []string{"other:method"}}, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			is, storage, user := newDenyTestService(t)
+			is.LegacyPerRoleTokens = test.legacy
+
+			accessTokens, err := is.generateAccessTokens(user, test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(accessTokens) != test.expectedTokens {
+				t.Fatalf("expected %d access tokens, got %+v", test.expectedTokens, accessTokens)
+			}
+			for _, accessToken := range accessTokens {
+				if accessToken.Token == "" {
+					t.Errorf("expected no empty token, got %+v", accessTokens)
+				}
+				if isImpersonationToken(accessToken.Token) != (test.options.ImpersonatorID != "") {
+					t.Errorf("unexpected impersonation prefix on %q", accessToken.Token)
+				}
+			}
+
+			for _, document := range storage.documents("tokenPermissions") {
+				if document["token"] == "" || document["token"] == nil {
+					t.Errorf("expected no token permission without a token, got %v", document)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,476 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+const (
+	// apiKeyPrefix tells API keys apart from access tokens in check
+	apiKeyPrefix = "sak_"
+	// apiKeyLastUsedResolution limits last_used_at writes to one per period
+	apiKeyLastUsedResolution = time.Minute
+)
+
+type APIKeyRequest struct {
+	UserID string   `json:"user_id"`
+	Name   string   `json:"name" validate:"required"`
+	Scopes []string `json:"scopes" validate:"required,min=1"`
+	// ExpiredAt is a unix timestamp, zero for keys that never expire
+	ExpiredAt int64 `json:"expired_at"`
+}
+
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// validateAPIKeyRequest checks that the scopes are granted by the roles of
+// the owner. It returns the error text or an empty string.
+func (is *InternalService) validateAPIKeyRequest(user *entities.User, request *APIKeyRequest) (string, error) {
+	if request.ExpiredAt != 0 && request.ExpiredAt <= time.Now().Unix() {
+		return "expired_at must be in the future", nil
+	}
+
+	roles, err := is.userRoles(user)
+	if err != nil {
+		return "", err
+	}
+	for _, scope := range request.Scopes {
+		if !validScope(scope) || isOIDCScope(scope) {
+			return "Invalid scope: " + scope, nil
+		}
+
+		granted := false
+		for _, role := range roles {
+			for _, permission := range role.Permissions {
+				if len(scopePermissions([]string{scope}, permission)) > 0 {
+					granted = true
+				}
+			}
+		}
+		if !granted {
+			return "Scope is not granted by the roles of the user: " + scope, nil
+		}
+	}
+
+	return "", nil
+}
+
+// createAPIKey stores a new key of the user and returns it together with the
+// key value, which is not stored and cannot be shown again.
+func (is *InternalService) createAPIKey(user *entities.User, request *APIKeyRequest) (*entities.APIKey, string, error) {
+	id, err := generateRandomToken(16)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate api key id: %v", err)
+	}
+
+	secret, err := generateRandomToken(32)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate api key: %v", err)
+	}
+	key := apiKeyPrefix + secret
+
+	apiKey := &entities.APIKey{
+		ID:        id,
+		Name:      request.Name,
+		Prefix:    key[:len(apiKeyPrefix)+8],
+		KeyHash:   hashToken(key),
+		UserID:    user.InternalId,
+		Scopes:    request.Scopes,
+		CreatedAt: time.Now().Unix(),
+		ExpiredAt: request.ExpiredAt,
+	}
+
+	err = is.APIKeysRepository.CreateAPIKey(apiKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return apiKey, key, nil
+}
+
+// checkAPIKey validates the request against the permissions the key holds.
+// They are computed from the current roles of the owner, so removing a role
+// also narrows the keys of the user.
+func (is InternalService) checkAPIKey(key string, request Request, data map[string]interface{}) (bool, error) {
+	apiKey, user, err := is.findActiveAPIKey(key)
+	if err != nil || apiKey == nil {
+		return false, err
+	}
+
+	roles, err := is.userRoles(user)
+	if err != nil {
+		return false, err
+	}
+
+	tokens, err := is.apiKeyPermissions(user, roles, apiKey, request.Microservice, request.Method)
+	if err != nil || len(tokens) == 0 {
+		return false, err
+	}
+
+	return Validate(data, tokens), nil
+}
+
+// findActiveAPIKey returns the key and its owner, or nils when the key is
+// unknown, expired or its owner was removed. It records the use of the key.
+func (is InternalService) findActiveAPIKey(key string) (*entities.APIKey, *entities.User, error) {
+	apiKeys, err := is.APIKeysRepository.GetAPIKeys(map[string]interface{}{
+		"___key": hashToken(key),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now().Unix()
+	if len(apiKeys) == 0 || apiKeys[0].Expired(now) {
+		return nil, nil, nil
+	}
+	apiKey := apiKeys[0]
+
+	user, err := is.UsersRepository.GetUserByID(apiKey.UserID)
+	if err != nil {
+		// The owner was removed
+		return nil, nil, nil
+	}
+
+	if now-apiKey.LastUsedAt >= int64(apiKeyLastUsedResolution.Seconds()) {
+		err = is.APIKeysRepository.SetLastUsedAt(apiKey.ID, now)
+		if err != nil {
+			log.Println("Cannot update api key last use, err:", err)
+		}
+	}
+
+	return &apiKey, user, nil
+}
+
+// apiKeyPermissions returns the permissions of the method the key holds,
+// including the deny permissions of the owner, in the form of access token
+// permissions. roles are the expanded roles of the owner.
+func (is InternalService) apiKeyPermissions(user *entities.User, roles []entities.Role, apiKey *entities.APIKey, microservice string, method string) ([]entities.TokenPermission, error) {
+	var tokenPermissions []entities.TokenPermission
+
+	// The key is limited to the methods its scopes grant
+	if len(scopePermissions(apiKey.Scopes, entities.Permission{Microservice: microservice, Method: method})) == 0 {
+		return nil, nil
+	}
+
+	for _, role := range roles {
+		for _, permission := range role.Permissions {
+			if !permission.Matches(microservice, method) {
+				continue
+			}
+
+			requiredParams, err := is.replacePlaceholders(permission.RequiredParams, user)
+			if err != nil {
+				return nil, err
+			}
+			restrictedParams, err := is.replacePlaceholders(permission.RestrictedParams, user)
+			if err != nil {
+				return nil, err
+			}
+
+			tokenPermissions = append(tokenPermissions, entities.TokenPermission{
+				UserID:                     user.InternalId,
+				Type:                       role.Type,
+				ExpiredAt:                  apiKey.ExpiredAt,
+				RoleInternalID:             role.InternalID,
+				PermissionMicroservice:     permission.Microservice,
+				PermissionMethod:           permission.Method,
+				PermissionRequiredParams:   requiredParams,
+				PermissionRestrictedParams: restrictedParams,
+			})
+		}
+	}
+
+	// Deny permissions apply whatever the scopes of the key
+	denyPermissions, err := is.denyTokenPermissions(user, roles)
+	if err != nil {
+		return nil, err
+	}
+	for _, denyPermission := range denyPermissions {
+		if denyPermission.Matches(microservice, method) {
+			denyPermission.ExpiredAt = apiKey.ExpiredAt
+			tokenPermissions = append(tokenPermissions, denyPermission)
+		}
+	}
+
+	return tokenPermissions, nil
+}
+
+func (is InternalService) getUserAPIKeys(userID string) ([]entities.APIKey, error) {
+	apiKeys, err := is.APIKeysRepository.GetAPIKeys(map[string]interface{}{
+		"user_id": userID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]entities.APIKey, 0, len(apiKeys))
+	for _, apiKey := range apiKeys {
+		result = append(result, apiKey.Redacted())
+	}
+
+	return result, nil
+}
+
+func (is *InternalService) parseAPIKeyRequest(data interface{}) (*APIKeyRequest, interface{}, int, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return nil, NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Marshal" + err.Error())
+	}
+
+	var request APIKeyRequest
+	err = json.Unmarshal(jsonData, &request)
+	if err != nil {
+		return nil, NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Unmarshal" + err.Error())
+	}
+
+	errs := is.Validate.Struct(request)
+	if errs != nil {
+		log.Printf("Validation errors: %v", errs)
+		return nil, NewErrorResponse(
+			"InvalidDataFormatError",
+			"VLE_03",
+			"Validation error.",
+		), http.StatusBadRequest, errs
+	}
+
+	return &request, nil, 0, nil
+}
+
+func (is *InternalService) createAPIKeyResponse(user *entities.User, request *APIKeyRequest) (interface{}, int, error) {
+	errText, err := is.validateAPIKeyRequest(user, request)
+	if err != nil {
+		log.Println("Cannot get roles of the user, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+	if errText != "" {
+		return NewErrorResponse(
+			"APIKeyError",
+			"AKE_01",
+			errText,
+		), http.StatusBadRequest, nil
+	}
+
+	apiKey, key, err := is.createAPIKey(user, request)
+	if err != nil {
+		log.Println("Cannot create api key, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse(map[string]interface{}{
+		"api_key": apiKey.Redacted(),
+		"key":     key,
+	})
+}
+
+func (is *InternalService) createAPIKeyHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	tokenPermission, err := is.getTokenPermission(tokenFromRequest(data, meta))
+	// Tokens of OAuth clients cannot mint keys beyond their scope, nor can
+	// admins impersonating the user
+	if err != nil || tokenPermission.ClientID != "" || tokenPermission.ImpersonatorID != "" {
+		if err != nil && !errors.Is(err, errTokenNotFound) {
+			log.Println("Cannot get token owner, err:", err)
+		}
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	request, errResponse, status, err := is.parseAPIKeyRequest(data)
+	if request == nil {
+		return errResponse, status, err
+	}
+
+	user, err := is.UsersRepository.GetUserByID(tokenPermission.UserID)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	return is.createAPIKeyResponse(user, request)
+}
+
+func (is *InternalService) getAPIKeysHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	userID, err := is.getTokenOwnerID(tokenFromRequest(data, meta))
+	if err != nil {
+		if !errors.Is(err, errTokenNotFound) {
+			log.Println("Cannot get token owner, err:", err)
+		}
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	return is.getAPIKeysResponse(userID)
+}
+
+func (is *InternalService) revokeAPIKeyHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		log.Println("Invalid data format in revokeAPIKeyHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	userID, err := is.getTokenOwnerID(tokenFromRequest(data, meta))
+	if err != nil {
+		if !errors.Is(err, errTokenNotFound) {
+			log.Println("Cannot get token owner, err:", err)
+		}
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	apiKeyID, _ := dataMap["api_key_id"].(string)
+
+	// Users may only revoke their own keys
+	apiKey, err := is.APIKeysRepository.GetAPIKeyByID(apiKeyID)
+	if err != nil || apiKey.UserID != userID {
+		return NewErrorResponse(
+			"APIKeyNotFoundError",
+			"AKE_02",
+			"API key not found",
+		), http.StatusNotFound, nil
+	}
+
+	return is.revokeAPIKeyResponse(apiKey.ID)
+}
+
+func (is *InternalService) createUserAPIKeyHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	request, errResponse, status, err := is.parseAPIKeyRequest(data)
+	if request == nil {
+		return errResponse, status, err
+	}
+
+	if request.UserID == "" {
+		return NewErrorResponse(
+			"InvalidUserIDError",
+			"IUE_04",
+			"Invalid user ID",
+		), http.StatusBadRequest, nil
+	}
+
+	user, err := is.UsersRepository.GetUserByID(request.UserID)
+	if err != nil {
+		return NewErrorResponse(
+			"UserNotFoundError",
+			"UNF_01",
+			"User not found",
+		), http.StatusBadRequest, nil
+	}
+
+	return is.createAPIKeyResponse(user, request)
+}
+
+func (is *InternalService) getUserAPIKeysHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		log.Println("Invalid data format in getUserAPIKeysHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	userID, ok := dataMap["user_id"].(string)
+	if !ok || userID == "" {
+		return NewErrorResponse(
+			"InvalidUserIDError",
+			"IUE_04",
+			"Invalid user ID",
+		), http.StatusBadRequest, nil
+	}
+
+	return is.getAPIKeysResponse(userID)
+}
+
+func (is *InternalService) revokeUserAPIKeyHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		log.Println("Invalid data format in revokeUserAPIKeyHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	apiKeyID, _ := dataMap["api_key_id"].(string)
+
+	apiKey, err := is.APIKeysRepository.GetAPIKeyByID(apiKeyID)
+	if err != nil {
+		return NewErrorResponse(
+			"APIKeyNotFoundError",
+			"AKE_02",
+			"API key not found",
+		), http.StatusNotFound, nil
+	}
+
+	return is.revokeAPIKeyResponse(apiKey.ID)
+}
+
+func (is *InternalService) getAPIKeysResponse(userID string) (interface{}, int, error) {
+	apiKeys, err := is.getUserAPIKeys(userID)
+	if err != nil {
+		log.Println("Cannot get api keys, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse(apiKeys)
+}
+
+func (is *InternalService) revokeAPIKeyResponse(apiKeyID string) (interface{}, int, error) {
+	err := is.APIKeysRepository.RemoveAPIKeys(map[string]interface{}{"api_key_id": apiKeyID})
+	if err != nil {
+		log.Println("Cannot revoke api key, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse("API key revoked successfully")
+}
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+type testAPIKey struct {
+	APIKey entities.APIKey `json:"api_key"`
+	Key    string          `json:"key"`
+}
+
+// createTestAPIKey creates a key with the token of its owner.
+func createTestAPIKey(t *testing.T, is *InternalService, token string, scopes ...interface{}) testAPIKey {
+	t.Helper()
+
+	response, _, _ := is.createAPIKeyHandler(map[string]interface{}{"name": "ci", "scopes": scopes}, map[string]interface{}{"token": token})
+
+	var created testAPIKey
+	decodeResult(t, response, &created)
+
+	return created
+}
+
+func checkAPIKeyAllowed(t *testing.T, is *InternalService, key string, method string, data map[string]interface{}) bool {
+	t.Helper()
+
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["token"] = key
+
+	return checkAllowed(t, is, Request{Microservice: "crud", Method: method, Data: data})
+}
+
+func TestAPIKeyPermissions(t *testing.T) {
+	is, storage, user := newDenyTestService(t)
+	created := createTestAPIKey(t, is, signedInToken(t, is, user.InternalId), "crud:delete")
+
+	if !strings.HasPrefix(created.Key, apiKeyPrefix) || !strings.HasPrefix(created.Key, created.APIKey.Prefix) || created.APIKey.KeyHash != "" {
+		t.Fatalf("expected a prefixed key and no hash in the response, got %+v", created)
+	}
+	for _, document := range storage.documents("apiKeys") {
+		if document["___key"] != hashToken(created.Key) {
+			t.Errorf("expected only the hash of the key to be stored, got %v", document)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		data     map[string]interface{}
+		expected bool
+	}{
+		{"scope granted by a role", "delete", map[string]interface{}{"archived": "false"}, true},
+		{"deny of the owner", "delete", map[string]interface{}{"archived": "true"}, false},
+		// The default role grants read, but the key is not scoped to it
+		{"outside the scopes", "read", nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if allowed := checkAPIKeyAllowed(t, is, created.Key, test.method, test.data); allowed != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, allowed)
+			}
+		})
+	}
+
+	apiKey, err := is.APIKeysRepository.GetAPIKeyByID(created.APIKey.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiKey.LastUsedAt == 0 {
+		t.Error("expected the use of the key to be recorded")
+	}
+
+	// Keys follow the roles of the owner
+	user.Roles = user.Roles[1:]
+	if err := is.UsersRepository.UpdateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if checkAPIKeyAllowed(t, is, created.Key, "delete", map[string]interface{}{"archived": "false"}) {
+		t.Error("expected the key to lose the permissions of a removed role")
+	}
+}
+
+func TestCreateAPIKeyValidation(t *testing.T) {
+	is, _, user := newDenyTestService(t)
+	token := signedInToken(t, is, user.InternalId)
+
+	tests := []struct {
+		name     string
+		data     map[string]interface{}
+		expected string
+	}{
+		{"no name", map[string]interface{}{"scopes": []interface{}{"crud:read"}}, "VLE_03"},
+		{"no scopes", map[string]interface{}{"name": "ci", "scopes": []interface{}{}}, "VLE_03"},
+		{"invalid scope", map[string]interface{}{"name": "ci", "scopes": []interface{}{"crud"}}, "AKE_01"},
+		{"openid scope", map[string]interface{}{"name": "ci", "scopes": []interface{}{oidcScopeOpenID}}, "AKE_01"},
+		{"scope not granted", map[string]interface{}{"name": "ci", "scopes": []interface{}{"crud:create"}}, "AKE_01"},
+		{"expired", map[string]interface{}{"name": "ci", "scopes": []interface{}{"crud:read"}, "expired_at": float64(time.Now().Add(-time.Hour).Unix())}, "AKE_01"},
+		{"granted by the default role", map[string]interface{}{"name": "ci", "scopes": []interface{}{"crud:read"}}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, _, _ := is.createAPIKeyHandler(test.data, map[string]interface{}{"token": token})
+			if code := errorCode(response); code != test.expected {
+				t.Errorf("expected %q, got %+v", test.expected, response)
+			}
+		})
+	}
+}
+
+func TestCreateAPIKeyWithDelegatedToken(t *testing.T) {
+	is, _, user := newDenyTestService(t)
+
+	for _, options := range []accessTokenOptions{
+		{SessionID: "impersonation", ImpersonatorID: "admin"},
+		{SessionID: "oauth", ClientID: "app", Scopes: []string{"crud:read"}},
+	} {
+		accessTokens, err := is.generateAccessTokens(user, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, _, _ := is.createAPIKeyHandler(map[string]interface{}{"name": "ci", "scopes": []interface{}{"crud:read"}}, map[string]interface{}{"token": accessTokens[0].Token})
+		if code := errorCode(response); code != "TKE_01" {
+			t.Errorf("expected TKE_01 for a token of %+v, got %+v", options, response)
+		}
+	}
+}
+
+func TestExpiredAPIKey(t *testing.T) {
+	is, storage, _ := newDenyTestService(t)
+
+	key := apiKeyPrefix + "expired"
+	storage.insert("apiKeys", entities.APIKey{
+		ID:        "expired",
+		Name:      "ci",
+		KeyHash:   hashToken(key),
+		UserID:    "user",
+		Scopes:    []string{"crud:read"},
+		ExpiredAt: time.Now().Add(-time.Minute).Unix(),
+	})
+
+	if checkAPIKeyAllowed(t, is, key, "read", nil) {
+		t.Error("expected an expired key to be refused")
+	}
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	is, storage, user := newDenyTestService(t)
+	storage.insert("users", entities.User{InternalId: "other", Email: "other@example.com"})
+
+	created := createTestAPIKey(t, is, signedInToken(t, is, user.InternalId), "crud:read")
+	otherToken := signedInToken(t, is, "other")
+
+	response, _, _ := is.getAPIKeysHandler(nil, map[string]interface{}{"token": otherToken})
+	var listed []entities.APIKey
+	decodeResult(t, response, &listed)
+	if len(listed) != 0 {
+		t.Errorf("expected only the keys of the token owner, got %+v", listed)
+	}
+
+	// Users may only revoke their own keys
+	response, _, _ = is.revokeAPIKeyHandler(map[string]interface{}{"api_key_id": created.APIKey.ID}, map[string]interface{}{"token": otherToken})
+	if code := errorCode(response); code != "AKE_02" {
+		t.Fatalf("expected AKE_02 for the key of another user, got %+v", response)
+	}
+	if !checkAPIKeyAllowed(t, is, created.Key, "read", nil) {
+		t.Fatal("expected the key to be kept")
+	}
+
+	response, _, _ = is.getUserAPIKeysHandler(map[string]interface{}{"user_id": "user"}, nil)
+	decodeResult(t, response, &listed)
+	if len(listed) != 1 || listed[0].KeyHash != "" {
+		t.Errorf("expected the key without its hash, got %+v", listed)
+	}
+
+	response, _, _ = is.revokeUserAPIKeyHandler(map[string]interface{}{"api_key_id": created.APIKey.ID}, nil)
+	if code := errorCode(response); code != "" {
+		t.Fatalf("expected the key to be revoked, got %+v", response)
+	}
+	if checkAPIKeyAllowed(t, is, created.Key, "read", nil) {
+		t.Error("expected a revoked key to be refused")
+	}
+}
@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+// Authenticator verifies a login and password against an external
+// directory. Authenticators are tried in order before the local password.
+type Authenticator interface {
+	// Name identifies the directory in the identities of its users
+	Name() string
+	// LinkByEmail reports whether the directory is trusted with emails, so an
+	// entry can be linked to an existing user with the same email
+	LinkByEmail() bool
+	// Authenticate returns the directory entry when the password matches,
+	// errInvalidCredentials when the login is unknown or the password wrong
+	Authenticate(login string, password string) (*DirectoryUser, error)
+}
+
+// DirectoryUser is an entry of an external directory.
+type DirectoryUser struct {
+	// ID is the stable id of the entry in the directory
+	ID    string
+	Email string
+	Phone string
+	// Data is merged into User.Data on every sign in
+	Data map[string]interface{}
+	// RoleIDs are the roles granted through group membership. ManagedRoleIDs
+	// are all roles the directory controls; those not granted are removed.
+	RoleIDs        []string
+	ManagedRoleIDs []string
+}
+
+var errDirectoryUserConflict = errors.New("a user with the email of the directory entry exists")
+
+// authenticate checks the credentials with the configured authenticators
+// and falls back to the local password.
+func (is *InternalService) authenticate(login string, password string) (*entities.User, error) {
+	for _, authenticator := range is.Authenticators {
+		directoryUser, err := authenticator.Authenticate(login, password)
+		if err != nil {
+			if !errors.Is(err, errInvalidCredentials) {
+				log.Println("Cannot authenticate with "+authenticator.Name()+", err:", err)
+			}
+			continue
+		}
+
+		user, err := is.provisionDirectoryUser(authenticator, directoryUser)
+		if errors.Is(err, errDirectoryUserConflict) {
+			// The existing user may still sign in with its local password
+			log.Println("Cannot link "+authenticator.Name()+" entry "+directoryUser.ID+", err:", err)
+			continue
+		}
+
+		return user, err
+	}
+
+	return is.authenticatePassword(login, password)
+}
+
+// provisionDirectoryUser returns the user of the directory entry, creating
+// it just in time, and syncs its data and directory managed roles. An
+// existing user with the same email is only linked to the entry when the
+// directory is trusted with emails and manages all roles of the user, since
+// the directory would otherwise take over permissions it does not control.
+// Else errDirectoryUserConflict is returned.
+func (is *InternalService) provisionDirectoryUser(authenticator Authenticator, directoryUser *DirectoryUser) (*entities.User, error) {
+	user, err := is.UsersRepository.GetUserByIdentity(authenticator.Name(), directoryUser.ID)
+	if err != nil && directoryUser.Email != "" {
+		emailUser, emailErr := is.UsersRepository.GetUserByEmail(directoryUser.Email)
+		if emailErr == nil {
+			if !authenticator.LinkByEmail() || !managesAllRoles(directoryUser, emailUser) {
+				return nil, errDirectoryUserConflict
+			}
+			user, err = emailUser, nil
+		}
+	}
+
+	if err != nil {
+		newUser := &entities.User{
+			Email: directoryUser.Email,
+			Data:  map[string]interface{}{},
+		}
+		// Phones must stay unique across users
+		if directoryUser.Phone != "" {
+			if _, err := is.UsersRepository.GetUserByPhone(directoryUser.Phone); err != nil {
+				newUser.Phone = directoryUser.Phone
+			}
+		}
+		newUser.AddIdentity(directoryIdentity(authenticator, directoryUser))
+
+		err = is.UsersRepository.CreateUser(newUser)
+		if err != nil {
+			return nil, err
+		}
+
+		// The storage assigns the internal id
+		user, err = is.UsersRepository.GetUserByIdentity(authenticator.Name(), directoryUser.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if user.FindIdentity(authenticator.Name()) == nil {
+		user.AddIdentity(directoryIdentity(authenticator, directoryUser))
+	}
+
+	if len(directoryUser.Data) > 0 {
+		data, ok := user.Data.(map[string]interface{})
+		if !ok {
+			data = map[string]interface{}{}
+		}
+		for key, value := range directoryUser.Data {
+			data[key] = value
+		}
+		user.Data = data
+	}
+
+	previousRoleIDs := userRoleIDs(user)
+	for _, roleID := range directoryUser.ManagedRoleIDs {
+		if !containsString(directoryUser.RoleIDs, roleID) {
+			user.DeleteRole(roleID)
+			continue
+		}
+
+		role, err := is.getRole(roleID)
+		if err != nil {
+			log.Println("Cannot get role "+roleID+" of directory group, err:", err)
+			continue
+		}
+		user.AddRole(*role)
+	}
+
+	err = is.UsersRepository.UpdateUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens issued before a group change hold the previous roles
+	if !sameStrings(previousRoleIDs, userRoleIDs(user)) {
+		err = is.removeUserAccessTokens(user.InternalId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+func managesAllRoles(directoryUser *DirectoryUser, user *entities.User) bool {
+	for _, role := range user.Roles {
+		if !containsString(directoryUser.ManagedRoleIDs, role.InternalID) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func userRoleIDs(user *entities.User) []string {
+	var roleIDs []string
+	for _, role := range user.Roles {
+		roleIDs = append(roleIDs, role.InternalID)
+	}
+
+	return roleIDs
+}
+
+// sameStrings reports whether both lists hold the same values, in any order.
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, value := range a {
+		if !containsString(b, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func directoryIdentity(authenticator Authenticator, directoryUser *DirectoryUser) entities.Identity {
+	return entities.Identity{
+		Provider: authenticator.Name(),
+		Subject:  directoryUser.ID,
+		Email:    directoryUser.Email,
+		LinkedAt: time.Now().Unix(),
+	}
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+// stubAuthenticator accepts the password for its single entry.
+type stubAuthenticator struct {
+	password    string
+	entry       DirectoryUser
+	linkByEmail bool
+}
+
+func (a *stubAuthenticator) Name() string {
+	return "ldap"
+}
+
+func (a *stubAuthenticator) LinkByEmail() bool {
+	return a.linkByEmail
+}
+
+func (a *stubAuthenticator) Authenticate(login string, password string) (*DirectoryUser, error) {
+	if login != a.entry.Email || password != a.password {
+		return nil, errInvalidCredentials
+	}
+
+	entry := a.entry
+	return &entry, nil
+}
+
+func newDirectoryTestService(t *testing.T, linkByEmail bool) (*InternalService, *testStorage, *stubAuthenticator) {
+	is, storage := newTestService(t)
+	storage.insert("roles",
+		entities.Role{InternalID: "staff-role", Type: "staff"},
+		entities.Role{InternalID: "admins-role", Type: "admins"},
+		entities.Role{InternalID: "local-role", Type: "local"},
+	)
+
+	authenticator := &stubAuthenticator{
+		password: "directory-password",
+		entry: DirectoryUser{
+			ID:             "alice-uuid",
+			Email:          "alice@example.com",
+			Data:           map[string]interface{}{"first_name": "Alice"},
+			RoleIDs:        []string{"staff-role"},
+			ManagedRoleIDs: []string{"staff-role", "admins-role"},
+		},
+		linkByEmail: linkByEmail,
+	}
+	is.Authenticators = []Authenticator{authenticator}
+
+	return is, storage, authenticator
+}
+
+func TestProvisionDirectoryUserCreatesAndSyncs(t *testing.T) {
+	is, storage, authenticator := newDirectoryTestService(t, false)
+
+	user, err := is.authenticate("alice@example.com", "directory-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.FindIdentity("ldap") == nil || user.Email != "alice@example.com" {
+		t.Errorf("expected a user with the ldap identity, got %+v", user)
+	}
+	if roleIDs := userRoleIDs(user); len(roleIDs) != 1 || roleIDs[0] != "staff-role" {
+		t.Errorf("expected the staff role, got %v", roleIDs)
+	}
+
+	// Group changes are synced on the next sign in
+	authenticator.entry.RoleIDs = []string{"admins-role"}
+	user, err = is.authenticate("alice@example.com", "directory-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roleIDs := userRoleIDs(user); len(roleIDs) != 1 || roleIDs[0] != "admins-role" {
+		t.Errorf("expected only the admins role, got %v", roleIDs)
+	}
+	if len(storage.documents("users")) != 1 {
+		t.Errorf("expected one user, got %d", len(storage.documents("users")))
+	}
+}
+
+func TestProvisionDirectoryUserWithExistingEmail(t *testing.T) {
+	tests := []struct {
+		name        string
+		linkByEmail bool
+		roleIDs     []string
+		linked      bool
+	}{
+		{"link by email disabled", false, nil, false},
+		{"unmanaged role", true, []string{"staff-role", "local-role"}, false},
+		{"managed roles only", true, []string{"admins-role"}, true},
+		{"no roles", true, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			is, storage, _ := newDirectoryTestService(t, test.linkByEmail)
+
+			var roles []entities.Role
+			for _, roleID := range test.roleIDs {
+				roles = append(roles, entities.Role{InternalID: roleID})
+			}
+			storage.insert("users", entities.User{
+				InternalId: "existing",
+				Email:      "alice@example.com",
+				Roles:      roles,
+			})
+
+			user, err := is.provisionDirectoryUser(is.Authenticators[0], &DirectoryUser{
+				ID:             "alice-uuid",
+				Email:          "alice@example.com",
+				RoleIDs:        []string{"staff-role"},
+				ManagedRoleIDs: []string{"staff-role", "admins-role"},
+			})
+
+			if !test.linked {
+				if !errors.Is(err, errDirectoryUserConflict) {
+					t.Fatalf("expected errDirectoryUserConflict, got %v", err)
+				}
+				existing, err := is.UsersRepository.GetUserByID("existing")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if existing.FindIdentity("ldap") != nil || len(existing.Roles) != len(test.roleIDs) {
+					t.Errorf("expected the existing user unchanged, got %+v", existing)
+				}
+				if len(storage.documents("users")) != 1 {
+					t.Error("expected no user to be created")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.InternalId != "existing" || user.FindIdentity("ldap") == nil {
+				t.Errorf("expected the identity linked to the existing user, got %+v", user)
+			}
+			if roleIDs := userRoleIDs(user); len(roleIDs) != 1 || roleIDs[0] != "staff-role" {
+				t.Errorf("expected the directory roles, got %v", roleIDs)
+			}
+		})
+	}
+}
+
+func TestAuthenticateFallsBackToLocalPasswordOnConflict(t *testing.T) {
+	is, storage, _ := newDirectoryTestService(t, false)
+
+	hash, err := is.hashPassword("local-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.insert("users", entities.User{
+		InternalId:     "existing",
+		Email:          "alice@example.com",
+		HashedPassword: hash,
+	})
+
+	_, err = is.authenticate("alice@example.com", "directory-password")
+	if !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("expected the directory sign in refused, got %v", err)
+	}
+
+	user, err := is.authenticate("alice@example.com", "local-password")
+	if err != nil || user.InternalId != "existing" || user.FindIdentity("ldap") != nil {
+		t.Errorf("expected the local sign in without linking, got %+v %v", user, err)
+	}
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Limpid-LLC/go-auth/internal/repo"
+)
+
+// maxCheckBatchItems limits the items of one check_batch request
+const maxCheckBatchItems = 100
+
+// CheckBatchRequest asks for the decisions on several methods for one token.
+// The items carry no token.
+type CheckBatchRequest struct {
+	Token string    `json:"token"`
+	Items []Request `json:"items"`
+}
+
+// CheckBatchResult is the decision on one item, in the order of the items.
+type CheckBatchResult struct {
+	Microservice string `json:"microservice"`
+	Method       string `json:"method"`
+	Allowed      bool   `json:"allowed"`
+}
+
+func (is InternalService) checkBatchHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	var request CheckBatchRequest
+	err = json.Unmarshal(encodedData, &request)
+	if err != nil || request.Token == "" || len(request.Items) == 0 || len(request.Items) > maxCheckBatchItems {
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	allowed, err := is.checkBatch(request.Token, request.Items, methodCallIP)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	results := make([]CheckBatchResult, len(request.Items))
+	for i, item := range request.Items {
+		results[i] = CheckBatchResult{
+			Microservice: item.Microservice,
+			Method:       item.Method,
+			Allowed:      allowed[i],
+		}
+	}
+
+	return NewOkResponse(results)
+}
+
+// checkBatch decides on every item like check does, reading the credential
+// and its permissions once for all of them.
+func (is InternalService) checkBatch(token string, items []Request, ip string) ([]bool, error) {
+	allowed := make([]bool, len(items))
+
+	serviceToken, err := is.findServiceToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if serviceToken != nil {
+		for i, item := range items {
+			allowed[i] = serviceTokenAllows(serviceToken, item, ip)
+		}
+		return allowed, nil
+	}
+
+	if isAPIKey(token) {
+		apiKey, user, err := is.findActiveAPIKey(token)
+		if err != nil || apiKey == nil {
+			return allowed, err
+		}
+
+		roles, err := is.userRoles(user)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, item := range items {
+			tokens, err := is.apiKeyPermissions(user, roles, apiKey, item.Microservice, item.Method)
+			if err != nil {
+				return nil, err
+			}
+			allowed[i] = len(tokens) > 0 && Validate(checkItemData(item), tokens)
+		}
+		return allowed, nil
+	}
+
+	tokenPermissions, err := is.tokenPermissions(token)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, item := range items {
+		tokens := repo.MatchTokenPermissions(tokenPermissions, item.Microservice, item.Method)
+
+		allowed[i] = len(tokens) > 0 && Validate(checkItemData(item), tokens)
+
+		if isImpersonationToken(token) {
+			is.auditImpersonatedCheck(token, tokens, item, allowed[i])
+		}
+	}
+
+	return allowed, nil
+}
+
+func checkItemData(item Request) map[string]interface{} {
+	data, ok := item.Data.(map[string]interface{})
+	if !ok {
+		return map[string]interface{}{}
+	}
+
+	return data
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+	"github.com/Limpid-LLC/go-auth/logger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func checkBatchItem(microservice string, method string, data map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"microservice": microservice, "method": method, "data": data}
+}
+
+// checkBatchDecisions runs check_batch and returns the decisions.
+func checkBatchDecisions(t *testing.T, is *InternalService, token string, items ...map[string]interface{}) []bool {
+	t.Helper()
+
+	var list []interface{}
+	for _, item := range items {
+		list = append(list, item)
+	}
+
+	response, _, err := is.checkBatchHandler(map[string]interface{}{"token": token, "items": list}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var results []CheckBatchResult
+	decodeResult(t, response, &results)
+	if len(results) != len(items) {
+		t.Fatalf("expected %d results, got %+v", len(items), results)
+	}
+
+	decisions := make([]bool, len(results))
+	for i, result := range results {
+		if result.Microservice != items[i]["microservice"] || result.Method != items[i]["method"] {
+			t.Fatalf("expected the results in the order of the items, got %+v", results)
+		}
+		decisions[i] = result.Allowed
+	}
+
+	return decisions
+}
+
+func expectDecisions(t *testing.T, decisions []bool, expected ...bool) {
+	t.Helper()
+
+	for i := range expected {
+		if decisions[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, decisions)
+			return
+		}
+	}
+}
+
+func TestCheckBatch(t *testing.T) {
+	is, storage, user := newDenyTestService(t)
+	token := signedInToken(t, is, user.InternalId)
+
+	storage.resetRequestCounts()
+	decisions := checkBatchDecisions(t, is, token,
+		checkBatchItem("crud", "read", nil),
+		checkBatchItem("crud", "delete", map[string]interface{}{"archived": "true"}),
+		checkBatchItem("crud", "delete", map[string]interface{}{"archived": "false"}),
+		checkBatchItem("crud", "create", nil),
+	)
+
+	expectDecisions(t, decisions, true, false, true, false)
+	if count := storage.requestCount("read", "tokenPermissions"); count != 1 {
+		t.Errorf("expected a single read of the token permissions, got %d", count)
+	}
+}
+
+func TestCheckBatchOtherCredentials(t *testing.T) {
+	is, storage, _ := newDenyTestService(t)
+
+	serviceTokens, err := NewServiceTokens(map[string]interface{}{"name": "billing", "token": "billing", "permissions": []interface{}{"crud:read"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.ServiceTokens = serviceTokens
+
+	key := apiKeyPrefix + "key"
+	storage.insert("apiKeys", entities.APIKey{ID: "api-key", Name: "key", KeyHash: hashToken(key), UserID: "user", Scopes: []string{"crud:delete"}})
+
+	items := []map[string]interface{}{
+		checkBatchItem("crud", "read", nil),
+		checkBatchItem("crud", "delete", map[string]interface{}{"archived": "true"}),
+		checkBatchItem("crud", "delete", map[string]interface{}{"archived": "false"}),
+	}
+
+	expectDecisions(t, checkBatchDecisions(t, is, "billing", items...), true, false, false)
+	expectDecisions(t, checkBatchDecisions(t, is, key, items...), false, false, true)
+	expectDecisions(t, checkBatchDecisions(t, is, "unknown", items...), false, false, false)
+}
+
+func TestCheckBatchInvalidRequests(t *testing.T) {
+	is, _ := newTestService(t)
+
+	var tooMany []interface{}
+	for i := 0; i <= maxCheckBatchItems; i++ {
+		tooMany = append(tooMany, checkBatchItem("crud", "read", nil))
+	}
+
+	tests := []struct {
+		name string
+		data map[string]interface{}
+	}{
+		{"no token", map[string]interface{}{"items": []interface{}{checkBatchItem("crud", "read", nil)}}},
+		{"no items", map[string]interface{}{"token": "token", "items": []interface{}{}}},
+		{"too many items", map[string]interface{}{"token": "token", "items": tooMany}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, _, _ := is.checkBatchHandler(test.data, nil)
+			if code := errorCode(response); code != "DFE_01" {
+				t.Errorf("expected DFE_01, got %+v", response)
+			}
+		})
+	}
+}
+
+func TestCheckBatchAuditsImpersonatedChecks(t *testing.T) {
+	is, _, user := newDenyTestService(t)
+
+	accessTokens, err := is.generateAccessTokens(user, accessTokenOptions{SessionID: "session", ImpersonatorID: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	logger.Logger = zap.New(core)
+
+	checkBatchDecisions(t, is, accessTokens[0].Token,
+		checkBatchItem("crud", "read", nil),
+		checkBatchItem("other", "method", nil),
+	)
+
+	entries := logs.FilterMessage("Impersonated check").All()
+	if len(entries) != 2 {
+		t.Fatalf("expected an audit entry per item, got %+v", logs.All())
+	}
+	for i, allowed := range []bool{true, false} {
+		fields := entries[i].ContextMap()
+		if fields["impersonator_id"] != "admin" || fields["user_id"] != "user" || fields["allowed"] != allowed {
+			t.Errorf("expected the impersonator and the decision %v, got %v", allowed, fields)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+	"github.com/Limpid-LLC/go-auth/internal/repo"
+)
+
+// Reasons of an explained check decision
+const (
+	ExplainReasonAllowed      = "allowed"
+	ExplainReasonInvalidToken = "invalid_token"
+	ExplainReasonExpiredToken = "expired_token"
+	ExplainReasonIPNotAllowed = "ip_not_allowed"
+	ExplainReasonNoPermission = "no_permission"
+	ExplainReasonParamsFailed = "params_failed"
+	ExplainReasonDenied       = "denied"
+)
+
+// CheckExplanation is the decision check would make, with the permissions
+// it evaluated.
+type CheckExplanation struct {
+	Allowed bool `json:"allowed"`
+	// Credential is access_token, api_key or service_token
+	Credential  string                  `json:"credential,omitempty"`
+	Reason      string                  `json:"reason"`
+	Permissions []PermissionExplanation `json:"permissions"`
+}
+
+// PermissionExplanation describes a permission matching the method. Holds
+// reports whether its params hold for the request, which allows it, or
+// refuses it for a deny.
+type PermissionExplanation struct {
+	Microservice   string             `json:"microservice"`
+	Method         string             `json:"method"`
+	RoleInternalID string             `json:"role_internal_id,omitempty"`
+	Deny           bool               `json:"deny,omitempty"`
+	Holds          bool               `json:"holds"`
+	FailedParam    *ParamExplanation  `json:"failed_param,omitempty"`
+	Params         []ParamExplanation `json:"params"`
+}
+
+// ParamExplanation shows the values a param resolved to in the request and
+// what it expected. A required param passes when its condition holds, a
+// restricted one when it does not.
+type ParamExplanation struct {
+	Kind     string        `json:"kind"`
+	Param    string        `json:"param"`
+	Operator string        `json:"operator,omitempty"`
+	Type     string        `json:"type,omitempty"`
+	All      bool          `json:"all,omitempty"`
+	Expected []string      `json:"expected"`
+	Resolved []interface{} `json:"resolved"`
+	Passed   bool          `json:"passed"`
+}
+
+// checkExplainHandler takes the same data as check. It is limited to admins
+// and service credentials by its middleware.
+func (is InternalService) checkExplainHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	var request Request
+	err = json.Unmarshal(encodedData, &request)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	requestData, ok := request.Data.(map[string]interface{})
+	if !ok {
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	explanation, err := is.explainCheck(request, requestData, methodCallIP)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse(explanation)
+}
+
+// explainCheck evaluates the request like check without recording anything.
+func (is InternalService) explainCheck(request Request, data map[string]interface{}, ip string) (*CheckExplanation, error) {
+	explanation := &CheckExplanation{Permissions: []PermissionExplanation{}}
+
+	token, _ := data["token"].(string)
+	if token == "" {
+		explanation.Reason = ExplainReasonInvalidToken
+		return explanation, nil
+	}
+
+	serviceToken, err := is.findServiceToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if serviceToken != nil {
+		explainServiceToken(explanation, serviceToken, request, ip)
+		return explanation, nil
+	}
+
+	var tokens []entities.TokenPermission
+	if isAPIKey(token) {
+		explanation.Credential = "api_key"
+
+		apiKeys, err := is.APIKeysRepository.GetAPIKeys(map[string]interface{}{
+			"___key": hashToken(token),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(apiKeys) == 0 {
+			explanation.Reason = ExplainReasonInvalidToken
+			return explanation, nil
+		}
+		if apiKeys[0].Expired(time.Now().Unix()) {
+			explanation.Reason = ExplainReasonExpiredToken
+			return explanation, nil
+		}
+
+		user, err := is.UsersRepository.GetUserByID(apiKeys[0].UserID)
+		if err != nil {
+			explanation.Reason = ExplainReasonInvalidToken
+			return explanation, nil
+		}
+		roles, err := is.userRoles(user)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens, err = is.apiKeyPermissions(user, roles, &apiKeys[0], request.Microservice, request.Method)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		explanation.Credential = "access_token"
+
+		// Expired rows are read too, so an expired token is told from an
+		// unknown one; check only uses the unexpired rows
+		tokenPermissions, err := is.TokenPermissionsRepository.GetTokenPermissions(token, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(tokenPermissions) == 0 {
+			explanation.Reason = ExplainReasonInvalidToken
+			return explanation, nil
+		}
+		if allExpired(tokenPermissions, time.Now().Unix()) {
+			explanation.Reason = ExplainReasonExpiredToken
+			return explanation, nil
+		}
+
+		tokens = repo.MatchTokenPermissions(tokenPermissions, request.Microservice, request.Method)
+	}
+
+	explainPermissions(explanation, data, tokens)
+	return explanation, nil
+}
+
+// allExpired reports whether every row of the token has expired.
+func allExpired(tokenPermissions []entities.TokenPermission, now int64) bool {
+	for _, tokenPermission := range tokenPermissions {
+		if tokenPermission.ExpiredAt > now {
+			return false
+		}
+	}
+
+	return true
+}
+
+func explainServiceToken(explanation *CheckExplanation, serviceToken *entities.ServiceToken, request Request, ip string) {
+	explanation.Credential = "service_token"
+
+	for _, permission := range serviceToken.Permissions {
+		if permissionPatternMatches(permission, request.Microservice, request.Method) {
+			parts := strings.SplitN(permission, ":", 2)
+			explanation.Permissions = append(explanation.Permissions, PermissionExplanation{
+				Microservice: parts[0],
+				Method:       parts[1],
+				Holds:        true,
+				Params:       []ParamExplanation{},
+			})
+		}
+	}
+
+	explanation.Allowed = serviceTokenAllows(serviceToken, request, ip)
+	switch {
+	case explanation.Allowed:
+		explanation.Reason = ExplainReasonAllowed
+	case serviceToken.Expired(time.Now().Unix()):
+		explanation.Reason = ExplainReasonExpiredToken
+	case len(explanation.Permissions) == 0:
+		explanation.Reason = ExplainReasonNoPermission
+	default:
+		explanation.Reason = ExplainReasonIPNotAllowed
+	}
+}
+
+// explainPermissions evaluates the permissions in the order of Validate.
+func explainPermissions(explanation *CheckExplanation, data map[string]interface{}, tokens []entities.TokenPermission) {
+	denied := false
+	allowed := false
+	hasAllow := false
+	for _, tokenPermission := range tokens {
+		permission := explainPermission(data, tokenPermission)
+		explanation.Permissions = append(explanation.Permissions, permission)
+
+		if tokenPermission.Deny {
+			denied = denied || permission.Holds
+			continue
+		}
+		hasAllow = true
+		allowed = allowed || permission.Holds
+	}
+
+	switch {
+	case denied:
+		explanation.Reason = ExplainReasonDenied
+	case allowed:
+		explanation.Allowed = true
+		explanation.Reason = ExplainReasonAllowed
+	case hasAllow:
+		explanation.Reason = ExplainReasonParamsFailed
+	default:
+		explanation.Reason = ExplainReasonNoPermission
+	}
+}
+
+func explainPermission(data map[string]interface{}, tokenPermission entities.TokenPermission) PermissionExplanation {
+	permission := PermissionExplanation{
+		Microservice:   tokenPermission.PermissionMicroservice,
+		Method:         tokenPermission.PermissionMethod,
+		RoleInternalID: tokenPermission.RoleInternalID,
+		Deny:           tokenPermission.Deny,
+		Holds:          true,
+		Params:         []ParamExplanation{},
+	}
+
+	for _, param := range tokenPermission.PermissionRequiredParams {
+		permission.addParam(explainParam(data, param, "required"))
+	}
+	for _, param := range tokenPermission.PermissionRestrictedParams {
+		permission.addParam(explainParam(data, param, "restricted"))
+	}
+
+	return permission
+}
+
+func (permission *PermissionExplanation) addParam(param ParamExplanation) {
+	permission.Params = append(permission.Params, param)
+
+	if !param.Passed && permission.FailedParam == nil {
+		permission.Holds = false
+		failed := param
+		permission.FailedParam = &failed
+	}
+}
+
+func explainParam(data map[string]interface{}, param entities.Params, kind string) ParamExplanation {
+	explanation := ParamExplanation{
+		Kind:     kind,
+		Param:    param.Param,
+		Operator: param.Operator,
+		Type:     param.Type,
+		All:      param.All,
+		Expected: param.Values,
+		Resolved: []interface{}{},
+	}
+	if explanation.Expected == nil {
+		explanation.Expected = []string{}
+	}
+
+	if segments, err := parseParamPath(param.Param); err == nil {
+		explanation.Resolved = append(explanation.Resolved, resolveParamPath(data, segments)...)
+	}
+
+	if kind == "required" {
+		explanation.Passed = paramMatches(data, param, ParamMatchAll)
+	} else {
+		explanation.Passed = !paramMatches(data, param, ParamMatchAny)
+	}
+
+	return explanation
+}
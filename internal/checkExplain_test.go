@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+func explainTestRow(token string, method string, expiredAt time.Time) entities.TokenPermission {
+	return entities.TokenPermission{
+		Token:                  token,
+		Type:                   "access_token",
+		UserID:                 "user",
+		ExpiredAt:              expiredAt.Unix(),
+		RoleInternalID:         "role",
+		PermissionMicroservice: "crud",
+		PermissionMethod:       method,
+	}
+}
+
+func TestExplainCheck(t *testing.T) {
+	is, storage := newTestService(t)
+
+	expired := time.Now().Add(-time.Minute)
+	live := time.Now().Add(time.Hour)
+	storage.insert("tokenPermissions",
+		explainTestRow("expired", "read", expired),
+		explainTestRow("expired", "delete", expired),
+		// Rows are issued per permission, so a token can outlive some of them
+		explainTestRow("partly-expired", "read", expired),
+		explainTestRow("partly-expired", "delete", live),
+	)
+	denied := explainTestRow("denied", "delete", live)
+	denied.Deny = true
+	storage.insert("tokenPermissions", explainTestRow("denied", "*", live), denied)
+
+	tests := []struct {
+		name     string
+		token    string
+		method   string
+		expected string
+	}{
+		{"no token", "", "read", ExplainReasonInvalidToken},
+		{"unknown token", "unknown", "read", ExplainReasonInvalidToken},
+		{"every row expired", "expired", "delete", ExplainReasonExpiredToken},
+		{"live row", "partly-expired", "delete", ExplainReasonAllowed},
+		{"expired row", "partly-expired", "read", ExplainReasonNoPermission},
+		{"allowed", "denied", "read", ExplainReasonAllowed},
+		{"denied", "denied", "delete", ExplainReasonDenied},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := map[string]interface{}{"token": test.token}
+			explanation, err := is.explainCheck(Request{Microservice: "crud", Method: test.method, Data: data}, data, methodCallIP)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if explanation.Reason != test.expected {
+				t.Errorf("expected %s, got %+v", test.expected, explanation)
+			}
+			if explanation.Allowed != (test.expected == ExplainReasonAllowed) {
+				t.Errorf("expected the decision to follow the reason, got %+v", explanation)
+			}
+		})
+	}
+}
+
+func TestExplainCheckAgreesWithCheck(t *testing.T) {
+	is, storage := newTestService(t)
+
+	storage.insert("tokenPermissions",
+		explainTestRow("token", "read", time.Now().Add(-time.Minute)),
+		explainTestRow("token", "delete", time.Now().Add(time.Hour)),
+	)
+
+	for _, method := range []string{"read", "delete"} {
+		data := map[string]interface{}{"token": "token"}
+		request := Request{Microservice: "crud", Method: method, Data: data}
+
+		explanation, err := is.explainCheck(request, data, methodCallIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed := checkAllowed(t, is, request); allowed != explanation.Allowed {
+			t.Errorf("%s: expected check_explain to agree with check %v, got %+v", method, allowed, explanation)
+		}
+	}
+}
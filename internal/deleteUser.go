@@ -16,6 +16,23 @@ func (is *InternalService) deleteUsersHandler(data interface{}, meta interface{}
 		), http.StatusBadRequest, nil
 	}
 
+	// The tokens of the users are revoked once they are removed
+	usersRes, err := is.Storage.Send(adapter.Request{
+		Method: "read",
+		Data: adapter.ReadRequest{
+			Collection: "users",
+			Select:     req,
+		},
+	})
+	if err != nil {
+		log.Println("Cannot get users to remove, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, nil
+	}
+
 	updateReq := adapter.Request{
 		Method: "delete",
 		Data: adapter.DeleteRequest{
@@ -24,7 +41,7 @@ func (is *InternalService) deleteUsersHandler(data interface{}, meta interface{}
 		},
 	}
 
-	_, err := is.Storage.Send(updateReq)
+	_, err = is.Storage.Send(updateReq)
 	if err != nil {
 		log.Println(
 			"Cannot remove user, err:", err)
@@ -35,5 +52,17 @@ func (is *InternalService) deleteUsersHandler(data interface{}, meta interface{}
 		), http.StatusInternalServerError, nil
 	}
 
+	for _, user := range usersRes.Result {
+		userID, _ := user["internal_id"].(string)
+		if userID == "" {
+			continue
+		}
+
+		err = is.signOutAll(userID)
+		if err != nil {
+			log.Println("Cannot revoke tokens of removed user "+userID+", err:", err)
+		}
+	}
+
 	return NewOkResponse("Users removed successfully")
 }
@@ -0,0 +1,28 @@
+package entities
+
+// APIKey is a long-lived credential of a user or service account. It is
+// accepted by check like an access token, limited to Scopes of the form
+// "microservice:method" that the owner's roles grant. Only the hash of the
+// key is stored, Prefix identifies it in listings.
+type APIKey struct {
+	ID         string   `json:"api_key_id"`
+	Name       string   `json:"name" validate:"required"`
+	Prefix     string   `json:"prefix"`
+	KeyHash    string   `json:"___key,omitempty"`
+	UserID     string   `json:"user_id"`
+	Scopes     []string `json:"scopes" validate:"required,min=1"`
+	CreatedAt  int64    `json:"created_at"`
+	LastUsedAt int64    `json:"last_used_at"`
+	// ExpiredAt is zero for keys that never expire
+	ExpiredAt int64 `json:"expired_at"`
+}
+
+// Redacted returns a copy of the key without its hash, suitable for listing.
+func (k APIKey) Redacted() APIKey {
+	k.KeyHash = ""
+	return k
+}
+
+func (k APIKey) Expired(now int64) bool {
+	return k.ExpiredAt != 0 && k.ExpiredAt <= now
+}
@@ -1,6 +1,9 @@
 package entities
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 type AccessToken struct {
 	Token     string `json:"token"`
@@ -13,6 +16,11 @@ type TokenPermission struct {
 	Token                      string   `json:"token"`
 	Type                       string   `json:"type"`
 	UserID                     string   `json:"user_id"`
+	SessionID                  string   `json:"session_id"`
+	ClientID                   string   `json:"client_id,omitempty"`
+	Scope                      string   `json:"scope,omitempty"`
+	ImpersonatorID             string   `json:"impersonator_id,omitempty"`
+	Deny                       bool     `json:"deny,omitempty"`
 	ExpiredAt                  int64    `json:"expired_at"`
 	RoleInternalID             string   `json:"role_internal_id"`
 	PermissionMicroservice     string   `json:"permission_microservice"`
@@ -21,6 +29,11 @@ type TokenPermission struct {
 	PermissionRestrictedParams []Params `json:"permission_restricted_params"`
 }
 
+// Matches reports whether the permission of the row applies to the method.
+func (tp TokenPermission) Matches(microservice string, method string) bool {
+	return MatchPattern(tp.PermissionMicroservice, microservice) && MatchPattern(tp.PermissionMethod, method)
+}
+
 func (tp TokenPermission) CreateAccessToken() AccessToken {
 	return AccessToken{
 		Token:     tp.Token,
@@ -34,15 +47,33 @@ type Role struct {
 	InternalID  string       `json:"internal_id"`
 	Type        string       `json:"type" validate:"required"`
 	Permissions []Permission `json:"permissions" validate:"required"`
-	Data        interface{}  `json:"data"`
+	// DenyPermissions refuse the methods they match when their params hold,
+	// even if a permission of this or another role allows them
+	DenyPermissions []Permission `json:"deny_permissions,omitempty"`
+	// Parents are the internal ids of the roles whose permissions the role
+	// inherits
+	Parents []string    `json:"parents,omitempty"`
+	Data    interface{} `json:"data"`
 }
 
+// Params is a condition on a request parameter. Without an operator the
+// value must equal one of Values, or be present at all when All is set.
 type Params struct {
 	Param  string   `json:"param" validate:"required"`
 	Values []string `json:"values" validate:"required"`
 	All    bool     `json:"all" validate:"required"`
+	// Operator is one of eq, in, prefix, regex, lt, lte, gt, gte, between,
+	// exists and not_exists
+	Operator string `json:"operator,omitempty"`
+	// Type is string, number, bool or date; order operators default to number
+	Type string `json:"type,omitempty"`
+	// Match is all or any, for paths with wildcards such as items[*].id
+	Match string `json:"match,omitempty"`
 }
 
+// Permission grants a method of a microservice. Microservice and Method may
+// be patterns where * stands for any characters, e.g. "*" or "get_*".
+// Names are case insensitive and stored in lower case.
 type Permission struct {
 	Microservice     string   `json:"microservice" validate:"required"`
 	Method           string   `json:"method" validate:"required"`
@@ -50,9 +81,71 @@ type Permission struct {
 	RestrictedParams []Params `json:"restricted_params"`
 }
 
+// Matches reports whether the permission applies to the method.
+func (p Permission) Matches(microservice string, method string) bool {
+	return MatchPattern(p.Microservice, microservice) && MatchPattern(p.Method, method)
+}
+
+// Canonical returns the permission with the names in lower case.
+func (p Permission) Canonical() Permission {
+	p.Microservice = strings.ToLower(p.Microservice)
+	p.Method = strings.ToLower(p.Method)
+	return p
+}
+
+// Canonical returns the role with all permission names, allowed and denied,
+// in lower case.
+func (r Role) Canonical() Role {
+	permissions := make([]Permission, len(r.Permissions))
+	for i, permission := range r.Permissions {
+		permissions[i] = permission.Canonical()
+	}
+	r.Permissions = permissions
+
+	if r.DenyPermissions != nil {
+		denyPermissions := make([]Permission, len(r.DenyPermissions))
+		for i, permission := range r.DenyPermissions {
+			denyPermissions[i] = permission.Canonical()
+		}
+		r.DenyPermissions = denyPermissions
+	}
+	return r
+}
+
+// MatchPattern reports whether the name matches the pattern, in which *
+// stands for any sequence of characters. The comparison ignores case.
+func MatchPattern(pattern string, name string) bool {
+	pattern = strings.ToLower(pattern)
+	name = strings.ToLower(name)
+
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+
+	last := len(parts) - 1
+	for _, part := range parts[1:last] {
+		index := strings.Index(name, part)
+		if index < 0 {
+			return false
+		}
+		name = name[index+len(part):]
+	}
+
+	return strings.HasSuffix(name, parts[last])
+}
+
 type TokenExpirations struct {
 	RefreshToken time.Duration
 	AccessToken  time.Duration
+	LinkToken    time.Duration
+	// Impersonation is the lifetime of tokens issued by impersonate_user
+	Impersonation time.Duration
 }
 
 type RoutineExecutionPeriods struct {
@@ -0,0 +1,47 @@
+package entities
+
+const (
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeRefreshToken      = "refresh_token"
+	GrantTypeClientCredentials = "client_credentials"
+)
+
+// OAuthClient is an application registered to obtain tokens through the
+// OAuth 2.0 endpoints. Public clients have no secret and must use PKCE.
+// Tokens of the client_credentials grant act on behalf of ServiceUserID.
+type OAuthClient struct {
+	ClientID      string   `json:"client_id"`
+	SecretHash    string   `json:"___secret,omitempty"`
+	Name          string   `json:"name" validate:"required"`
+	RedirectURIs  []string `json:"redirect_uris"`
+	GrantTypes    []string `json:"grant_types" validate:"required"`
+	Scopes        []string `json:"scopes" validate:"required"`
+	Public        bool     `json:"public"`
+	ServiceUserID string   `json:"service_user_id"`
+}
+
+func (c OAuthClient) AllowsGrantType(grantType string) bool {
+	return containsString(c.GrantTypes, grantType)
+}
+
+func (c OAuthClient) AllowsRedirectURI(redirectURI string) bool {
+	return containsString(c.RedirectURIs, redirectURI)
+}
+
+func (c OAuthClient) AllowsScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		if !containsString(c.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,12 @@
+package entities
+
+// PermissionInvalidation tells the other instances to drop the cached
+// permissions of the tokens whose rows have one of Values in Field, which is
+// token, user_id, session_id, client_id or role_internal_id.
+type PermissionInvalidation struct {
+	InstanceID string   `json:"instance_id"`
+	Field      string   `json:"field"`
+	Values     []string `json:"values"`
+	// CreatedAt is in unix milliseconds
+	CreatedAt int64 `json:"created_at"`
+}
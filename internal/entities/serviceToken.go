@@ -0,0 +1,30 @@
+package entities
+
+// ServiceToken is a named credential of another service. It is accepted by
+// check for the methods in Permissions, given as "microservice:method" where
+// either part may be "*". Several tokens may share a name, so a new token
+// can be rolled out before the old one expires. Only the hash of the token
+// is stored.
+type ServiceToken struct {
+	ID          string   `json:"service_token_id"`
+	Name        string   `json:"name" validate:"required"`
+	Prefix      string   `json:"prefix"`
+	TokenHash   string   `json:"___token,omitempty"`
+	Permissions []string `json:"permissions" validate:"required,min=1"`
+	// AllowedIPs holds addresses and CIDR ranges, empty allows any address
+	AllowedIPs []string `json:"allowed_ips"`
+	CreatedAt  int64    `json:"created_at"`
+	// ExpiredAt is zero for tokens that never expire
+	ExpiredAt int64 `json:"expired_at"`
+}
+
+// Redacted returns a copy of the token without its hash, suitable for
+// listing.
+func (t ServiceToken) Redacted() ServiceToken {
+	t.TokenHash = ""
+	return t
+}
+
+func (t ServiceToken) Expired(now int64) bool {
+	return t.ExpiredAt != 0 && t.ExpiredAt <= now
+}
@@ -0,0 +1,27 @@
+package entities
+
+// Session groups the tokens issued by one sign in, so a device can be listed
+// and revoked as a whole. Its id is also the family id of its refresh tokens.
+// Sessions opened through OAuth carry the id of the client they were granted
+// to, impersonation sessions the id of the admin.
+type Session struct {
+	ID             string   `json:"session_id"`
+	UserID         string   `json:"user_id"`
+	IP             string   `json:"ip"`
+	UserAgent      string   `json:"user_agent"`
+	ClientID       string   `json:"client_id,omitempty"`
+	ImpersonatorID string   `json:"impersonator_id,omitempty"`
+	CreatedAt      int64    `json:"created_at"`
+	LastSeenAt     int64    `json:"last_seen_at"`
+	ExpiredAt      int64    `json:"expired_at"`
+	AccessTokens   []string `json:"access_tokens,omitempty"`
+	RefreshToken   string   `json:"refresh_token,omitempty"`
+}
+
+// Redacted returns a copy of the session without token values, suitable for
+// listing devices.
+func (s Session) Redacted() Session {
+	s.AccessTokens = nil
+	s.RefreshToken = ""
+	return s
+}
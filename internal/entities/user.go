@@ -6,9 +6,57 @@ type User struct {
 	Phone          string      `json:"phone"`
 	HashedPassword string      `json:"___password"`
 	Roles          []Role      `json:"___roles"`
+	TOTP           *TOTP       `json:"___totp,omitempty"`
+	Identities     []Identity  `json:"___identities"`
 	Data           interface{} `json:"data"`
 }
 
+// TOTP holds the two-factor authentication state of a user. The secret is
+// pending until the first code is confirmed; recovery codes are stored as
+// sha256 hashes and removed once used.
+type TOTP struct {
+	Secret        string   `json:"secret"`
+	Enabled       bool     `json:"enabled"`
+	RecoveryCodes []string `json:"recovery_codes"`
+	LastUsedStep  int64    `json:"last_used_step"`
+}
+
+// Identity links the user to an account of an external identity provider.
+// Subject is the stable id of the account at the provider.
+type Identity struct {
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+	Email    string `json:"email,omitempty"`
+	LinkedAt int64  `json:"linked_at"`
+}
+
+func (u *User) FindIdentity(provider string) *Identity {
+	for i, identity := range u.Identities {
+		if identity.Provider == provider {
+			return &u.Identities[i]
+		}
+	}
+	return nil
+}
+
+// AddIdentity links the identity, replacing an earlier one of the provider.
+func (u *User) AddIdentity(identity Identity) {
+	if existing := u.FindIdentity(identity.Provider); existing != nil {
+		*existing = identity
+		return
+	}
+	u.Identities = append(u.Identities, identity)
+}
+
+func (u *User) RemoveIdentity(provider string) {
+	for i, identity := range u.Identities {
+		if identity.Provider == provider {
+			u.Identities = append(u.Identities[:i], u.Identities[i+1:]...)
+			break
+		}
+	}
+}
+
 func (u *User) AddRole(role Role) {
 	updated := u.UpdateRole(role)
 	if !updated {
@@ -26,6 +74,17 @@ func (u *User) UpdateRole(updatedRole Role) bool {
 	return false
 }
 
+// HasRole reports whether the user holds the role. Roles of the config,
+// which have no internal id, are compared by type.
+func (u *User) HasRole(role Role) bool {
+	for _, userRole := range u.Roles {
+		if userRole.InternalID == role.InternalID && (role.InternalID != "" || userRole.Type == role.Type) {
+			return true
+		}
+	}
+	return false
+}
+
 func (u *User) DeleteRole(roleID string) {
 	for i, role := range u.Roles {
 		if role.InternalID == roleID {
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"sync"
 	"time"
 )
 
@@ -13,7 +14,13 @@ type Flood struct {
 
 var Flooders = make(FloodList, 10000)
 
+// floodMutex guards Flooders, which every handler may change concurrently
+var floodMutex sync.Mutex
+
 func (is *InternalService) FloodAdd(ip string) {
+	floodMutex.Lock()
+	defer floodMutex.Unlock()
+
 	if flood := is.FloodGet(ip); flood != nil {
 		Flooders[ip].Count++
 		Flooders[ip].Expired = time.Now().Add(time.Minute * time.Duration(is.AuthFloodDuration)).Unix()
@@ -35,6 +42,9 @@ func (is *InternalService) FloodGet(ip string) *Flood {
 }
 
 func (is *InternalService) isFlooder(ip string) bool {
+	floodMutex.Lock()
+	defer floodMutex.Unlock()
+
 	if flood := is.FloodGet(ip); flood != nil && flood.Count >= is.AuthFloodLimit && flood.Expired > time.Now().Unix() {
 		return true
 	}
@@ -49,11 +59,13 @@ func (is *InternalService) FloodClear() {
 		for {
 			select {
 			case <-ticker.C:
+				floodMutex.Lock()
 				for i, v := range Flooders {
 					if v.Expired < time.Now().Unix() {
 						delete(Flooders, i)
 					}
 				}
+				floodMutex.Unlock()
 			}
 		}
 	}()
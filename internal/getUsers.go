@@ -36,9 +36,10 @@ func (is *InternalService) getUsersHandler(data interface{}, meta interface{}) (
 		), http.StatusInternalServerError, err
 	}
 
-	// Remove hashed passwords from the response
+	// Remove hashed passwords and 2FA secrets from the response
 	for _, user := range res.Result {
 		delete(user, "___password")
+		delete(user, "___totp")
 	}
 
 	return NewOkResponse(res.Result)
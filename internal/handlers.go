@@ -24,16 +24,282 @@ func (is InternalService) NewHandler() saiService.Handler {
 			Description: "Registers a new user",
 			Function:    is.signUpHandler,
 		},
+		"jwks": saiService.HandlerElement{
+			Name:        "JWKS",
+			Description: "Publishes the public keys used to sign JWTs",
+			Function:    is.jwksHandler,
+		},
 		"check": saiService.HandlerElement{
 			Name:        "Check token validity for request",
 			Description: "Checks token validity for request",
 			Function:    is.checkHandler,
 		},
+		"check_batch": saiService.HandlerElement{
+			Name:        "Check token validity for several requests",
+			Description: "Checks token validity for a list of requests at once",
+			Function:    is.checkBatchHandler,
+		},
+		"permission_cache_stats": saiService.HandlerElement{
+			Name:        "Permission cache statistics",
+			Description: "Returns the hit and miss counters of the permission cache",
+			Function:    is.permissionCacheStatsHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "permission_cache_stats"),
+			},
+		},
+		"check_explain": saiService.HandlerElement{
+			Name:        "Explain check decision",
+			Description: "Shows how check decides on a request, for admins and service credentials",
+			Function:    is.checkExplainHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "check_explain"),
+			},
+		},
 		"sign_in": saiService.HandlerElement{
 			Name:        "Login",
 			Description: "Login user",
 			Function:    is.signInHandler,
 		},
+		"send_sign_in_code": saiService.HandlerElement{
+			Name:        "Send sign in code",
+			Description: "Sends a one-time sign in code to the phone or email of an existing user",
+			Function:    is.sendSignInCodeHandler,
+		},
+		"sign_in_with_otp": saiService.HandlerElement{
+			Name:        "Login with OTP",
+			Description: "Exchanges a one-time sign in code for tokens",
+			Function:    is.signInWithOTPHandler,
+		},
+		"send_magic_link": saiService.HandlerElement{
+			Name:        "Send magic link",
+			Description: "Emails a single-use sign in or password reset link",
+			Function:    is.sendMagicLinkHandler,
+		},
+		"sign_in_with_link": saiService.HandlerElement{
+			Name:        "Login with magic link",
+			Description: "Exchanges a magic link token for tokens",
+			Function:    is.signInWithLinkHandler,
+		},
+		"reset_password_with_link": saiService.HandlerElement{
+			Name:        "Reset password with link",
+			Description: "Sets a new password using a password reset link token",
+			Function:    is.resetPasswordWithLinkHandler,
+		},
+		"sign_in_with_provider": saiService.HandlerElement{
+			Name:        "Sign in with provider",
+			Description: "Starts a sign in with an external identity provider",
+			Function:    is.signInWithProviderHandler,
+		},
+		"provider_callback": saiService.HandlerElement{
+			Name:        "Provider callback",
+			Description: "Finishes a sign in or link with an external identity provider",
+			Function:    is.providerCallbackHandler,
+		},
+		"link_provider": saiService.HandlerElement{
+			Name:        "Link provider",
+			Description: "Starts linking an external identity to the token owner",
+			Function:    is.linkProviderHandler,
+		},
+		"unlink_provider": saiService.HandlerElement{
+			Name:        "Unlink provider",
+			Description: "Removes an external identity from the token owner",
+			Function:    is.unlinkProviderHandler,
+		},
+		"sign_in_totp": saiService.HandlerElement{
+			Name:        "Login with 2FA",
+			Description: "Exchanges a 2FA challenge and a TOTP or recovery code for tokens",
+			Function:    is.signInTOTPHandler,
+		},
+		"enroll_totp": saiService.HandlerElement{
+			Name:        "Enroll 2FA",
+			Description: "Generates a TOTP secret for the token owner",
+			Function:    is.enrollTOTPHandler,
+		},
+		"confirm_totp": saiService.HandlerElement{
+			Name:        "Confirm 2FA",
+			Description: "Enables 2FA after verifying the first TOTP code",
+			Function:    is.confirmTOTPHandler,
+		},
+		"disable_totp": saiService.HandlerElement{
+			Name:        "Disable 2FA",
+			Description: "Disables 2FA after verifying a TOTP or recovery code",
+			Function:    is.disableTOTPHandler,
+		},
+		"refresh_token": saiService.HandlerElement{
+			Name:        "Refresh token",
+			Description: "Exchanges a refresh token for new access tokens and a new refresh token",
+			Function:    is.refreshTokenHandler,
+		},
+		"sign_out": saiService.HandlerElement{
+			Name:        "Sign out",
+			Description: "Revokes the access token and its paired refresh token",
+			Function:    is.signOutHandler,
+		},
+		"sign_out_all": saiService.HandlerElement{
+			Name:        "Sign out everywhere",
+			Description: "Revokes all access and refresh tokens of the token owner",
+			Function:    is.signOutAllHandler,
+		},
+		"sign_out_user": saiService.HandlerElement{
+			Name:        "Sign out user",
+			Description: "Revokes all access and refresh tokens of the user",
+			Function:    is.signOutUserHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "sign_out_user"),
+			},
+		},
+		"get_sessions": saiService.HandlerElement{
+			Name:        "Get sessions",
+			Description: "Fetches active sessions of the token owner",
+			Function:    is.getSessionsHandler,
+		},
+		"revoke_session": saiService.HandlerElement{
+			Name:        "Revoke session",
+			Description: "Revokes a session of the token owner",
+			Function:    is.revokeSessionHandler,
+		},
+		"get_user_sessions": saiService.HandlerElement{
+			Name:        "Get user sessions",
+			Description: "Fetches active sessions of the user",
+			Function:    is.getUserSessionsHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "get_user_sessions"),
+			},
+		},
+		"revoke_user_session": saiService.HandlerElement{
+			Name:        "Revoke user session",
+			Description: "Revokes any user session",
+			Function:    is.revokeUserSessionHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "revoke_user_session"),
+			},
+		},
+		"create_api_key": saiService.HandlerElement{
+			Name:        "Create API key",
+			Description: "Creates an API key of the token owner",
+			Function:    is.createAPIKeyHandler,
+		},
+		"get_api_keys": saiService.HandlerElement{
+			Name:        "Get API keys",
+			Description: "Fetches API keys of the token owner",
+			Function:    is.getAPIKeysHandler,
+		},
+		"revoke_api_key": saiService.HandlerElement{
+			Name:        "Revoke API key",
+			Description: "Revokes an API key of the token owner",
+			Function:    is.revokeAPIKeyHandler,
+		},
+		"create_user_api_key": saiService.HandlerElement{
+			Name:        "Create user API key",
+			Description: "Creates an API key of the user",
+			Function:    is.createUserAPIKeyHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "create_user_api_key"),
+			},
+		},
+		"get_user_api_keys": saiService.HandlerElement{
+			Name:        "Get user API keys",
+			Description: "Fetches API keys of the user",
+			Function:    is.getUserAPIKeysHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "get_user_api_keys"),
+			},
+		},
+		"revoke_user_api_key": saiService.HandlerElement{
+			Name:        "Revoke user API key",
+			Description: "Revokes any API key",
+			Function:    is.revokeUserAPIKeyHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "revoke_user_api_key"),
+			},
+		},
+		"create_service_token": saiService.HandlerElement{
+			Name:        "Create service token",
+			Description: "Creates a named service token",
+			Function:    is.createServiceTokenHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "create_service_token"),
+			},
+		},
+		"get_service_tokens": saiService.HandlerElement{
+			Name:        "Get service tokens",
+			Description: "Fetches service tokens",
+			Function:    is.getServiceTokensHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "get_service_tokens"),
+			},
+		},
+		"rotate_service_token": saiService.HandlerElement{
+			Name:        "Rotate service token",
+			Description: "Replaces a service token, keeping the old one valid for a while",
+			Function:    is.rotateServiceTokenHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "rotate_service_token"),
+			},
+		},
+		"delete_service_tokens": saiService.HandlerElement{
+			Name:        "Delete service tokens",
+			Description: "Removes service tokens",
+			Function:    is.deleteServiceTokensHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "delete_service_tokens"),
+			},
+		},
+		"impersonate_user": saiService.HandlerElement{
+			Name:        "Impersonate user",
+			Description: "Issues short-lived access tokens to act as the user",
+			Function:    is.impersonateUserHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "impersonate_user"),
+			},
+		},
+		"end_impersonation": saiService.HandlerElement{
+			Name:        "End impersonation",
+			Description: "Revokes an impersonation session of the admin",
+			Function:    is.endImpersonationHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "end_impersonation"),
+			},
+		},
+		"authorize": saiService.HandlerElement{
+			Name:        "Authorize",
+			Description: "Issues an OAuth authorization code for the token owner",
+			Function:    is.authorizeHandler,
+		},
+		"introspect": saiService.HandlerElement{
+			Name:        "Introspect",
+			Description: "Describes a token for services holding a service token (RFC 7662)",
+			Function:    is.introspectHandler,
+		},
+		"userinfo": saiService.HandlerElement{
+			Name:        "Userinfo",
+			Description: "Fetches the OpenID Connect claims of the token owner",
+			Function:    is.userinfoHandler,
+		},
+		"create_oauth_client": saiService.HandlerElement{
+			Name:        "Create OAuth client",
+			Description: "Registers an OAuth client",
+			Function:    is.createOAuthClientHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "create_oauth_client"),
+			},
+		},
+		"get_oauth_clients": saiService.HandlerElement{
+			Name:        "Get OAuth clients",
+			Description: "Fetches OAuth clients",
+			Function:    is.getOAuthClientsHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "get_oauth_clients"),
+			},
+		},
+		"delete_oauth_clients": saiService.HandlerElement{
+			Name:        "Delete OAuth clients",
+			Description: "Removes OAuth clients and revokes their tokens",
+			Function:    is.deleteOAuthClientsHandler,
+			Middlewares: []saiService.Middleware{
+				middlewares.CreateAuthMiddleware(is.AuthUrl, is.Name, "delete_oauth_clients"),
+			},
+		},
 		"update_user": saiService.HandlerElement{
 			Name:        "Update user",
 			Description: "Updates user information",
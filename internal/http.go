@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// NewHTTPHandlers returns plain HTTP endpoints that cannot be expressed as
+// service methods because clients expect fixed paths and raw payloads.
+func (is *InternalService) NewHTTPHandlers() map[string]http.HandlerFunc {
+	handlers := map[string]http.HandlerFunc{
+		"/authorize":  is.authorizeHTTPHandler,
+		"/token":      is.tokenHTTPHandler,
+		"/introspect": is.introspectHTTPHandler,
+	}
+
+	if is.JWTEnabled {
+		handlers["/.well-known/jwks.json"] = is.jwksHTTPHandler
+		handlers["/.well-known/openid-configuration"] = is.openIDConfigurationHTTPHandler
+		handlers["/userinfo"] = is.userinfoHTTPHandler
+	}
+
+	return handlers
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Println("Cannot write response, err:", err)
+	}
+}
+
+// requestIP returns the address of the client. X-Forwarded-For is only
+// honoured when the request comes from a trusted proxy, and is read from the
+// right, skipping the trusted proxies, since the left entries are set by the
+// client and can be forged.
+func (is *InternalService) requestIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || net.ParseIP(ip) == nil {
+		return ""
+	}
+
+	if !is.isTrustedProxy(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(forwardedIP) == nil {
+			break
+		}
+
+		ip = forwardedIP
+		if !is.isTrustedProxy(ip) {
+			break
+		}
+	}
+
+	return ip
+}
+
+func (is *InternalService) isTrustedProxy(ip string) bool {
+	parsedIP := net.ParseIP(ip)
+	for _, network := range is.TrustedProxies {
+		if network.Contains(parsedIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseTrustedProxies reads the addresses and CIDR ranges of the
+// common.auth.trusted_proxies config entry.
+func ParseTrustedProxies(config []interface{}) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range config {
+		value, ok := item.(string)
+		if !ok {
+			return nil, errors.New("trusted proxies should be strings")
+		}
+
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", value)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// requestMeta builds the metadata the service methods receive, so sessions
+// started over plain HTTP record the same details.
+func (is *InternalService) requestMeta(r *http.Request) map[string]interface{} {
+	return map[string]interface{}{
+		"ip":         is.requestIP(r),
+		"user_agent": r.UserAgent(),
+	}
+}
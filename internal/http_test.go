@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestIP(t *testing.T) {
+	trustedProxies, err := ParseTrustedProxies([]interface{}{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := &InternalService{TrustedProxies: trustedProxies}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		trustProxies bool
+		expectedIP   string
+	}{
+		{"no proxy", "203.0.113.5:1234", "", true, "203.0.113.5"},
+		{"untrusted peer ignores header", "203.0.113.5:1234", "198.51.100.7", true, "203.0.113.5"},
+		{"no trusted proxies ignores header", "10.0.0.2:1234", "198.51.100.7", false, "10.0.0.2"},
+		{"trusted peer", "10.0.0.2:1234", "198.51.100.7", true, "198.51.100.7"},
+		{"forged left entries", "10.0.0.2:1234", "1.2.3.4, 198.51.100.7", true, "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.2:1234", "198.51.100.7, 192.168.1.1, 10.1.1.1", true, "198.51.100.7"},
+		{"invalid entry stops the walk", "10.0.0.2:1234", "198.51.100.7, junk", true, "10.0.0.2"},
+		{"only trusted entries", "10.0.0.2:1234", "10.0.0.3", true, "10.0.0.3"},
+		{"invalid peer", "junk", "198.51.100.7", true, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/token", nil)
+			r.RemoteAddr = test.remoteAddr
+			if test.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", test.forwardedFor)
+			}
+
+			service := is
+			if !test.trustProxies {
+				service = &InternalService{}
+			}
+
+			if ip := service.requestIP(r); ip != test.expectedIP {
+				t.Errorf("expected %q, got %q", test.expectedIP, ip)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesRejectsInvalidEntries(t *testing.T) {
+	for _, config := range [][]interface{}{{"not an ip"}, {"10.0.0.0/33"}, {42}} {
+		if _, err := ParseTrustedProxies(config); err == nil {
+			t.Errorf("expected an error for %v", config)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const providerJWKSCacheDuration = time.Hour
+
+var providerHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// IdentityProvider is an upstream OpenID Connect (or plain OAuth 2.0)
+// provider users can sign in with. Endpoints that are not configured are
+// discovered from the issuer. Providers without ID tokens need a userinfo
+// endpoint.
+type IdentityProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+	Scopes       []string
+	// LinkByEmail signs a new identity in to the existing user with the same
+	// email when the provider reports the email as verified
+	LinkByEmail bool
+
+	AuthorizationEndpoint string
+	TokenEndpoint         string
+	UserinfoEndpoint      string
+	JWKSURI               string
+
+	mu            sync.Mutex
+	discovered    bool
+	jwks          JWKS
+	jwksFetchedAt time.Time
+}
+
+// ProviderIdentity is the verified account of the user at the provider.
+type ProviderIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Claims        map[string]interface{}
+}
+
+// NewIdentityProvider reads a provider from its config entry.
+func NewIdentityProvider(config map[string]interface{}) (*IdentityProvider, error) {
+	provider := &IdentityProvider{}
+	provider.Name, _ = config["name"].(string)
+	provider.Issuer, _ = config["issuer"].(string)
+	provider.ClientID, _ = config["client_id"].(string)
+	provider.ClientSecret, _ = config["client_secret"].(string)
+	provider.RedirectURI, _ = config["redirect_uri"].(string)
+	provider.LinkByEmail, _ = config["link_by_email"].(bool)
+	provider.AuthorizationEndpoint, _ = config["authorization_endpoint"].(string)
+	provider.TokenEndpoint, _ = config["token_endpoint"].(string)
+	provider.UserinfoEndpoint, _ = config["userinfo_endpoint"].(string)
+	provider.JWKSURI, _ = config["jwks_uri"].(string)
+
+	scopes, _ := config["scopes"].([]interface{})
+	for _, scope := range scopes {
+		if value, ok := scope.(string); ok {
+			provider.Scopes = append(provider.Scopes, value)
+		}
+	}
+	if len(provider.Scopes) == 0 {
+		provider.Scopes = []string{oidcScopeOpenID, oidcScopeEmail, oidcScopeProfile}
+	}
+
+	if provider.Name == "" || provider.ClientID == "" || provider.RedirectURI == "" {
+		return nil, errors.New("identity provider needs name, client_id and redirect_uri")
+	}
+
+	if provider.Issuer == "" && (provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "") {
+		return nil, fmt.Errorf("identity provider %s needs an issuer or its endpoints", provider.Name)
+	}
+
+	return provider, nil
+}
+
+// discover fills the endpoints that are not configured from the OpenID
+// Connect discovery document of the issuer.
+func (p *IdentityProvider) discover() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovered || p.Issuer == "" {
+		return nil
+	}
+
+	var document struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	err := getJSON(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", "", &document)
+	if err != nil {
+		return fmt.Errorf("failed to discover provider %s: %v", p.Name, err)
+	}
+
+	if document.Issuer != p.Issuer {
+		return fmt.Errorf("provider %s reports issuer %s", p.Name, document.Issuer)
+	}
+
+	if p.AuthorizationEndpoint == "" {
+		p.AuthorizationEndpoint = document.AuthorizationEndpoint
+	}
+	if p.TokenEndpoint == "" {
+		p.TokenEndpoint = document.TokenEndpoint
+	}
+	if p.UserinfoEndpoint == "" {
+		p.UserinfoEndpoint = document.UserinfoEndpoint
+	}
+	if p.JWKSURI == "" {
+		p.JWKSURI = document.JWKSURI
+	}
+	p.discovered = true
+
+	return nil
+}
+
+// keys returns the cached JWKS of the provider. refresh forces a reload,
+// e.g. when a token is signed with a key that is not cached yet.
+func (p *IdentityProvider) keys(refresh bool) (JWKS, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !refresh && len(p.jwks.Keys) > 0 && time.Since(p.jwksFetchedAt) < providerJWKSCacheDuration {
+		return p.jwks, nil
+	}
+
+	if p.JWKSURI == "" {
+		return JWKS{}, fmt.Errorf("provider %s has no jwks_uri", p.Name)
+	}
+
+	var jwks JWKS
+	err := getJSON(p.JWKSURI, "", &jwks)
+	if err != nil {
+		return JWKS{}, fmt.Errorf("failed to get keys of provider %s: %v", p.Name, err)
+	}
+
+	p.jwks = jwks
+	p.jwksFetchedAt = time.Now()
+
+	return jwks, nil
+}
+
+// authorizationURL builds the url the user is sent to. PKCE and the nonce
+// are always used, providers ignore what they do not support.
+func (p *IdentityProvider) authorizationURL(state string, nonce string, codeChallenge string) (string, error) {
+	err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	link, err := url.Parse(p.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint of provider %s: %v", p.Name, err)
+	}
+
+	query := link.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURI)
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", pkceMethodS256)
+	link.RawQuery = query.Encode()
+
+	return link.String(), nil
+}
+
+// identity exchanges the authorization code and verifies who the user is,
+// from the ID token when the provider issues one and from userinfo
+// otherwise.
+func (p *IdentityProvider) identity(code string, codeVerifier string, nonce string) (*ProviderIdentity, error) {
+	err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURI)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	err = doJSON(req, &tokenResponse)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange code with provider %s: %v", p.Name, err)
+	}
+
+	var claims map[string]interface{}
+	if tokenResponse.IDToken != "" {
+		claims, err = p.verifyIDToken(tokenResponse.IDToken, nonce)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if p.UserinfoEndpoint == "" || tokenResponse.AccessToken == "" {
+			return nil, fmt.Errorf("provider %s returned neither an id token nor a usable access token", p.Name)
+		}
+		err = getJSON(p.UserinfoEndpoint, tokenResponse.AccessToken, &claims)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get userinfo from provider %s: %v", p.Name, err)
+		}
+	}
+
+	// Plain OAuth 2.0 providers often name the subject "id"
+	subject := claimString(claims, "sub")
+	if subject == "" {
+		subject = claimString(claims, "id")
+	}
+	if subject == "" {
+		return nil, fmt.Errorf("provider %s returned no subject", p.Name)
+	}
+
+	return &ProviderIdentity{
+		Subject:       subject,
+		Email:         strings.ToLower(claimString(claims, "email")),
+		EmailVerified: claimString(claims, "email_verified") == "true",
+		Claims:        claims,
+	}, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of
+// the ID token.
+func (p *IdentityProvider) verifyIDToken(idToken string, nonce string) (map[string]interface{}, error) {
+	jwks, err := p.keys(false)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := verifyJWT(idToken, jwks)
+	if errors.Is(err, errInvalidJWT) {
+		// The provider may have rotated its keys
+		jwks, err = p.keys(true)
+		if err != nil {
+			return nil, err
+		}
+		claims, err = verifyJWT(idToken, jwks)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token from provider %s: %v", p.Name, err)
+	}
+
+	if p.Issuer != "" && claimString(claims, "iss") != p.Issuer {
+		return nil, fmt.Errorf("id token from provider %s has a wrong issuer", p.Name)
+	}
+
+	audienceOK := false
+	switch audience := claims["aud"].(type) {
+	case string:
+		audienceOK = audience == p.ClientID
+	case []interface{}:
+		for _, item := range audience {
+			if item == p.ClientID {
+				audienceOK = true
+			}
+		}
+		if azp := claimString(claims, "azp"); len(audience) > 1 && azp != p.ClientID {
+			audienceOK = false
+		}
+	}
+	if !audienceOK {
+		return nil, fmt.Errorf("id token from provider %s is not issued for this client", p.Name)
+	}
+
+	// One minute of clock skew is tolerated
+	exp, _ := claims["exp"].(float64)
+	if time.Now().Add(-time.Minute).Unix() > int64(exp) {
+		return nil, fmt.Errorf("id token from provider %s has expired", p.Name)
+	}
+
+	if claimString(claims, "nonce") != nonce {
+		return nil, fmt.Errorf("id token from provider %s has a wrong nonce", p.Name)
+	}
+
+	return claims, nil
+}
+
+// claimString returns the claim as a string. Numbers and booleans are
+// formatted, since providers differ in how they encode e.g. ids.
+func claimString(claims map[string]interface{}, name string) string {
+	switch value := claims[name].(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case float64:
+		return fmt.Sprintf("%.0f", value)
+	case bool:
+		return fmt.Sprintf("%t", value)
+	default:
+		return ""
+	}
+}
+
+func getJSON(endpoint string, bearerToken string, target interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+bearerToken)
+	}
+
+	return doJSON(req, target)
+}
+
+func doJSON(req *http.Request, target interface{}) error {
+	resp, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	return decoder.Decode(target)
+}
@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+	"github.com/Limpid-LLC/go-auth/logger"
+	"go.uber.org/zap"
+)
+
+// impersonationTokenPrefix marks impersonated access tokens, so check can
+// audit them without loading the token first
+const impersonationTokenPrefix = "imp_"
+
+func isImpersonationToken(token string) bool {
+	return strings.HasPrefix(token, impersonationTokenPrefix)
+}
+
+// auditImpersonatedCheck logs a check decision made with an impersonated
+// token. tokens are the rows check found, which may be none.
+func (is InternalService) auditImpersonatedCheck(token string, tokens []entities.TokenPermission, request Request, allowed bool) {
+	var tokenPermission *entities.TokenPermission
+	if len(tokens) > 0 {
+		tokenPermission = &tokens[0]
+	} else {
+		found, err := is.getTokenPermission(token)
+		if err != nil && !errors.Is(err, errTokenNotFound) {
+			log.Println("Cannot get impersonated token, err:", err)
+		}
+		tokenPermission = found
+	}
+
+	if tokenPermission == nil {
+		logger.Logger.Info("Impersonated check with an expired or revoked token",
+			zap.String("microservice", request.Microservice),
+			zap.String("method", request.Method),
+			zap.Bool("allowed", allowed),
+		)
+		return
+	}
+
+	logger.Logger.Info("Impersonated check",
+		zap.String("impersonator_id", tokenPermission.ImpersonatorID),
+		zap.String("user_id", tokenPermission.UserID),
+		zap.String("session_id", tokenPermission.SessionID),
+		zap.String("microservice", request.Microservice),
+		zap.String("method", request.Method),
+		zap.Bool("allowed", allowed),
+	)
+}
+
+// impersonateUserHandler starts a session of the user for the admin. It has
+// no refresh token and expires after tokens.expiration.impersonation.
+func (is *InternalService) impersonateUserHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		log.Println("Invalid data format in impersonateUserHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	actorPermission, err := is.getTokenPermission(tokenFromRequest(data, meta))
+	// Only admins acting as themselves may impersonate, which rules out
+	// chains and tokens of OAuth clients
+	if err != nil || actorPermission.ClientID != "" || actorPermission.ImpersonatorID != "" {
+		if err != nil && !errors.Is(err, errTokenNotFound) {
+			log.Println("Cannot get token owner, err:", err)
+		}
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+	actorID := actorPermission.UserID
+
+	userID, ok := dataMap["user_id"].(string)
+	if !ok || userID == "" || userID == actorID {
+		return NewErrorResponse(
+			"InvalidUserIDError",
+			"IUE_04",
+			"Invalid user ID",
+		), http.StatusBadRequest, nil
+	}
+	reason, _ := dataMap["reason"].(string)
+
+	user, err := is.UsersRepository.GetUserByID(userID)
+	if err != nil {
+		return NewErrorResponse(
+			"UserNotFoundError",
+			"UNF_01",
+			"User not found",
+		), http.StatusBadRequest, nil
+	}
+
+	actor, err := is.UsersRepository.GetUserByID(actorID)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	if !is.mayImpersonate(actor, user) {
+		logger.Logger.Info("Impersonation refused",
+			zap.String("impersonator_id", actorID),
+			zap.String("user_id", user.InternalId),
+		)
+		return NewErrorResponse(
+			"ImpersonationError",
+			"IME_01",
+			"The user cannot be impersonated",
+		), http.StatusForbidden, nil
+	}
+
+	session, err := is.startSession(user, meta, "")
+	if err != nil {
+		log.Println("Cannot start session, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	accessTokens, err := is.generateAccessTokens(user, accessTokenOptions{
+		SessionID:      session.ID,
+		ImpersonatorID: actorID,
+		Expiration:     is.TokenExpirations.Impersonation,
+	})
+	if err != nil {
+		log.Println("Cannot generate tokens, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	session.ImpersonatorID = actorID
+	session.ExpiredAt = time.Now().Add(is.TokenExpirations.Impersonation).Unix()
+	err = is.touchSession(session, accessTokens, nil)
+	if err != nil {
+		log.Println("Cannot update session, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	logger.Logger.Info("Impersonation started",
+		zap.String("impersonator_id", actorID),
+		zap.String("user_id", user.InternalId),
+		zap.String("session_id", session.ID),
+		zap.String("ip", session.IP),
+		zap.String("reason", reason),
+	)
+
+	response := map[string]interface{}{
+		"accessTokens": accessTokens,
+		"sessionId":    session.ID,
+		"expired_at":   session.ExpiredAt,
+	}
+	if !is.LegacyPerRoleTokens && len(accessTokens) == 1 {
+		response["accessToken"] = accessTokens[0].Token
+	}
+
+	return NewOkResponse(response)
+}
+
+// mayImpersonate reports whether the actor may act as the user. Admins are
+// never impersonated, and the user may hold no role the actor lacks, so
+// impersonation cannot widen the permissions of the actor.
+func (is *InternalService) mayImpersonate(actor *entities.User, user *entities.User) bool {
+	for _, role := range user.Roles {
+		if role.Type == is.AdminRole.Type || !actor.HasRole(role) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// endImpersonationHandler revokes an impersonation session started by the
+// token owner.
+func (is *InternalService) endImpersonationHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		log.Println("Invalid data format in endImpersonationHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	actorID, err := is.getTokenOwnerID(tokenFromRequest(data, meta))
+	if err != nil {
+		if !errors.Is(err, errTokenNotFound) {
+			log.Println("Cannot get token owner, err:", err)
+		}
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	sessionID, _ := dataMap["session_id"].(string)
+
+	session, err := is.SessionsRepository.GetSessionByID(sessionID)
+	if err != nil || session.ImpersonatorID == "" || session.ImpersonatorID != actorID {
+		return NewErrorResponse(
+			"SessionNotFoundError",
+			"SNF_01",
+			"Session not found",
+		), http.StatusNotFound, nil
+	}
+
+	logger.Logger.Info("Impersonation ended",
+		zap.String("impersonator_id", actorID),
+		zap.String("user_id", session.UserID),
+		zap.String("session_id", session.ID),
+	)
+
+	return is.revokeSessionResponse(session.ID)
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+// signedInToken issues an access token for the stored user.
+func signedInToken(t *testing.T, is *InternalService, userID string) string {
+	t.Helper()
+
+	user, err := is.UsersRepository.GetUserByID(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accessTokens, err := is.generateAccessTokens(user, accessTokenOptions{SessionID: "session-" + userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return accessTokens[0].Token
+}
+
+func newImpersonationTestService(t *testing.T) *InternalService {
+	is, storage := newTestService(t)
+
+	staff := entities.Role{InternalID: "staff-role", Type: "staff"}
+	finance := entities.Role{InternalID: "finance-role", Type: "finance"}
+	storage.insert("users",
+		entities.User{InternalId: "admin", Email: "admin@example.com", Roles: []entities.Role{is.AdminRole, staff}},
+		entities.User{InternalId: "other-admin", Email: "other@example.com", Roles: []entities.Role{is.AdminRole}},
+		entities.User{InternalId: "staff-user", Email: "staff@example.com", Roles: []entities.Role{staff}},
+		entities.User{InternalId: "finance-user", Email: "finance@example.com", Roles: []entities.Role{finance}},
+		entities.User{InternalId: "plain-user", Email: "plain@example.com"},
+	)
+
+	return is
+}
+
+func TestImpersonateUserTargets(t *testing.T) {
+	tests := []struct {
+		userID       string
+		expectedCode string
+	}{
+		{"staff-user", ""},
+		{"plain-user", ""},
+		{"finance-user", "IME_01"},
+		{"other-admin", "IME_01"},
+		{"admin", "IUE_04"},
+		{"unknown", "UNF_01"},
+	}
+
+	is := newImpersonationTestService(t)
+	adminToken := signedInToken(t, is, "admin")
+
+	for _, test := range tests {
+		t.Run(test.userID, func(t *testing.T) {
+			response, _, _ := is.impersonateUserHandler(
+				map[string]interface{}{"user_id": test.userID},
+				map[string]interface{}{"token": adminToken},
+			)
+
+			if code := errorCode(response); code != test.expectedCode {
+				t.Fatalf("expected %q, got %+v", test.expectedCode, response)
+			}
+			if test.expectedCode != "" {
+				return
+			}
+
+			var result map[string]interface{}
+			decodeResult(t, response, &result)
+			token, _ := result["accessToken"].(string)
+			if !strings.HasPrefix(token, impersonationTokenPrefix) {
+				t.Errorf("expected an impersonated token, got %v", result)
+			}
+		})
+	}
+}
+
+func TestImpersonatedTokenCannotChangeCredentials(t *testing.T) {
+	is := newImpersonationTestService(t)
+	adminToken := signedInToken(t, is, "admin")
+
+	response, _, _ := is.impersonateUserHandler(
+		map[string]interface{}{"user_id": "staff-user"},
+		map[string]interface{}{"token": adminToken},
+	)
+	var result map[string]interface{}
+	decodeResult(t, response, &result)
+	impersonatedMeta := map[string]interface{}{"token": result["accessToken"]}
+	ownMeta := map[string]interface{}{"token": signedInToken(t, is, "staff-user")}
+
+	handlers := map[string]func(interface{}, interface{}) (interface{}, int, error){
+		"sign_out_all":  is.signOutAllHandler,
+		"enroll_totp":   is.enrollTOTPHandler,
+		"confirm_totp":  is.confirmTOTPHandler,
+		"disable_totp":  is.disableTOTPHandler,
+		"link_provider": is.linkProviderHandler,
+	}
+	for method, handler := range handlers {
+		response, status, _ := handler(map[string]interface{}{}, impersonatedMeta)
+		if errorCode(response) != "TKE_01" || status != 401 {
+			t.Errorf("expected %s to refuse the impersonated token, got %d %+v", method, status, response)
+		}
+	}
+
+	for _, field := range []string{"password", "email", "phone"} {
+		response, _, _ := is.updateUserHandler(map[string]interface{}{
+			"Select": map[string]interface{}{"internal_id": "staff-user"},
+			"Data":   map[string]interface{}{field: "new-" + field},
+		}, impersonatedMeta)
+		if errorCode(response) != "RFE_02" {
+			t.Errorf("expected update_user to refuse %s, got %+v", field, response)
+		}
+	}
+
+	// Other fields, and the credentials with the own token of the user, can
+	// still be changed
+	response, _, _ = is.updateUserHandler(map[string]interface{}{
+		"Select": map[string]interface{}{"internal_id": "staff-user"},
+		"Data":   map[string]interface{}{"data.name": "Staff"},
+	}, impersonatedMeta)
+	if code := errorCode(response); code != "" {
+		t.Errorf("expected the data update to pass, got %+v", response)
+	}
+
+	response, _, _ = is.enrollTOTPHandler(map[string]interface{}{}, ownMeta)
+	if code := errorCode(response); code != "" {
+		t.Errorf("expected enrollment with the own token to pass, got %+v", response)
+	}
+}
@@ -0,0 +1,292 @@
+package internal
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+const introspectMethod = "introspect"
+
+var inactiveToken = map[string]interface{}{"active": false}
+
+// introspectionAllowed reports whether the credential is a service token
+// that may call introspect from the given address.
+func (is *InternalService) introspectionAllowed(credential string, ip string) (bool, error) {
+	serviceToken, err := is.findServiceToken(credential)
+	if err != nil || serviceToken == nil {
+		return false, err
+	}
+
+	return serviceTokenAllows(serviceToken, Request{Microservice: is.Name, Method: introspectMethod}, ip), nil
+}
+
+// introspect describes the token as defined by RFC 7662. Unknown and expired
+// tokens are only reported as inactive.
+func (is *InternalService) introspect(token string) (map[string]interface{}, error) {
+	if token == "" {
+		return inactiveToken, nil
+	}
+
+	serviceToken, err := is.findServiceToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if serviceToken != nil {
+		return introspectServiceToken(serviceToken), nil
+	}
+
+	if isAPIKey(token) {
+		return is.introspectAPIKey(token)
+	}
+
+	tokenPermissions, err := is.TokenPermissionsRepository.GetTokenPermissions(token, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokenPermissions) == 0 || tokenPermissions[0].UserID == "" {
+		return inactiveToken, nil
+	}
+
+	first := tokenPermissions[0]
+	result := map[string]interface{}{
+		"active":     true,
+		"token_type": "access_token",
+		"sub":        first.UserID,
+		"exp":        first.ExpiredAt,
+	}
+	if first.SessionID != "" {
+		result["sid"] = first.SessionID
+	}
+	if first.ClientID != "" {
+		result["client_id"] = first.ClientID
+	}
+	if first.Scope != "" {
+		result["scope"] = first.Scope
+	}
+	// The acting party of an impersonated token (RFC 8693)
+	if first.ImpersonatorID != "" {
+		result["act"] = map[string]interface{}{"sub": first.ImpersonatorID}
+	}
+
+	roles := []string{}
+	roleTypes := []string{}
+	permissions := []string{}
+	var deniedPermissions []string
+	for _, tokenPermission := range tokenPermissions {
+		// The identity row of single tokens carries no role
+		if tokenPermission.RoleInternalID != "" && !containsString(roles, tokenPermission.RoleInternalID) {
+			roles = append(roles, tokenPermission.RoleInternalID)
+		}
+		if tokenPermission.Type != "" && !containsString(roleTypes, tokenPermission.Type) {
+			roleTypes = append(roleTypes, tokenPermission.Type)
+		}
+		if tokenPermission.PermissionMethod != "" {
+			permission := tokenPermission.PermissionMicroservice + ":" + tokenPermission.PermissionMethod
+			if tokenPermission.Deny {
+				if !containsString(deniedPermissions, permission) {
+					deniedPermissions = append(deniedPermissions, permission)
+				}
+			} else if !containsString(permissions, permission) {
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	result["roles"] = roles
+	result["role_types"] = roleTypes
+	result["permissions"] = permissions
+	if len(deniedPermissions) > 0 {
+		result["denied_permissions"] = deniedPermissions
+	}
+
+	return result, nil
+}
+
+func introspectServiceToken(serviceToken *entities.ServiceToken) map[string]interface{} {
+	if serviceToken.Expired(time.Now().Unix()) {
+		return inactiveToken
+	}
+
+	result := map[string]interface{}{
+		"active":      true,
+		"token_type":  "service_token",
+		"sub":         serviceToken.Name,
+		"permissions": serviceToken.Permissions,
+	}
+	if serviceToken.ExpiredAt != 0 {
+		result["exp"] = serviceToken.ExpiredAt
+	}
+
+	return result
+}
+
+// introspectAPIKey reports the permissions the key currently holds, which
+// depend on the roles of its owner.
+func (is *InternalService) introspectAPIKey(key string) (map[string]interface{}, error) {
+	apiKeys, err := is.APIKeysRepository.GetAPIKeys(map[string]interface{}{
+		"___key": hashToken(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(apiKeys) == 0 || apiKeys[0].Expired(time.Now().Unix()) {
+		return inactiveToken, nil
+	}
+	apiKey := apiKeys[0]
+
+	user, err := is.UsersRepository.GetUserByID(apiKey.UserID)
+	if err != nil {
+		return inactiveToken, nil
+	}
+
+	roles := []string{}
+	roleTypes := []string{}
+	permissions := []string{}
+	ownerRoles, err := is.userRoles(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range ownerRoles {
+		granted := false
+		for _, permission := range role.Permissions {
+			for _, scoped := range scopePermissions(apiKey.Scopes, permission) {
+				granted = true
+
+				name := scoped.Microservice + ":" + scoped.Method
+				if !containsString(permissions, name) {
+					permissions = append(permissions, name)
+				}
+			}
+		}
+
+		if granted {
+			if role.InternalID != "" {
+				roles = append(roles, role.InternalID)
+			}
+			if !containsString(roleTypes, role.Type) {
+				roleTypes = append(roleTypes, role.Type)
+			}
+		}
+	}
+
+	result := map[string]interface{}{
+		"active":      true,
+		"token_type":  "api_key",
+		"sub":         apiKey.UserID,
+		"iat":         apiKey.CreatedAt,
+		"scope":       strings.Join(apiKey.Scopes, " "),
+		"roles":       roles,
+		"role_types":  roleTypes,
+		"permissions": permissions,
+	}
+	if apiKey.ExpiredAt != 0 {
+		result["exp"] = apiKey.ExpiredAt
+	}
+
+	return result, nil
+}
+
+// introspectHTTPHandler is the RFC 7662 introspection endpoint. Callers
+// authenticate with a service token in the Authorization header.
+func (is *InternalService) introspectHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSON(w, http.StatusMethodNotAllowed, OAuthError{"invalid_request", "The introspection endpoint only accepts POST"})
+		return
+	}
+
+	ip := is.requestIP(r)
+	if is.isFlooder(ip) {
+		log.Println("Flood protection in introspectHTTPHandler")
+		writeJSON(w, http.StatusTooManyRequests, OAuthError{"invalid_request", "Flood protection"})
+		return
+	}
+
+	credential := ""
+	if authorization := r.Header.Get("Authorization"); len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		credential = strings.TrimSpace(authorization[7:])
+	}
+
+	allowed, err := is.introspectionAllowed(credential, ip)
+	if err != nil {
+		log.Println("Cannot authenticate introspection caller, err:", err)
+		writeJSON(w, http.StatusInternalServerError, OAuthError{"server_error", "Internal server error"})
+		return
+	}
+	if !allowed {
+		is.FloodAdd(ip)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeJSON(w, http.StatusUnauthorized, OAuthError{"invalid_token", "A service token allowed to introspect is required"})
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, OAuthError{"invalid_request", "Invalid form data"})
+		return
+	}
+
+	result, err := is.introspect(r.PostForm.Get("token"))
+	if err != nil {
+		log.Println("Cannot introspect token, err:", err)
+		writeJSON(w, http.StatusInternalServerError, OAuthError{"server_error", "Internal server error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// introspectHandler is the JSON method. The service token of the caller is
+// taken from the metadata, the introspected token from the data.
+func (is *InternalService) introspectHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	metaMap, _ := meta.(map[string]interface{})
+	ip, _ := metaMap["ip"].(string)
+	credential, _ := metaMap["token"].(string)
+
+	if is.isFlooder(ip) {
+		log.Println("Flood protection in introspectHandler")
+		return NewErrorResponse(
+			"FloodError",
+			"DFE_07",
+			"Flood protection",
+		), http.StatusBadRequest, nil
+	}
+
+	allowed, err := is.introspectionAllowed(credential, methodCallIP)
+	if err != nil {
+		log.Println("Cannot authenticate introspection caller, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+	if !allowed {
+		is.FloodAdd(ip)
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	dataMap, _ := data.(map[string]interface{})
+	token, _ := dataMap["token"].(string)
+
+	result, err := is.introspect(token)
+	if err != nil {
+		log.Println("Cannot introspect token, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse(result)
+}
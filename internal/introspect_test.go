@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+// newIntrospectTestService configures the service token "resource-server",
+// allowed to introspect.
+func newIntrospectTestService(t *testing.T) (*InternalService, *testStorage, *entities.User) {
+	is, storage, user := newDenyTestService(t)
+
+	serviceTokens, err := NewServiceTokens(map[string]interface{}{
+		"name":        "resource-server",
+		"token":       "resource-server",
+		"permissions": []interface{}{"Auth:introspect"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.ServiceTokens = serviceTokens
+
+	return is, storage, user
+}
+
+func TestIntrospectAccessToken(t *testing.T) {
+	is, _, user := newIntrospectTestService(t)
+
+	accessTokens, err := is.generateAccessTokens(user, accessTokenOptions{SessionID: "session", ImpersonatorID: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := is.introspect(accessTokens[0].Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, _ := json.Marshal(result)
+	var introspection struct {
+		Active            bool              `json:"active"`
+		TokenType         string            `json:"token_type"`
+		Sub               string            `json:"sub"`
+		Sid               string            `json:"sid"`
+		Exp               int64             `json:"exp"`
+		Act               map[string]string `json:"act"`
+		Roles             []string          `json:"roles"`
+		RoleTypes         []string          `json:"role_types"`
+		Permissions       []string          `json:"permissions"`
+		DeniedPermissions []string          `json:"denied_permissions"`
+	}
+	if err := json.Unmarshal(encoded, &introspection); err != nil {
+		t.Fatal(err)
+	}
+
+	if !introspection.Active || introspection.TokenType != "access_token" || introspection.Sub != "user" || introspection.Sid != "session" {
+		t.Errorf("expected an active access token of the session, got %s", encoded)
+	}
+	if introspection.Exp <= time.Now().Unix() {
+		t.Errorf("expected the expiry of the token, got %d", introspection.Exp)
+	}
+	if introspection.Act["sub"] != "admin" {
+		t.Errorf("expected the impersonator as the acting party, got %s", encoded)
+	}
+	if !containsString(introspection.Roles, "editor-role") || !containsString(introspection.RoleTypes, "default") {
+		t.Errorf("expected the roles of the token, got %s", encoded)
+	}
+	if !containsString(introspection.Permissions, "crud:read") || !containsString(introspection.Permissions, "crud:delete") {
+		t.Errorf("expected the permissions of the roles, got %s", encoded)
+	}
+	if len(introspection.DeniedPermissions) != 1 || introspection.DeniedPermissions[0] != "crud:delete" {
+		t.Errorf("expected the deny permission, got %s", encoded)
+	}
+}
+
+func TestIntrospectOtherCredentials(t *testing.T) {
+	is, storage, _ := newIntrospectTestService(t)
+
+	key := apiKeyPrefix + "key"
+	storage.insert("apiKeys", entities.APIKey{ID: "key", Name: "ci", KeyHash: hashToken(key), UserID: "user", Scopes: []string{"crud:delete"}})
+
+	result, err := is.introspect(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	permissions, _ := result["permissions"].([]string)
+	if result["token_type"] != "api_key" || result["scope"] != "crud:delete" || len(permissions) != 1 || permissions[0] != "crud:delete" {
+		t.Errorf("expected the permissions the key holds, got %v", result)
+	}
+
+	result, err = is.introspect("resource-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["token_type"] != "service_token" || result["sub"] != "resource-server" {
+		t.Errorf("expected the service token, got %v", result)
+	}
+}
+
+func TestIntrospectInactiveTokens(t *testing.T) {
+	is, storage, _ := newIntrospectTestService(t)
+
+	storage.insert("tokenPermissions", entities.TokenPermission{
+		Token:                  "expired",
+		UserID:                 "user",
+		ExpiredAt:              time.Now().Add(-time.Minute).Unix(),
+		PermissionMicroservice: "crud",
+		PermissionMethod:       "read",
+	})
+	storage.insert("apiKeys", entities.APIKey{
+		ID:        "expired",
+		KeyHash:   hashToken(apiKeyPrefix + "expired"),
+		UserID:    "user",
+		Scopes:    []string{"crud:read"},
+		ExpiredAt: time.Now().Add(-time.Minute).Unix(),
+	})
+
+	for _, token := range []string{"", "unknown", "expired", apiKeyPrefix + "expired", apiKeyPrefix + "unknown"} {
+		result, err := is.introspect(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != 1 || result["active"] != false {
+			t.Errorf("%q: expected only active false, got %v", token, result)
+		}
+	}
+}
+
+func introspectHTTPRequest(is *InternalService, method string, credential string, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/introspect", strings.NewReader(url.Values{"token": {token}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if credential != "" {
+		r.Header.Set("Authorization", "Bearer "+credential)
+	}
+	r.RemoteAddr = "203.0.113.5:1234"
+	w := httptest.NewRecorder()
+
+	is.introspectHTTPHandler(w, r)
+
+	return w
+}
+
+func TestIntrospectHTTPHandler(t *testing.T) {
+	is, _, user := newIntrospectTestService(t)
+	token := signedInToken(t, is, user.InternalId)
+
+	w := introspectHTTPRequest(is, http.MethodPost, "resource-server", token)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"active":true`) {
+		t.Errorf("expected the token to be active, got %d %s", w.Code, w.Body.String())
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		credential string
+		expected   int
+	}{
+		{"GET", http.MethodGet, "resource-server", http.StatusMethodNotAllowed},
+		{"no credential", http.MethodPost, "", http.StatusUnauthorized},
+		// Access tokens cannot introspect other tokens
+		{"access token", http.MethodPost, token, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if w := introspectHTTPRequest(is, test.method, test.credential, token); w.Code != test.expected {
+				t.Errorf("expected %d, got %d %s", test.expected, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestIntrospectHandler(t *testing.T) {
+	is, _, user := newIntrospectTestService(t)
+	token := signedInToken(t, is, user.InternalId)
+
+	response, _, _ := is.introspectHandler(map[string]interface{}{"token": token}, map[string]interface{}{"token": "resource-server"})
+	var result map[string]interface{}
+	decodeResult(t, response, &result)
+	if result["active"] != true || result["sub"] != "user" {
+		t.Errorf("expected the token to be active, got %v", result)
+	}
+
+	response, _, _ = is.introspectHandler(map[string]interface{}{"token": token}, map[string]interface{}{"token": token})
+	if code := errorCode(response); code != "TKE_01" {
+		t.Errorf("expected TKE_01 for a caller without a service token, got %+v", response)
+	}
+}
@@ -0,0 +1,298 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+const (
+	JWTAlgorithmEdDSA = "EdDSA"
+	JWTAlgorithmRS256 = "RS256"
+	JWTAlgorithmES256 = "ES256"
+)
+
+var errInvalidJWT = errors.New("invalid jwt")
+
+// SigningKey is a private key used to sign JWTs. The first configured key
+// signs new tokens, the others are only published in the JWKS so tokens
+// signed before a rotation stay verifiable.
+type SigningKey struct {
+	ID         string
+	Algorithm  string
+	PrivateKey crypto.Signer
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// LoadSigningKey reads a PEM encoded PKCS#8 (or PKCS#1 for RSA) private key.
+func LoadSigningKey(id string, algorithm string, path string) (SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("failed to read key %s: %v", id, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, fmt.Errorf("key %s is not PEM encoded", id)
+	}
+
+	var key interface{}
+	key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return SigningKey{}, fmt.Errorf("failed to parse key %s: %v", id, err)
+		}
+	}
+
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		if algorithm != JWTAlgorithmEdDSA {
+			return SigningKey{}, fmt.Errorf("key %s is an Ed25519 key, expected %s", id, algorithm)
+		}
+		return SigningKey{ID: id, Algorithm: algorithm, PrivateKey: k}, nil
+	case *rsa.PrivateKey:
+		if algorithm != JWTAlgorithmRS256 {
+			return SigningKey{}, fmt.Errorf("key %s is an RSA key, expected %s", id, algorithm)
+		}
+		return SigningKey{ID: id, Algorithm: algorithm, PrivateKey: k}, nil
+	default:
+		return SigningKey{}, fmt.Errorf("key %s has an unsupported type", id)
+	}
+}
+
+// signJWT signs the claims with the active signing key.
+func (is *InternalService) signJWT(claims map[string]interface{}) (string, error) {
+	if len(is.SigningKeys) == 0 {
+		return "", errors.New("no signing keys configured")
+	}
+	key := is.SigningKeys[0]
+
+	header, err := json.Marshal(map[string]string{
+		"alg": key.Algorithm,
+		"typ": "JWT",
+		"kid": key.ID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch key.Algorithm {
+	case JWTAlgorithmEdDSA:
+		signature, err = key.PrivateKey.Sign(rand.Reader, []byte(signingInput), crypto.Hash(0))
+	case JWTAlgorithmRS256:
+		digest := sha256.Sum256([]byte(signingInput))
+		signature, err = key.PrivateKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default:
+		err = fmt.Errorf("unsupported algorithm: %s", key.Algorithm)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// generateAccessJWT issues a JWT describing the identity behind the access
+// tokens of a session. It only carries identity and role ids; parameter
+// level authorization still requires the check method.
+func (is *InternalService) generateAccessJWT(user *entities.User, session *entities.Session) (string, error) {
+	jti, err := generateRandomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	roleIDs := []string{}
+	roleTypes := []string{}
+	for _, role := range append(user.Roles, is.DefaultRole) {
+		if role.InternalID != "" {
+			roleIDs = append(roleIDs, role.InternalID)
+		}
+		roleTypes = append(roleTypes, role.Type)
+	}
+
+	now := time.Now()
+
+	return is.signJWT(map[string]interface{}{
+		"iss":        is.JWTIssuer,
+		"sub":        user.InternalId,
+		"sid":        session.ID,
+		"jti":        jti,
+		"iat":        now.Unix(),
+		"exp":        now.Add(is.TokenExpirations.AccessToken).Unix(),
+		"roles":      roleIDs,
+		"role_types": roleTypes,
+	})
+}
+
+func (is *InternalService) jwks() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+
+	for _, key := range is.SigningKeys {
+		jwk := JWK{
+			Use: "sig",
+			Kid: key.ID,
+			Alg: key.Algorithm,
+		}
+
+		switch publicKey := key.PrivateKey.Public().(type) {
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		default:
+			continue
+		}
+
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	return jwks
+}
+
+func (is *InternalService) jwksHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	return NewOkResponse(is.jwks())
+}
+
+func (is *InternalService) jwksHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, is.jwks())
+}
+
+// verifyJWT checks the signature of a JWT issued by another party against
+// its JWKS and returns the claims. The claims themselves are not validated.
+func verifyJWT(token string, jwks JWKS) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidJWT
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(headerBytes, &header)
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+
+	verified := false
+	for _, key := range jwks.Keys {
+		if (header.Kid != "" && key.Kid != header.Kid) || (key.Alg != "" && key.Alg != header.Alg) {
+			continue
+		}
+
+		if verifyJWKSignature(key, header.Alg, signingInput, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: signature verification failed", errInvalidJWT)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+
+	var claims map[string]interface{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+
+	return claims, nil
+}
+
+func verifyJWKSignature(key JWK, algorithm string, signingInput []byte, signature []byte) bool {
+	switch {
+	case algorithm == JWTAlgorithmRS256 && key.Kty == "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return false
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return false
+		}
+		publicKey := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		digest := sha256.Sum256(signingInput)
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	case algorithm == JWTAlgorithmES256 && key.Kty == "EC" && key.Crv == "P-256":
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return false
+		}
+		y, err := base64.RawURLEncoding.DecodeString(key.Y)
+		if err != nil || len(signature) != 64 {
+			return false
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		digest := sha256.Sum256(signingInput)
+		return ecdsa.Verify(publicKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))
+	case algorithm == JWTAlgorithmEdDSA && key.Kty == "OKP" && key.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return false
+		}
+		return ed25519.Verify(ed25519.PublicKey(x), signingInput, signature)
+	default:
+		return false
+	}
+}
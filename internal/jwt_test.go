@@ -0,0 +1,290 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+func newTestSigningKey(t *testing.T, id string, algorithm string) SigningKey {
+	t.Helper()
+
+	var key SigningKey
+	switch algorithm {
+	case JWTAlgorithmEdDSA:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key = SigningKey{ID: id, Algorithm: algorithm, PrivateKey: privateKey}
+	case JWTAlgorithmRS256:
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key = SigningKey{ID: id, Algorithm: algorithm, PrivateKey: privateKey}
+	default:
+		t.Fatalf("unsupported algorithm %s", algorithm)
+	}
+
+	return key
+}
+
+// newJWTTestService enables JWTs signed with an Ed25519 key.
+func newJWTTestService(t *testing.T) (*InternalService, *testStorage) {
+	is, storage := newTestService(t)
+	is.JWTEnabled = true
+	is.JWTIssuer = "https://auth.example.com/"
+	is.SigningKeys = []SigningKey{newTestSigningKey(t, "key-1", JWTAlgorithmEdDSA)}
+
+	return is, storage
+}
+
+func TestSignJWT(t *testing.T) {
+	for _, algorithm := range []string{JWTAlgorithmEdDSA, JWTAlgorithmRS256} {
+		t.Run(algorithm, func(t *testing.T) {
+			is := &InternalService{SigningKeys: []SigningKey{newTestSigningKey(t, "key-1", algorithm)}}
+
+			token, err := is.signJWT(map[string]interface{}{"sub": "user"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			claims, err := verifyJWT(token, is.jwks())
+			if err != nil {
+				t.Fatalf("expected the token to verify with the JWKS, got %v", err)
+			}
+			if claims["sub"] != "user" {
+				t.Errorf("expected the claims, got %v", claims)
+			}
+
+			parts := strings.Split(token, ".")
+			forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`)) + "." + parts[2]
+			if _, err := verifyJWT(forged, is.jwks()); err == nil {
+				t.Error("expected a changed payload to be refused")
+			}
+
+			other := &InternalService{SigningKeys: []SigningKey{newTestSigningKey(t, "key-1", algorithm)}}
+			if _, err := verifyJWT(token, other.jwks()); err == nil {
+				t.Error("expected another key to be refused")
+			}
+		})
+	}
+}
+
+func TestJWKSKeyRotation(t *testing.T) {
+	oldKey := newTestSigningKey(t, "key-1", JWTAlgorithmEdDSA)
+	newKey := newTestSigningKey(t, "key-2", JWTAlgorithmRS256)
+
+	is := &InternalService{SigningKeys: []SigningKey{oldKey}}
+	oldToken, err := is.signJWT(map[string]interface{}{"sub": "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new key signs, the old one is only published
+	is.SigningKeys = []SigningKey{newKey, oldKey}
+	newToken, err := is.signJWT(map[string]interface{}{"sub": "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(strings.Split(newToken, ".")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(header), `"kid":"key-2"`) || !strings.Contains(string(header), `"alg":"RS256"`) {
+		t.Errorf("expected the new key to sign, got %s", header)
+	}
+
+	jwks := is.jwks()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kty != "RSA" || jwks.Keys[1].Kty != "OKP" || jwks.Keys[1].Crv != "Ed25519" {
+		t.Fatalf("expected both public keys, got %+v", jwks)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := verifyJWT(token, jwks); err != nil {
+			t.Errorf("expected the token to verify after the rotation, got %v", err)
+		}
+	}
+}
+
+func TestVerifyES256JWT(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","kid":"ec"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"subject"}`))
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, privateKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	token := signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	jwks := JWKS{Keys: []JWK{{
+		Kty: "EC",
+		Kid: "ec",
+		Alg: JWTAlgorithmES256,
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(privateKey.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(privateKey.Y.FillBytes(make([]byte, 32))),
+	}}}
+
+	claims, err := verifyJWT(token, jwks)
+	if err != nil || claims["sub"] != "subject" {
+		t.Fatalf("expected the token to verify, got %v %v", claims, err)
+	}
+
+	jwks.Keys[0].Kid = "other"
+	if _, err := verifyJWT(token, jwks); err == nil {
+		t.Error("expected a key with another id to be skipped")
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	dir := t.TempDir()
+
+	writeKey := func(name string, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edPath := writeKey("ed25519.pem", "PRIVATE KEY", edDER)
+	rsaPath := writeKey("rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+	invalidPath := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalidPath, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		algorithm string
+		path      string
+		valid     bool
+	}{
+		{"ed25519", JWTAlgorithmEdDSA, edPath, true},
+		{"pkcs1 rsa", JWTAlgorithmRS256, rsaPath, true},
+		{"algorithm of another key type", JWTAlgorithmRS256, edPath, false},
+		{"not PEM", JWTAlgorithmEdDSA, invalidPath, false},
+		{"missing file", JWTAlgorithmEdDSA, filepath.Join(dir, "missing.pem"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := LoadSigningKey("key", test.algorithm, test.path)
+			if (err == nil) != test.valid {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+			if test.valid && (key.ID != "key" || key.Algorithm != test.algorithm || key.PrivateKey == nil) {
+				t.Errorf("expected the key, got %+v", key)
+			}
+		})
+	}
+}
+
+func TestSignInJWT(t *testing.T) {
+	is, storage := newJWTTestService(t)
+
+	hash, err := is.hashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.insert("users", entities.User{
+		InternalId:     "user",
+		Email:          "user@example.com",
+		HashedPassword: hash,
+		Roles:          []entities.Role{{InternalID: "editor-role", Type: "editor"}},
+	})
+
+	response, _, _ := is.signInHandler(
+		map[string]interface{}{"login": "user@example.com", "password": "password"},
+		map[string]interface{}{"ip": "203.0.113.5"},
+	)
+	var result struct {
+		JWT       string `json:"jwt"`
+		SessionID string `json:"sessionId"`
+	}
+	decodeResult(t, response, &result)
+
+	claims, err := verifyJWT(result.JWT, is.jwks())
+	if err != nil {
+		t.Fatalf("expected a verifiable JWT, got %v", err)
+	}
+
+	if claims["iss"] != is.JWTIssuer || claims["sub"] != "user" || claims["sid"] != result.SessionID || claims["jti"] == "" {
+		t.Errorf("expected the identity of the session, got %v", claims)
+	}
+	exp, _ := claims["exp"].(float64)
+	if remaining := time.Until(time.Unix(int64(exp), 0)); remaining <= 0 || remaining > is.TokenExpirations.AccessToken {
+		t.Errorf("expected the JWT to expire with the access token, got %v", remaining)
+	}
+
+	roles, _ := json.Marshal(claims["roles"])
+	roleTypes, _ := json.Marshal(claims["role_types"])
+	if string(roles) != `["editor-role"]` || string(roleTypes) != `["editor","default"]` {
+		t.Errorf("expected the roles and the default role, got %s %s", roles, roleTypes)
+	}
+}
+
+func TestJWKSHTTPHandler(t *testing.T) {
+	is, _ := newJWTTestService(t)
+
+	if _, ok := is.NewHTTPHandlers()["/.well-known/jwks.json"]; !ok {
+		t.Fatal("expected the JWKS endpoint when JWTs are enabled")
+	}
+
+	w := httptest.NewRecorder()
+	is.jwksHTTPHandler(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+
+	var jwks JWKS
+	if err := json.Unmarshal(w.Body.Bytes(), &jwks); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || len(jwks.Keys) != 1 || jwks.Keys[0].Kid != "key-1" || jwks.Keys[0].Use != "sig" {
+		t.Errorf("expected the public key, got %d %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), `"d"`) {
+		t.Errorf("expected no private key material, got %s", w.Body.String())
+	}
+
+	is.JWTEnabled = false
+	if _, ok := is.NewHTTPHandlers()["/.well-known/jwks.json"]; ok {
+		t.Error("expected no JWKS endpoint when JWTs are disabled")
+	}
+}
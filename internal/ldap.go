@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const ldapTimeout = 10 * time.Second
+
+// LDAPAuthenticator authenticates users with a simple bind against an LDAP
+// directory or Active Directory. The entry is searched with the service
+// account (or anonymously), then the password is checked by binding as the
+// entry.
+type LDAPAuthenticator struct {
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	BindDN             string
+	BindPassword       string
+	BaseDN             string
+	// UserFilter finds the entry, {login} is replaced with the escaped login
+	UserFilter     string
+	IDAttribute    string
+	EmailAttribute string
+	PhoneAttribute string
+	GroupAttribute string
+	// DataAttributes maps User.Data fields to entry attributes
+	DataAttributes map[string]string
+	// GroupRoles maps group DNs to role internal ids
+	GroupRoles map[string]string
+	// LinkEmails links entries to existing users with the same email
+	LinkEmails bool
+}
+
+// NewLDAPAuthenticator reads the authenticator from its config entry.
+func NewLDAPAuthenticator(config map[string]interface{}) (*LDAPAuthenticator, error) {
+	authenticator := &LDAPAuthenticator{
+		UserFilter:     "(uid={login})",
+		EmailAttribute: "mail",
+		PhoneAttribute: "telephoneNumber",
+		GroupAttribute: "memberOf",
+		DataAttributes: map[string]string{},
+		GroupRoles:     map[string]string{},
+	}
+
+	authenticator.URL, _ = config["url"].(string)
+	authenticator.StartTLS, _ = config["start_tls"].(bool)
+	authenticator.InsecureSkipVerify, _ = config["insecure_skip_verify"].(bool)
+	authenticator.BindDN, _ = config["bind_dn"].(string)
+	authenticator.BindPassword, _ = config["bind_password"].(string)
+	authenticator.BaseDN, _ = config["base_dn"].(string)
+	authenticator.IDAttribute, _ = config["id_attribute"].(string)
+	authenticator.LinkEmails, _ = config["link_by_email"].(bool)
+
+	for key, target := range map[string]*string{
+		"user_filter":     &authenticator.UserFilter,
+		"email_attribute": &authenticator.EmailAttribute,
+		"phone_attribute": &authenticator.PhoneAttribute,
+		"group_attribute": &authenticator.GroupAttribute,
+	} {
+		if value, ok := config[key].(string); ok && value != "" {
+			*target = value
+		}
+	}
+
+	dataAttributes, _ := config["data_attributes"].(map[string]interface{})
+	for field, attribute := range dataAttributes {
+		if value, ok := attribute.(string); ok {
+			authenticator.DataAttributes[field] = value
+		}
+	}
+
+	// Group DNs are compared case-insensitively
+	groupRoles, _ := config["group_roles"].(map[string]interface{})
+	for group, roleID := range groupRoles {
+		if value, ok := roleID.(string); ok {
+			authenticator.GroupRoles[strings.ToLower(group)] = value
+		}
+	}
+
+	if authenticator.URL == "" || authenticator.BaseDN == "" {
+		return nil, errors.New("ldap needs url and base_dn")
+	}
+
+	if !strings.Contains(authenticator.UserFilter, "{login}") {
+		return nil, errors.New("ldap user_filter should contain {login}")
+	}
+
+	return authenticator, nil
+}
+
+func (a *LDAPAuthenticator) Name() string {
+	return "ldap"
+}
+
+func (a *LDAPAuthenticator) LinkByEmail() bool {
+	return a.LinkEmails
+}
+
+func (a *LDAPAuthenticator) Authenticate(login string, password string) (*DirectoryUser, error) {
+	// An empty password would be an unauthenticated bind, which succeeds
+	if login == "" || password == "" {
+		return nil, errInvalidCredentials
+	}
+
+	conn, err := a.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if a.BindDN != "" {
+		err = conn.Bind(a.BindDN, a.BindPassword)
+		if err != nil {
+			return nil, fmt.Errorf("failed to bind ldap service account: %v", err)
+		}
+	}
+
+	attributes := []string{a.EmailAttribute, a.PhoneAttribute, a.GroupAttribute}
+	if a.IDAttribute != "" {
+		attributes = append(attributes, a.IDAttribute)
+	}
+	for _, attribute := range a.DataAttributes {
+		attributes = append(attributes, attribute)
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		int(ldapTimeout.Seconds()),
+		false,
+		strings.ReplaceAll(a.UserFilter, "{login}", ldap.EscapeFilter(login)),
+		attributes,
+		nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("failed to search ldap: %v", err)
+	}
+
+	// Ambiguous logins are rejected rather than guessed
+	if result == nil || len(result.Entries) != 1 {
+		return nil, errInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	err = conn.Bind(entry.DN, password)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, errInvalidCredentials
+		}
+		return nil, fmt.Errorf("failed to bind ldap user: %v", err)
+	}
+
+	return a.directoryUser(entry), nil
+}
+
+func (a *LDAPAuthenticator) connect() (*ldap.Conn, error) {
+	parsedURL, err := url.Parse(a.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ldap url: %v", err)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         parsedURL.Hostname(),
+		InsecureSkipVerify: a.InsecureSkipVerify,
+	}
+
+	conn, err := ldap.DialURL(
+		a.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(tlsConfig),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ldap: %v", err)
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if a.StartTLS {
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to start tls with ldap: %v", err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (a *LDAPAuthenticator) directoryUser(entry *ldap.Entry) *DirectoryUser {
+	directoryUser := &DirectoryUser{
+		ID:    entry.DN,
+		Email: strings.ToLower(entry.GetAttributeValue(a.EmailAttribute)),
+		Phone: entry.GetAttributeValue(a.PhoneAttribute),
+		Data:  map[string]interface{}{},
+	}
+
+	// Binary ids such as the objectGUID of Active Directory are hex encoded
+	if a.IDAttribute != "" {
+		if raw := entry.GetRawAttributeValue(a.IDAttribute); len(raw) > 0 {
+			if utf8.Valid(raw) {
+				directoryUser.ID = string(raw)
+			} else {
+				directoryUser.ID = hex.EncodeToString(raw)
+			}
+		}
+	}
+
+	for field, attribute := range a.DataAttributes {
+		if value := entry.GetAttributeValue(attribute); value != "" {
+			directoryUser.Data[field] = value
+		}
+	}
+
+	for _, roleID := range a.GroupRoles {
+		if !containsString(directoryUser.ManagedRoleIDs, roleID) {
+			directoryUser.ManagedRoleIDs = append(directoryUser.ManagedRoleIDs, roleID)
+		}
+	}
+	for _, group := range entry.GetAttributeValues(a.GroupAttribute) {
+		roleID, ok := a.GroupRoles[strings.ToLower(group)]
+		if ok && !containsString(directoryUser.RoleIDs, roleID) {
+			directoryUser.RoleIDs = append(directoryUser.RoleIDs, roleID)
+		}
+	}
+
+	return directoryUser
+}
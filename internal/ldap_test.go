@@ -0,0 +1,288 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// stubLDAPServer answers simple binds and searches from the entries. An
+// entry is returned when the search filter contains one of its attribute
+// values as an equality match.
+type stubLDAPServer struct {
+	listener net.Listener
+	// passwords maps DNs, entries and the service account, to passwords
+	passwords map[string]string
+	entries   []stubLDAPEntry
+
+	mutex   sync.Mutex
+	filters []string
+	bindDNs []string
+}
+
+type stubLDAPEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+func newStubLDAPServer(t *testing.T, passwords map[string]string, entries ...stubLDAPEntry) *stubLDAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &stubLDAPServer{listener: listener, passwords: passwords, entries: entries}
+	go server.serve()
+
+	return server
+}
+
+func (s *stubLDAPServer) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *stubLDAPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *stubLDAPServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+
+			s.mutex.Lock()
+			s.bindDNs = append(s.bindDNs, dn)
+			s.mutex.Unlock()
+
+			resultCode := ldap.LDAPResultSuccess
+			if expected, ok := s.passwords[dn]; !ok || expected != password {
+				resultCode = ldap.LDAPResultInvalidCredentials
+			}
+			conn.Write(ldapResponse(messageID, ldap.ApplicationBindResponse, resultCode).Bytes())
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				return
+			}
+
+			s.mutex.Lock()
+			s.filters = append(s.filters, filter)
+			s.mutex.Unlock()
+
+			for _, entry := range s.entries {
+				if entry.matches(filter) {
+					conn.Write(ldapEntryResponse(messageID, entry).Bytes())
+				}
+			}
+			conn.Write(ldapResponse(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+func (e stubLDAPEntry) matches(filter string) bool {
+	for attribute, values := range e.Attributes {
+		for _, value := range values {
+			if strings.Contains(filter, "("+attribute+"="+value+")") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func ldapResponse(messageID interface{}, tag ber.Tag, resultCode int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(resultCode), "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+
+	return ldapMessage(messageID, op)
+}
+
+func ldapEntryResponse(messageID interface{}, entry stubLDAPEntry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "objectName"))
+
+	attributes := ber.NewSequence("attributes")
+	for name, values := range entry.Attributes {
+		attribute := ber.NewSequence("attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+		}
+		attribute.AppendChild(set)
+		attributes.AppendChild(attribute)
+	}
+	op.AppendChild(attributes)
+
+	return ldapMessage(messageID, op)
+}
+
+func ldapMessage(messageID interface{}, op *ber.Packet) *ber.Packet {
+	message := ber.NewSequence("LDAP Message")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	message.AppendChild(op)
+
+	return message
+}
+
+func newTestLDAPAuthenticator(t *testing.T, server *stubLDAPServer) *LDAPAuthenticator {
+	authenticator, err := NewLDAPAuthenticator(map[string]interface{}{
+		"url":           server.url(),
+		"bind_dn":       "cn=service,dc=example,dc=com",
+		"bind_password": "service-password",
+		"base_dn":       "dc=example,dc=com",
+		"user_filter":   "(|(uid={login})(mail={login}))",
+		"id_attribute":  "entryUUID",
+		"data_attributes": map[string]interface{}{
+			"first_name": "givenName",
+		},
+		"group_roles": map[string]interface{}{
+			"CN=Admins,OU=Groups,DC=example,DC=com": "admins-role",
+			"cn=staff,ou=groups,dc=example,dc=com":  "staff-role",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return authenticator
+}
+
+var stubAlice = stubLDAPEntry{
+	DN: "uid=alice,ou=people,dc=example,dc=com",
+	Attributes: map[string][]string{
+		"uid":       {"alice"},
+		"mail":      {"Alice@Example.com"},
+		"entryUUID": {"alice-uuid"},
+		"givenName": {"Alice"},
+		"memberOf":  {"cn=admins,ou=groups,dc=example,dc=com", "cn=other,ou=groups,dc=example,dc=com"},
+	},
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	server := newStubLDAPServer(t, map[string]string{
+		"cn=service,dc=example,dc=com": "service-password",
+		stubAlice.DN:                   "alice-password",
+	}, stubAlice)
+	authenticator := newTestLDAPAuthenticator(t, server)
+
+	directoryUser, err := authenticator.Authenticate("alice", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if directoryUser.ID != "alice-uuid" || directoryUser.Email != "alice@example.com" {
+		t.Errorf("unexpected entry %+v", directoryUser)
+	}
+	if directoryUser.Data["first_name"] != "Alice" {
+		t.Errorf("expected the data attributes, got %v", directoryUser.Data)
+	}
+	if len(directoryUser.RoleIDs) != 1 || directoryUser.RoleIDs[0] != "admins-role" {
+		t.Errorf("expected the admins role from the group, got %v", directoryUser.RoleIDs)
+	}
+	if len(directoryUser.ManagedRoleIDs) != 2 {
+		t.Errorf("expected both group roles managed, got %v", directoryUser.ManagedRoleIDs)
+	}
+
+	// The login is escaped in the filter
+	_, err = authenticator.Authenticate("*)(uid=alice", "alice-password")
+	if !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("expected an injected filter to find nothing, got %v", err)
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, filter := range server.filters {
+		if strings.Contains(filter, "(uid=*)") {
+			t.Errorf("login was not escaped: %s", filter)
+		}
+	}
+}
+
+func TestLDAPAuthenticateRejects(t *testing.T) {
+	bob := stubLDAPEntry{
+		DN:         "uid=bob,ou=people,dc=example,dc=com",
+		Attributes: map[string][]string{"uid": {"bob"}, "mail": {"shared@example.com"}},
+	}
+	carol := stubLDAPEntry{
+		DN:         "uid=carol,ou=people,dc=example,dc=com",
+		Attributes: map[string][]string{"uid": {"carol"}, "mail": {"shared@example.com"}},
+	}
+	server := newStubLDAPServer(t, map[string]string{
+		"cn=service,dc=example,dc=com": "service-password",
+		stubAlice.DN:                   "alice-password",
+		bob.DN:                         "bob-password",
+	}, stubAlice, bob, carol)
+	authenticator := newTestLDAPAuthenticator(t, server)
+
+	tests := []struct {
+		name     string
+		login    string
+		password string
+	}{
+		{"wrong password", "alice", "wrong"},
+		{"unknown login", "dave", "password"},
+		{"empty password", "alice", ""},
+		{"ambiguous login", "shared@example.com", "bob-password"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := authenticator.Authenticate(test.login, test.password)
+			if !errors.Is(err, errInvalidCredentials) {
+				t.Errorf("expected errInvalidCredentials, got %v", err)
+			}
+		})
+	}
+
+	// Only the wrong password binds as the entry; an empty one would be an
+	// unauthenticated bind, which succeeds
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	aliceBinds := 0
+	for _, dn := range server.bindDNs {
+		if dn == stubAlice.DN {
+			aliceBinds++
+		}
+	}
+	if aliceBinds != 1 {
+		t.Errorf("expected one bind as the entry, got %d", aliceBinds)
+	}
+}
+
+func TestLDAPAuthenticateServiceAccountFailure(t *testing.T) {
+	server := newStubLDAPServer(t, map[string]string{stubAlice.DN: "alice-password"}, stubAlice)
+	authenticator := newTestLDAPAuthenticator(t, server)
+
+	_, err := authenticator.Authenticate("alice", "alice-password")
+	if err == nil || errors.Is(err, errInvalidCredentials) {
+		t.Errorf("expected a directory error, got %v", err)
+	}
+}
@@ -0,0 +1,382 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+	"github.com/saiset-co/sai-storage-mongo/external/adapter"
+)
+
+const (
+	linkPurposeSignIn        = "sign_in"
+	linkPurposeResetPassword = "reset_password"
+)
+
+var errLinkTokenNotFound = errors.New("link token not found")
+
+// LinkToken is a single-use token sent by email as a link. Only the hash of
+// the token is stored.
+type LinkToken struct {
+	Token     string `json:"token"`
+	UserID    string `json:"user_id"`
+	Purpose   string `json:"purpose"`
+	ExpiredAt int64  `json:"expired_at"`
+}
+
+type MagicLinkRequest struct {
+	Email   string `json:"email" validate:"required,email"`
+	Purpose string `json:"purpose" validate:"required,oneof=sign_in reset_password"`
+}
+
+type RedeemLinkRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password"`
+}
+
+// magicLink builds the link sent to the user from the configured base url.
+func (is *InternalService) magicLink(token string, purpose string) (string, error) {
+	link, err := url.Parse(is.LinkBaseUrl)
+	if err != nil {
+		return "", fmt.Errorf("invalid link base url: %v", err)
+	}
+
+	query := link.Query()
+	query.Set("token", token)
+	query.Set("purpose", purpose)
+	link.RawQuery = query.Encode()
+
+	return link.String(), nil
+}
+
+func (is *InternalService) createLinkToken(user *entities.User, purpose string) (string, error) {
+	token, err := generateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	req := adapter.Request{
+		Method: "create",
+		Data: adapter.CreateRequest{
+			Collection: "linkTokens",
+			Documents: []interface{}{
+				LinkToken{
+					Token:     hashToken(token),
+					UserID:    user.InternalId,
+					Purpose:   purpose,
+					ExpiredAt: time.Now().Add(is.TokenExpirations.LinkToken).Unix(),
+				},
+			},
+		},
+	}
+
+	if _, err := is.Storage.Send(req); err != nil {
+		return "", fmt.Errorf("failed to save link token: %v", err)
+	}
+
+	return token, nil
+}
+
+// redeemLinkToken consumes the link token and returns its owner. Of
+// concurrent uses of the same link only the one winning the redemption gets
+// the user.
+func (is *InternalService) redeemLinkToken(token string, purpose string) (*entities.User, error) {
+	selectData := map[string]interface{}{
+		"token":   hashToken(token),
+		"purpose": purpose,
+	}
+
+	readSelect := copyMap(selectData)
+	readSelect["expired_at"] = map[string]interface{}{
+		"$gt": time.Now().Unix(),
+	}
+
+	res, err := is.Storage.Send(adapter.Request{
+		Method: "read",
+		Data: adapter.ReadRequest{
+			Collection: "linkTokens",
+			Select:     readSelect,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get link token: %v", err)
+	}
+
+	if len(res.Result) == 0 {
+		return nil, errLinkTokenNotFound
+	}
+
+	var tokens []LinkToken
+	itemBytes, err := json.Marshal(res.Result)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(itemBytes, &tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	redeemed, err := is.redeem("link_token", token, tokens[0].ExpiredAt)
+	if err != nil {
+		return nil, err
+	}
+	if !redeemed {
+		return nil, errLinkTokenNotFound
+	}
+
+	_, err = is.Storage.Send(adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: "linkTokens",
+			Select:     selectData,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove link token: %v", err)
+	}
+
+	return is.UsersRepository.GetUserByID(tokens[0].UserID)
+}
+
+func (is *InternalService) removeExpiredLinkTokens() {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: "linkTokens",
+			Select: map[string]interface{}{
+				"expired_at": map[string]interface{}{
+					"$lt": time.Now().Unix(),
+				},
+			},
+		},
+	}
+
+	if _, err := is.Storage.Send(req); err != nil {
+		log.Printf("Error removing expired link tokens: %v", err)
+	}
+}
+
+func (is *InternalService) sendMagicLinkHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	metaMap, _ := meta.(map[string]interface{})
+	ip, _ := metaMap["ip"].(string)
+
+	if is.isFlooder(ip) {
+		log.Println("Flood protection in sendMagicLinkHandler")
+
+		return NewErrorResponse(
+			"FloodError",
+			"DFE_07",
+			"Flood protection",
+		), http.StatusBadRequest, nil
+	}
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Marshal" + err.Error())
+	}
+
+	var request MagicLinkRequest
+	err = json.Unmarshal(jsonData, &request)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Unmarshal" + err.Error())
+	}
+
+	errs := is.Validate.Struct(request)
+	if errs != nil {
+		log.Printf("Validation errors: %v", errs)
+		is.FloodAdd(ip)
+
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"VLE_03",
+			"Validation error.",
+		), http.StatusBadRequest, errs
+	}
+
+	// Unknown emails get the same answer, so the method cannot be used to
+	// find out who is registered
+	user, err := is.UsersRepository.GetUserByEmail(request.Email)
+	if err != nil {
+		is.FloodAdd(ip)
+		return NewOkResponse("Link sent")
+	}
+
+	token, err := is.createLinkToken(user, request.Purpose)
+	if err != nil {
+		log.Println("Cannot create link token, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	link, err := is.magicLink(token, request.Purpose)
+	if err != nil {
+		log.Println("Cannot build link, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	subject := "Sign In"
+	if request.Purpose == linkPurposeResetPassword {
+		subject = "Reset Password"
+	}
+
+	err = is.sendEmail(user.Email, subject, link)
+	if err != nil {
+		log.Printf("Error sending Email: %v", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse("Link sent")
+}
+
+func (is *InternalService) signInWithLinkHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	request, ip, errResp, status, err := is.parseRedeemLinkRequest(data, meta)
+	if errResp != nil {
+		return errResp, status, err
+	}
+
+	user, err := is.redeemLinkToken(request.Token, linkPurposeSignIn)
+	if err != nil {
+		if !errors.Is(err, errLinkTokenNotFound) {
+			log.Println("Cannot redeem link token, err:", err)
+		}
+		is.FloodAdd(ip)
+		return NewErrorResponse(
+			"LinkTokenError",
+			"LTE_01",
+			"Link is invalid or expired",
+		), http.StatusBadRequest, nil
+	}
+
+	return is.completeSignIn(user, meta)
+}
+
+func (is *InternalService) resetPasswordWithLinkHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	request, ip, errResp, status, err := is.parseRedeemLinkRequest(data, meta)
+	if errResp != nil {
+		return errResp, status, err
+	}
+
+	if request.Password == "" {
+		log.Printf("Validation errors: password is required")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"VLE_03",
+			"Validation error.",
+		), http.StatusBadRequest, errors.New("password is required")
+	}
+
+	user, err := is.redeemLinkToken(request.Token, linkPurposeResetPassword)
+	if err != nil {
+		if !errors.Is(err, errLinkTokenNotFound) {
+			log.Println("Cannot redeem link token, err:", err)
+		}
+		is.FloodAdd(ip)
+		return NewErrorResponse(
+			"LinkTokenError",
+			"LTE_01",
+			"Link is invalid or expired",
+		), http.StatusBadRequest, nil
+	}
+
+	user.HashedPassword, err = is.hashPassword(request.Password)
+	if err != nil {
+		log.Println("Cannot hash password, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, nil
+	}
+
+	err = is.UsersRepository.UpdateUser(user)
+	if err != nil {
+		log.Println("Cannot update user data, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, nil
+	}
+
+	// Sessions opened with the old password must not survive the reset
+	err = is.signOutAll(user.InternalId)
+	if err != nil {
+		log.Println("Cannot sign out user after password reset, err:", err)
+	}
+
+	return NewOkResponse("Restore password successfully")
+}
+
+// parseRedeemLinkRequest applies the flood protection and decodes the
+// request. A non-nil error response must be returned to the client as is.
+func (is *InternalService) parseRedeemLinkRequest(data interface{}, meta interface{}) (*RedeemLinkRequest, string, interface{}, int, error) {
+	metaMap, _ := meta.(map[string]interface{})
+	ip, _ := metaMap["ip"].(string)
+
+	if is.isFlooder(ip) {
+		log.Println("Flood protection in parseRedeemLinkRequest")
+
+		return nil, ip, NewErrorResponse(
+			"FloodError",
+			"DFE_07",
+			"Flood protection",
+		), http.StatusBadRequest, nil
+	}
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return nil, ip, NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Marshal" + err.Error())
+	}
+
+	var request RedeemLinkRequest
+	err = json.Unmarshal(jsonData, &request)
+	if err != nil {
+		return nil, ip, NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Unmarshal" + err.Error())
+	}
+
+	errs := is.Validate.Struct(request)
+	if errs != nil {
+		log.Printf("Validation errors: %v", errs)
+		is.FloodAdd(ip)
+
+		return nil, ip, NewErrorResponse(
+			"InvalidDataFormatError",
+			"VLE_03",
+			"Validation error.",
+		), http.StatusBadRequest, errs
+	}
+
+	return &request, ip, nil, 0, nil
+}
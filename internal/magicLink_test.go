@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+// sendTestLink sends a link for the purpose to the email and returns the
+// token it carries.
+func sendTestLink(t *testing.T, is *InternalService, mailer *testMailer, email string, purpose string) string {
+	t.Helper()
+
+	response, _, _ := is.sendMagicLinkHandler(map[string]interface{}{"email": email, "purpose": purpose}, nil)
+	if code := errorCode(response); code != "" {
+		t.Fatalf("expected the link to be sent, got %+v", response)
+	}
+
+	link, err := url.Parse(mailer.last(t, email).Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Query().Get("purpose") != purpose {
+		t.Fatalf("expected a %s link, got %s", purpose, link)
+	}
+
+	return link.Query().Get("token")
+}
+
+func newMagicLinkTestService(t *testing.T) (*InternalService, *testStorage, *testMailer) {
+	is, storage := newTestService(t)
+	is.LinkBaseUrl = "https://app.example.com/link"
+
+	return is, storage, newTestMailer(t, is)
+}
+
+func TestSignInWithLink(t *testing.T) {
+	is, storage, mailer := newMagicLinkTestService(t)
+	storage.insert("users", entities.User{InternalId: "user", Email: "user@example.com"})
+
+	token := sendTestLink(t, is, mailer, "user@example.com", linkPurposeSignIn)
+
+	// A sign in link does not reset the password
+	response, _, _ := is.resetPasswordWithLinkHandler(map[string]interface{}{"token": token, "password": "new-password"}, nil)
+	if code := errorCode(response); code != "LTE_01" {
+		t.Fatalf("expected LTE_01 for another purpose, got %+v", response)
+	}
+
+	response, _, _ = is.signInWithLinkHandler(map[string]interface{}{"token": token}, nil)
+	var result testSignIn
+	decodeResult(t, response, &result)
+	if result.AccessToken == "" {
+		t.Fatalf("expected an access token, got %+v", result)
+	}
+
+	response, _, _ = is.signInWithLinkHandler(map[string]interface{}{"token": token}, nil)
+	if code := errorCode(response); code != "LTE_01" {
+		t.Errorf("expected the link to work once, got %+v", response)
+	}
+}
+
+func TestSendMagicLinkToUnknownEmail(t *testing.T) {
+	is, _, mailer := newMagicLinkTestService(t)
+
+	response, _, _ := is.sendMagicLinkHandler(map[string]interface{}{"email": "nobody@example.com", "purpose": linkPurposeSignIn}, nil)
+	if code := errorCode(response); code != "" {
+		t.Fatalf("expected the same answer as for known emails, got %+v", response)
+	}
+	if mailer.count() != 0 {
+		t.Error("expected no email to an unknown address")
+	}
+}
+
+func TestSignInWithExpiredLink(t *testing.T) {
+	is, storage, _ := newMagicLinkTestService(t)
+	storage.insert("users", entities.User{InternalId: "user", Email: "user@example.com"})
+	storage.insert("linkTokens", LinkToken{
+		Token:     hashToken("expired"),
+		UserID:    "user",
+		Purpose:   linkPurposeSignIn,
+		ExpiredAt: time.Now().Add(-time.Minute).Unix(),
+	})
+
+	response, _, _ := is.signInWithLinkHandler(map[string]interface{}{"token": "expired"}, nil)
+	if code := errorCode(response); code != "LTE_01" {
+		t.Errorf("expected LTE_01 for an expired link, got %+v", response)
+	}
+}
+
+func TestSignInWithLinkConcurrently(t *testing.T) {
+	is, storage, mailer := newMagicLinkTestService(t)
+	storage.insert("users", entities.User{InternalId: "user", Email: "user@example.com"})
+
+	token := sendTestLink(t, is, mailer, "user@example.com", linkPurposeSignIn)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	signedIn := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			response, _, _ := is.signInWithLinkHandler(map[string]interface{}{"token": token}, nil)
+			if _, ok := response.(ResponseOk); ok {
+				mutex.Lock()
+				signedIn++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if signedIn != 1 {
+		t.Errorf("expected exactly one sign in with the link, got %d", signedIn)
+	}
+}
+
+func TestResetPasswordWithLink(t *testing.T) {
+	is, storage, mailer := newMagicLinkTestService(t)
+	signIn := signInTestUser(t, is, storage, entities.User{InternalId: "user", Email: "user@example.com"}, "old-password")
+
+	token := sendTestLink(t, is, mailer, "user@example.com", linkPurposeResetPassword)
+
+	response, _, _ := is.resetPasswordWithLinkHandler(map[string]interface{}{"token": token}, nil)
+	if code := errorCode(response); code != "VLE_03" {
+		t.Fatalf("expected VLE_03 without a password, got %+v", response)
+	}
+
+	response, _, _ = is.resetPasswordWithLinkHandler(map[string]interface{}{"token": token, "password": "new-password"}, nil)
+	if code := errorCode(response); code != "" {
+		t.Fatalf("expected the password to be reset, got %+v", response)
+	}
+
+	if _, err := is.authenticate("user@example.com", "new-password"); err != nil {
+		t.Errorf("expected the new password to sign in, got %v", err)
+	}
+	if _, err := is.authenticate("user@example.com", "old-password"); err == nil {
+		t.Error("expected the old password to be refused")
+	}
+	if checkAllowed(t, is, Request{Microservice: "crud", Method: "read", Data: map[string]interface{}{"token": signIn.AccessToken}}) {
+		t.Error("expected the tokens issued before the reset to be revoked")
+	}
+
+	response, _, _ = is.resetPasswordWithLinkHandler(map[string]interface{}{"token": token, "password": "other-password"}, nil)
+	if code := errorCode(response); code != "LTE_01" {
+		t.Errorf("expected the link to work once, got %+v", response)
+	}
+}
@@ -0,0 +1,794 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+	"github.com/saiset-co/sai-storage-mongo/external/adapter"
+)
+
+const (
+	oauthCodeExpiration = time.Minute
+
+	pkceMethodS256  = "S256"
+	pkceMethodPlain = "plain"
+)
+
+var errOAuthCodeNotFound = errors.New("authorization code not found")
+
+// OAuthCode is an authorization code waiting to be exchanged at the token
+// endpoint. Only the hash of the code is stored. RedirectURI is kept as it
+// was sent, since the token request has to repeat it.
+type OAuthCode struct {
+	Code                string `json:"code"`
+	ClientID            string `json:"client_id"`
+	UserID              string `json:"user_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	Nonce               string `json:"nonce"`
+	ExpiredAt           int64  `json:"expired_at"`
+}
+
+type AuthorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	Nonce               string `json:"nonce"`
+}
+
+// OAuthError is the error body defined by RFC 6749.
+type OAuthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// validScope accepts scopes in the "microservice:method" form and the
+// OpenID Connect scopes.
+func validScope(scope string) bool {
+	if isOIDCScope(scope) {
+		return true
+	}
+
+	parts := strings.SplitN(scope, ":", 2)
+	return len(parts) == 2 && parts[0] != "" && parts[1] != "" && !strings.ContainsAny(scope, " \t\n")
+}
+
+// scopePermissions returns the part of the permission the scopes grant.
+// Scopes and permissions may both be patterns: a scope covering the
+// permission grants it whole, while a narrower scope only grants its own
+// methods, e.g. "crud:read" out of "crud:*".
+func scopePermissions(scopes []string, permission entities.Permission) []entities.Permission {
+	var permissions []entities.Permission
+	for _, scope := range scopes {
+		parts := strings.SplitN(scope, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		if entities.MatchPattern(parts[0], permission.Microservice) && entities.MatchPattern(parts[1], permission.Method) {
+			return []entities.Permission{permission}
+		}
+
+		if permission.Matches(parts[0], parts[1]) {
+			narrowed := permission
+			narrowed.Microservice = strings.ToLower(parts[0])
+			narrowed.Method = strings.ToLower(parts[1])
+			permissions = append(permissions, narrowed)
+		}
+	}
+
+	return permissions
+}
+
+// isSubset reports whether every scope is part of the allowed ones.
+func isSubset(scopes []string, allowed []string) bool {
+	for _, scope := range scopes {
+		if !containsString(allowed, scope) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validateAuthorizationRequest resolves the client and the granted scope of
+// the request. A nil client with an error means the redirect uri cannot be
+// trusted and the error must be shown to the user instead of redirecting.
+func (is *InternalService) validateAuthorizationRequest(request *AuthorizationRequest) (*entities.OAuthClient, *OAuthError) {
+	client, err := is.OAuthClientsRepository.GetClientByID(request.ClientID)
+	if err != nil {
+		return nil, &OAuthError{"invalid_client", "Unknown client"}
+	}
+
+	if request.RedirectURI == "" && len(client.RedirectURIs) != 1 {
+		return nil, &OAuthError{"invalid_request", "Missing redirect_uri"}
+	}
+	if request.RedirectURI != "" && !client.AllowsRedirectURI(request.RedirectURI) {
+		return nil, &OAuthError{"invalid_request", "Invalid redirect_uri"}
+	}
+
+	if request.ResponseType != "code" {
+		return client, &OAuthError{"unsupported_response_type", "Only the code response type is supported"}
+	}
+
+	if !client.AllowsGrantType(entities.GrantTypeAuthorizationCode) {
+		return client, &OAuthError{"unauthorized_client", "The client cannot use the authorization_code grant"}
+	}
+
+	scopes := strings.Fields(request.Scope)
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	if !client.AllowsScopes(scopes) {
+		return client, &OAuthError{"invalid_scope", "The requested scope is not allowed for the client"}
+	}
+	request.Scope = strings.Join(scopes, " ")
+
+	if request.CodeChallenge == "" {
+		if client.Public {
+			return client, &OAuthError{"invalid_request", "Public clients must use PKCE"}
+		}
+	} else {
+		if request.CodeChallengeMethod == "" {
+			request.CodeChallengeMethod = pkceMethodPlain
+		}
+		if request.CodeChallengeMethod != pkceMethodS256 && request.CodeChallengeMethod != pkceMethodPlain {
+			return client, &OAuthError{"invalid_request", "Unsupported code_challenge_method"}
+		}
+	}
+
+	return client, nil
+}
+
+// authorizationRedirect builds the redirect back to the client with the
+// state of the request and the given parameters.
+func authorizationRedirect(client *entities.OAuthClient, request *AuthorizationRequest, params url.Values) string {
+	redirectURI := request.RedirectURI
+	if redirectURI == "" {
+		redirectURI = client.RedirectURIs[0]
+	}
+
+	// Redirect uris are validated on registration
+	link, _ := url.Parse(redirectURI)
+	query := link.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if request.State != "" {
+		query.Set("state", request.State)
+	}
+	link.RawQuery = query.Encode()
+
+	return link.String()
+}
+
+func authorizationErrorRedirect(client *entities.OAuthClient, request *AuthorizationRequest, oauthErr *OAuthError) string {
+	params := url.Values{}
+	params.Set("error", oauthErr.Error)
+	if oauthErr.Description != "" {
+		params.Set("error_description", oauthErr.Description)
+	}
+
+	return authorizationRedirect(client, request, params)
+}
+
+// issueAuthorizationCode stores a code for the user and returns the redirect
+// that delivers it to the client.
+func (is *InternalService) issueAuthorizationCode(client *entities.OAuthClient, user *entities.User, request *AuthorizationRequest) (string, error) {
+	code, err := generateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	req := adapter.Request{
+		Method: "create",
+		Data: adapter.CreateRequest{
+			Collection: "oauthCodes",
+			Documents: []interface{}{
+				OAuthCode{
+					Code:                hashToken(code),
+					ClientID:            client.ClientID,
+					UserID:              user.InternalId,
+					RedirectURI:         request.RedirectURI,
+					Scope:               request.Scope,
+					CodeChallenge:       request.CodeChallenge,
+					CodeChallengeMethod: request.CodeChallengeMethod,
+					Nonce:               request.Nonce,
+					ExpiredAt:           time.Now().Add(oauthCodeExpiration).Unix(),
+				},
+			},
+		},
+	}
+
+	if _, err := is.Storage.Send(req); err != nil {
+		return "", fmt.Errorf("failed to save authorization code: %v", err)
+	}
+
+	return authorizationRedirect(client, request, url.Values{"code": {code}}), nil
+}
+
+// redeemAuthorizationCode consumes the code, so it can be exchanged once.
+// Of concurrent exchanges of the same code only the one winning the
+// redemption gets it.
+func (is *InternalService) redeemAuthorizationCode(code string) (*OAuthCode, error) {
+	selectData := map[string]interface{}{
+		"code": hashToken(code),
+	}
+
+	readSelect := copyMap(selectData)
+	readSelect["expired_at"] = map[string]interface{}{
+		"$gt": time.Now().Unix(),
+	}
+
+	res, err := is.Storage.Send(adapter.Request{
+		Method: "read",
+		Data: adapter.ReadRequest{
+			Collection: "oauthCodes",
+			Select:     readSelect,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get authorization code: %v", err)
+	}
+
+	if len(res.Result) == 0 {
+		return nil, errOAuthCodeNotFound
+	}
+
+	var codes []OAuthCode
+	itemBytes, err := json.Marshal(res.Result)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(itemBytes, &codes)
+	if err != nil {
+		return nil, err
+	}
+
+	redeemed, err := is.redeem("authorization_code", code, codes[0].ExpiredAt)
+	if err != nil {
+		return nil, err
+	}
+	if !redeemed {
+		return nil, errOAuthCodeNotFound
+	}
+
+	_, err = is.Storage.Send(adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: "oauthCodes",
+			Select:     selectData,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove authorization code: %v", err)
+	}
+
+	return &codes[0], nil
+}
+
+func (is *InternalService) removeExpiredOAuthCodes() {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: "oauthCodes",
+			Select: map[string]interface{}{
+				"expired_at": map[string]interface{}{
+					"$lt": time.Now().Unix(),
+				},
+			},
+		},
+	}
+
+	if _, err := is.Storage.Send(req); err != nil {
+		log.Printf("Error removing expired authorization codes: %v", err)
+	}
+}
+
+// verifyPKCE checks the code verifier against the challenge of the
+// authorization request (RFC 7636). Codes issued without a challenge need no
+// verifier.
+func verifyPKCE(code *OAuthCode, verifier string) bool {
+	if code.CodeChallenge == "" {
+		return true
+	}
+
+	if verifier == "" {
+		return false
+	}
+
+	expected := verifier
+	if code.CodeChallengeMethod == pkceMethodS256 {
+		digest := sha256.Sum256([]byte(verifier))
+		expected = base64.RawURLEncoding.EncodeToString(digest[:])
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(code.CodeChallenge)) == 1
+}
+
+// issueOAuthTokens issues a single access token limited to the scopes and,
+// for sessions of clients allowed to refresh, a refresh token keeping the
+// originally granted scope. Sessions granted the openid scope also get an ID
+// token.
+func (is *InternalService) issueOAuthTokens(client *entities.OAuthClient, user *entities.User, session *entities.Session, scopes []string, grantedScope string, nonce string) (map[string]interface{}, error) {
+	if scopes == nil {
+		scopes = []string{}
+	}
+
+	options := accessTokenOptions{
+		ClientID:    client.ClientID,
+		Scopes:      scopes,
+		SingleToken: true,
+	}
+	if session != nil {
+		options.SessionID = session.ID
+	}
+
+	accessTokens, err := is.generateAccessTokens(user, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate access token: %v", err)
+	}
+	if len(accessTokens) != 1 {
+		return nil, fmt.Errorf("expected a single access token, got %d", len(accessTokens))
+	}
+
+	response := map[string]interface{}{
+		"access_token": accessTokens[0].Token,
+		"token_type":   "Bearer",
+		"expires_in":   int64(is.TokenExpirations.AccessToken.Seconds()),
+		"scope":        strings.Join(scopes, " "),
+	}
+
+	if session == nil {
+		return response, nil
+	}
+
+	if is.JWTEnabled && containsString(scopes, oidcScopeOpenID) {
+		idToken, err := is.generateIDToken(client, user, session, scopes, nonce)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate id token: %v", err)
+		}
+		response["id_token"] = idToken
+	}
+
+	var refreshToken *RefreshToken
+	if client.AllowsGrantType(entities.GrantTypeRefreshToken) {
+		refreshToken, err = is.generateRefreshToken(user, session.ID, client.ClientID, grantedScope)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate refresh token: %v", err)
+		}
+		response["refresh_token"] = refreshToken.RefreshToken
+	}
+
+	session.ClientID = client.ClientID
+	err = is.touchSession(session, accessTokens, refreshToken)
+	if err != nil {
+		log.Println("Cannot update session, err:", err)
+	}
+
+	return response, nil
+}
+
+// authorizeHTTPHandler serves the consent page. GET renders the sign in and
+// consent form, POST authenticates the user and redirects back to the client
+// with an authorization code.
+func (is *InternalService) authorizeHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		renderAuthorizeError(w, "Invalid request")
+		return
+	}
+
+	request := &AuthorizationRequest{
+		ResponseType:        r.Form.Get("response_type"),
+		ClientID:            r.Form.Get("client_id"),
+		RedirectURI:         r.Form.Get("redirect_uri"),
+		Scope:               r.Form.Get("scope"),
+		State:               r.Form.Get("state"),
+		CodeChallenge:       r.Form.Get("code_challenge"),
+		CodeChallengeMethod: r.Form.Get("code_challenge_method"),
+		Nonce:               r.Form.Get("nonce"),
+	}
+
+	client, oauthErr := is.validateAuthorizationRequest(request)
+	if oauthErr != nil {
+		if client == nil {
+			renderAuthorizeError(w, oauthErr.Description)
+			return
+		}
+		http.Redirect(w, r, authorizationErrorRedirect(client, request, oauthErr), http.StatusFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		renderAuthorizeForm(w, http.StatusOK, client, request, "")
+		return
+	}
+
+	if r.PostForm.Get("action") != "allow" {
+		http.Redirect(w, r, authorizationErrorRedirect(client, request, &OAuthError{"access_denied", "The user denied the request"}), http.StatusFound)
+		return
+	}
+
+	ip := is.requestIP(r)
+	if is.isFlooder(ip) {
+		log.Println("Flood protection in authorizeHTTPHandler")
+		renderAuthorizeForm(w, http.StatusTooManyRequests, client, request, "Too many attempts, try again later")
+		return
+	}
+
+	user, err := is.authenticate(r.PostForm.Get("login"), r.PostForm.Get("password"))
+	if err != nil {
+		is.FloodAdd(ip)
+		renderAuthorizeForm(w, http.StatusUnauthorized, client, request, "User not found or password is incorrect")
+		return
+	}
+
+	if user.TOTP != nil && user.TOTP.Enabled {
+		code := strings.TrimSpace(r.PostForm.Get("code"))
+		if !verifySecondFactor(user, code, "") && !verifySecondFactor(user, "", code) {
+			is.FloodAdd(ip)
+			renderAuthorizeForm(w, http.StatusUnauthorized, client, request, "Invalid two-factor code")
+			return
+		}
+
+		err = is.UsersRepository.UpdateUser(user)
+		if err != nil {
+			log.Println("Cannot update user data, err:", err)
+			renderAuthorizeError(w, "Internal server error")
+			return
+		}
+	}
+
+	redirect, err := is.issueAuthorizationCode(client, user, request)
+	if err != nil {
+		log.Println("Cannot issue authorization code, err:", err)
+		renderAuthorizeError(w, "Internal server error")
+		return
+	}
+
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// authorizeHandler lets first-party apps with their own consent screen issue
+// an authorization code for the signed in user.
+func (is *InternalService) authorizeHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	tokenPermission, err := is.getTokenPermission(tokenFromRequest(data, meta))
+	// Tokens issued to OAuth clients cannot authorize other clients, nor can
+	// admins impersonating the user
+	if err != nil || tokenPermission.ClientID != "" || tokenPermission.ImpersonatorID != "" {
+		if err != nil && !errors.Is(err, errTokenNotFound) {
+			log.Println("Cannot get token owner, err:", err)
+		}
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Marshal" + err.Error())
+	}
+
+	var request AuthorizationRequest
+	err = json.Unmarshal(jsonData, &request)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Unmarshal" + err.Error())
+	}
+
+	client, oauthErr := is.validateAuthorizationRequest(&request)
+	if oauthErr != nil {
+		return NewErrorResponse(
+			"OAuthError",
+			"OAE_01",
+			oauthErr.Error+": "+oauthErr.Description,
+		), http.StatusBadRequest, nil
+	}
+
+	user, err := is.UsersRepository.GetUserByID(tokenPermission.UserID)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	redirect, err := is.issueAuthorizationCode(client, user, &request)
+	if err != nil {
+		log.Println("Cannot issue authorization code, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse(map[string]interface{}{
+		"redirect_uri": redirect,
+	})
+}
+
+// tokenHTTPHandler is the OAuth token endpoint. Clients authenticate with
+// HTTP Basic or with client_id and client_secret in the form.
+func (is *InternalService) tokenHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSON(w, http.StatusMethodNotAllowed, OAuthError{"invalid_request", "The token endpoint only accepts POST"})
+		return
+	}
+
+	ip := is.requestIP(r)
+	if is.isFlooder(ip) {
+		log.Println("Flood protection in tokenHTTPHandler")
+		writeJSON(w, http.StatusTooManyRequests, OAuthError{"invalid_request", "Flood protection"})
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, OAuthError{"invalid_request", "Invalid form data"})
+		return
+	}
+
+	clientID, secret, basicAuth := r.BasicAuth()
+	if basicAuth {
+		// Credentials in the header are form encoded (RFC 6749, 2.3.1)
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := is.authenticateOAuthClient(clientID, secret)
+	if err != nil {
+		is.FloodAdd(ip)
+		if basicAuth {
+			w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		}
+		writeJSON(w, http.StatusUnauthorized, OAuthError{"invalid_client", "Client authentication failed"})
+		return
+	}
+
+	grantType := r.PostForm.Get("grant_type")
+	if !client.AllowsGrantType(grantType) {
+		writeJSON(w, http.StatusBadRequest, OAuthError{"unauthorized_client", "The client cannot use this grant type"})
+		return
+	}
+
+	meta := is.requestMeta(r)
+
+	var response map[string]interface{}
+	var oauthErr *OAuthError
+	switch grantType {
+	case entities.GrantTypeAuthorizationCode:
+		response, oauthErr = is.authorizationCodeGrant(client, r.PostForm, meta)
+	case entities.GrantTypeRefreshToken:
+		response, oauthErr = is.refreshTokenGrant(client, r.PostForm, meta)
+	case entities.GrantTypeClientCredentials:
+		response, oauthErr = is.clientCredentialsGrant(client, r.PostForm)
+	default:
+		oauthErr = &OAuthError{"unsupported_grant_type", "Unsupported grant type"}
+	}
+
+	if oauthErr != nil {
+		status := http.StatusBadRequest
+		if oauthErr.Error == "server_error" {
+			status = http.StatusInternalServerError
+		} else if oauthErr.Error == "invalid_grant" {
+			is.FloodAdd(ip)
+		}
+		writeJSON(w, status, oauthErr)
+		return
+	}
+
+	w.Header().Set("Pragma", "no-cache")
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (is *InternalService) authorizationCodeGrant(client *entities.OAuthClient, form url.Values, meta interface{}) (map[string]interface{}, *OAuthError) {
+	code, err := is.redeemAuthorizationCode(form.Get("code"))
+	if err != nil {
+		if !errors.Is(err, errOAuthCodeNotFound) {
+			log.Println("Cannot redeem authorization code, err:", err)
+		}
+		return nil, &OAuthError{"invalid_grant", "Authorization code is invalid or expired"}
+	}
+
+	if code.ClientID != client.ClientID || code.RedirectURI != form.Get("redirect_uri") {
+		return nil, &OAuthError{"invalid_grant", "Authorization code was issued to another client or redirect_uri"}
+	}
+
+	if !verifyPKCE(code, form.Get("code_verifier")) {
+		return nil, &OAuthError{"invalid_grant", "Invalid code_verifier"}
+	}
+
+	user, err := is.UsersRepository.GetUserByID(code.UserID)
+	if err != nil {
+		return nil, &OAuthError{"invalid_grant", "User not found"}
+	}
+
+	session, err := is.startSession(user, meta, "")
+	if err != nil {
+		log.Println("Cannot start session, err:", err)
+		return nil, &OAuthError{"server_error", ""}
+	}
+
+	response, err := is.issueOAuthTokens(client, user, session, strings.Fields(code.Scope), code.Scope, code.Nonce)
+	if err != nil {
+		log.Println("Cannot issue tokens, err:", err)
+		return nil, &OAuthError{"server_error", ""}
+	}
+
+	return response, nil
+}
+
+func (is *InternalService) refreshTokenGrant(client *entities.OAuthClient, form url.Values, meta interface{}) (map[string]interface{}, *OAuthError) {
+	// The owner and the scope are checked before rotating, so another
+	// client or an invalid request cannot burn the token
+	token, err := is.getRefreshToken(form.Get("refresh_token"))
+	if err != nil || token.ClientID != client.ClientID {
+		if err != nil && !errors.Is(err, errRefreshTokenNotFound) {
+			log.Println("Cannot get refresh token, err:", err)
+		}
+		return nil, &OAuthError{"invalid_grant", "Refresh token is invalid or expired"}
+	}
+
+	grantedScopes := strings.Fields(token.Scope)
+	scopes := grantedScopes
+	if requested := strings.Fields(form.Get("scope")); len(requested) > 0 {
+		if !isSubset(requested, grantedScopes) {
+			return nil, &OAuthError{"invalid_scope", "The requested scope exceeds the granted scope"}
+		}
+		scopes = requested
+	}
+
+	user, token, err := is.rotateRefreshToken(token.RefreshToken)
+	if err != nil {
+		if !errors.Is(err, errRefreshTokenNotFound) && !errors.Is(err, errRefreshTokenReused) {
+			log.Println("Cannot rotate refresh token, err:", err)
+		}
+		return nil, &OAuthError{"invalid_grant", "Refresh token is invalid or expired"}
+	}
+
+	session, err := is.getOrStartSession(user, meta, token.FamilyID)
+	if err != nil {
+		log.Println("Cannot start session, err:", err)
+		return nil, &OAuthError{"server_error", ""}
+	}
+
+	response, err := is.issueOAuthTokens(client, user, session, scopes, token.Scope, "")
+	if err != nil {
+		log.Println("Cannot issue tokens, err:", err)
+		return nil, &OAuthError{"server_error", ""}
+	}
+
+	return response, nil
+}
+
+// clientCredentialsGrant issues tokens for the service account of the
+// client. No session or refresh token is created.
+func (is *InternalService) clientCredentialsGrant(client *entities.OAuthClient, form url.Values) (map[string]interface{}, *OAuthError) {
+	scopes := strings.Fields(form.Get("scope"))
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	if !client.AllowsScopes(scopes) {
+		return nil, &OAuthError{"invalid_scope", "The requested scope is not allowed for the client"}
+	}
+
+	user, err := is.UsersRepository.GetUserByID(client.ServiceUserID)
+	if err != nil {
+		log.Println("Cannot get service user of oauth client, err:", err)
+		return nil, &OAuthError{"unauthorized_client", "The client has no service user"}
+	}
+
+	response, err := is.issueOAuthTokens(client, user, nil, scopes, "", "")
+	if err != nil {
+		log.Println("Cannot issue tokens, err:", err)
+		return nil, &OAuthError{"server_error", ""}
+	}
+
+	return response, nil
+}
+
+var authorizeFormTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in to {{.Client.Name}}</title></head>
+<body>
+<h1>{{.Client.Name}} wants to access your account</h1>
+{{if .Scopes}}<p>Requested permissions:</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>{{end}}
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post">
+<input type="hidden" name="response_type" value="{{.Request.ResponseType}}">
+<input type="hidden" name="client_id" value="{{.Request.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.Request.RedirectURI}}">
+<input type="hidden" name="scope" value="{{.Request.Scope}}">
+<input type="hidden" name="state" value="{{.Request.State}}">
+<input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}">
+<input type="hidden" name="nonce" value="{{.Request.Nonce}}">
+<p><label>Login <input name="login" autocomplete="username" required></label></p>
+<p><label>Password <input type="password" name="password" autocomplete="current-password" required></label></p>
+<p><label>Two-factor code (if enabled) <input name="code" autocomplete="one-time-code"></label></p>
+<button type="submit" name="action" value="allow">Allow</button>
+<button type="submit" name="action" value="deny" formnovalidate>Deny</button>
+</form>
+</body>
+</html>
+`))
+
+var authorizeErrorTemplate = template.Must(template.New("authorizeError").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Authorization error</title></head>
+<body>
+<h1>Authorization error</h1>
+<p>{{.}}</p>
+</body>
+</html>
+`))
+
+func renderAuthorizeForm(w http.ResponseWriter, status int, client *entities.OAuthClient, request *AuthorizationRequest, errorText string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// The form must not be framed by other sites (clickjacking)
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(status)
+
+	err := authorizeFormTemplate.Execute(w, map[string]interface{}{
+		"Client":  client,
+		"Request": request,
+		"Scopes":  strings.Fields(request.Scope),
+		"Error":   errorText,
+	})
+	if err != nil {
+		log.Println("Cannot render authorize form, err:", err)
+	}
+}
+
+func renderAuthorizeError(w http.ResponseWriter, errorText string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusBadRequest)
+
+	err := authorizeErrorTemplate.Execute(w, errorText)
+	if err != nil {
+		log.Println("Cannot render authorize error, err:", err)
+	}
+}
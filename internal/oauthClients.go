@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+// authenticateOAuthClient returns the client when the secret matches. Public
+// clients are identified by their id alone.
+func (is *InternalService) authenticateOAuthClient(clientID string, secret string) (*entities.OAuthClient, error) {
+	client, err := is.OAuthClientsRepository.GetClientByID(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if client.Public {
+		return client, nil
+	}
+
+	if secret == "" || subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashToken(secret))) != 1 {
+		return nil, fmt.Errorf("invalid client secret")
+	}
+
+	return client, nil
+}
+
+func (is *InternalService) createOAuthClientHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Marshal" + err.Error())
+	}
+
+	var client entities.OAuthClient
+	err = json.Unmarshal(jsonData, &client)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Unmarshal" + err.Error())
+	}
+
+	errs := is.Validate.Struct(client)
+	if errs != nil {
+		log.Printf("Validation errors: %v", errs)
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"VLE_03",
+			"Validation error.",
+		), http.StatusBadRequest, errs
+	}
+
+	if errText := validateOAuthClient(&client); errText != "" {
+		return NewErrorResponse(
+			"OAuthClientError",
+			"OCE_01",
+			errText,
+		), http.StatusBadRequest, nil
+	}
+
+	client.ClientID, err = generateRandomToken(16)
+	if err != nil {
+		log.Println("Cannot generate client id, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	// The secret is only returned once, the registry keeps its hash
+	secret := ""
+	client.SecretHash = ""
+	if !client.Public {
+		secret, err = generateRandomToken(32)
+		if err != nil {
+			log.Println("Cannot generate client secret, err:", err)
+			return NewErrorResponse(
+				"ServerError",
+				"SVE_06",
+				"Internal server error",
+			), http.StatusInternalServerError, err
+		}
+		client.SecretHash = hashToken(secret)
+	}
+
+	err = is.OAuthClientsRepository.CreateClient(&client)
+	if err != nil {
+		log.Println("Cannot create oauth client, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	client.SecretHash = ""
+
+	return NewOkResponse(map[string]interface{}{
+		"client":        client,
+		"client_secret": secret,
+	})
+}
+
+// validateOAuthClient checks the registration for combinations the token
+// endpoint cannot serve. It returns the error text or an empty string.
+func validateOAuthClient(client *entities.OAuthClient) string {
+	for _, grantType := range client.GrantTypes {
+		switch grantType {
+		case entities.GrantTypeAuthorizationCode, entities.GrantTypeRefreshToken:
+		case entities.GrantTypeClientCredentials:
+			if client.Public {
+				return "Public clients cannot use the client_credentials grant"
+			}
+			if client.ServiceUserID == "" {
+				return "The client_credentials grant requires service_user_id"
+			}
+		default:
+			return "Unsupported grant type: " + grantType
+		}
+	}
+
+	if client.AllowsGrantType(entities.GrantTypeAuthorizationCode) && len(client.RedirectURIs) == 0 {
+		return "The authorization_code grant requires redirect_uris"
+	}
+
+	for _, redirectURI := range client.RedirectURIs {
+		parsed, err := url.Parse(redirectURI)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			return "Invalid redirect uri: " + redirectURI
+		}
+	}
+
+	for _, scope := range client.Scopes {
+		if !validScope(scope) {
+			return "Invalid scope: " + scope
+		}
+	}
+
+	return ""
+}
+
+func (is *InternalService) getOAuthClientsHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	selectData, ok := data.(map[string]interface{})
+	if !ok {
+		log.Println("Invalid data format in getOAuthClientsHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	clients, err := is.OAuthClientsRepository.GetClients(selectData)
+	if err != nil {
+		log.Println("Cannot get oauth clients, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	// Remove secret hashes from the response
+	for i := range clients {
+		clients[i].SecretHash = ""
+	}
+
+	return NewOkResponse(clients)
+}
+
+func (is *InternalService) deleteOAuthClientsHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	selectData, ok := data.(map[string]interface{})
+	if !ok || len(selectData) < 1 {
+		log.Println("Invalid data format in deleteOAuthClientsHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	clients, err := is.OAuthClientsRepository.GetClients(selectData)
+	if err != nil {
+		log.Println("Cannot get oauth clients, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	err = is.OAuthClientsRepository.RemoveClients(selectData)
+	if err != nil {
+		log.Println("Cannot remove oauth clients, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	// Tokens issued to removed clients must stop working
+	for _, client := range clients {
+		err = is.revokeOAuthClientTokens(client.ClientID)
+		if err != nil {
+			log.Println("Cannot revoke oauth client tokens, err:", err)
+			return NewErrorResponse(
+				"ServerError",
+				"SVE_06",
+				"Internal server error",
+			), http.StatusInternalServerError, err
+		}
+	}
+
+	return NewOkResponse("OAuth clients removed successfully")
+}
+
+func (is *InternalService) revokeOAuthClientTokens(clientID string) error {
+	err := is.TokenPermissionsRepository.RemoveTokenPermissionsByClientID(clientID)
+	if err != nil {
+		return err
+	}
+	is.PermissionCache.Invalidate("client_id", clientID)
+
+	err = is.removeRefreshTokens(map[string]interface{}{"client_id": clientID})
+	if err != nil {
+		return err
+	}
+
+	return is.SessionsRepository.RemoveSessions(map[string]interface{}{"client_id": clientID})
+}
@@ -0,0 +1,406 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	digest := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(digest[:])
+
+	tests := []struct {
+		name     string
+		code     OAuthCode
+		verifier string
+		expected bool
+	}{
+		{"no challenge", OAuthCode{}, "", true},
+		{"no challenge with verifier", OAuthCode{}, verifier, true},
+		{"S256", OAuthCode{CodeChallenge: challenge, CodeChallengeMethod: pkceMethodS256}, verifier, true},
+		{"S256 wrong verifier", OAuthCode{CodeChallenge: challenge, CodeChallengeMethod: pkceMethodS256}, verifier + "x", false},
+		{"S256 missing verifier", OAuthCode{CodeChallenge: challenge, CodeChallengeMethod: pkceMethodS256}, "", false},
+		{"S256 challenge as verifier", OAuthCode{CodeChallenge: challenge, CodeChallengeMethod: pkceMethodS256}, challenge, false},
+		{"plain", OAuthCode{CodeChallenge: verifier, CodeChallengeMethod: pkceMethodPlain}, verifier, true},
+		{"plain wrong verifier", OAuthCode{CodeChallenge: verifier, CodeChallengeMethod: pkceMethodPlain}, "other", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if verified := verifyPKCE(&test.code, test.verifier); verified != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, verified)
+			}
+		})
+	}
+}
+
+// newOAuthTestService stores a user, a confidential client "app" with the
+// secret "secret", a public client "spa" and a client_credentials client
+// "worker" acting as the user.
+func newOAuthTestService(t *testing.T) (*InternalService, *testStorage, *entities.User) {
+	is, storage := newTestService(t)
+
+	user := entities.User{InternalId: "user", Email: "user@example.com"}
+	storage.insert("users", user)
+	storage.insert("oauthClients",
+		entities.OAuthClient{
+			ClientID:     "app",
+			SecretHash:   hashToken("secret"),
+			Name:         "App",
+			RedirectURIs: []string{"https://app.example.com/callback", "https://app.example.com/other"},
+			GrantTypes:   []string{entities.GrantTypeAuthorizationCode, entities.GrantTypeRefreshToken},
+			Scopes:       []string{"crud:read", "crud:update"},
+		},
+		entities.OAuthClient{
+			ClientID:     "spa",
+			Name:         "SPA",
+			RedirectURIs: []string{"https://spa.example.com/callback"},
+			GrantTypes:   []string{entities.GrantTypeAuthorizationCode, entities.GrantTypeRefreshToken},
+			Scopes:       []string{"crud:read"},
+			Public:       true,
+		},
+		entities.OAuthClient{
+			ClientID:      "worker",
+			SecretHash:    hashToken("worker-secret"),
+			Name:          "Worker",
+			GrantTypes:    []string{entities.GrantTypeClientCredentials},
+			Scopes:        []string{"crud:read"},
+			ServiceUserID: "user",
+		},
+	)
+
+	return is, storage, &user
+}
+
+// testAuthorizationCode issues a code for the user as the authorization
+// endpoint would.
+func testAuthorizationCode(t *testing.T, is *InternalService, user *entities.User, request AuthorizationRequest) string {
+	t.Helper()
+
+	request.ResponseType = "code"
+	client, oauthErr := is.validateAuthorizationRequest(&request)
+	if oauthErr != nil {
+		t.Fatalf("expected a valid authorization request, got %+v", oauthErr)
+	}
+
+	redirect, err := is.issueAuthorizationCode(client, user, &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return link.Query().Get("code")
+}
+
+// tokenRequest posts the form to the token endpoint and returns the status
+// and the decoded body.
+func tokenRequest(t *testing.T, is *InternalService, form url.Values) (int, map[string]interface{}) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	is.tokenHTTPHandler(w, r)
+
+	var body map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatalf("expected a JSON body, got %q", w.Body.String())
+	}
+
+	return w.Code, body
+}
+
+func TestValidateAuthorizationRequestRedirectURI(t *testing.T) {
+	is, _, _ := newOAuthTestService(t)
+
+	tests := []struct {
+		name        string
+		clientID    string
+		redirectURI string
+		trusted     bool
+		expected    string
+	}{
+		{"registered", "app", "https://app.example.com/callback", true, ""},
+		{"another registered", "app", "https://app.example.com/other", true, ""},
+		{"prefix of a registered", "app", "https://app.example.com/callback/evil", false, "invalid_request"},
+		{"other host", "app", "https://evil.example.com/callback", false, "invalid_request"},
+		{"query added", "app", "https://app.example.com/callback?x=1", false, "invalid_request"},
+		{"missing with several registered", "app", "", false, "invalid_request"},
+		{"missing with one registered", "spa", "", true, "invalid_request"},
+		{"unknown client", "unknown", "https://app.example.com/callback", false, "invalid_client"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The public client needs PKCE, so a valid request fails after
+			// the redirect uri is trusted
+			request := &AuthorizationRequest{ResponseType: "code", ClientID: test.clientID, RedirectURI: test.redirectURI}
+			client, oauthErr := is.validateAuthorizationRequest(request)
+
+			if (client != nil) != test.trusted {
+				t.Errorf("expected trusted redirect %v, got client %+v", test.trusted, client)
+			}
+			var errorCode string
+			if oauthErr != nil {
+				errorCode = oauthErr.Error
+			}
+			if errorCode != test.expected {
+				t.Errorf("expected %q, got %+v", test.expected, oauthErr)
+			}
+		})
+	}
+}
+
+func TestAuthorizationCodeGrant(t *testing.T) {
+	verifier := "verifier-of-the-spa-0123456789-0123456789"
+	digest := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(digest[:])
+
+	appRequest := AuthorizationRequest{ClientID: "app", RedirectURI: "https://app.example.com/callback", Scope: "crud:read"}
+	spaRequest := AuthorizationRequest{
+		ClientID:            "spa",
+		RedirectURI:         "https://spa.example.com/callback",
+		CodeChallenge:       challenge,
+		CodeChallengeMethod: pkceMethodS256,
+	}
+
+	tests := []struct {
+		name     string
+		request  AuthorizationRequest
+		form     url.Values
+		expected string
+	}{
+		{
+			name:    "confidential client",
+			request: appRequest,
+			form:    url.Values{"client_id": {"app"}, "client_secret": {"secret"}, "redirect_uri": {"https://app.example.com/callback"}},
+		},
+		{
+			name:     "wrong secret",
+			request:  appRequest,
+			form:     url.Values{"client_id": {"app"}, "client_secret": {"wrong"}, "redirect_uri": {"https://app.example.com/callback"}},
+			expected: "invalid_client",
+		},
+		{
+			name:     "other redirect uri",
+			request:  appRequest,
+			form:     url.Values{"client_id": {"app"}, "client_secret": {"secret"}, "redirect_uri": {"https://app.example.com/other"}},
+			expected: "invalid_grant",
+		},
+		{
+			name:     "missing redirect uri",
+			request:  appRequest,
+			form:     url.Values{"client_id": {"app"}, "client_secret": {"secret"}},
+			expected: "invalid_grant",
+		},
+		{
+			name:     "issued to another client",
+			request:  spaRequest,
+			form:     url.Values{"client_id": {"app"}, "client_secret": {"secret"}, "redirect_uri": {"https://spa.example.com/callback"}, "code_verifier": {verifier}},
+			expected: "invalid_grant",
+		},
+		{
+			name:    "public client with PKCE",
+			request: spaRequest,
+			form:    url.Values{"client_id": {"spa"}, "redirect_uri": {"https://spa.example.com/callback"}, "code_verifier": {verifier}},
+		},
+		{
+			name:     "public client without verifier",
+			request:  spaRequest,
+			form:     url.Values{"client_id": {"spa"}, "redirect_uri": {"https://spa.example.com/callback"}},
+			expected: "invalid_grant",
+		},
+		{
+			name:     "public client with wrong verifier",
+			request:  spaRequest,
+			form:     url.Values{"client_id": {"spa"}, "redirect_uri": {"https://spa.example.com/callback"}, "code_verifier": {"wrong"}},
+			expected: "invalid_grant",
+		},
+		{
+			name:     "client not allowed the grant",
+			request:  appRequest,
+			form:     url.Values{"client_id": {"worker"}, "client_secret": {"worker-secret"}, "redirect_uri": {"https://app.example.com/callback"}},
+			expected: "unauthorized_client",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			is, _, user := newOAuthTestService(t)
+			code := testAuthorizationCode(t, is, user, test.request)
+
+			form := test.form
+			form.Set("grant_type", entities.GrantTypeAuthorizationCode)
+			form.Set("code", code)
+			status, body := tokenRequest(t, is, form)
+
+			if test.expected != "" {
+				if status == http.StatusOK || body["error"] != test.expected {
+					t.Fatalf("expected %s, got %d %v", test.expected, status, body)
+				}
+				return
+			}
+
+			if status != http.StatusOK {
+				t.Fatalf("expected tokens, got %d %v", status, body)
+			}
+			accessToken, _ := body["access_token"].(string)
+			allowed, err := is.check(Request{Microservice: "crud", Method: "read", Data: map[string]interface{}{"token": accessToken}}, "")
+			if err != nil || !allowed {
+				t.Errorf("expected the access token to allow the granted scope, got %v %v", allowed, err)
+			}
+			if body["refresh_token"] == nil || body["token_type"] != "Bearer" {
+				t.Errorf("expected a bearer token and a refresh token, got %v", body)
+			}
+
+			// A code is exchanged once
+			status, body = tokenRequest(t, is, form)
+			if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+				t.Errorf("expected the code to be consumed, got %d %v", status, body)
+			}
+		})
+	}
+}
+
+func TestAuthorizationCodeConcurrentExchanges(t *testing.T) {
+	is, _, user := newOAuthTestService(t)
+	code := testAuthorizationCode(t, is, user, AuthorizationRequest{ClientID: "app", RedirectURI: "https://app.example.com/callback"})
+
+	form := url.Values{
+		"grant_type":    {entities.GrantTypeAuthorizationCode},
+		"code":          {code},
+		"client_id":     {"app"},
+		"client_secret": {"secret"},
+		"redirect_uri":  {"https://app.example.com/callback"},
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	exchanged := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			status, _ := tokenRequest(t, is, form)
+			if status == http.StatusOK {
+				mutex.Lock()
+				exchanged++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if exchanged != 1 {
+		t.Errorf("expected exactly one exchange of the code, got %d", exchanged)
+	}
+}
+
+func TestOAuthRefreshTokenGrant(t *testing.T) {
+	is, _, user := newOAuthTestService(t)
+	code := testAuthorizationCode(t, is, user, AuthorizationRequest{
+		ClientID:    "app",
+		RedirectURI: "https://app.example.com/callback",
+		Scope:       "crud:read crud:update",
+	})
+
+	status, body := tokenRequest(t, is, url.Values{
+		"grant_type":    {entities.GrantTypeAuthorizationCode},
+		"code":          {code},
+		"client_id":     {"app"},
+		"client_secret": {"secret"},
+		"redirect_uri":  {"https://app.example.com/callback"},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("expected tokens, got %d %v", status, body)
+	}
+	refreshToken, _ := body["refresh_token"].(string)
+
+	// Another client can neither use nor burn the token
+	status, body = tokenRequest(t, is, url.Values{
+		"grant_type":    {entities.GrantTypeRefreshToken},
+		"refresh_token": {refreshToken},
+		"client_id":     {"spa"},
+	})
+	if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("expected the token to be bound to its client, got %d %v", status, body)
+	}
+
+	// Nor can the sign in refresh of first-party apps
+	response, _, _ := is.refreshTokenHandler(map[string]interface{}{"refresh_token": refreshToken}, nil)
+	if code := errorCode(response); code == "" {
+		t.Fatalf("expected refresh_token to refuse the OAuth token, got %+v", response)
+	}
+
+	form := url.Values{
+		"grant_type":    {entities.GrantTypeRefreshToken},
+		"refresh_token": {refreshToken},
+		"client_id":     {"app"},
+		"client_secret": {"secret"},
+		"scope":         {"crud:read crud:delete"},
+	}
+	status, body = tokenRequest(t, is, form)
+	if status != http.StatusBadRequest || body["error"] != "invalid_scope" {
+		t.Fatalf("expected a wider scope to be refused, got %d %v", status, body)
+	}
+
+	form.Set("scope", "crud:read")
+	status, body = tokenRequest(t, is, form)
+	if status != http.StatusOK || body["scope"] != "crud:read" {
+		t.Fatalf("expected the owner to refresh with a narrower scope, got %d %v", status, body)
+	}
+
+	// The rotated token keeps the originally granted scope
+	form.Set("refresh_token", body["refresh_token"].(string))
+	form.Del("scope")
+	status, body = tokenRequest(t, is, form)
+	if status != http.StatusOK || body["scope"] != "crud:read crud:update" {
+		t.Errorf("expected the granted scope after rotation, got %d %v", status, body)
+	}
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	is, _, _ := newOAuthTestService(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(url.Values{"grant_type": {entities.GrantTypeClientCredentials}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth("worker", "worker-secret")
+	w := httptest.NewRecorder()
+	is.tokenHTTPHandler(w, r)
+
+	var body map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || body["scope"] != "crud:read" || body["refresh_token"] != nil {
+		t.Fatalf("expected an access token without refresh token, got %d %v", w.Code, body)
+	}
+
+	status, body := tokenRequest(t, is, url.Values{
+		"grant_type":    {entities.GrantTypeClientCredentials},
+		"client_id":     {"worker"},
+		"client_secret": {"worker-secret"},
+		"scope":         {"crud:delete"},
+	})
+	if status != http.StatusBadRequest || body["error"] != "invalid_scope" {
+		t.Errorf("expected a scope outside the client to be refused, got %d %v", status, body)
+	}
+}
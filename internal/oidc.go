@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+const (
+	oidcScopeOpenID  = "openid"
+	oidcScopeProfile = "profile"
+	oidcScopeEmail   = "email"
+	oidcScopePhone   = "phone"
+)
+
+func isOIDCScope(scope string) bool {
+	switch scope {
+	case oidcScopeOpenID, oidcScopeProfile, oidcScopeEmail, oidcScopePhone:
+		return true
+	}
+
+	return false
+}
+
+// userClaims returns the standard claims of the user released for the
+// scopes. nil scopes release every claim; it is used for first-party tokens.
+// Profile claims are taken from User.Data as configured in OIDCClaims.
+func (is *InternalService) userClaims(user *entities.User, scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub": user.InternalId,
+	}
+
+	if (scopes == nil || containsString(scopes, oidcScopeEmail)) && user.Email != "" {
+		claims["email"] = user.Email
+	}
+
+	if (scopes == nil || containsString(scopes, oidcScopePhone)) && user.Phone != "" {
+		claims["phone_number"] = user.Phone
+	}
+
+	if scopes == nil || containsString(scopes, oidcScopeProfile) {
+		data, _ := user.Data.(map[string]interface{})
+		for claim, path := range is.OIDCClaims {
+			if data == nil {
+				break
+			}
+
+			value, err := getNestedParam(data, strings.Split(path, "."))
+			if err == nil && value != nil {
+				claims[claim] = value
+			}
+		}
+	}
+
+	return claims
+}
+
+// generateIDToken issues the OpenID Connect ID token of the session for the
+// client.
+func (is *InternalService) generateIDToken(client *entities.OAuthClient, user *entities.User, session *entities.Session, scopes []string, nonce string) (string, error) {
+	claims := is.userClaims(user, scopes)
+
+	now := time.Now()
+	claims["iss"] = is.JWTIssuer
+	claims["aud"] = client.ClientID
+	claims["azp"] = client.ClientID
+	claims["sid"] = session.ID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(is.TokenExpirations.AccessToken).Unix()
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	return is.signJWT(claims)
+}
+
+func (is *InternalService) openIDConfiguration() map[string]interface{} {
+	issuer := strings.TrimSuffix(is.JWTIssuer, "/")
+
+	algorithms := []string{}
+	for _, key := range is.SigningKeys {
+		if !containsString(algorithms, key.Algorithm) {
+			algorithms = append(algorithms, key.Algorithm)
+		}
+	}
+
+	claims := []string{"sub", "iss", "aud", "exp", "iat", "nonce", "sid", "email", "phone_number"}
+	for claim := range is.OIDCClaims {
+		claims = append(claims, claim)
+	}
+
+	return map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"introspection_endpoint":                issuer + "/introspect",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{entities.GrantTypeAuthorizationCode, entities.GrantTypeRefreshToken, entities.GrantTypeClientCredentials},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": algorithms,
+		"scopes_supported":                      []string{oidcScopeOpenID, oidcScopeProfile, oidcScopeEmail, oidcScopePhone},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{pkceMethodS256, pkceMethodPlain},
+		"claims_supported":                      claims,
+	}
+}
+
+func (is *InternalService) openIDConfigurationHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, is.openIDConfiguration())
+}
+
+var errInsufficientScope = errors.New("the token was not granted the openid scope")
+
+// userinfo returns the claims of the token owner. Tokens issued to OAuth
+// clients need the openid scope and only release the claims of their scopes.
+func (is *InternalService) userinfo(token string) (map[string]interface{}, error) {
+	tokenPermission, err := is.getTokenPermission(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var scopes []string
+	if tokenPermission.ClientID != "" {
+		scopes = strings.Fields(tokenPermission.Scope)
+		if !containsString(scopes, oidcScopeOpenID) {
+			return nil, errInsufficientScope
+		}
+	}
+
+	user, err := is.UsersRepository.GetUserByID(tokenPermission.UserID)
+	if err != nil {
+		return nil, errTokenNotFound
+	}
+
+	return is.userClaims(user, scopes), nil
+}
+
+// userinfoHTTPHandler is the OpenID Connect userinfo endpoint. The access
+// token is sent as a bearer token.
+func (is *InternalService) userinfoHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := ""
+	if authorization := r.Header.Get("Authorization"); len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		token = strings.TrimSpace(authorization[7:])
+	}
+
+	claims, err := is.userinfo(token)
+	if err != nil {
+		if errors.Is(err, errInsufficientScope) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+			writeJSON(w, http.StatusForbidden, OAuthError{"insufficient_scope", "The openid scope is required"})
+			return
+		}
+		if !errors.Is(err, errTokenNotFound) {
+			log.Println("Cannot get userinfo, err:", err)
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeJSON(w, http.StatusUnauthorized, OAuthError{"invalid_token", "Token is missing, invalid or expired"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, claims)
+}
+
+func (is *InternalService) userinfoHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	claims, err := is.userinfo(tokenFromRequest(data, meta))
+	if err != nil {
+		if errors.Is(err, errInsufficientScope) {
+			return NewErrorResponse(
+				"OAuthError",
+				"OAE_02",
+				"The openid scope is required",
+			), http.StatusForbidden, nil
+		}
+		if !errors.Is(err, errTokenNotFound) {
+			log.Println("Cannot get userinfo, err:", err)
+		}
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	return NewOkResponse(claims)
+}
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+// newOIDCTestService adds the client "oidc", allowed the OpenID Connect
+// scopes, to the OAuth test service and signs JWTs.
+func newOIDCTestService(t *testing.T) (*InternalService, *testStorage, *entities.User) {
+	is, storage, _ := newOAuthTestService(t)
+	is.JWTEnabled = true
+	is.JWTIssuer = "https://auth.example.com/"
+	is.SigningKeys = []SigningKey{newTestSigningKey(t, "key-1", JWTAlgorithmEdDSA)}
+	is.OIDCClaims = map[string]string{"name": "profile.name"}
+
+	user := entities.User{
+		InternalId: "oidc-user",
+		Email:      "oidc@example.com",
+		Phone:      "+15550100",
+		Data:       map[string]interface{}{"profile": map[string]interface{}{"name": "Jane"}},
+	}
+	storage.insert("users", user)
+	storage.insert("oauthClients", entities.OAuthClient{
+		ClientID:     "oidc",
+		SecretHash:   hashToken("secret"),
+		Name:         "OIDC",
+		RedirectURIs: []string{"https://oidc.example.com/callback"},
+		GrantTypes:   []string{entities.GrantTypeAuthorizationCode},
+		Scopes:       []string{"crud:read", oidcScopeOpenID, oidcScopeProfile, oidcScopeEmail, oidcScopePhone},
+	})
+
+	return is, storage, &user
+}
+
+// oidcTokens runs the authorization code flow for the scope.
+func oidcTokens(t *testing.T, is *InternalService, user *entities.User, scope string, nonce string) map[string]interface{} {
+	t.Helper()
+
+	code := testAuthorizationCode(t, is, user, AuthorizationRequest{
+		ClientID:    "oidc",
+		RedirectURI: "https://oidc.example.com/callback",
+		Scope:       scope,
+		Nonce:       nonce,
+	})
+
+	status, body := tokenRequest(t, is, url.Values{
+		"grant_type":    {entities.GrantTypeAuthorizationCode},
+		"code":          {code},
+		"client_id":     {"oidc"},
+		"client_secret": {"secret"},
+		"redirect_uri":  {"https://oidc.example.com/callback"},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("expected tokens, got %d %v", status, body)
+	}
+
+	return body
+}
+
+func TestOpenIDConfiguration(t *testing.T) {
+	is, _, _ := newOIDCTestService(t)
+
+	configuration := is.openIDConfiguration()
+	if configuration["issuer"] != "https://auth.example.com" || configuration["jwks_uri"] != "https://auth.example.com/.well-known/jwks.json" {
+		t.Errorf("expected the endpoints of the issuer, got %v", configuration)
+	}
+
+	algorithms, _ := configuration["id_token_signing_alg_values_supported"].([]string)
+	if len(algorithms) != 1 || algorithms[0] != JWTAlgorithmEdDSA {
+		t.Errorf("expected the algorithm of the signing key, got %v", algorithms)
+	}
+
+	claims, _ := configuration["claims_supported"].([]string)
+	if !containsString(claims, "name") {
+		t.Errorf("expected the configured claims, got %v", claims)
+	}
+}
+
+func TestIDToken(t *testing.T) {
+	is, _, user := newOIDCTestService(t)
+
+	body := oidcTokens(t, is, user, "openid email crud:read", "nonce-1")
+	idToken, _ := body["id_token"].(string)
+
+	claims, err := verifyJWT(idToken, is.jwks())
+	if err != nil {
+		t.Fatalf("expected a verifiable ID token, got %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"iss":   is.JWTIssuer,
+		"sub":   "oidc-user",
+		"aud":   "oidc",
+		"nonce": "nonce-1",
+		"email": "oidc@example.com",
+	}
+	for claim, value := range expected {
+		if claims[claim] != value {
+			t.Errorf("expected %s %v, got %v", claim, value, claims[claim])
+		}
+	}
+	if _, ok := claims["phone_number"]; ok {
+		t.Errorf("expected no claims of scopes not granted, got %v", claims)
+	}
+	if _, ok := claims["name"]; ok {
+		t.Errorf("expected no profile claims without the profile scope, got %v", claims)
+	}
+
+	body = oidcTokens(t, is, user, "crud:read", "")
+	if _, ok := body["id_token"]; ok {
+		t.Errorf("expected no ID token without the openid scope, got %v", body)
+	}
+}
+
+func userinfoRequest(is *InternalService, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+
+	is.userinfoHTTPHandler(w, r)
+
+	return w
+}
+
+func TestUserinfo(t *testing.T) {
+	is, storage, user := newOIDCTestService(t)
+
+	body := oidcTokens(t, is, user, "openid profile", "")
+	accessToken, _ := body["access_token"].(string)
+
+	claims, err := is.userinfo(accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "oidc-user" || claims["name"] != "Jane" || claims["email"] != nil {
+		t.Errorf("expected the claims of the granted scopes, got %v", claims)
+	}
+
+	body = oidcTokens(t, is, user, "crud:read", "")
+	accessToken, _ = body["access_token"].(string)
+	if w := userinfoRequest(is, accessToken); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without the openid scope, got %d %s", w.Code, w.Body.String())
+	}
+	if response, _, _ := is.userinfoHandler(nil, map[string]interface{}{"token": accessToken}); errorCode(response) != "OAE_02" {
+		t.Errorf("expected OAE_02 without the openid scope, got %+v", response)
+	}
+
+	// First-party tokens release every claim
+	signIn := signInTestUser(t, is, storage, entities.User{InternalId: "user-2", Email: "user-2@example.com", Phone: "+15550101"}, "password")
+	response, _, _ := is.userinfoHandler(nil, map[string]interface{}{"token": signIn.AccessToken})
+	var firstParty map[string]interface{}
+	decodeResult(t, response, &firstParty)
+	if firstParty["email"] != "user-2@example.com" || firstParty["phone_number"] != "+15550101" {
+		t.Errorf("expected every claim for a first-party token, got %v", firstParty)
+	}
+
+	if w := userinfoRequest(is, ""); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("expected 401 without a token, got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,442 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+const (
+	ParamOperatorEq        = "eq"
+	ParamOperatorIn        = "in"
+	ParamOperatorPrefix    = "prefix"
+	ParamOperatorRegex     = "regex"
+	ParamOperatorLt        = "lt"
+	ParamOperatorLte       = "lte"
+	ParamOperatorGt        = "gt"
+	ParamOperatorGte       = "gte"
+	ParamOperatorBetween   = "between"
+	ParamOperatorExists    = "exists"
+	ParamOperatorNotExists = "not_exists"
+
+	// ParamMatchAll requires every value a wildcard path selects to satisfy
+	// the condition, ParamMatchAny one of them
+	ParamMatchAll = "all"
+	ParamMatchAny = "any"
+
+	ParamTypeString = "string"
+	ParamTypeNumber = "number"
+	ParamTypeBool   = "bool"
+	ParamTypeDate   = "date"
+)
+
+// paramRegexps caches compiled patterns of regex params by their source
+var paramRegexps sync.Map
+
+// validateParams checks the operators, types and values of role params, so
+// mistakes are reported when the role is saved rather than denying every
+// request. It returns the error text or an empty string.
+func validateParams(params []entities.Params) string {
+	for _, param := range params {
+		if param.Param == "" {
+			return "Param name is required"
+		}
+
+		if _, err := parseParamPath(param.Param); err != nil {
+			return fmt.Sprintf("Invalid path of param %s: %v", param.Param, err)
+		}
+
+		if param.Match != "" && param.Match != ParamMatchAll && param.Match != ParamMatchAny {
+			return fmt.Sprintf("Unknown match %s of param %s", param.Match, param.Param)
+		}
+
+		valueCount := len(param.Values)
+		switch param.Operator {
+		case "", ParamOperatorIn, ParamOperatorPrefix, ParamOperatorRegex:
+		case ParamOperatorEq, ParamOperatorLt, ParamOperatorLte, ParamOperatorGt, ParamOperatorGte:
+			if valueCount != 1 {
+				return fmt.Sprintf("Operator %s of param %s needs one value", param.Operator, param.Param)
+			}
+		case ParamOperatorBetween:
+			if valueCount != 2 {
+				return fmt.Sprintf("Operator %s of param %s needs two values", param.Operator, param.Param)
+			}
+		case ParamOperatorExists, ParamOperatorNotExists:
+			continue
+		default:
+			return fmt.Sprintf("Unknown operator %s of param %s", param.Operator, param.Param)
+		}
+
+		if param.Operator != "" && valueCount == 0 {
+			return fmt.Sprintf("Operator %s of param %s needs values", param.Operator, param.Param)
+		}
+
+		paramType := paramValueType(param)
+		switch paramType {
+		case ParamTypeString, ParamTypeNumber, ParamTypeBool, ParamTypeDate:
+		default:
+			return fmt.Sprintf("Unknown type %s of param %s", param.Type, param.Param)
+		}
+
+		if (param.Operator == ParamOperatorPrefix || param.Operator == ParamOperatorRegex) && paramType != ParamTypeString {
+			return fmt.Sprintf("Operator %s of param %s only compares strings", param.Operator, param.Param)
+		}
+		if paramType == ParamTypeBool && param.Operator != ParamOperatorEq && param.Operator != ParamOperatorIn {
+			return fmt.Sprintf("Operator %s of param %s cannot compare booleans", param.Operator, param.Param)
+		}
+
+		for _, value := range param.Values {
+			// Placeholders are only known once tokens are issued
+			if isPlaceholder(value) {
+				continue
+			}
+
+			if param.Operator == ParamOperatorRegex {
+				if _, err := paramRegexp(value); err != nil {
+					return fmt.Sprintf("Invalid pattern %s of param %s", value, param.Param)
+				}
+				continue
+			}
+
+			if _, ok := parseParamValue(value, paramType); !ok {
+				return fmt.Sprintf("Value %s of param %s is not a %s", value, param.Param, paramType)
+			}
+		}
+	}
+
+	return ""
+}
+
+// validatePermissionsParams validates the params of every permission.
+func validatePermissionsParams(permissions []entities.Permission) string {
+	for _, permission := range permissions {
+		if errText := validateParams(permission.RequiredParams); errText != "" {
+			return errText
+		}
+		if errText := validateParams(permission.RestrictedParams); errText != "" {
+			return errText
+		}
+	}
+
+	return ""
+}
+
+func isPlaceholder(value string) bool {
+	return len(value) > 2 && value[:1] == placeholder
+}
+
+// paramValueType returns the type values are compared as. Order operators
+// compare numbers unless a type is given, everything else strings.
+func paramValueType(param entities.Params) string {
+	if param.Type != "" {
+		return param.Type
+	}
+
+	switch param.Operator {
+	case ParamOperatorLt, ParamOperatorLte, ParamOperatorGt, ParamOperatorGte, ParamOperatorBetween:
+		return ParamTypeNumber
+	default:
+		return ParamTypeString
+	}
+}
+
+// paramMatches reports whether the payload satisfies the condition of the
+// param. When the path has wildcards, every selected value (ParamMatchAll)
+// or one of them (ParamMatchAny) has to; defaultMatch applies unless the
+// param sets Match. A path that selects nothing counts as a missing value.
+func paramMatches(payload map[string]interface{}, param entities.Params, defaultMatch string) bool {
+	segments, err := parseParamPath(param.Param)
+	if err != nil {
+		return false
+	}
+
+	values := resolveParamPath(payload, segments)
+	if len(values) == 0 {
+		return valueMatches(nil, false, param)
+	}
+
+	match := param.Match
+	if match == "" {
+		match = defaultMatch
+	}
+
+	for _, value := range values {
+		matches := valueMatches(value, value != nil, param)
+		if match == ParamMatchAny && matches {
+			return true
+		}
+		if match != ParamMatchAny && !matches {
+			return false
+		}
+	}
+
+	return match != ParamMatchAny
+}
+
+// valueMatches checks a single value against the condition. Params without
+// an operator keep their original meaning: the value must be present and,
+// unless All is set, equal one of the values.
+func valueMatches(value interface{}, exists bool, param entities.Params) bool {
+	switch param.Operator {
+	case "":
+		if !exists {
+			return false
+		}
+		if param.All {
+			return true
+		}
+		return containsString(param.Values, fmt.Sprintf("%v", value))
+	case ParamOperatorExists:
+		return exists
+	case ParamOperatorNotExists:
+		return !exists
+	}
+
+	if !exists {
+		return false
+	}
+
+	paramType := paramValueType(param)
+
+	switch param.Operator {
+	case ParamOperatorEq, ParamOperatorIn:
+		for _, expected := range param.Values {
+			if result, ok := compareParamValue(value, expected, paramType); ok && result == 0 {
+				return true
+			}
+		}
+	case ParamOperatorPrefix:
+		text := fmt.Sprintf("%v", value)
+		for _, expected := range param.Values {
+			if strings.HasPrefix(text, expected) {
+				return true
+			}
+		}
+	case ParamOperatorRegex:
+		text := fmt.Sprintf("%v", value)
+		for _, expected := range param.Values {
+			pattern, err := paramRegexp(expected)
+			if err == nil && pattern.MatchString(text) {
+				return true
+			}
+		}
+	case ParamOperatorLt, ParamOperatorLte, ParamOperatorGt, ParamOperatorGte:
+		result, ok := compareParamValue(value, param.Values[0], paramType)
+		if !ok {
+			return false
+		}
+		switch param.Operator {
+		case ParamOperatorLt:
+			return result < 0
+		case ParamOperatorLte:
+			return result <= 0
+		case ParamOperatorGt:
+			return result > 0
+		default:
+			return result >= 0
+		}
+	case ParamOperatorBetween:
+		low, lowOK := compareParamValue(value, param.Values[0], paramType)
+		high, highOK := compareParamValue(value, param.Values[1], paramType)
+		return lowOK && highOK && low >= 0 && high <= 0
+	}
+
+	return false
+}
+
+// parseParamPath splits a param path into segments. Besides dots, array
+// elements can be addressed as items[0] and all of them as items[*]; a
+// numeric segment also indexes arrays, e.g. filter.$or.0.internal_id.
+func parseParamPath(path string) ([]string, error) {
+	var segments []string
+
+	for _, part := range strings.Split(path, ".") {
+		name := part
+		var indexes []string
+
+		if open := strings.Index(part, "["); open >= 0 {
+			name = part[:open]
+			rest := part[open:]
+			for rest != "" {
+				end := strings.Index(rest, "]")
+				if rest[0] != '[' || end < 0 {
+					return nil, fmt.Errorf("unbalanced brackets in %s", part)
+				}
+
+				index := rest[1:end]
+				if index != "*" {
+					if _, err := strconv.Atoi(index); err != nil {
+						return nil, fmt.Errorf("invalid index %s", index)
+					}
+				}
+				indexes = append(indexes, index)
+				rest = rest[end+1:]
+			}
+		}
+
+		if name == "" && len(indexes) == 0 {
+			return nil, fmt.Errorf("empty segment")
+		}
+		if name != "" {
+			segments = append(segments, name)
+		}
+		segments = append(segments, indexes...)
+	}
+
+	return segments, nil
+}
+
+// resolveParamPath returns the values the path selects. "*" selects every
+// element of an array or every value of a map.
+func resolveParamPath(data interface{}, segments []string) []interface{} {
+	if len(segments) == 0 {
+		return []interface{}{data}
+	}
+
+	segment, rest := segments[0], segments[1:]
+
+	switch typed := data.(type) {
+	case map[string]interface{}:
+		if segment == "*" {
+			var values []interface{}
+			for _, item := range typed {
+				values = append(values, resolveParamPath(item, rest)...)
+			}
+			return values
+		}
+
+		item, ok := typed[segment]
+		if !ok {
+			return nil
+		}
+		return resolveParamPath(item, rest)
+	case []interface{}:
+		if segment == "*" {
+			var values []interface{}
+			for _, item := range typed {
+				values = append(values, resolveParamPath(item, rest)...)
+			}
+			return values
+		}
+
+		index, err := strconv.Atoi(segment)
+		if err != nil || index < 0 || index >= len(typed) {
+			return nil
+		}
+		return resolveParamPath(typed[index], rest)
+	default:
+		return nil
+	}
+}
+
+// compareParamValue compares the payload value with the expected value as
+// the given type. ok is false when either cannot be read as that type.
+func compareParamValue(value interface{}, expected string, paramType string) (result int, ok bool) {
+	expectedValue, ok := parseParamValue(expected, paramType)
+	if !ok {
+		return 0, false
+	}
+
+	var actualValue interface{}
+	switch typed := value.(type) {
+	case string:
+		actualValue, ok = parseParamValue(typed, paramType)
+	case float64:
+		actualValue, ok = numberParamValue(typed, paramType)
+	case json.Number:
+		number, err := typed.Float64()
+		if err != nil {
+			return 0, false
+		}
+		actualValue, ok = numberParamValue(number, paramType)
+	case bool:
+		actualValue, ok = typed, paramType == ParamTypeBool
+		if paramType == ParamTypeString {
+			actualValue, ok = strconv.FormatBool(typed), true
+		}
+	default:
+		actualValue, ok = parseParamValue(fmt.Sprintf("%v", value), paramType)
+	}
+	if !ok {
+		return 0, false
+	}
+
+	switch expectedTyped := expectedValue.(type) {
+	case float64:
+		return compareFloats(actualValue.(float64), expectedTyped), true
+	case bool:
+		if actualValue.(bool) == expectedTyped {
+			return 0, true
+		}
+		return 1, true
+	default:
+		return strings.Compare(actualValue.(string), expectedTyped.(string)), true
+	}
+}
+
+// parseParamValue reads a value of a role or payload. Dates are RFC 3339
+// timestamps, plain dates or unix seconds and compare as unix seconds.
+func parseParamValue(value string, paramType string) (interface{}, bool) {
+	switch paramType {
+	case ParamTypeNumber:
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return number, err == nil
+	case ParamTypeBool:
+		boolean, err := strconv.ParseBool(strings.TrimSpace(value))
+		return boolean, err == nil
+	case ParamTypeDate:
+		value = strings.TrimSpace(value)
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+			if parsed, err := time.Parse(layout, value); err == nil {
+				return float64(parsed.Unix()), true
+			}
+		}
+		seconds, err := strconv.ParseFloat(value, 64)
+		return seconds, err == nil
+	default:
+		return value, true
+	}
+}
+
+func numberParamValue(number float64, paramType string) (interface{}, bool) {
+	switch paramType {
+	case ParamTypeNumber, ParamTypeDate:
+		return number, true
+	case ParamTypeString:
+		return fmt.Sprintf("%v", number), true
+	default:
+		return nil, false
+	}
+}
+
+func compareFloats(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// paramRegexp compiles the pattern so that it has to match the whole value.
+func paramRegexp(pattern string) (*regexp.Regexp, error) {
+	if cached, ok := paramRegexps.Load(pattern); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+
+	compiled, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, err
+	}
+	paramRegexps.Store(pattern, compiled)
+
+	return compiled, nil
+}
@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+func TestValueMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		param    entities.Params
+		value    interface{}
+		exists   bool
+		expected bool
+	}{
+		// Params without an operator
+		{"legacy equal", entities.Params{Values: []string{"a", "b"}}, "b", true, true},
+		{"legacy not equal", entities.Params{Values: []string{"a", "b"}}, "c", true, false},
+		{"legacy number", entities.Params{Values: []string{"5"}}, float64(5), true, true},
+		{"legacy missing", entities.Params{Values: []string{"a"}}, nil, false, false},
+		{"legacy all", entities.Params{All: true}, "anything", true, true},
+		{"legacy all missing", entities.Params{All: true}, nil, false, false},
+
+		{"eq", entities.Params{Operator: ParamOperatorEq, Values: []string{"a"}}, "a", true, true},
+		{"eq other", entities.Params{Operator: ParamOperatorEq, Values: []string{"a"}}, "A", true, false},
+		{"eq missing", entities.Params{Operator: ParamOperatorEq, Values: []string{"a"}}, nil, false, false},
+		{"in", entities.Params{Operator: ParamOperatorIn, Values: []string{"a", "b"}}, "b", true, true},
+		{"in other", entities.Params{Operator: ParamOperatorIn, Values: []string{"a", "b"}}, "c", true, false},
+		{"prefix", entities.Params{Operator: ParamOperatorPrefix, Values: []string{"org/1/"}}, "org/1/doc", true, true},
+		{"prefix other", entities.Params{Operator: ParamOperatorPrefix, Values: []string{"org/1/"}}, "org/12/doc", true, false},
+		{"regex", entities.Params{Operator: ParamOperatorRegex, Values: []string{"[a-z]+-\\d+"}}, "doc-12", true, true},
+		{"regex is anchored", entities.Params{Operator: ParamOperatorRegex, Values: []string{"[a-z]+"}}, "doc-12", true, false},
+		{"regex invalid", entities.Params{Operator: ParamOperatorRegex, Values: []string{"("}}, "(", true, false},
+
+		{"exists", entities.Params{Operator: ParamOperatorExists}, "", true, true},
+		{"exists missing", entities.Params{Operator: ParamOperatorExists}, nil, false, false},
+		{"not exists", entities.Params{Operator: ParamOperatorNotExists}, nil, false, true},
+		{"not exists present", entities.Params{Operator: ParamOperatorNotExists}, "", true, false},
+
+		// Order operators compare numbers by default
+		{"lt", entities.Params{Operator: ParamOperatorLt, Values: []string{"10"}}, float64(9), true, true},
+		{"lt equal", entities.Params{Operator: ParamOperatorLt, Values: []string{"10"}}, float64(10), true, false},
+		{"lte equal", entities.Params{Operator: ParamOperatorLte, Values: []string{"10"}}, float64(10), true, true},
+		{"gt", entities.Params{Operator: ParamOperatorGt, Values: []string{"10"}}, "11", true, true},
+		{"gt numeric not lexical", entities.Params{Operator: ParamOperatorGt, Values: []string{"10"}}, "9", true, false},
+		{"gte equal", entities.Params{Operator: ParamOperatorGte, Values: []string{"10"}}, json.Number("10"), true, true},
+		{"gte not a number", entities.Params{Operator: ParamOperatorGte, Values: []string{"10"}}, "ten", true, false},
+		{"lt missing", entities.Params{Operator: ParamOperatorLt, Values: []string{"10"}}, nil, false, false},
+		{"between", entities.Params{Operator: ParamOperatorBetween, Values: []string{"1", "10"}}, float64(5), true, true},
+		{"between bounds", entities.Params{Operator: ParamOperatorBetween, Values: []string{"1", "10"}}, float64(10), true, true},
+		{"between outside", entities.Params{Operator: ParamOperatorBetween, Values: []string{"1", "10"}}, float64(11), true, false},
+
+		// Typed comparison
+		{"string order", entities.Params{Operator: ParamOperatorLt, Type: ParamTypeString, Values: []string{"b"}}, "a", true, true},
+		{"string order of numbers", entities.Params{Operator: ParamOperatorGt, Type: ParamTypeString, Values: []string{"10"}}, float64(9), true, true},
+		{"number eq", entities.Params{Operator: ParamOperatorEq, Type: ParamTypeNumber, Values: []string{"5"}}, "5.0", true, true},
+		{"bool eq", entities.Params{Operator: ParamOperatorEq, Type: ParamTypeBool, Values: []string{"true"}}, true, true, true},
+		{"bool eq string", entities.Params{Operator: ParamOperatorEq, Type: ParamTypeBool, Values: []string{"true"}}, "TRUE", true, true},
+		{"bool other", entities.Params{Operator: ParamOperatorEq, Type: ParamTypeBool, Values: []string{"true"}}, false, true, false},
+		{"bool not a bool", entities.Params{Operator: ParamOperatorEq, Type: ParamTypeBool, Values: []string{"true"}}, float64(1), true, false},
+		{"string eq bool", entities.Params{Operator: ParamOperatorEq, Values: []string{"true"}}, true, true, true},
+
+		// Dates are RFC 3339, plain dates or unix seconds
+		{"date before", entities.Params{Operator: ParamOperatorLt, Type: ParamTypeDate, Values: []string{"2026-01-01"}}, "2025-12-31T23:59:59Z", true, true},
+		{"date after", entities.Params{Operator: ParamOperatorLt, Type: ParamTypeDate, Values: []string{"2026-01-01"}}, "2026-01-01T00:00:01Z", true, false},
+		{"date time zone", entities.Params{Operator: ParamOperatorGte, Type: ParamTypeDate, Values: []string{"2026-01-01T00:00:00Z"}}, "2026-01-01T01:00:00+01:00", true, true},
+		{"date unix seconds", entities.Params{Operator: ParamOperatorEq, Type: ParamTypeDate, Values: []string{"2026-01-01"}}, float64(1767225600), true, true},
+		{"date between", entities.Params{Operator: ParamOperatorBetween, Type: ParamTypeDate, Values: []string{"2026-01-01", "2026-12-31"}}, "2026-06-15", true, true},
+		{"date between outside", entities.Params{Operator: ParamOperatorBetween, Type: ParamTypeDate, Values: []string{"2026-01-01", "2026-12-31"}}, "2027-01-01", true, false},
+		{"date invalid", entities.Params{Operator: ParamOperatorLt, Type: ParamTypeDate, Values: []string{"2026-01-01"}}, "yesterday", true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if matches := valueMatches(test.value, test.exists, test.param); matches != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, matches)
+			}
+		})
+	}
+}
+
+func TestParamMatches(t *testing.T) {
+	payload := map[string]interface{}{
+		"owner_id": "user",
+		"amount":   float64(250),
+		"filter": map[string]interface{}{
+			"status": "draft",
+		},
+	}
+
+	tests := []struct {
+		name     string
+		param    entities.Params
+		expected bool
+	}{
+		{"top level", entities.Params{Param: "owner_id", Values: []string{"user"}}, true},
+		{"nested", entities.Params{Param: "filter.status", Values: []string{"draft"}}, true},
+		{"nested other", entities.Params{Param: "filter.status", Values: []string{"published"}}, false},
+		{"missing", entities.Params{Param: "filter.owner_id", Values: []string{"user"}}, false},
+		{"missing exists", entities.Params{Param: "filter.owner_id", Operator: ParamOperatorExists}, false},
+		{"missing not exists", entities.Params{Param: "filter.owner_id", Operator: ParamOperatorNotExists}, true},
+		{"path through a value", entities.Params{Param: "owner_id.id", Operator: ParamOperatorNotExists}, true},
+		{"order", entities.Params{Param: "amount", Operator: ParamOperatorLte, Values: []string{"500"}}, true},
+		{"invalid path", entities.Params{Param: "filter[x]", Operator: ParamOperatorNotExists}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if matches := paramMatches(payload, test.param, ParamMatchAll); matches != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, matches)
+			}
+		})
+	}
+}
+
+func TestParseParamPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected []string
+		valid    bool
+	}{
+		{"owner_id", []string{"owner_id"}, true},
+		{"filter.$or.0.internal_id", []string{"filter", "$or", "0", "internal_id"}, true},
+		{"items[*].owner_id", []string{"items", "*", "owner_id"}, true},
+		{"items[1][*]", []string{"items", "1", "*"}, true},
+		{"items[x]", nil, false},
+		{"items[1", nil, false},
+		{"items..id", nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			segments, err := parseParamPath(test.path)
+			if (err == nil) != test.valid {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+			if len(segments) != len(test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, segments)
+			}
+			for i := range segments {
+				if segments[i] != test.expected[i] {
+					t.Fatalf("expected %v, got %v", test.expected, segments)
+				}
+			}
+		})
+	}
+}
+
+func TestWildcardParams(t *testing.T) {
+	items := func(ownerIDs ...string) map[string]interface{} {
+		var list []interface{}
+		for _, ownerID := range ownerIDs {
+			list = append(list, map[string]interface{}{"owner_id": ownerID})
+		}
+		return map[string]interface{}{"items": list}
+	}
+	orFilter := map[string]interface{}{
+		"filter": map[string]interface{}{
+			"$or": []interface{}{
+				map[string]interface{}{"internal_id": "user"},
+				map[string]interface{}{"internal_id": "other"},
+			},
+		},
+	}
+	emptyItems := map[string]interface{}{"items": []interface{}{}}
+
+	ownItems := entities.Params{Param: "items[*].owner_id", Values: []string{"user"}}
+	anyOwnItem := entities.Params{Param: "items[*].owner_id", Values: []string{"user"}, Match: ParamMatchAny}
+	otherItems := entities.Params{Param: "items[*].owner_id", Values: []string{"other"}}
+	allOtherItems := entities.Params{Param: "items[*].owner_id", Values: []string{"other"}, Match: ParamMatchAll}
+	firstOr := entities.Params{Param: "filter.$or.0.internal_id", Values: []string{"user"}}
+	secondOr := entities.Params{Param: "filter.$or.1.internal_id", Values: []string{"user"}}
+
+	tests := []struct {
+		name       string
+		data       map[string]interface{}
+		required   []entities.Params
+		restricted []entities.Params
+		expected   bool
+	}{
+		{"required all items own", items("user", "user"), []entities.Params{ownItems}, nil, true},
+		{"required one item other", items("user", "other"), []entities.Params{ownItems}, nil, false},
+		{"required any item own", items("other", "user"), []entities.Params{anyOwnItem}, nil, true},
+		{"restricted any item other", items("user", "other"), nil, []entities.Params{otherItems}, false},
+		{"restricted no item other", items("user", "user"), nil, []entities.Params{otherItems}, true},
+		{"restricted all items other", items("user", "other"), nil, []entities.Params{allOtherItems}, true},
+		{"required index", orFilter, []entities.Params{firstOr}, nil, true},
+		{"required other index", orFilter, []entities.Params{secondOr}, nil, false},
+		{"required empty array", emptyItems, []entities.Params{ownItems}, nil, false},
+		{"restricted empty array", emptyItems, nil, []entities.Params{otherItems}, true},
+		{"required missing path", map[string]interface{}{}, []entities.Params{ownItems}, nil, false},
+		{"restricted missing path", map[string]interface{}{}, nil, []entities.Params{otherItems}, true},
+		{"required index out of range", map[string]interface{}{"filter": map[string]interface{}{"$or": []interface{}{}}}, []entities.Params{firstOr}, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allowed := Validate(test.data, []entities.TokenPermission{{
+				PermissionRequiredParams:   test.required,
+				PermissionRestrictedParams: test.restricted,
+			}})
+			if allowed != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PasswordAlgorithmArgon2id = "argon2id"
+	PasswordAlgorithmBcrypt   = "bcrypt"
+
+	argon2Time    uint32 = 3
+	argon2Memory  uint32 = 64 * 1024
+	argon2Threads uint8  = 2
+	argon2KeyLen  uint32 = 32
+	argon2SaltLen        = 16
+
+	bcryptCost = 12
+)
+
+var errUnknownPasswordHash = errors.New("unknown password hash format")
+
+// hashPassword hashes the password with the configured algorithm and returns
+// it in a self-describing format, so the algorithm can be changed later
+// without breaking existing hashes.
+func (is *InternalService) hashPassword(password string) (string, error) {
+	peppered := is.pepperPassword(password)
+
+	switch is.PasswordAlgorithm {
+	case PasswordAlgorithmBcrypt:
+		hash, err := bcrypt.GenerateFromPassword(peppered, bcryptCost)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash password: %v", err)
+		}
+		return string(hash), nil
+	case PasswordAlgorithmArgon2id, "":
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", fmt.Errorf("failed to generate salt: %v", err)
+		}
+
+		key := argon2.IDKey(peppered, salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+		return fmt.Sprintf(
+			"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version,
+			argon2Memory,
+			argon2Time,
+			argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	default:
+		return "", fmt.Errorf("unsupported password algorithm: %s", is.PasswordAlgorithm)
+	}
+}
+
+// verifyPassword checks the password against the stored hash. needsRehash is
+// true when the hash was produced by a legacy or non-current algorithm or
+// parameters and should be replaced with hashPassword output.
+func (is *InternalService) verifyPassword(password string, hash string) (ok bool, needsRehash bool, err error) {
+	switch {
+	case hash == "":
+		// Users created through an identity provider have no password
+		return false, false, nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		ok, current, err := is.verifyArgon2id(password, hash)
+		if err != nil || !ok {
+			return false, false, err
+		}
+		return true, !current || !is.isCurrentAlgorithm(PasswordAlgorithmArgon2id), nil
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), is.pepperPassword(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return false, false, err
+		}
+		return true, cost != bcryptCost || !is.isCurrentAlgorithm(PasswordAlgorithmBcrypt), nil
+	case len(hash) == sha256.Size*2:
+		// Legacy sha256(password + salt) hashes are always upgraded
+		legacy := is.legacyHashPassword(password)
+		if subtle.ConstantTimeCompare([]byte(legacy), []byte(hash)) != 1 {
+			return false, false, nil
+		}
+		return true, true, nil
+	default:
+		return false, false, errUnknownPasswordHash
+	}
+}
+
+func (is *InternalService) verifyArgon2id(password string, hash string) (ok bool, current bool, err error) {
+	// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, false, errUnknownPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, false, errUnknownPasswordHash
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, false, errUnknownPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, errUnknownPasswordHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false, errUnknownPasswordHash
+	}
+
+	computed := argon2.IDKey(is.pepperPassword(password), salt, iterations, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return false, false, nil
+	}
+
+	current = version == argon2.Version &&
+		memory == argon2Memory &&
+		iterations == argon2Time &&
+		threads == argon2Threads &&
+		uint32(len(key)) == argon2KeyLen
+
+	return true, current, nil
+}
+
+func (is *InternalService) isCurrentAlgorithm(algorithm string) bool {
+	if is.PasswordAlgorithm == "" {
+		return algorithm == PasswordAlgorithmArgon2id
+	}
+	return is.PasswordAlgorithm == algorithm
+}
+
+// pepperPassword mixes the server-side pepper into the password. The result
+// is base64 encoded so it always fits into the bcrypt 72 bytes limit.
+func (is *InternalService) pepperPassword(password string) []byte {
+	if is.Pepper == "" {
+		return []byte(password)
+	}
+
+	mac := hmac.New(sha256.New, []byte(is.Pepper))
+	mac.Write([]byte(password))
+
+	return []byte(base64.RawStdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// legacyHashPassword reproduces the sha256(password + salt) scheme used before
+// versioned hashes were introduced. It is only used to verify old hashes.
+func (is *InternalService) legacyHashPassword(password string) string {
+	saltedPassword := password + is.Salt
+	hashedPassword := sha256.Sum256([]byte(saltedPassword))
+	return hex.EncodeToString(hashedPassword[:])
+}
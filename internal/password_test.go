@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+func TestPasswordHashes(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		prefix    string
+	}{
+		{"argon2id", PasswordAlgorithmArgon2id, "$argon2id$"},
+		{"default", "", "$argon2id$"},
+		{"bcrypt", PasswordAlgorithmBcrypt, "$2a$"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			is := &InternalService{PasswordAlgorithm: test.algorithm, Pepper: "pepper"}
+
+			hash, err := is.hashPassword("password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(hash, test.prefix) {
+				t.Fatalf("expected a %s hash, got %s", test.prefix, hash)
+			}
+
+			other, err := is.hashPassword("password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if other == hash {
+				t.Error("expected a random salt per hash")
+			}
+
+			valid, needsRehash, err := is.verifyPassword("password", hash)
+			if err != nil || !valid || needsRehash {
+				t.Errorf("expected a current hash to verify, got %v %v %v", valid, needsRehash, err)
+			}
+
+			valid, _, err = is.verifyPassword("other-password", hash)
+			if err != nil || valid {
+				t.Errorf("expected another password to be refused, got %v %v", valid, err)
+			}
+
+			is.Pepper = "other-pepper"
+			valid, _, err = is.verifyPassword("password", hash)
+			if err != nil || valid {
+				t.Errorf("expected another pepper to be refused, got %v %v", valid, err)
+			}
+		})
+	}
+}
+
+func TestVerifyPasswordNeedsRehash(t *testing.T) {
+	bcryptService := &InternalService{PasswordAlgorithm: PasswordAlgorithmBcrypt, Salt: "salt"}
+	bcryptHash, err := bcryptService.hashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	argon2idService := &InternalService{PasswordAlgorithm: PasswordAlgorithmArgon2id, Salt: "salt"}
+	argon2idHash, err := argon2idService.hashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		is          *InternalService
+		hash        string
+		needsRehash bool
+	}{
+		{"current bcrypt", bcryptService, bcryptHash, false},
+		{"bcrypt after switching to argon2id", argon2idService, bcryptHash, true},
+		{"argon2id after switching to bcrypt", bcryptService, argon2idHash, true},
+		{"legacy sha256", bcryptService, bcryptService.legacyHashPassword("password"), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			valid, needsRehash, err := test.is.verifyPassword("password", test.hash)
+			if err != nil || !valid {
+				t.Fatalf("expected the password to verify, got %v %v", valid, err)
+			}
+			if needsRehash != test.needsRehash {
+				t.Errorf("expected needsRehash %v, got %v", test.needsRehash, needsRehash)
+			}
+		})
+	}
+
+	if _, _, err := bcryptService.verifyPassword("password", "plain"); err != errUnknownPasswordHash {
+		t.Errorf("expected errUnknownPasswordHash, got %v", err)
+	}
+	if valid, _, err := bcryptService.verifyPassword("", ""); err != nil || valid {
+		t.Errorf("expected a user without a password to be refused, got %v %v", valid, err)
+	}
+}
+
+func TestSignInUpgradesLegacyHash(t *testing.T) {
+	is, storage := newTestService(t)
+	legacyHash := is.legacyHashPassword("password")
+	storage.insert("users", entities.User{InternalId: "user", Email: "user@example.com", HashedPassword: legacyHash})
+
+	if _, err := is.authenticate("user@example.com", "other-password"); err == nil {
+		t.Fatal("expected another password to be refused")
+	}
+
+	if _, err := is.authenticate("user@example.com", "password"); err != nil {
+		t.Fatalf("expected the legacy hash to verify, got %v", err)
+	}
+
+	user, err := is.UsersRepository.GetUserByID("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(user.HashedPassword, "$2a$") {
+		t.Fatalf("expected the hash to be upgraded to bcrypt, got %s", user.HashedPassword)
+	}
+
+	if _, err := is.authenticate("user@example.com", "password"); err != nil {
+		t.Errorf("expected the upgraded hash to verify, got %v", err)
+	}
+}
+
+func TestSignInWithSharedLogin(t *testing.T) {
+	is, storage := newTestService(t)
+
+	// The email of one user is the phone of the other
+	for _, user := range []entities.User{
+		{InternalId: "email-user", Email: "+15550100", HashedPassword: is.legacyHashPassword("email-password")},
+		{InternalId: "phone-user", Phone: "+15550100", HashedPassword: is.legacyHashPassword("phone-password")},
+	} {
+		storage.insert("users", user)
+	}
+
+	tests := []struct {
+		password string
+		expected string
+	}{
+		{"email-password", "email-user"},
+		{"phone-password", "phone-user"},
+	}
+
+	for _, test := range tests {
+		user, err := is.authenticate("+15550100", test.password)
+		if err != nil {
+			t.Fatalf("expected %s to sign in, got %v", test.expected, err)
+		}
+		if user.InternalId != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, user.InternalId)
+		}
+	}
+
+	if _, err := is.authenticate("+15550100", "other-password"); err == nil {
+		t.Error("expected another password to be refused")
+	}
+}
@@ -0,0 +1,321 @@
+package internal
+
+import (
+	"container/list"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+	"github.com/Limpid-LLC/go-auth/internal/repo"
+)
+
+const (
+	defaultPermissionCacheSize       = 10000
+	defaultPermissionCacheTTL        = 30 * time.Second
+	defaultPermissionCacheSyncPeriod = 2 * time.Second
+	// permissionCacheSyncMargin makes each sync read the invalidations again
+	// a while before the previous one, to tolerate clock skew between
+	// instances. Invalidations are idempotent.
+	permissionCacheSyncMargin = 5 * time.Second
+)
+
+// PermissionCache keeps the permission rows of recently checked tokens. It is
+// a LRU cache whose entries also expire after TTL, which bounds how long an
+// invalidation missed by an instance can go unnoticed. Invalidations are
+// published through the storage so other instances drop their entries on
+// their next sync. A nil cache is disabled and caches nothing.
+type PermissionCache struct {
+	Size       int
+	TTL        time.Duration
+	SyncPeriod time.Duration
+
+	Invalidations *repo.PermissionInvalidationsRepository
+
+	instanceID string
+	mutex      sync.Mutex
+	entries    map[string]*list.Element
+	// order holds the entries, the most recently used first
+	order *list.List
+	// generation changes with every invalidation, so rows read from the
+	// storage before an invalidation are not cached after it
+	generation uint64
+	lastSync   int64
+
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	evictions     atomic.Uint64
+	invalidations atomic.Uint64
+}
+
+type permissionCacheEntry struct {
+	token            string
+	tokenPermissions []entities.TokenPermission
+	expiresAt        time.Time
+}
+
+// PermissionCacheStats are the counters of the cache since the start.
+type PermissionCacheStats struct {
+	Enabled       bool    `json:"enabled"`
+	Entries       int     `json:"entries"`
+	Size          int     `json:"size"`
+	Hits          uint64  `json:"hits"`
+	Misses        uint64  `json:"misses"`
+	HitRatio      float64 `json:"hit_ratio"`
+	Evictions     uint64  `json:"evictions"`
+	Invalidations uint64  `json:"invalidations"`
+}
+
+// NewPermissionCache reads the cache from the tokens.cache config entry. It
+// returns nil when the cache is not enabled.
+func NewPermissionCache(config map[string]interface{}, invalidations *repo.PermissionInvalidationsRepository) (*PermissionCache, error) {
+	if enabled, _ := config["enabled"].(bool); !enabled {
+		return nil, nil
+	}
+
+	instanceID, err := generateRandomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &PermissionCache{
+		Size:          defaultPermissionCacheSize,
+		TTL:           defaultPermissionCacheTTL,
+		SyncPeriod:    defaultPermissionCacheSyncPeriod,
+		Invalidations: invalidations,
+		instanceID:    instanceID,
+		entries:       map[string]*list.Element{},
+		order:         list.New(),
+		lastSync:      time.Now().UnixMilli(),
+	}
+
+	if size, ok := config["size"].(int); ok {
+		cache.Size = size
+	}
+	if ttl, ok := config["ttl"].(int); ok {
+		cache.TTL = time.Duration(ttl)
+	}
+	if syncPeriod, ok := config["sync_period"].(int); ok {
+		cache.SyncPeriod = time.Duration(syncPeriod)
+	}
+
+	if cache.Size <= 0 || cache.TTL <= 0 || cache.SyncPeriod <= 0 {
+		return nil, errors.New("size, ttl and sync_period must be positive")
+	}
+
+	return cache, nil
+}
+
+// Get returns the cached rows of the token and the generation to pass to
+// Put after a miss.
+func (c *PermissionCache) Get(token string) ([]entities.TokenPermission, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[token]
+	if ok && time.Now().Before(element.Value.(*permissionCacheEntry).expiresAt) {
+		c.order.MoveToFront(element)
+		c.hits.Add(1)
+		return element.Value.(*permissionCacheEntry).tokenPermissions, c.generation, true
+	}
+
+	if ok {
+		c.removeElement(element)
+	}
+	c.misses.Add(1)
+	return nil, c.generation, false
+}
+
+// Put caches the rows of the token unless an invalidation happened since the
+// generation was taken.
+func (c *PermissionCache) Put(token string, tokenPermissions []entities.TokenPermission, generation uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if element, ok := c.entries[token]; ok {
+		c.removeElement(element)
+	}
+
+	c.entries[token] = c.order.PushFront(&permissionCacheEntry{
+		token:            token,
+		tokenPermissions: tokenPermissions,
+		expiresAt:        time.Now().Add(c.TTL),
+	})
+
+	for c.order.Len() > c.Size {
+		c.removeElement(c.order.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// Invalidate drops the entries of the tokens whose rows have one of the
+// values in the field, here and, through the storage, in other instances.
+func (c *PermissionCache) Invalidate(field string, values ...string) {
+	if c == nil || len(values) == 0 {
+		return
+	}
+
+	c.invalidate(field, values)
+
+	err := c.Invalidations.CreateInvalidation(&entities.PermissionInvalidation{
+		InstanceID: c.instanceID,
+		Field:      field,
+		Values:     values,
+		CreatedAt:  time.Now().UnixMilli(),
+	})
+	if err != nil {
+		log.Println("Cannot publish permission invalidation, err:", err)
+	}
+}
+
+func (c *PermissionCache) invalidate(field string, values []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+	c.invalidations.Add(1)
+
+	if field == "token" {
+		for _, token := range values {
+			if element, ok := c.entries[token]; ok {
+				c.removeElement(element)
+			}
+		}
+		return
+	}
+
+	for _, element := range c.entries {
+		for _, tokenPermission := range element.Value.(*permissionCacheEntry).tokenPermissions {
+			if containsString(values, tokenPermissionField(tokenPermission, field)) {
+				c.removeElement(element)
+				break
+			}
+		}
+	}
+}
+
+func (c *PermissionCache) removeElement(element *list.Element) {
+	delete(c.entries, element.Value.(*permissionCacheEntry).token)
+	c.order.Remove(element)
+}
+
+// Sync applies the invalidations published by other instances since the
+// previous sync.
+func (c *PermissionCache) Sync() {
+	now := time.Now().UnixMilli()
+
+	invalidations, err := c.Invalidations.GetInvalidationsSince(c.lastSync - permissionCacheSyncMargin.Milliseconds())
+	if err != nil {
+		log.Println("Cannot get permission invalidations, err:", err)
+		return
+	}
+
+	for _, invalidation := range invalidations {
+		if invalidation.InstanceID != c.instanceID {
+			c.invalidate(invalidation.Field, invalidation.Values)
+		}
+	}
+
+	c.lastSync = now
+}
+
+// RemoveOldInvalidations removes the invalidations older than any cached
+// entry.
+func (c *PermissionCache) RemoveOldInvalidations() {
+	c.Invalidations.RemoveInvalidationsBefore(time.Now().Add(-c.TTL - permissionCacheSyncMargin).UnixMilli())
+}
+
+func (c *PermissionCache) Stats() PermissionCacheStats {
+	if c == nil {
+		return PermissionCacheStats{}
+	}
+
+	c.mutex.Lock()
+	entries := c.order.Len()
+	c.mutex.Unlock()
+
+	stats := PermissionCacheStats{
+		Enabled:       true,
+		Entries:       entries,
+		Size:          c.Size,
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Evictions:     c.evictions.Load(),
+		Invalidations: c.invalidations.Load(),
+	}
+	if stats.Hits+stats.Misses > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+	}
+
+	return stats
+}
+
+func tokenPermissionField(tokenPermission entities.TokenPermission, field string) string {
+	switch field {
+	case "user_id":
+		return tokenPermission.UserID
+	case "session_id":
+		return tokenPermission.SessionID
+	case "client_id":
+		return tokenPermission.ClientID
+	case "role_internal_id":
+		return tokenPermission.RoleInternalID
+	}
+
+	return tokenPermission.Token
+}
+
+// tokenPermissions returns the unexpired rows of the token, from the cache
+// when it holds them. Cached rows may expire meanwhile, so callers match them
+// with MatchTokenPermissions.
+func (is InternalService) tokenPermissions(token string) ([]entities.TokenPermission, error) {
+	tokenPermissions, generation, ok := is.PermissionCache.Get(token)
+	if ok {
+		return tokenPermissions, nil
+	}
+
+	tokenPermissions, err := is.TokenPermissionsRepository.GetTokenPermissions(token, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unknown tokens are not cached, so they cannot push out valid ones
+	if len(tokenPermissions) > 0 {
+		is.PermissionCache.Put(token, tokenPermissions, generation)
+	}
+
+	return tokenPermissions, nil
+}
+
+// findTokenPermissions is FindTokenPermissions of the repository served from
+// the cache when it is enabled.
+func (is InternalService) findTokenPermissions(token string, microservice string, method string) ([]entities.TokenPermission, error) {
+	if is.PermissionCache == nil {
+		return is.TokenPermissionsRepository.FindTokenPermissions(token, microservice, method)
+	}
+
+	tokenPermissions, err := is.tokenPermissions(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.MatchTokenPermissions(tokenPermissions, microservice, method), nil
+}
+
+func (is InternalService) permissionCacheStatsHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	return NewOkResponse(is.PermissionCache.Stats())
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/Limpid-LLC/go-auth/internal/repo"
+)
+
+// enablePermissionCache gives the service a cache publishing invalidations to
+// the test storage.
+func enablePermissionCache(t *testing.T, is *InternalService) {
+	t.Helper()
+
+	cache, err := NewPermissionCache(map[string]interface{}{"enabled": true}, &repo.PermissionInvalidationsRepository{
+		Storage:    is.Storage,
+		Collection: "permissionInvalidations",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.PermissionCache = cache
+}
+
+// checkCached checks the request twice and expects the second check to be
+// answered from the cache.
+func checkCached(t *testing.T, is *InternalService, storage *testStorage, request Request) bool {
+	t.Helper()
+
+	allowed, err := is.check(request, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage.resetRequestCounts()
+	cachedAllowed, err := is.check(request, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cachedAllowed != allowed || storage.requestCount("read", "tokenPermissions") != 0 {
+		t.Fatalf("expected the token permissions to be cached")
+	}
+
+	return allowed
+}
+
+func checkAllowed(t *testing.T, is *InternalService, request Request) bool {
+	t.Helper()
+
+	allowed, err := is.check(request, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return allowed
+}
+
+func TestDetachRoleInvalidatesCachedTokens(t *testing.T) {
+	is, storage, user := newDenyTestService(t)
+	enablePermissionCache(t, is)
+
+	accessTokens, err := is.generateAccessTokens(user, accessTokenOptions{SessionID: "session"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := Request{Microservice: "crud", Method: "delete", Data: map[string]interface{}{"token": accessTokens[0].Token}}
+
+	if !checkCached(t, is, storage, request) {
+		t.Fatal("expected the editor role to allow the request")
+	}
+
+	err = is.detachRole(user.InternalId, "editor-role")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if checkAllowed(t, is, request) {
+		t.Error("expected the detached role to no longer allow the request")
+	}
+	if len(storage.documents("permissionInvalidations")) == 0 {
+		t.Error("expected the invalidation to be published")
+	}
+}
+
+func TestDeleteUsersRevokesCachedTokens(t *testing.T) {
+	is, storage, user := newDenyTestService(t)
+	enablePermissionCache(t, is)
+
+	accessTokens, err := is.generateAccessTokens(user, accessTokenOptions{SessionID: "session"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := Request{Microservice: "crud", Method: "delete", Data: map[string]interface{}{"token": accessTokens[0].Token}}
+
+	if !checkCached(t, is, storage, request) {
+		t.Fatal("expected the token to allow the request")
+	}
+
+	response, _, _ := is.deleteUsersHandler(map[string]interface{}{"internal_id": user.InternalId}, nil)
+	if code := errorCode(response); code != "" {
+		t.Fatalf("expected the user to be removed, got %+v", response)
+	}
+
+	if checkAllowed(t, is, request) {
+		t.Error("expected the token of the removed user to be revoked")
+	}
+}
+
+func TestDirectoryGroupChangeInvalidatesCachedTokens(t *testing.T) {
+	is, storage, authenticator := newDirectoryTestService(t, false)
+	enablePermissionCache(t, is)
+
+	user, err := is.authenticate("alice@example.com", "directory-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessTokens, err := is.generateAccessTokens(user, accessTokenOptions{SessionID: "session"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := Request{Microservice: "crud", Method: "read", Data: map[string]interface{}{"token": accessTokens[0].Token}}
+
+	if !checkCached(t, is, storage, request) {
+		t.Fatal("expected the token to allow the request")
+	}
+
+	// Signing in again with the same groups keeps the tokens
+	_, err = is.authenticate("alice@example.com", "directory-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkAllowed(t, is, request) {
+		t.Fatal("expected the token to be kept without a group change")
+	}
+
+	authenticator.entry.RoleIDs = []string{"admins-role"}
+	_, err = is.authenticate("alice@example.com", "directory-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkAllowed(t, is, request) {
+		t.Error("expected the token issued before the group change to be removed")
+	}
+}
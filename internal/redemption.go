@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/saiset-co/sai-storage-mongo/external/adapter"
+)
+
+// redeem records the single use of a credential, e.g. a refresh token or an
+// authorization code. sai-storage has no conditional update: update and
+// delete find the documents first and report them even when a concurrent
+// request changed them in between. The redemption is therefore a create
+// whose _id is derived from the credential, which MongoDB keeps unique, so
+// of several concurrent redemptions exactly one succeeds. It returns false
+// for the others. expiredAt is when the credential expires on its own, after
+// which the record is removed.
+func (is InternalService) redeem(kind string, credential string, expiredAt int64) (bool, error) {
+	id := kind + ":" + hashToken(credential)
+
+	req := adapter.Request{
+		Method: "create",
+		Data: adapter.CreateRequest{
+			Collection: "redemptions",
+			Documents: []interface{}{map[string]interface{}{
+				"_id":           id,
+				"redemption_id": id,
+				"expired_at":    expiredAt,
+			}},
+		},
+	}
+
+	res, err := is.Storage.Send(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to redeem %s: %v", kind, err)
+	}
+	if res.Status == "OK" {
+		return true, nil
+	}
+
+	// The storage reports a duplicate id like any other failure, so only an
+	// existing record means the credential was redeemed before
+	req = adapter.Request{
+		Method: "read",
+		Data: adapter.ReadRequest{
+			Collection: "redemptions",
+			Select: map[string]interface{}{
+				"redemption_id": id,
+			},
+		},
+	}
+
+	res, err = is.Storage.Send(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to redeem %s: %v", kind, err)
+	}
+	if len(res.Result) == 0 {
+		return false, errors.New("failed to redeem " + kind)
+	}
+
+	return false, nil
+}
+
+func (is InternalService) removeExpiredRedemptions() {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: "redemptions",
+			Select: map[string]interface{}{
+				"expired_at": map[string]interface{}{
+					"$lt": time.Now().Unix(),
+				},
+			},
+		},
+	}
+
+	_, err := is.Storage.Send(req)
+	if err != nil {
+		fmt.Printf("failed to remove expired redemptions: %v\n", err)
+	}
+}
@@ -2,19 +2,38 @@ package internal
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"net/http"
+	"time"
+
 	"github.com/Limpid-LLC/go-auth/internal/entities"
 	"github.com/saiset-co/sai-storage-mongo/external/adapter"
-	"time"
 )
 
+var (
+	errRefreshTokenNotFound = errors.New("refresh token not found")
+	errRefreshTokenReused   = errors.New("refresh token reuse detected")
+)
+
+// RefreshToken is a single-use token. Every exchange marks it as used and
+// issues a new token of the same family; presenting a used token again means
+// it was stolen, so the whole family is revoked. The family id is the id of
+// the session the token belongs to.
 type RefreshToken struct {
 	RefreshToken string `json:"refresh_token"`
 	ExpiredAt    int64  `json:"expired_at"`
 	UserID       string `json:"user_id"`
+	FamilyID     string `json:"family_id"`
+	Used         bool   `json:"used"`
+	ClientID     string `json:"client_id,omitempty"`
+	Scope        string `json:"scope,omitempty"`
 }
 
-func (is *InternalService) generateRefreshToken(user *entities.User) (*RefreshToken, error) {
+// generateRefreshToken issues a refresh token of the family. OAuth clients
+// pass their id and the granted scope, which are kept across rotations.
+func (is *InternalService) generateRefreshToken(user *entities.User, familyID string, clientID string, scope string) (*RefreshToken, error) {
 	// Generate a random refresh token
 	refreshToken, err := generateRandomToken(64)
 
@@ -29,6 +48,9 @@ func (is *InternalService) generateRefreshToken(user *entities.User) (*RefreshTo
 		RefreshToken: refreshToken,
 		ExpiredAt:    expiredAt,
 		UserID:       user.InternalId,
+		FamilyID:     familyID,
+		ClientID:     clientID,
+		Scope:        scope,
 	}
 
 	req := adapter.Request{
@@ -46,7 +68,7 @@ func (is *InternalService) generateRefreshToken(user *entities.User) (*RefreshTo
 	return &token, nil
 }
 
-func (is InternalService) getUserByRefreshToken(refreshToken string) (*entities.User, error) {
+func (is InternalService) getRefreshToken(refreshToken string) (*RefreshToken, error) {
 	req := adapter.Request{
 		Method: "read",
 		Data: adapter.ReadRequest{
@@ -66,7 +88,7 @@ func (is InternalService) getUserByRefreshToken(refreshToken string) (*entities.
 	}
 
 	if len(res.Result) == 0 {
-		return nil, fmt.Errorf("refresh token not found")
+		return nil, errRefreshTokenNotFound
 	}
 
 	var tokens []RefreshToken
@@ -79,13 +101,162 @@ func (is InternalService) getUserByRefreshToken(refreshToken string) (*entities.
 		return nil, err
 	}
 
-	user, err := is.UsersRepository.GetUserByID(tokens[0].UserID)
+	return &tokens[0], nil
+}
+
+// rotateRefreshToken marks the refresh token as used and returns its owner
+// together with the token; its family is the one the replacement must join.
+func (is InternalService) rotateRefreshToken(refreshToken string) (*entities.User, *RefreshToken, error) {
+	token, err := is.getRefreshToken(refreshToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if token.Used {
+		return nil, nil, is.revokeRefreshTokenFamily(token)
+	}
+
+	// Of two concurrent exchanges of the token only one redeems it, the
+	// other is treated as reuse
+	redeemed, err := is.redeem("refresh_token", token.RefreshToken, token.ExpiredAt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !redeemed {
+		return nil, nil, is.revokeRefreshTokenFamily(token)
+	}
+
+	req := adapter.Request{
+		Method: "update",
+		Data: adapter.UpdateRequest{
+			Collection: "refreshTokens",
+			Select: map[string]interface{}{
+				"refresh_token": token.RefreshToken,
+			},
+			Document: map[string]interface{}{"$set": map[string]interface{}{"used": true}},
+		},
+	}
+
+	if _, err := is.Storage.Send(req); err != nil {
+		return nil, nil, fmt.Errorf("failed to update refresh token: %v", err)
+	}
+
+	user, err := is.UsersRepository.GetUserByID(token.UserID)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get user by id: %v", err)
+	}
+
+	if token.FamilyID == "" {
+		token.FamilyID, err = generateRandomToken(16)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate refresh token family: %v", err)
+		}
+	}
+
+	return user, token, nil
+}
+
+// revokeRefreshTokenFamily revokes the family of a reused token and returns
+// errRefreshTokenReused.
+func (is InternalService) revokeRefreshTokenFamily(token *RefreshToken) error {
+	var err error
+	if token.FamilyID != "" {
+		err = is.revokeSession(token.FamilyID)
+	} else {
+		err = is.removeRefreshTokens(map[string]interface{}{"refresh_token": token.RefreshToken})
+	}
+	if err != nil {
+		log.Println("Cannot revoke refresh token family, err:", err)
+	}
+
+	return errRefreshTokenReused
+}
+
+func (is InternalService) removeRefreshTokens(selectData map[string]interface{}) error {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: "refreshTokens",
+			Select:     selectData,
+		},
+	}
+
+	if _, err := is.Storage.Send(req); err != nil {
+		return fmt.Errorf("failed to remove refresh tokens: %v", err)
+	}
+
+	return nil
+}
+
+func (is *InternalService) refreshTokenHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		log.Println("Invalid data format in refreshTokenHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, errors.New("invalid data format")
+	}
+
+	rules := map[string]interface{}{
+		"refresh_token": "required",
+	}
+	errs := is.Validate.ValidateMap(dataMap, rules)
+	if len(errs) > 0 {
+		log.Println("Validation error in refreshTokenHandler:", errs)
+		return createErrorResponse(errs), http.StatusBadRequest, errors.New("not valid data")
+	}
+
+	refreshToken, _ := dataMap["refresh_token"].(string)
+
+	// Tokens issued to OAuth clients are exchanged at the token endpoint.
+	// They are checked before rotating, so this method cannot burn them.
+	token, err := is.getRefreshToken(refreshToken)
+	if err != nil || token.ClientID != "" {
+		if err != nil && !errors.Is(err, errRefreshTokenNotFound) {
+			log.Println("Cannot get refresh token, err:", err)
+		}
+		return NewErrorResponse(
+			"RefreshTokenError",
+			"RTE_01",
+			"Refresh token is invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	user, token, err := is.rotateRefreshToken(token.RefreshToken)
+	if errors.Is(err, errRefreshTokenReused) {
+		log.Println("Refresh token reuse detected, family revoked")
+		return NewErrorResponse(
+			"RefreshTokenError",
+			"RTE_02",
+			"Refresh token has already been used",
+		), http.StatusUnauthorized, nil
+	}
+	if err != nil {
+		if !errors.Is(err, errRefreshTokenNotFound) {
+			log.Println("Cannot rotate refresh token, err:", err)
+		}
+		return NewErrorResponse(
+			"RefreshTokenError",
+			"RTE_01",
+			"Refresh token is invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
 
+	// Tokens issued before sessions existed get a session on first use
+	session, err := is.getOrStartSession(user, meta, token.FamilyID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user by id: %v", err)
+		log.Println("Cannot start session, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
 	}
 
-	return user, nil
+	return is.signInResponse(user, session)
 }
 
 func (is InternalService) removeExpiredRefreshTokens() {
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+func refreshTestToken(is *InternalService, refreshToken string) (interface{}, int) {
+	response, status, _ := is.refreshTokenHandler(
+		map[string]interface{}{"refresh_token": refreshToken},
+		map[string]interface{}{"ip": "203.0.113.5"},
+	)
+
+	return response, status
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	is, storage := newTestService(t)
+	signIn := signInTestUser(t, is, storage, entities.User{InternalId: "user", Email: "user@example.com"}, "password")
+
+	response, _ := refreshTestToken(is, signIn.RefreshToken.RefreshToken)
+	var rotated testSignIn
+	decodeResult(t, response, &rotated)
+
+	if rotated.RefreshToken.RefreshToken == signIn.RefreshToken.RefreshToken || rotated.AccessToken == "" {
+		t.Fatalf("expected new tokens, got %+v", rotated)
+	}
+	if rotated.SessionID != signIn.SessionID || rotated.RefreshToken.FamilyID != signIn.SessionID {
+		t.Errorf("expected the rotated token to stay in the session, got %+v", rotated)
+	}
+
+	// The replacement works in turn
+	response, _ = refreshTestToken(is, rotated.RefreshToken.RefreshToken)
+	if code := errorCode(response); code != "" {
+		t.Errorf("expected the replacement to be accepted, got %+v", response)
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	is, storage := newTestService(t)
+	signIn := signInTestUser(t, is, storage, entities.User{InternalId: "user", Email: "user@example.com"}, "password")
+
+	response, _ := refreshTestToken(is, signIn.RefreshToken.RefreshToken)
+	var rotated testSignIn
+	decodeResult(t, response, &rotated)
+
+	response, status := refreshTestToken(is, signIn.RefreshToken.RefreshToken)
+	if errorCode(response) != "RTE_02" || status != 401 {
+		t.Fatalf("expected RTE_02 for a used token, got %d %+v", status, response)
+	}
+
+	// The whole family is revoked, including the replacement and the
+	// access tokens of the session
+	response, _ = refreshTestToken(is, rotated.RefreshToken.RefreshToken)
+	if code := errorCode(response); code != "RTE_01" {
+		t.Errorf("expected the replacement to be revoked, got %+v", response)
+	}
+	if len(storage.documents("tokenPermissions")) != 0 || len(storage.documents("sessions")) != 0 {
+		t.Error("expected the session and its access tokens to be revoked")
+	}
+}
+
+func TestRefreshTokenConcurrentExchanges(t *testing.T) {
+	is, storage := newTestService(t)
+	signIn := signInTestUser(t, is, storage, entities.User{InternalId: "user", Email: "user@example.com"}, "password")
+
+	const exchanges = 8
+	codes := make([]string, exchanges)
+	var wg sync.WaitGroup
+	for i := 0; i < exchanges; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			response, _ := refreshTestToken(is, signIn.RefreshToken.RefreshToken)
+			codes[i] = errorCode(response)
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, code := range codes {
+		if code == "" {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("expected exactly one exchange to succeed, got %v", codes)
+	}
+}
+
+func TestRefreshTokenRejectsUnknownAndOAuthTokens(t *testing.T) {
+	is, storage := newTestService(t)
+	storage.insert("refreshTokens", RefreshToken{
+		RefreshToken: "client-token",
+		ExpiredAt:    4102444800,
+		UserID:       "user",
+		ClientID:     "client",
+	})
+
+	for _, refreshToken := range []string{"unknown", "client-token"} {
+		response, status := refreshTestToken(is, refreshToken)
+		if errorCode(response) != "RTE_01" || status != 401 {
+			t.Errorf("expected RTE_01 for %s, got %d %+v", refreshToken, status, response)
+		}
+	}
+
+	// The OAuth token is not burnt
+	token, err := is.getRefreshToken("client-token")
+	if err != nil || token.Used {
+		t.Errorf("expected the client token to stay usable, got %+v %v", token, err)
+	}
+}
+
+func TestRedeem(t *testing.T) {
+	is, storage := newTestService(t)
+
+	redeemed, err := is.redeem("code", "credential", 4102444800)
+	if err != nil || !redeemed {
+		t.Fatalf("expected the first redemption to succeed, got %v %v", redeemed, err)
+	}
+	redeemed, err = is.redeem("code", "credential", 4102444800)
+	if err != nil || redeemed {
+		t.Errorf("expected the second redemption to be refused, got %v %v", redeemed, err)
+	}
+	redeemed, err = is.redeem("other", "credential", 4102444800)
+	if err != nil || !redeemed {
+		t.Errorf("expected the kinds to be separate, got %v %v", redeemed, err)
+	}
+
+	storage.insert("redemptions", map[string]interface{}{"redemption_id": "expired", "expired_at": 1})
+	is.removeExpiredRedemptions()
+	if len(storage.documents("redemptions")) != 2 {
+		t.Errorf("expected the expired redemption to be removed, got %v", storage.documents("redemptions"))
+	}
+}
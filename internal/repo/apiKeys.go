@@ -0,0 +1,125 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+	"github.com/saiset-co/sai-storage-mongo/external/adapter"
+)
+
+type APIKeysRepository struct {
+	Collection string
+	Storage    *adapter.SaiStorage
+}
+
+func (repo APIKeysRepository) CreateAPIKey(apiKey *entities.APIKey) error {
+	req := adapter.Request{
+		Method: "create",
+		Data: adapter.CreateRequest{
+			Collection: repo.Collection,
+			Documents:  []interface{}{apiKey},
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		return fmt.Errorf("failed to create api key: %v", err)
+	}
+
+	return nil
+}
+
+func (repo APIKeysRepository) GetAPIKeyByHash(keyHash string) (*entities.APIKey, error) {
+	apiKeys, err := repo.GetAPIKeys(map[string]interface{}{
+		"___key": keyHash,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(apiKeys) == 0 {
+		return nil, fmt.Errorf("api key not found")
+	}
+
+	return &apiKeys[0], nil
+}
+
+func (repo APIKeysRepository) GetAPIKeyByID(id string) (*entities.APIKey, error) {
+	apiKeys, err := repo.GetAPIKeys(map[string]interface{}{
+		"api_key_id": id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(apiKeys) == 0 {
+		return nil, fmt.Errorf("api key not found")
+	}
+
+	return &apiKeys[0], nil
+}
+
+func (repo APIKeysRepository) GetAPIKeys(selectData map[string]interface{}) ([]entities.APIKey, error) {
+	req := adapter.Request{
+		Method: "read",
+		Data: adapter.ReadRequest{
+			Collection: repo.Collection,
+			Select:     selectData,
+		},
+	}
+
+	res, err := repo.Storage.Send(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api keys: %v", err)
+	}
+
+	var apiKeys []entities.APIKey
+	itemBytes, err := json.Marshal(res.Result)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(itemBytes, &apiKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	return apiKeys, nil
+}
+
+func (repo APIKeysRepository) SetLastUsedAt(id string, lastUsedAt int64) error {
+	req := adapter.Request{
+		Method: "update",
+		Data: adapter.UpdateRequest{
+			Collection: repo.Collection,
+			Select: map[string]interface{}{
+				"api_key_id": id,
+			},
+			Document: map[string]interface{}{"$set": map[string]interface{}{"last_used_at": lastUsedAt}},
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		return fmt.Errorf("failed to update api key: %v", err)
+	}
+
+	return nil
+}
+
+func (repo APIKeysRepository) RemoveAPIKeys(selectData map[string]interface{}) error {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: repo.Collection,
+			Select:     selectData,
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		return fmt.Errorf("failed to remove api keys: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+	"github.com/saiset-co/sai-storage-mongo/external/adapter"
+)
+
+type OAuthClientsRepository struct {
+	Collection string
+	Storage    *adapter.SaiStorage
+}
+
+func (repo OAuthClientsRepository) CreateClient(client *entities.OAuthClient) error {
+	req := adapter.Request{
+		Method: "create",
+		Data: adapter.CreateRequest{
+			Collection: repo.Collection,
+			Documents:  []interface{}{client},
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		return fmt.Errorf("failed to create oauth client: %v", err)
+	}
+
+	return nil
+}
+
+func (repo OAuthClientsRepository) GetClientByID(clientID string) (*entities.OAuthClient, error) {
+	clients, err := repo.GetClients(map[string]interface{}{
+		"client_id": clientID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("oauth client not found")
+	}
+
+	return &clients[0], nil
+}
+
+func (repo OAuthClientsRepository) GetClients(selectData map[string]interface{}) ([]entities.OAuthClient, error) {
+	req := adapter.Request{
+		Method: "read",
+		Data: adapter.ReadRequest{
+			Collection: repo.Collection,
+			Select:     selectData,
+		},
+	}
+
+	res, err := repo.Storage.Send(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get oauth clients: %v", err)
+	}
+
+	var clients []entities.OAuthClient
+	itemBytes, err := json.Marshal(res.Result)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(itemBytes, &clients)
+	if err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+func (repo OAuthClientsRepository) RemoveClients(selectData map[string]interface{}) error {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: repo.Collection,
+			Select:     selectData,
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		return fmt.Errorf("failed to remove oauth clients: %v", err)
+	}
+
+	return nil
+}
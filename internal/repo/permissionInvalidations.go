@@ -0,0 +1,85 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+	"github.com/saiset-co/sai-storage-mongo/external/adapter"
+)
+
+type PermissionInvalidationsRepository struct {
+	Collection string
+	Storage    *adapter.SaiStorage
+}
+
+func (repo PermissionInvalidationsRepository) CreateInvalidation(invalidation *entities.PermissionInvalidation) error {
+	req := adapter.Request{
+		Method: "create",
+		Data: adapter.CreateRequest{
+			Collection: repo.Collection,
+			Documents:  []interface{}{invalidation},
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		return fmt.Errorf("failed to create permission invalidation: %v", err)
+	}
+
+	return nil
+}
+
+// GetInvalidationsSince returns the invalidations created after the time, in
+// unix milliseconds.
+func (repo PermissionInvalidationsRepository) GetInvalidationsSince(since int64) ([]entities.PermissionInvalidation, error) {
+	req := adapter.Request{
+		Method: "read",
+		Data: adapter.ReadRequest{
+			Collection: repo.Collection,
+			Select: map[string]interface{}{
+				"created_at": map[string]interface{}{
+					"$gt": since,
+				},
+			},
+		},
+	}
+
+	res, err := repo.Storage.Send(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get permission invalidations: %v", err)
+	}
+
+	var invalidations []entities.PermissionInvalidation
+	itemBytes, err := json.Marshal(res.Result)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(itemBytes, &invalidations)
+	if err != nil {
+		return nil, err
+	}
+
+	return invalidations, nil
+}
+
+// RemoveInvalidationsBefore removes the invalidations created before the
+// time, in unix milliseconds.
+func (repo PermissionInvalidationsRepository) RemoveInvalidationsBefore(before int64) {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: repo.Collection,
+			Select: map[string]interface{}{
+				"created_at": map[string]interface{}{
+					"$lt": before,
+				},
+			},
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		fmt.Printf("failed to remove permission invalidations: %v\n", err)
+	}
+}
@@ -0,0 +1,133 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+	"github.com/saiset-co/sai-storage-mongo/external/adapter"
+)
+
+type ServiceTokensRepository struct {
+	Collection string
+	Storage    *adapter.SaiStorage
+}
+
+func (repo ServiceTokensRepository) CreateServiceToken(serviceToken *entities.ServiceToken) error {
+	req := adapter.Request{
+		Method: "create",
+		Data: adapter.CreateRequest{
+			Collection: repo.Collection,
+			Documents:  []interface{}{serviceToken},
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		return fmt.Errorf("failed to create service token: %v", err)
+	}
+
+	return nil
+}
+
+func (repo ServiceTokensRepository) GetServiceTokenByID(id string) (*entities.ServiceToken, error) {
+	serviceTokens, err := repo.GetServiceTokens(map[string]interface{}{
+		"service_token_id": id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(serviceTokens) == 0 {
+		return nil, fmt.Errorf("service token not found")
+	}
+
+	return &serviceTokens[0], nil
+}
+
+func (repo ServiceTokensRepository) GetServiceTokens(selectData map[string]interface{}) ([]entities.ServiceToken, error) {
+	req := adapter.Request{
+		Method: "read",
+		Data: adapter.ReadRequest{
+			Collection: repo.Collection,
+			Select:     selectData,
+		},
+	}
+
+	res, err := repo.Storage.Send(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get service tokens: %v", err)
+	}
+
+	var serviceTokens []entities.ServiceToken
+	itemBytes, err := json.Marshal(res.Result)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(itemBytes, &serviceTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	return serviceTokens, nil
+}
+
+func (repo ServiceTokensRepository) SetExpiredAt(id string, expiredAt int64) error {
+	req := adapter.Request{
+		Method: "update",
+		Data: adapter.UpdateRequest{
+			Collection: repo.Collection,
+			Select: map[string]interface{}{
+				"service_token_id": id,
+			},
+			Document: map[string]interface{}{"$set": map[string]interface{}{"expired_at": expiredAt}},
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		return fmt.Errorf("failed to update service token: %v", err)
+	}
+
+	return nil
+}
+
+func (repo ServiceTokensRepository) RemoveServiceTokens(selectData map[string]interface{}) error {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: repo.Collection,
+			Select:     selectData,
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		return fmt.Errorf("failed to remove service tokens: %v", err)
+	}
+
+	return nil
+}
+
+// RemoveExpiredServiceTokens removes tokens past their expiry. Tokens
+// without an expiry are kept.
+func (repo ServiceTokensRepository) RemoveExpiredServiceTokens() {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: repo.Collection,
+			Select: map[string]interface{}{
+				"expired_at": map[string]interface{}{
+					"$gt": 0,
+					"$lt": time.Now().Unix(),
+				},
+			},
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		fmt.Printf("failed to remove expired service tokens: %v\n", err)
+	}
+}
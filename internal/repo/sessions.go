@@ -0,0 +1,132 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+	"github.com/saiset-co/sai-storage-mongo/external/adapter"
+)
+
+type SessionsRepository struct {
+	Collection string
+	Storage    *adapter.SaiStorage
+}
+
+func (repo SessionsRepository) CreateSession(session *entities.Session) error {
+	req := adapter.Request{
+		Method: "create",
+		Data: adapter.CreateRequest{
+			Collection: repo.Collection,
+			Documents:  []interface{}{session},
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+
+	return nil
+}
+
+// UpdateSession updates a session by its id.
+func (repo SessionsRepository) UpdateSession(session *entities.Session) error {
+	req := adapter.Request{
+		Method: "update",
+		Data: adapter.UpdateRequest{
+			Collection: repo.Collection,
+			Select: map[string]interface{}{
+				"session_id": session.ID,
+			},
+			Document: map[string]interface{}{"$set": session},
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		return fmt.Errorf("failed to update session: %v", err)
+	}
+
+	return nil
+}
+
+func (repo SessionsRepository) GetSessionByID(id string) (*entities.Session, error) {
+	sessions, err := repo.GetSessions(map[string]interface{}{
+		"session_id": id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sessions) == 0 {
+		return nil, fmt.Errorf("session not found")
+	}
+
+	return &sessions[0], nil
+}
+
+func (repo SessionsRepository) GetSessionsByUserID(userID string) ([]entities.Session, error) {
+	return repo.GetSessions(map[string]interface{}{
+		"user_id": userID,
+		"expired_at": map[string]interface{}{
+			"$gt": time.Now().Unix(),
+		},
+	})
+}
+
+func (repo SessionsRepository) GetSessions(selectData map[string]interface{}) ([]entities.Session, error) {
+	req := adapter.Request{
+		Method: "read",
+		Data: adapter.ReadRequest{
+			Collection: repo.Collection,
+			Select:     selectData,
+		},
+	}
+
+	res, err := repo.Storage.Send(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions: %v", err)
+	}
+
+	var sessions []entities.Session
+	itemBytes, err := json.Marshal(res.Result)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(itemBytes, &sessions)
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (repo SessionsRepository) RemoveSessions(selectData map[string]interface{}) error {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: repo.Collection,
+			Select:     selectData,
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		return fmt.Errorf("failed to remove sessions: %v", err)
+	}
+
+	return nil
+}
+
+func (repo SessionsRepository) RemoveExpiredSessions() {
+	err := repo.RemoveSessions(map[string]interface{}{
+		"expired_at": map[string]interface{}{
+			"$lt": time.Now().Unix(),
+		},
+	})
+	if err != nil {
+		fmt.Printf("failed to remove expired sessions: %v\n", err)
+	}
+}
@@ -35,16 +35,50 @@ func (repo TokenPermissionsRepository) RemoveExpiredTokens() {
 	}
 }
 
+// FindTokenPermissions returns the unexpired rows of the token whose
+// permission matches the method. Permissions may be patterns, so the rows of
+// the token are matched here rather than by the storage.
 func (repo TokenPermissionsRepository) FindTokenPermissions(token string, microservice string, method string) ([]entities.TokenPermission, error) {
+	tokenPermissions, err := repo.GetTokenPermissions(token, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return MatchTokenPermissions(tokenPermissions, microservice, method), nil
+}
+
+// MatchTokenPermissions returns the unexpired rows whose permission matches
+// the method.
+func MatchTokenPermissions(tokenPermissions []entities.TokenPermission, microservice string, method string) []entities.TokenPermission {
+	now := time.Now().Unix()
+	var matched []entities.TokenPermission
+	for _, tokenPermission := range tokenPermissions {
+		if tokenPermission.ExpiredAt > now && tokenPermission.Matches(microservice, method) {
+			matched = append(matched, tokenPermission)
+		}
+	}
+
+	return matched
+}
+
+// GetTokenPermissions returns the rows of the token. Expired rows are left
+// out unless includeExpired is set, e.g. to tell an expired token from an
+// unknown one.
+func (repo TokenPermissionsRepository) GetTokenPermissions(token string, includeExpired bool) ([]entities.TokenPermission, error) {
+	selectData := map[string]interface{}{
+		"token": token,
+	}
+	if !includeExpired {
+		selectData["expired_at"] = map[string]interface{}{
+			"$gt": time.Now().Unix(),
+		}
+	}
+
 	req := adapter.Request{
 		Method: "read",
 		Data: adapter.ReadRequest{
 			Collection: repo.Collection,
-			Select: map[string]interface{}{
-				"token":                   token,
-				"permission_microservice": microservice,
-				"permission_method":       method,
-			},
+			Select:     selectData,
 		},
 	}
 
@@ -102,3 +136,123 @@ func (repo TokenPermissionsRepository) RemoveTokenPermissionsByRoleInternalID(ro
 
 	return nil
 }
+
+// FindDenyTokens returns the tokens holding deny permissions of the roles.
+func (repo TokenPermissionsRepository) FindDenyTokens(roleInternalIDs []string) ([]string, error) {
+	req := adapter.Request{
+		Method: "read",
+		Data: adapter.ReadRequest{
+			Collection: repo.Collection,
+			Select: map[string]interface{}{
+				"role_internal_id": map[string]interface{}{
+					"$in": roleInternalIDs,
+				},
+				"deny": true,
+			},
+		},
+	}
+
+	res, err := repo.Storage.Send(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token permissions: %v", err)
+	}
+
+	var tokenPermissions []entities.TokenPermission
+	itemBytes, err := json.Marshal(res.Result)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(itemBytes, &tokenPermissions)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []string
+	seen := map[string]bool{}
+	for _, tokenPermission := range tokenPermissions {
+		if !seen[tokenPermission.Token] {
+			seen[tokenPermission.Token] = true
+			tokens = append(tokens, tokenPermission.Token)
+		}
+	}
+
+	return tokens, nil
+}
+
+func (repo TokenPermissionsRepository) RemoveTokenPermissionsByTokens(tokens []string) error {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: repo.Collection,
+			Select: map[string]interface{}{
+				"token": map[string]interface{}{
+					"$in": tokens,
+				},
+			},
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		return fmt.Errorf("failed to remove token permissions: %v", err)
+	}
+
+	return nil
+}
+
+func (repo TokenPermissionsRepository) RemoveTokenPermissionsByUserID(userID string) error {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: repo.Collection,
+			Select: map[string]interface{}{
+				"user_id": userID,
+			},
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		return fmt.Errorf("failed to remove token permissions: %v", err)
+	}
+
+	return nil
+}
+
+func (repo TokenPermissionsRepository) RemoveTokenPermissionsBySessionID(sessionID string) error {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: repo.Collection,
+			Select: map[string]interface{}{
+				"session_id": sessionID,
+			},
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		return fmt.Errorf("failed to remove token permissions: %v", err)
+	}
+
+	return nil
+}
+
+func (repo TokenPermissionsRepository) RemoveTokenPermissionsByClientID(clientID string) error {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: repo.Collection,
+			Select: map[string]interface{}{
+				"client_id": clientID,
+			},
+		},
+	}
+
+	_, err := repo.Storage.Send(req)
+	if err != nil {
+		return fmt.Errorf("failed to remove token permissions: %v", err)
+	}
+
+	return nil
+}
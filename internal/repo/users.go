@@ -108,15 +108,19 @@ func (repo *UsersRepository) GetUserByID(id string) (*entities.User, error) {
 	return &users[0], nil
 }
 
-func (repo *UsersRepository) GetUserByLoginAndPassword(login, hashedPassword string) (*entities.User, error) {
+// GetUsersByLogin finds the users whose email or phone is the login. One
+// user's email can be another's phone, so all of them are returned. The
+// password is verified by the caller, since salted hashes cannot be matched
+// inside the query.
+func (repo *UsersRepository) GetUsersByLogin(login string) ([]entities.User, error) {
 	req := adapter.Request{
 		Method: "read",
 		Data: adapter.ReadRequest{
 			Collection: repo.Collection,
 			Select: map[string]interface{}{
 				"$or": []map[string]string{
-					{"email": login, "___password": hashedPassword},
-					{"phone": login, "___password": hashedPassword},
+					{"email": login},
+					{"phone": login},
 				},
 			},
 		},
@@ -137,7 +141,7 @@ func (repo *UsersRepository) GetUserByLoginAndPassword(login, hashedPassword str
 		return nil, err
 	}
 
-	return &users[0], nil
+	return users, nil
 }
 
 func (repo *UsersRepository) GetUserByPhone(phone string) (*entities.User, error) {
@@ -169,6 +173,71 @@ func (repo *UsersRepository) GetUserByPhone(phone string) (*entities.User, error
 	return &users[0], nil
 }
 
+func (repo *UsersRepository) GetUserByEmail(email string) (*entities.User, error) {
+	req := adapter.Request{
+		Method: "read",
+		Data: adapter.ReadRequest{
+			Collection: repo.Collection,
+			Select: map[string]interface{}{
+				"email": email,
+			},
+		},
+	}
+
+	res, err := repo.Storage.Send(req)
+	if err != nil || len(res.Result) == 0 {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	var users []entities.User
+	rByres, err := json.Marshal(res.Result)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(rByres, &users)
+	if err != nil {
+		return nil, err
+	}
+
+	return &users[0], nil
+}
+
+// GetUserByIdentity returns the user linked to the account of the identity
+// provider.
+func (repo *UsersRepository) GetUserByIdentity(provider, subject string) (*entities.User, error) {
+	req := adapter.Request{
+		Method: "read",
+		Data: adapter.ReadRequest{
+			Collection: repo.Collection,
+			Select: map[string]interface{}{
+				"___identities": map[string]interface{}{
+					"$elemMatch": map[string]interface{}{
+						"provider": provider,
+						"subject":  subject,
+					},
+				},
+			},
+		},
+	}
+
+	res, err := repo.Storage.Send(req)
+	if err != nil || len(res.Result) == 0 {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	var users []entities.User
+	rByres, err := json.Marshal(res.Result)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(rByres, &users)
+	if err != nil {
+		return nil, err
+	}
+
+	return &users[0], nil
+}
+
 func (repo *UsersRepository) GetUserByPhoneOrEmail(phone, email string) (*entities.User, error) {
 	req := adapter.Request{
 		Method: "read",
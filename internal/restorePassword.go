@@ -67,7 +67,15 @@ func (is *InternalService) restorePasswordHandler(data interface{}, meta interfa
 		), http.StatusBadRequest, err
 	}
 
-	user.HashedPassword = is.hashAndSaltPassword(request.Password)
+	user.HashedPassword, err = is.hashPassword(request.Password)
+	if err != nil {
+		log.Println("Cannot hash password, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, nil
+	}
 
 	err = is.UsersRepository.UpdateUser(user)
 	if err != nil {
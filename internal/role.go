@@ -36,6 +36,40 @@ func (is *InternalService) createRoleHandler(data interface{}, meta interface{})
 		return nil, http.StatusInternalServerError, err
 	}
 
+	errText := validatePermissionsParams(role.Permissions)
+	if errText == "" {
+		errText = validatePermissionsParams(role.DenyPermissions)
+	}
+	if errText != "" {
+		return NewErrorResponse(
+			"InvalidParamsError",
+			"PRE_01",
+			errText,
+		), http.StatusBadRequest, nil
+	}
+
+	if len(role.Parents) > 0 {
+		errText, err := is.validateRoleParents(role.InternalID, role.Parents)
+		if err != nil {
+			log.Println("Cannot validate parent roles, err:", err)
+			return NewErrorResponse(
+				"ServerError",
+				"SVE_06",
+				"Internal server error",
+			), http.StatusInternalServerError, err
+		}
+		if errText != "" {
+			return NewErrorResponse(
+				"RoleParentsError",
+				"RLE_01",
+				errText,
+			), http.StatusBadRequest, nil
+		}
+	}
+
+	// Permission names are stored in lower case
+	role = role.Canonical()
+
 	req := adapter.Request{
 		Method: "create",
 		Data: adapter.CreateRequest{
@@ -80,6 +114,78 @@ func (is *InternalService) updateRolesHandler(data interface{}, meta interface{}
 		), http.StatusBadRequest, nil
 	}
 
+	for _, field := range []string{"permissions", "deny_permissions"} {
+		permissionsData, ok := updateData[field]
+		if !ok {
+			continue
+		}
+
+		var permissions []entities.Permission
+		jsonData, err := json.Marshal(permissionsData)
+		if err == nil {
+			err = json.Unmarshal(jsonData, &permissions)
+		}
+		if err != nil {
+			return NewErrorResponse(
+				"InvalidDataFormatError",
+				"DFE_01",
+				"Invalid data format",
+			), http.StatusBadRequest, nil
+		}
+
+		if errText := validatePermissionsParams(permissions); errText != "" {
+			return NewErrorResponse(
+				"InvalidParamsError",
+				"PRE_01",
+				errText,
+			), http.StatusBadRequest, nil
+		}
+
+		for i, permission := range permissions {
+			permissions[i] = permission.Canonical()
+		}
+		updateData[field] = permissions
+	}
+
+	if parentsData, ok := updateData["parents"]; ok {
+		var parents []string
+		jsonData, err := json.Marshal(parentsData)
+		if err == nil {
+			err = json.Unmarshal(jsonData, &parents)
+		}
+		if err != nil {
+			return NewErrorResponse(
+				"InvalidDataFormatError",
+				"DFE_01",
+				"Invalid data format",
+			), http.StatusBadRequest, nil
+		}
+
+		roles, err := is.findRoles(selectData)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		for _, role := range roles {
+			errText, err := is.validateRoleParents(role.InternalID, parents)
+			if err != nil {
+				log.Println("Cannot validate parent roles, err:", err)
+				return NewErrorResponse(
+					"ServerError",
+					"SVE_06",
+					"Internal server error",
+				), http.StatusInternalServerError, err
+			}
+			if errText != "" {
+				return NewErrorResponse(
+					"RoleParentsError",
+					"RLE_01",
+					errText,
+				), http.StatusBadRequest, nil
+			}
+		}
+	}
+
 	updateReq := adapter.Request{
 		Method: "update",
 		Data: adapter.UpdateRequest{
@@ -89,38 +195,19 @@ func (is *InternalService) updateRolesHandler(data interface{}, meta interface{}
 		},
 	}
 
-	getReq := adapter.Request{
-		Method: "read",
-		Data: adapter.ReadRequest{
-			Collection: "roles",
-			Select:     selectData,
-		},
-	}
-
 	_, err := is.Storage.Send(updateReq)
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
 	}
 
-	rolesData, err := is.Storage.Send(getReq)
-	if err != nil {
-		return nil, http.StatusInternalServerError, err
-	}
-
-	var roles []entities.Role
-	jsonData, err := json.Marshal(rolesData.Result)
-	if err != nil {
-		return nil, http.StatusInternalServerError, err
-	}
-	err = json.Unmarshal(jsonData, &roles)
+	roles, err := is.findRoles(selectData)
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
 	}
 
 	for _, role := range roles {
-		// remove related tokens
-
-		err = is.TokenPermissionsRepository.RemoveTokenPermissionsByRoleInternalID(role.InternalID)
+		// remove related tokens, including those of the inheriting roles
+		err = is.removeRoleTokens(role.InternalID)
 
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
@@ -147,14 +234,6 @@ func (is *InternalService) deleteRolesHandler(data interface{}, meta interface{}
 		), http.StatusBadRequest, nil
 	}
 
-	getReq := adapter.Request{
-		Method: "read",
-		Data: adapter.ReadRequest{
-			Collection: "roles",
-			Select:     dataMap,
-		},
-	}
-
 	req := adapter.Request{
 		Method: "delete",
 		Data: adapter.DeleteRequest{
@@ -163,32 +242,22 @@ func (is *InternalService) deleteRolesHandler(data interface{}, meta interface{}
 		},
 	}
 
-	rolesData, err := is.Storage.Send(getReq)
+	roles, err := is.findRoles(dataMap)
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
 	}
 
-	if len(rolesData.Result) == 0 {
+	if len(roles) == 0 {
 		return nil, http.StatusInternalServerError, errors.New("no roles to delete by the request")
 	}
 
-	var roles []entities.Role
-	jsonData, err := json.Marshal(rolesData.Result)
-	if err != nil {
-		return nil, http.StatusInternalServerError, err
-	}
-	err = json.Unmarshal(jsonData, &roles)
-	if err != nil {
-		return nil, http.StatusInternalServerError, err
-	}
-
 	_, err = is.Storage.Send(req)
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
 	}
 
 	for _, role := range roles {
-		err = is.TokenPermissionsRepository.RemoveTokenPermissionsByRoleInternalID(role.InternalID)
+		err = is.removeRoleTokens(role.InternalID)
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
 		}
@@ -203,45 +272,36 @@ func (is *InternalService) deleteRolesHandler(data interface{}, meta interface{}
 	return NewOkResponse("Role deleted successfully")
 }
 
-func (is *InternalService) attachRole(userID string, roleID string) error {
-	// Fetch the user
-	user, err := is.UsersRepository.GetUserByID(userID)
+func (is *InternalService) getRole(roleID string) (*entities.Role, error) {
+	roles, err := is.findRoles(map[string]interface{}{
+		"internal_id": roleID,
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	getReq := adapter.Request{
-		Method: "read",
-		Data: adapter.ReadRequest{
-			Collection: "roles",
-			Select: map[string]interface{}{
-				"internal_id": roleID,
-			},
-		},
+	if len(roles) == 0 {
+		return nil, errors.New("role not found")
 	}
 
-	// Fetch the role
-	rolesData, err := is.Storage.Send(getReq)
-	if err != nil {
-		return err
-	}
-
-	if len(rolesData.Result) == 0 {
-		return errors.New("role not found")
-	}
+	return &roles[0], nil
+}
 
-	var roles []entities.Role
-	jsonData, err := json.Marshal(rolesData.Result)
+func (is *InternalService) attachRole(userID string, roleID string) error {
+	// Fetch the user
+	user, err := is.UsersRepository.GetUserByID(userID)
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(jsonData, &roles)
+
+	// Fetch the role
+	role, err := is.getRole(roleID)
 	if err != nil {
 		return err
 	}
 
 	// Attach the role to the user
-	user.AddRole(roles[0])
+	user.AddRole(*role)
 
 	// Update the user
 	err = is.UsersRepository.UpdateUser(user)
@@ -249,7 +309,8 @@ func (is *InternalService) attachRole(userID string, roleID string) error {
 		return err
 	}
 
-	return nil
+	// Issued tokens hold the permissions of the previous roles
+	return is.removeUserAccessTokens(userID)
 }
 
 func (is *InternalService) detachRole(userID string, roleID string) error {
@@ -268,7 +329,8 @@ func (is *InternalService) detachRole(userID string, roleID string) error {
 		return err
 	}
 
-	return nil
+	// Issued tokens hold the permissions of the previous roles
+	return is.removeUserAccessTokens(userID)
 }
 
 func (is *InternalService) updateRoleInUsers(role *entities.Role) error {
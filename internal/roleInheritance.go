@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+	"github.com/saiset-co/sai-storage-mongo/external/adapter"
+)
+
+func (is *InternalService) findRoles(selectData map[string]interface{}) ([]entities.Role, error) {
+	req := adapter.Request{
+		Method: "read",
+		Data: adapter.ReadRequest{
+			Collection: "roles",
+			Select:     selectData,
+		},
+	}
+
+	rolesData, err := is.Storage.Send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var roles []entities.Role
+	jsonData, err := json.Marshal(rolesData.Result)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(jsonData, &roles)
+	if err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// validateRoleParents checks that the parents exist and that none of them
+// inherits from the role, which would form a cycle. It returns the error
+// text or an empty string.
+func (is *InternalService) validateRoleParents(roleID string, parents []string) (string, error) {
+	visited := map[string]bool{}
+	ids := parents
+	for level := 0; len(ids) > 0; level++ {
+		var next []string
+		for _, id := range ids {
+			if id == "" {
+				return "Invalid parent role id", nil
+			}
+			if id == roleID {
+				return "Parent roles form a cycle with role: " + roleID, nil
+			}
+		}
+
+		roles, err := is.findRoles(map[string]interface{}{
+			"internal_id": map[string]interface{}{"$in": ids},
+		})
+		if err != nil {
+			return "", err
+		}
+
+		if level == 0 {
+			for _, id := range ids {
+				if !containsRole(roles, id) {
+					return "Unknown parent role: " + id, nil
+				}
+			}
+		}
+
+		for _, role := range roles {
+			visited[role.InternalID] = true
+			for _, parent := range role.Parents {
+				if !visited[parent] && !containsString(next, parent) {
+					next = append(next, parent)
+				}
+			}
+		}
+		ids = next
+	}
+
+	return "", nil
+}
+
+// expandRoles returns the roles with the permissions and deny permissions of
+// all their ancestors added to their own. The parents of all roles are read
+// level by level, one query per level. Missing parents are skipped, and
+// cycles left in the storage are only walked once.
+func (is *InternalService) expandRoles(roles []entities.Role) ([]entities.Role, error) {
+	expanded := make([]entities.Role, len(roles))
+	visited := make([]map[string]bool, len(roles))
+	ids := make([][]string, len(roles))
+	for i, role := range roles {
+		role.Permissions = append([]entities.Permission{}, role.Permissions...)
+		role.DenyPermissions = append([]entities.Permission{}, role.DenyPermissions...)
+		expanded[i] = role
+		visited[i] = map[string]bool{role.InternalID: true}
+		ids[i] = role.Parents
+	}
+
+	// parents holds the roles read so far, nil for missing ones
+	parents := map[string]*entities.Role{}
+	for {
+		var pending []string
+		for i := range expanded {
+			var unvisited []string
+			for _, id := range ids[i] {
+				if !visited[i][id] {
+					visited[i][id] = true
+					unvisited = append(unvisited, id)
+				}
+			}
+			ids[i] = unvisited
+
+			for _, id := range unvisited {
+				if _, ok := parents[id]; !ok && !containsString(pending, id) {
+					pending = append(pending, id)
+				}
+			}
+		}
+
+		if len(pending) > 0 {
+			found, err := is.findRoles(map[string]interface{}{
+				"internal_id": map[string]interface{}{"$in": pending},
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			for _, id := range pending {
+				parents[id] = nil
+			}
+			for i := range found {
+				parents[found[i].InternalID] = &found[i]
+			}
+			for _, id := range pending {
+				if parents[id] == nil {
+					log.Println("Missing parent role", id)
+				}
+			}
+		}
+
+		done := true
+		for i := range expanded {
+			var next []string
+			for _, id := range ids[i] {
+				parent := parents[id]
+				if parent == nil {
+					continue
+				}
+				expanded[i].Permissions = append(expanded[i].Permissions, parent.Permissions...)
+				expanded[i].DenyPermissions = append(expanded[i].DenyPermissions, parent.DenyPermissions...)
+				next = append(next, parent.Parents...)
+			}
+			ids[i] = next
+			if len(next) > 0 {
+				done = false
+			}
+		}
+		if done {
+			return expanded, nil
+		}
+	}
+}
+
+// userRoles returns the roles of the user and the default role with their
+// inherited permissions.
+func (is *InternalService) userRoles(user *entities.User) ([]entities.Role, error) {
+	return is.expandRoles(append(append([]entities.Role{}, user.Roles...), is.DefaultRole))
+}
+
+// descendantRoleIDs returns the ids of the roles inheriting from the role,
+// directly or through other roles.
+func (is *InternalService) descendantRoleIDs(roleID string) ([]string, error) {
+	var descendants []string
+	visited := map[string]bool{roleID: true}
+	ids := []string{roleID}
+	for len(ids) > 0 {
+		children, err := is.findRoles(map[string]interface{}{
+			"parents": map[string]interface{}{"$in": ids},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		ids = nil
+		for _, child := range children {
+			if !visited[child.InternalID] {
+				visited[child.InternalID] = true
+				descendants = append(descendants, child.InternalID)
+				ids = append(ids, child.InternalID)
+			}
+		}
+	}
+
+	return descendants, nil
+}
+
+// removeRoleTokens removes the tokens issued for the role and for the roles
+// inheriting from it, since they all hold its permissions. Tokens holding
+// their deny permissions are removed whole, as dropping only the deny rows
+// would widen the other roles of the token.
+func (is *InternalService) removeRoleTokens(roleID string) error {
+	descendants, err := is.descendantRoleIDs(roleID)
+	if err != nil {
+		return err
+	}
+	roleIDs := append([]string{roleID}, descendants...)
+
+	denyTokens, err := is.TokenPermissionsRepository.FindDenyTokens(roleIDs)
+	if err != nil {
+		return err
+	}
+	if len(denyTokens) > 0 {
+		err = is.TokenPermissionsRepository.RemoveTokenPermissionsByTokens(denyTokens)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, id := range roleIDs {
+		err = is.TokenPermissionsRepository.RemoveTokenPermissionsByRoleInternalID(id)
+		if err != nil {
+			return err
+		}
+	}
+	// The tokens holding deny rows have rows of these roles as well
+	is.PermissionCache.Invalidate("role_internal_id", roleIDs...)
+
+	return nil
+}
+
+func containsRole(roles []entities.Role, roleID string) bool {
+	for _, role := range roles {
+		if role.InternalID == roleID {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+func permissionMethods(permissions []entities.Permission) []string {
+	var methods []string
+	for _, permission := range permissions {
+		methods = append(methods, permission.Method)
+	}
+
+	return methods
+}
+
+func TestUserRolesExpandsParentsPerLevel(t *testing.T) {
+	is, storage := newTestService(t)
+	storage.insert("roles",
+		entities.Role{InternalID: "base", Type: "base", Permissions: []entities.Permission{{Microservice: "crud", Method: "base"}}},
+		entities.Role{InternalID: "reader", Type: "reader", Parents: []string{"base"}, Permissions: []entities.Permission{{Microservice: "crud", Method: "reader"}}},
+		entities.Role{
+			InternalID:      "auditor",
+			Type:            "auditor",
+			Parents:         []string{"base", "missing"},
+			Permissions:     []entities.Permission{{Microservice: "crud", Method: "auditor"}},
+			DenyPermissions: []entities.Permission{{Microservice: "crud", Method: "delete"}},
+		},
+		// A cycle left in the storage
+		entities.Role{InternalID: "loop-a", Type: "loop-a", Parents: []string{"loop-b"}, Permissions: []entities.Permission{{Microservice: "crud", Method: "loop-a"}}},
+		entities.Role{InternalID: "loop-b", Type: "loop-b", Parents: []string{"loop-a"}, Permissions: []entities.Permission{{Microservice: "crud", Method: "loop-b"}}},
+	)
+
+	user := &entities.User{
+		InternalId: "user",
+		Roles: []entities.Role{
+			{InternalID: "editor", Type: "editor", Parents: []string{"reader"}, Permissions: []entities.Permission{{Microservice: "crud", Method: "editor"}}},
+			{InternalID: "manager", Type: "manager", Parents: []string{"auditor", "reader"}},
+			{InternalID: "loop-a", Type: "loop-a", Parents: []string{"loop-b"}, Permissions: []entities.Permission{{Microservice: "crud", Method: "loop-a"}}},
+		},
+	}
+
+	storage.resetRequestCounts()
+	roles, err := is.userRoles(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reader, auditor and loop-b are read at once, then base and missing;
+	// loop-a was visited already
+	if count := storage.requestCount("read", "roles"); count != 2 {
+		t.Errorf("expected one read per level of parents, got %d", count)
+	}
+
+	expected := map[string][]string{
+		"editor":  {"editor", "reader", "base"},
+		"manager": {"auditor", "reader", "base"},
+		"loop-a":  {"loop-a", "loop-b"},
+		"default": {"read", "update"},
+	}
+	if len(roles) != len(expected) {
+		t.Fatalf("expected %d roles, got %d", len(expected), len(roles))
+	}
+	for _, role := range roles {
+		methods := permissionMethods(role.Permissions)
+		if !sameStrings(methods, expected[role.Type]) || len(methods) != len(expected[role.Type]) {
+			t.Errorf("expected %s to hold %v, got %v", role.Type, expected[role.Type], methods)
+		}
+	}
+
+	if denies := permissionMethods(roles[1].DenyPermissions); len(denies) != 1 || denies[0] != "delete" {
+		t.Errorf("expected the inherited deny permission, got %v", denies)
+	}
+	if len(roles[0].DenyPermissions) != 0 {
+		t.Errorf("expected no deny permissions for editor, got %v", roles[0].DenyPermissions)
+	}
+	if len(user.Roles[0].Permissions) != 1 {
+		t.Errorf("expected the roles of the user unchanged, got %v", user.Roles[0].Permissions)
+	}
+}
+
+func TestUserRolesWithoutParents(t *testing.T) {
+	is, storage := newTestService(t)
+	user := &entities.User{InternalId: "user", Roles: []entities.Role{{InternalID: "plain", Type: "plain"}}}
+
+	roles, err := is.userRoles(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 2 || storage.requestCount("read", "roles") != 0 {
+		t.Errorf("expected the roles without reading parents, got %+v", roles)
+	}
+}
@@ -16,6 +16,7 @@ type OTPCode struct {
 	ExpiredAt time.Time `json:"expired_at"`
 	Phone     string    `json:"phone"`
 	Email     string    `json:"email"`
+	Purpose   string    `json:"purpose,omitempty"`
 }
 
 type SMSData struct {
@@ -211,7 +212,7 @@ func (is *InternalService) sendResetPasswordVerifyCodeHandler(data interface{},
 				), http.StatusInternalServerError, err
 			}
 		} else {
-			err = is.sendEmail(request.Email, "Code: "+code)
+			err = is.sendEmail(request.Email, "Reset Password", "Code: "+code)
 			if err != nil {
 				log.Printf("Error sending Email: %v", err)
 				return NewErrorResponse(
@@ -253,7 +254,7 @@ func (is *InternalService) sendSMS(phone, message, template string, variables ma
 	return err
 }
 
-func (is *InternalService) sendEmail(email, message string) error {
+func (is *InternalService) sendEmail(email, subject, message string) error {
 	if !is.EmailEnabled {
 		return nil
 	}
@@ -264,7 +265,7 @@ func (is *InternalService) sendEmail(email, message string) error {
 			Sender:    is.EmailSender,
 			Recipient: email,
 			Body:      message,
-			Subject:   "Reset Password",
+			Subject:   subject,
 		},
 	}
 
@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"net"
+
 	"github.com/Limpid-LLC/go-auth/internal/entities"
 	"github.com/Limpid-LLC/go-auth/internal/repo"
 	"github.com/saiset-co/sai-storage-mongo/external/adapter"
@@ -15,6 +17,13 @@ type InternalService struct {
 
 	UsersRepository            *repo.UsersRepository
 	TokenPermissionsRepository *repo.TokenPermissionsRepository
+	SessionsRepository         *repo.SessionsRepository
+	OAuthClientsRepository     *repo.OAuthClientsRepository
+	APIKeysRepository          *repo.APIKeysRepository
+	ServiceTokensRepository    *repo.ServiceTokensRepository
+
+	// PermissionCache caches the permissions read by check, nil disables it
+	PermissionCache *PermissionCache
 
 	Collection  string
 	DefaultRole entities.Role
@@ -30,16 +39,37 @@ type InternalService struct {
 	EmailServiceUrl string
 	EmailSender     string
 
-	Salt string
+	Salt              string
+	Pepper            string
+	PasswordAlgorithm string
 
 	TokenExpirations entities.TokenExpirations
-	MasterToken      string
+	// LegacyPerRoleTokens issues a token per role on sign in, as before
+	// single tokens, for clients that still pick a token by role
+	LegacyPerRoleTokens bool
+	// ServiceTokens are the service tokens defined in the config
+	ServiceTokens []entities.ServiceToken
 
 	RoutineExecutionPeriods entities.RoutineExecutionPeriods
 
+	TOTPIssuer string
+
+	JWTEnabled  bool
+	JWTIssuer   string
+	SigningKeys []SigningKey
+	// OIDCClaims maps ID token and userinfo claims to User.Data paths
+	OIDCClaims map[string]string
+
+	LinkBaseUrl string
+
+	IdentityProviders map[string]*IdentityProvider
+	Authenticators    []Authenticator
+
 	AuthUrl           string
 	AuthFloodLimit    int
 	AuthFloodDuration int
+	// TrustedProxies are the proxies whose X-Forwarded-For header is honoured
+	TrustedProxies []*net.IPNet
 
 	Name string
 }
@@ -48,5 +78,16 @@ func (is InternalService) Init() {
 	go startCleanupRoutine(is.Context.Context, is.RoutineExecutionPeriods.Otp, is.removeExpiredOtpCodes)
 	go startCleanupRoutine(is.Context.Context, is.RoutineExecutionPeriods.RefreshToken, is.removeExpiredRefreshTokens)
 	go startCleanupRoutine(is.Context.Context, is.RoutineExecutionPeriods.AccessToken, is.TokenPermissionsRepository.RemoveExpiredTokens)
+	go startCleanupRoutine(is.Context.Context, is.RoutineExecutionPeriods.RefreshToken, is.SessionsRepository.RemoveExpiredSessions)
+	go startCleanupRoutine(is.Context.Context, is.RoutineExecutionPeriods.RefreshToken, is.removeExpiredRedemptions)
+	go startCleanupRoutine(is.Context.Context, is.RoutineExecutionPeriods.Otp, is.removeExpiredMFAChallenges)
+	go startCleanupRoutine(is.Context.Context, is.RoutineExecutionPeriods.Otp, is.removeExpiredLinkTokens)
+	go startCleanupRoutine(is.Context.Context, is.RoutineExecutionPeriods.Otp, is.removeExpiredOAuthCodes)
+	go startCleanupRoutine(is.Context.Context, is.RoutineExecutionPeriods.Otp, is.removeExpiredProviderStates)
+	go startCleanupRoutine(is.Context.Context, is.RoutineExecutionPeriods.Otp, is.ServiceTokensRepository.RemoveExpiredServiceTokens)
+	if is.PermissionCache != nil {
+		go startCleanupRoutine(is.Context.Context, is.PermissionCache.SyncPeriod, is.PermissionCache.Sync)
+		go startCleanupRoutine(is.Context.Context, is.RoutineExecutionPeriods.AccessToken, is.PermissionCache.RemoveOldInvalidations)
+	}
 	go is.FloodClear()
 }
@@ -0,0 +1,396 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+const (
+	// serviceTokenPrefix marks tokens issued through create_service_token,
+	// only those are looked up in the storage
+	serviceTokenPrefix = "sst_"
+	// defaultServiceTokenOverlap is how long the old token stays valid after
+	// a rotation
+	defaultServiceTokenOverlap = time.Hour
+)
+
+// NewServiceTokens reads a service token entry of the config. An entry
+// holds one or more token values, e.g. the current and the previous one
+// during a rollover; each of them is registered with the same name and
+// permissions.
+func NewServiceTokens(config map[string]interface{}) ([]entities.ServiceToken, error) {
+	serviceToken := entities.ServiceToken{}
+	serviceToken.Name, _ = config["name"].(string)
+
+	permissions, _ := config["permissions"].([]interface{})
+	for _, permission := range permissions {
+		if value, ok := permission.(string); ok {
+			serviceToken.Permissions = append(serviceToken.Permissions, value)
+		}
+	}
+
+	allowedIPs, _ := config["allowed_ips"].([]interface{})
+	for _, allowedIP := range allowedIPs {
+		if value, ok := allowedIP.(string); ok {
+			serviceToken.AllowedIPs = append(serviceToken.AllowedIPs, value)
+		}
+	}
+
+	switch expiredAt := config["expired_at"].(type) {
+	case int:
+		serviceToken.ExpiredAt = int64(expiredAt)
+	case string:
+		parsed, err := time.Parse(time.RFC3339, expiredAt)
+		if err != nil {
+			return nil, fmt.Errorf("service token %s has an invalid expired_at: %v", serviceToken.Name, err)
+		}
+		serviceToken.ExpiredAt = parsed.Unix()
+	}
+
+	var values []string
+	if value, ok := config["token"].(string); ok && value != "" {
+		values = append(values, value)
+	}
+	tokens, _ := config["tokens"].([]interface{})
+	for _, token := range tokens {
+		if value, ok := token.(string); ok && value != "" {
+			values = append(values, value)
+		}
+	}
+
+	if serviceToken.Name == "" || len(values) == 0 {
+		return nil, errors.New("service token needs name and token")
+	}
+
+	if errText := validateServiceToken(&serviceToken); errText != "" {
+		return nil, fmt.Errorf("service token %s: %s", serviceToken.Name, errText)
+	}
+
+	serviceTokens := make([]entities.ServiceToken, 0, len(values))
+	for i, value := range values {
+		item := serviceToken
+		item.ID = fmt.Sprintf("config:%s:%d", serviceToken.Name, i)
+		item.TokenHash = hashToken(value)
+		serviceTokens = append(serviceTokens, item)
+	}
+
+	return serviceTokens, nil
+}
+
+// validateServiceToken checks the permission patterns and the allowed
+// addresses. It returns the error text or an empty string.
+func validateServiceToken(serviceToken *entities.ServiceToken) string {
+	for _, permission := range serviceToken.Permissions {
+		parts := strings.SplitN(permission, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return "Invalid permission: " + permission
+		}
+	}
+
+	for _, allowedIP := range serviceToken.AllowedIPs {
+		if net.ParseIP(allowedIP) == nil {
+			if _, _, err := net.ParseCIDR(allowedIP); err != nil {
+				return "Invalid allowed ip: " + allowedIP
+			}
+		}
+	}
+
+	return ""
+}
+
+// findServiceToken returns the service token with the given value, or nil
+// when the value is not a service token.
+func (is InternalService) findServiceToken(token string) (*entities.ServiceToken, error) {
+	tokenHash := hashToken(token)
+
+	for i := range is.ServiceTokens {
+		if subtle.ConstantTimeCompare([]byte(is.ServiceTokens[i].TokenHash), []byte(tokenHash)) == 1 {
+			return &is.ServiceTokens[i], nil
+		}
+	}
+
+	if !strings.HasPrefix(token, serviceTokenPrefix) {
+		return nil, nil
+	}
+
+	serviceTokens, err := is.ServiceTokensRepository.GetServiceTokens(map[string]interface{}{
+		"___token": tokenHash,
+	})
+	if err != nil || len(serviceTokens) == 0 {
+		return nil, err
+	}
+
+	return &serviceTokens[0], nil
+}
+
+// serviceTokenAllows reports whether the service token may call the method
+// from the given address.
+func serviceTokenAllows(serviceToken *entities.ServiceToken, request Request, ip string) bool {
+	if serviceToken.Expired(time.Now().Unix()) {
+		return false
+	}
+
+	if len(serviceToken.AllowedIPs) > 0 && !ipAllowed(serviceToken.AllowedIPs, ip) {
+		return false
+	}
+
+	for _, permission := range serviceToken.Permissions {
+		if permissionPatternMatches(permission, request.Microservice, request.Method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// permissionPatternMatches matches "microservice:method" patterns, where
+// * in either part stands for any characters.
+func permissionPatternMatches(pattern string, microservice string, method string) bool {
+	parts := strings.SplitN(pattern, ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	return entities.MatchPattern(parts[0], microservice) && entities.MatchPattern(parts[1], method)
+}
+
+func ipAllowed(allowedIPs []string, ip string) bool {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+
+	for _, allowedIP := range allowedIPs {
+		if _, network, err := net.ParseCIDR(allowedIP); err == nil {
+			if network.Contains(parsedIP) {
+				return true
+			}
+			continue
+		}
+
+		if parsedIP.Equal(net.ParseIP(allowedIP)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// methodCallIP is the address allowed_ips are checked against on service
+// method calls. saiService takes metadata.ip of a call from the X-Real-IP and
+// X-Forwarded-For headers as the client sent them, and websocket clients set
+// it themselves, so the address of the connection is unknown. Tokens with
+// allowed_ips are therefore only accepted by the HTTP endpoints, which see
+// the connection through requestIP.
+const methodCallIP = ""
+
+// issueServiceToken stores a new token with the settings of serviceToken and
+// returns the token value, which is not stored and cannot be shown again.
+func (is *InternalService) issueServiceToken(serviceToken *entities.ServiceToken) (string, error) {
+	var err error
+	serviceToken.ID, err = generateRandomToken(16)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate service token id: %v", err)
+	}
+
+	secret, err := generateRandomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate service token: %v", err)
+	}
+	token := serviceTokenPrefix + secret
+
+	serviceToken.Prefix = token[:len(serviceTokenPrefix)+8]
+	serviceToken.TokenHash = hashToken(token)
+	serviceToken.CreatedAt = time.Now().Unix()
+
+	err = is.ServiceTokensRepository.CreateServiceToken(serviceToken)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (is *InternalService) createServiceTokenHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Marshal" + err.Error())
+	}
+
+	var serviceToken entities.ServiceToken
+	err = json.Unmarshal(jsonData, &serviceToken)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Unmarshal" + err.Error())
+	}
+
+	errs := is.Validate.Struct(serviceToken)
+	if errs != nil {
+		log.Printf("Validation errors: %v", errs)
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"VLE_03",
+			"Validation error.",
+		), http.StatusBadRequest, errs
+	}
+
+	if errText := validateServiceToken(&serviceToken); errText != "" {
+		return NewErrorResponse(
+			"ServiceTokenError",
+			"STE_01",
+			errText,
+		), http.StatusBadRequest, nil
+	}
+
+	if serviceToken.ExpiredAt != 0 && serviceToken.ExpiredAt <= time.Now().Unix() {
+		return NewErrorResponse(
+			"ServiceTokenError",
+			"STE_01",
+			"expired_at must be in the future",
+		), http.StatusBadRequest, nil
+	}
+
+	token, err := is.issueServiceToken(&serviceToken)
+	if err != nil {
+		log.Println("Cannot create service token, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse(map[string]interface{}{
+		"service_token": serviceToken.Redacted(),
+		"token":         token,
+	})
+}
+
+func (is *InternalService) getServiceTokensHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	selectData, ok := data.(map[string]interface{})
+	if !ok {
+		log.Println("Invalid data format in getServiceTokensHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	serviceTokens, err := is.ServiceTokensRepository.GetServiceTokens(selectData)
+	if err != nil {
+		log.Println("Cannot get service tokens, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	for i := range serviceTokens {
+		serviceTokens[i] = serviceTokens[i].Redacted()
+	}
+
+	return NewOkResponse(serviceTokens)
+}
+
+// rotateServiceTokenHandler issues a new token with the settings of an
+// existing one. The old token keeps working for overlap seconds, so the
+// service can be switched over without downtime.
+func (is *InternalService) rotateServiceTokenHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		log.Println("Invalid data format in rotateServiceTokenHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	serviceTokenID, _ := dataMap["service_token_id"].(string)
+
+	overlap := defaultServiceTokenOverlap
+	if value, ok := dataMap["overlap"].(float64); ok && value >= 0 {
+		overlap = time.Duration(value) * time.Second
+	}
+
+	oldToken, err := is.ServiceTokensRepository.GetServiceTokenByID(serviceTokenID)
+	if err != nil || oldToken.Expired(time.Now().Unix()) {
+		return NewErrorResponse(
+			"ServiceTokenNotFoundError",
+			"STE_02",
+			"Service token not found",
+		), http.StatusNotFound, nil
+	}
+
+	newToken := *oldToken
+	token, err := is.issueServiceToken(&newToken)
+	if err != nil {
+		log.Println("Cannot create service token, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	// The old token never outlives its own expiry
+	expiredAt := time.Now().Add(overlap).Unix()
+	if oldToken.ExpiredAt == 0 || expiredAt < oldToken.ExpiredAt {
+		err = is.ServiceTokensRepository.SetExpiredAt(oldToken.ID, expiredAt)
+		if err != nil {
+			log.Println("Cannot expire service token, err:", err)
+			return NewErrorResponse(
+				"ServerError",
+				"SVE_06",
+				"Internal server error",
+			), http.StatusInternalServerError, err
+		}
+	}
+
+	return NewOkResponse(map[string]interface{}{
+		"service_token": newToken.Redacted(),
+		"token":         token,
+	})
+}
+
+func (is *InternalService) deleteServiceTokensHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	selectData, ok := data.(map[string]interface{})
+	if !ok || len(selectData) < 1 {
+		log.Println("Invalid data format in deleteServiceTokensHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	err := is.ServiceTokensRepository.RemoveServiceTokens(selectData)
+	if err != nil {
+		log.Println("Cannot remove service tokens, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse("Service tokens removed successfully")
+}
@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+func TestNewServiceTokens(t *testing.T) {
+	tests := []struct {
+		name           string
+		config         map[string]interface{}
+		expectedTokens int
+		valid          bool
+	}{
+		{"single token", map[string]interface{}{"name": "billing", "token": "a", "permissions": []interface{}{"crud:read"}}, 1, true},
+		{"rollover", map[string]interface{}{"name": "billing", "tokens": []interface{}{"a", "b"}, "permissions": []interface{}{"crud:*"}}, 2, true},
+		{"expiry", map[string]interface{}{"name": "billing", "token": "a", "permissions": []interface{}{"crud:read"}, "expired_at": "2027-01-01T00:00:00Z"}, 1, true},
+		{"allowed ips", map[string]interface{}{"name": "billing", "token": "a", "permissions": []interface{}{"crud:read"}, "allowed_ips": []interface{}{"10.0.0.0/8", "192.168.1.1"}}, 1, true},
+		{"missing name", map[string]interface{}{"token": "a", "permissions": []interface{}{"crud:read"}}, 0, false},
+		{"missing token", map[string]interface{}{"name": "billing", "permissions": []interface{}{"crud:read"}}, 0, false},
+		{"invalid permission", map[string]interface{}{"name": "billing", "token": "a", "permissions": []interface{}{"crud"}}, 0, false},
+		{"invalid allowed ip", map[string]interface{}{"name": "billing", "token": "a", "permissions": []interface{}{"crud:read"}, "allowed_ips": []interface{}{"10.0.0.0/33"}}, 0, false},
+		{"invalid expiry", map[string]interface{}{"name": "billing", "token": "a", "permissions": []interface{}{"crud:read"}, "expired_at": "tomorrow"}, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serviceTokens, err := NewServiceTokens(test.config)
+			if (err == nil) != test.valid {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+			if len(serviceTokens) != test.expectedTokens {
+				t.Fatalf("expected %d tokens, got %+v", test.expectedTokens, serviceTokens)
+			}
+			for _, serviceToken := range serviceTokens {
+				if serviceToken.TokenHash == "" || serviceToken.TokenHash == "a" || serviceToken.TokenHash == "b" {
+					t.Errorf("expected only the hash of the token, got %q", serviceToken.TokenHash)
+				}
+			}
+		})
+	}
+}
+
+// newServiceTokenTestService configures the service tokens "billing",
+// "expired" and "allowlisted", the last limited to 10.0.0.0/8.
+func newServiceTokenTestService(t *testing.T) *InternalService {
+	is, _ := newTestService(t)
+
+	configs := []map[string]interface{}{
+		{"name": "billing", "tokens": []interface{}{"billing-old", "billing-new"}, "permissions": []interface{}{"crud:read", "notifications:*"}},
+		{"name": "expired", "token": "expired", "permissions": []interface{}{"*:*"}, "expired_at": "2020-01-01T00:00:00Z"},
+		{"name": "allowlisted", "token": "allowlisted", "permissions": []interface{}{"crud:read", "Auth:introspect"}, "allowed_ips": []interface{}{"10.0.0.0/8"}},
+	}
+	for _, config := range configs {
+		serviceTokens, err := NewServiceTokens(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		is.ServiceTokens = append(is.ServiceTokens, serviceTokens...)
+	}
+
+	return is
+}
+
+func TestCheckServiceToken(t *testing.T) {
+	is := newServiceTokenTestService(t)
+
+	tests := []struct {
+		name         string
+		token        string
+		microservice string
+		method       string
+		expected     bool
+	}{
+		{"permitted method", "billing-new", "crud", "read", true},
+		{"previous token during rollover", "billing-old", "crud", "read", true},
+		{"method pattern", "billing-new", "notifications", "send", true},
+		{"other method", "billing-new", "crud", "delete", false},
+		{"expired", "expired", "crud", "read", false},
+		{"unknown", "unknown", "crud", "read", false},
+		// The address of a method call is not known
+		{"allowed ips on a method call", "allowlisted", "crud", "read", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, _, err := is.checkHandler(
+				map[string]interface{}{
+					"microservice": test.microservice,
+					"method":       test.method,
+					"data":         map[string]interface{}{"token": test.token},
+					"metadata":     map[string]interface{}{"ip": "10.0.0.2"},
+				},
+				map[string]interface{}{"ip": "10.0.0.2"},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed := errorCode(response) == ""; allowed != test.expected {
+				t.Errorf("expected %v, got %+v", test.expected, response)
+			}
+		})
+	}
+}
+
+func TestServiceTokenAllowedIPsOnIntrospect(t *testing.T) {
+	is := newServiceTokenTestService(t)
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		expected     int
+	}{
+		{"allowed peer", "10.0.0.2:1234", "", http.StatusOK},
+		{"other peer", "203.0.113.5:1234", "", http.StatusUnauthorized},
+		{"forged forwarding header", "203.0.113.5:1234", "10.0.0.2", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/introspect", strings.NewReader(url.Values{"token": {"unknown"}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Authorization", "Bearer allowlisted")
+			r.RemoteAddr = test.remoteAddr
+			if test.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", test.forwardedFor)
+				r.Header.Set("X-Real-IP", test.forwardedFor)
+			}
+			w := httptest.NewRecorder()
+
+			is.introspectHTTPHandler(w, r)
+
+			if w.Code != test.expected {
+				t.Errorf("expected %d, got %d %s", test.expected, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRotateServiceToken(t *testing.T) {
+	is, _ := newTestService(t)
+
+	response, _, _ := is.createServiceTokenHandler(map[string]interface{}{
+		"name":        "billing",
+		"permissions": []interface{}{"crud:read"},
+	}, nil)
+	var created struct {
+		ServiceToken entities.ServiceToken `json:"service_token"`
+		Token        string                `json:"token"`
+	}
+	decodeResult(t, response, &created)
+	if !strings.HasPrefix(created.Token, serviceTokenPrefix) || created.ServiceToken.TokenHash != "" {
+		t.Fatalf("expected a prefixed token and no hash in the response, got %+v", created)
+	}
+
+	checkToken := func(token string) bool {
+		allowed, err := is.check(Request{Microservice: "crud", Method: "read", Data: map[string]interface{}{"token": token}}, methodCallIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return allowed
+	}
+	if !checkToken(created.Token) {
+		t.Fatal("expected the created token to be accepted")
+	}
+
+	response, _, _ = is.rotateServiceTokenHandler(map[string]interface{}{
+		"service_token_id": created.ServiceToken.ID,
+		"overlap":          float64(3600),
+	}, nil)
+	var rotated struct {
+		ServiceToken entities.ServiceToken `json:"service_token"`
+		Token        string                `json:"token"`
+	}
+	decodeResult(t, response, &rotated)
+
+	if !checkToken(rotated.Token) || !checkToken(created.Token) {
+		t.Fatal("expected both tokens to be accepted during the overlap")
+	}
+
+	oldToken, err := is.ServiceTokensRepository.GetServiceTokenByID(created.ServiceToken.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining := time.Until(time.Unix(oldToken.ExpiredAt, 0)); remaining <= 0 || remaining > time.Hour {
+		t.Errorf("expected the old token to expire within the overlap, got %v", remaining)
+	}
+
+	response, _, _ = is.rotateServiceTokenHandler(map[string]interface{}{
+		"service_token_id": rotated.ServiceToken.ID,
+		"overlap":          float64(0),
+	}, nil)
+	if code := errorCode(response); code != "" {
+		t.Fatalf("expected the token to be rotated, got %+v", response)
+	}
+	if checkToken(rotated.Token) {
+		t.Error("expected the token rotated without overlap to be refused")
+	}
+}
@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+	"github.com/Limpid-LLC/go-auth/internal/repo"
+	"github.com/Limpid-LLC/go-auth/logger"
+	"github.com/go-playground/validator/v10"
+	"go.uber.org/zap"
+)
+
+// newTestService returns a service backed by an in-memory storage, with the
+// default and admin roles of config.yml.
+func newTestService(t *testing.T) (*InternalService, *testStorage) {
+	logger.Logger = zap.NewNop()
+
+	store, storage := newTestStorage(t)
+
+	is := &InternalService{
+		Storage: store,
+
+		UsersRepository:            &repo.UsersRepository{Storage: store, Collection: "users"},
+		TokenPermissionsRepository: &repo.TokenPermissionsRepository{Storage: store, Collection: "tokenPermissions"},
+		SessionsRepository:         &repo.SessionsRepository{Storage: store, Collection: "sessions"},
+		OAuthClientsRepository:     &repo.OAuthClientsRepository{Storage: store, Collection: "oauthClients"},
+		APIKeysRepository:          &repo.APIKeysRepository{Storage: store, Collection: "apiKeys"},
+		ServiceTokensRepository:    &repo.ServiceTokensRepository{Storage: store, Collection: "serviceTokens"},
+
+		DefaultRole: entities.Role{
+			Type: "default",
+			Permissions: []entities.Permission{
+				{Microservice: "crud", Method: "read"},
+				{Microservice: "crud", Method: "update", RequiredParams: []entities.Params{
+					{Param: "internal_id", Values: []string{"#internal_id"}},
+				}},
+			},
+		},
+		AdminRole: entities.Role{
+			Type:        "admin",
+			Permissions: []entities.Permission{{Microservice: "auth", Method: "*"}},
+		},
+		Validate: validator.New(),
+
+		Salt:              "salt",
+		PasswordAlgorithm: PasswordAlgorithmBcrypt,
+
+		TokenExpirations: entities.TokenExpirations{
+			AccessToken:   time.Hour,
+			RefreshToken:  24 * time.Hour,
+			LinkToken:     15 * time.Minute,
+			Impersonation: 15 * time.Minute,
+		},
+
+		AuthFloodLimit:    100,
+		AuthFloodDuration: 1,
+
+		Name: "Auth",
+	}
+
+	return is, storage
+}
+
+// decodeResult returns the result of an OK response decoded into target.
+func decodeResult(t *testing.T, response interface{}, target interface{}) {
+	t.Helper()
+
+	ok, isOK := response.(ResponseOk)
+	if !isOK {
+		t.Fatalf("expected an OK response, got %+v", response)
+	}
+
+	encoded, err := json.Marshal(ok.Result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(encoded, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// errorCode returns the code of an error response, or "" for other
+// responses.
+func errorCode(response interface{}) string {
+	errorResponse, ok := response.(ErrorResponse)
+	if !ok {
+		return ""
+	}
+
+	return errorResponse.ErrorCode
+}
+
+// testSignIn is the payload of sign_in.
+type testSignIn struct {
+	AccessToken  string       `json:"accessToken"`
+	RefreshToken RefreshToken `json:"refreshToken"`
+	SessionID    string       `json:"sessionId"`
+}
+
+// signInTestUser stores the user with the password and signs it in.
+func signInTestUser(t *testing.T, is *InternalService, storage *testStorage, user entities.User, password string) testSignIn {
+	t.Helper()
+
+	hash, err := is.hashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.HashedPassword = hash
+	storage.insert("users", user)
+
+	response, _, _ := is.signInHandler(
+		map[string]interface{}{"login": user.Email, "password": password},
+		map[string]interface{}{"ip": "203.0.113.5"},
+	)
+
+	var result testSignIn
+	decodeResult(t, response, &result)
+
+	return result
+}
+
+// testMailer records the emails the service sends.
+type testMailer struct {
+	mutex    sync.Mutex
+	messages []EmailData
+}
+
+// newTestMailer enables the emails of the service and records them.
+func newTestMailer(t *testing.T, is *InternalService) *testMailer {
+	mailer := &testMailer{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request EmailRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mailer.mutex.Lock()
+		mailer.messages = append(mailer.messages, request.Data)
+		mailer.mutex.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	is.EmailEnabled = true
+	is.EmailServiceUrl = server.URL
+
+	return mailer
+}
+
+// last returns the last email sent to the recipient.
+func (m *testMailer) last(t *testing.T, recipient string) EmailData {
+	t.Helper()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].Recipient == recipient {
+			return m.messages[i]
+		}
+	}
+	t.Fatalf("expected an email to %s", recipient)
+
+	return EmailData{}
+}
+
+func (m *testMailer) count() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return len(m.messages)
+}
@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+// startSession creates a session for the user. The ip and user agent are
+// taken from the request metadata. A new session id is generated when id is
+// empty.
+func (is InternalService) startSession(user *entities.User, meta interface{}, id string) (*entities.Session, error) {
+	var err error
+	if id == "" {
+		id, err = generateRandomToken(16)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate session id: %v", err)
+		}
+	}
+
+	metaMap, _ := meta.(map[string]interface{})
+	ip, _ := metaMap["ip"].(string)
+	userAgent, _ := metaMap["user_agent"].(string)
+
+	now := time.Now().Unix()
+
+	session := &entities.Session{
+		ID:         id,
+		UserID:     user.InternalId,
+		IP:         ip,
+		UserAgent:  userAgent,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiredAt:  time.Now().Add(is.TokenExpirations.RefreshToken).Unix(),
+	}
+
+	err = is.SessionsRepository.CreateSession(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// getOrStartSession returns the session or starts one with the given id when
+// it does not exist, e.g. for refresh tokens issued before sessions existed.
+func (is InternalService) getOrStartSession(user *entities.User, meta interface{}, id string) (*entities.Session, error) {
+	session, err := is.SessionsRepository.GetSessionByID(id)
+	if err == nil {
+		return session, nil
+	}
+
+	return is.startSession(user, meta, id)
+}
+
+// touchSession records newly issued tokens and extends the session lifetime
+// to the lifetime of its latest refresh token. refreshToken may be nil for
+// clients that are not allowed to refresh.
+func (is InternalService) touchSession(session *entities.Session, accessTokens []entities.AccessToken, refreshToken *RefreshToken) error {
+	for _, accessToken := range accessTokens {
+		if !containsString(session.AccessTokens, accessToken.Token) {
+			session.AccessTokens = append(session.AccessTokens, accessToken.Token)
+		}
+	}
+
+	if refreshToken != nil {
+		session.RefreshToken = refreshToken.RefreshToken
+		session.ExpiredAt = refreshToken.ExpiredAt
+	}
+	session.LastSeenAt = time.Now().Unix()
+
+	return is.SessionsRepository.UpdateSession(session)
+}
+
+// revokeSession removes the session with all its access and refresh tokens.
+func (is InternalService) revokeSession(sessionID string) error {
+	err := is.TokenPermissionsRepository.RemoveTokenPermissionsBySessionID(sessionID)
+	if err != nil {
+		return err
+	}
+	is.PermissionCache.Invalidate("session_id", sessionID)
+
+	err = is.removeRefreshTokens(map[string]interface{}{"family_id": sessionID})
+	if err != nil {
+		return err
+	}
+
+	return is.SessionsRepository.RemoveSessions(map[string]interface{}{"session_id": sessionID})
+}
+
+func (is InternalService) getUserSessions(userID string, currentSessionID string) ([]map[string]interface{}, error) {
+	sessions, err := is.SessionsRepository.GetSessionsByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]map[string]interface{}, 0, len(sessions))
+	for _, session := range sessions {
+		result = append(result, map[string]interface{}{
+			"session": session.Redacted(),
+			"current": session.ID == currentSessionID,
+		})
+	}
+
+	return result, nil
+}
+
+func (is *InternalService) getSessionsHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	tokenPermission, err := is.getTokenPermission(tokenFromRequest(data, meta))
+	if err != nil {
+		if !errors.Is(err, errTokenNotFound) {
+			log.Println("Cannot get token owner, err:", err)
+		}
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	sessions, err := is.getUserSessions(tokenPermission.UserID, tokenPermission.SessionID)
+	if err != nil {
+		log.Println("Cannot get sessions, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse(sessions)
+}
+
+func (is *InternalService) revokeSessionHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		log.Println("Invalid data format in revokeSessionHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	userID, err := is.getTokenOwnerID(tokenFromRequest(data, meta))
+	if err != nil {
+		if !errors.Is(err, errTokenNotFound) {
+			log.Println("Cannot get token owner, err:", err)
+		}
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	sessionID, _ := dataMap["session_id"].(string)
+
+	// Users may only revoke their own sessions
+	session, err := is.SessionsRepository.GetSessionByID(sessionID)
+	if err != nil || session.UserID != userID {
+		return NewErrorResponse(
+			"SessionNotFoundError",
+			"SNF_01",
+			"Session not found",
+		), http.StatusNotFound, nil
+	}
+
+	return is.revokeSessionResponse(session.ID)
+}
+
+func (is *InternalService) getUserSessionsHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		log.Println("Invalid data format in getUserSessionsHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	userID, ok := dataMap["user_id"].(string)
+	if !ok || userID == "" {
+		return NewErrorResponse(
+			"InvalidUserIDError",
+			"IUE_04",
+			"Invalid user ID",
+		), http.StatusBadRequest, nil
+	}
+
+	sessions, err := is.getUserSessions(userID, "")
+	if err != nil {
+		log.Println("Cannot get sessions, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse(sessions)
+}
+
+func (is *InternalService) revokeUserSessionHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		log.Println("Invalid data format in revokeUserSessionHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	sessionID, _ := dataMap["session_id"].(string)
+
+	session, err := is.SessionsRepository.GetSessionByID(sessionID)
+	if err != nil {
+		return NewErrorResponse(
+			"SessionNotFoundError",
+			"SNF_01",
+			"Session not found",
+		), http.StatusNotFound, nil
+	}
+
+	return is.revokeSessionResponse(session.ID)
+}
+
+func (is *InternalService) revokeSessionResponse(sessionID string) (interface{}, int, error) {
+	err := is.revokeSession(sessionID)
+	if err != nil {
+		log.Println("Cannot revoke session, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse("Session revoked successfully")
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+type testSession struct {
+	Session map[string]interface{} `json:"session"`
+	Current bool                   `json:"current"`
+}
+
+func TestGetSessions(t *testing.T) {
+	is, storage := newTestService(t)
+	first := signInTestUser(t, is, storage, entities.User{InternalId: "user", Email: "user@example.com"}, "password")
+	second := signInTestDevice(t, is, "user@example.com", "password", "phone")
+	signInTestUser(t, is, storage, entities.User{InternalId: "other", Email: "other@example.com"}, "password")
+
+	response, _, _ := is.getSessionsHandler(nil, map[string]interface{}{"token": second.AccessToken})
+	var sessions []testSession
+	decodeResult(t, response, &sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("expected the two sessions of the user, got %+v", sessions)
+	}
+
+	for _, session := range sessions {
+		if _, ok := session.Session["access_tokens"]; ok {
+			t.Errorf("expected no access tokens in the list, got %+v", session.Session)
+		}
+		if _, ok := session.Session["refresh_token"]; ok {
+			t.Errorf("expected no refresh token in the list, got %+v", session.Session)
+		}
+
+		switch session.Session["session_id"] {
+		case first.SessionID:
+			if session.Current {
+				t.Error("expected only the session of the token to be current")
+			}
+		case second.SessionID:
+			if !session.Current || session.Session["user_agent"] != "phone" {
+				t.Errorf("expected the current session from the phone, got %+v", session)
+			}
+		default:
+			t.Errorf("expected only the sessions of the user, got %+v", session)
+		}
+	}
+
+	response, _, _ = is.getUserSessionsHandler(map[string]interface{}{"user_id": "user"}, nil)
+	decodeResult(t, response, &sessions)
+	if len(sessions) != 2 {
+		t.Errorf("expected the two sessions of the user, got %+v", sessions)
+	}
+
+	response, _, _ = is.getSessionsHandler(nil, map[string]interface{}{"token": "unknown"})
+	if code := errorCode(response); code != "TKE_01" {
+		t.Errorf("expected TKE_01 for an unknown token, got %+v", response)
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	is, storage := newTestService(t)
+	first := signInTestUser(t, is, storage, entities.User{InternalId: "user", Email: "user@example.com"}, "password")
+	second := signInTestDevice(t, is, "user@example.com", "password", "phone")
+	other := signInTestUser(t, is, storage, entities.User{InternalId: "other", Email: "other@example.com"}, "password")
+
+	// Users may only revoke their own sessions
+	response, _, _ := is.revokeSessionHandler(map[string]interface{}{"session_id": other.SessionID}, map[string]interface{}{"token": first.AccessToken})
+	if code := errorCode(response); code != "SNF_01" {
+		t.Fatalf("expected SNF_01 for the session of another user, got %+v", response)
+	}
+	expectSignedIn(t, is, other, true)
+
+	response, _, _ = is.revokeSessionHandler(map[string]interface{}{"session_id": second.SessionID}, map[string]interface{}{"token": first.AccessToken})
+	if code := errorCode(response); code != "" {
+		t.Fatalf("expected the session to be revoked, got %+v", response)
+	}
+
+	expectSignedIn(t, is, second, false)
+	expectSignedIn(t, is, first, true)
+}
+
+func TestRevokeUserSession(t *testing.T) {
+	is, storage := newTestService(t)
+	signIn := signInTestUser(t, is, storage, entities.User{InternalId: "user", Email: "user@example.com"}, "password")
+
+	response, _, _ := is.revokeUserSessionHandler(map[string]interface{}{"session_id": "unknown"}, nil)
+	if code := errorCode(response); code != "SNF_01" {
+		t.Fatalf("expected SNF_01 for an unknown session, got %+v", response)
+	}
+
+	response, _, _ = is.revokeUserSessionHandler(map[string]interface{}{"session_id": signIn.SessionID}, nil)
+	if code := errorCode(response); code != "" {
+		t.Fatalf("expected the session to be revoked, got %+v", response)
+	}
+
+	expectSignedIn(t, is, signIn, false)
+}
@@ -4,8 +4,12 @@ import (
 	"errors"
 	"log"
 	"net/http"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
 )
 
+var errInvalidCredentials = errors.New("user not found or password is incorrect")
+
 func (is *InternalService) signInHandler(data interface{}, meta interface{}) (interface{}, int, error) {
 	metaMap, ok := meta.(map[string]interface{})
 	if !ok {
@@ -64,11 +68,8 @@ func (is *InternalService) signInHandler(data interface{}, meta interface{}) (in
 		return createErrorResponse(errs), http.StatusBadRequest, errors.New("not valid data")
 	}
 
-	// Hash and salt the password
-	hashedPassword := is.hashAndSaltPassword(dataMap["password"].(string))
-
 	// Check if user exists and password matches
-	user, err := is.UsersRepository.GetUserByLoginAndPassword(dataMap["login"].(string), hashedPassword)
+	user, err := is.authenticate(dataMap["login"].(string), dataMap["password"].(string))
 	if err != nil {
 		is.FloodAdd(ip)
 		return NewErrorResponse(
@@ -78,8 +79,14 @@ func (is *InternalService) signInHandler(data interface{}, meta interface{}) (in
 		), http.StatusBadRequest, nil
 	}
 
+	return is.completeSignIn(user, meta)
+}
+
+// signInResponse issues access tokens and a refresh token for the session
+// and builds the sign in payload.
+func (is *InternalService) signInResponse(user *entities.User, session *entities.Session) (interface{}, int, error) {
 	// Generate access token and refresh token
-	accessTokens, err := is.generateAccessTokens(user)
+	accessTokens, err := is.generateAccessTokens(user, accessTokenOptions{SessionID: session.ID})
 	if err != nil {
 		log.Println("Cannot generate tokens, err:", err)
 		return NewErrorResponse(
@@ -89,7 +96,7 @@ func (is *InternalService) signInHandler(data interface{}, meta interface{}) (in
 		), http.StatusInternalServerError, err
 	}
 
-	refreshToken, err := is.generateRefreshToken(user)
+	refreshToken, err := is.generateRefreshToken(user, session.ID, "", "")
 
 	if err != nil {
 		log.Println("Cannot generate refresh token, err:", err)
@@ -100,12 +107,89 @@ func (is *InternalService) signInHandler(data interface{}, meta interface{}) (in
 		), http.StatusInternalServerError, err
 	}
 
-	user.HashedPassword = "hidden"
+	err = is.touchSession(session, accessTokens, refreshToken)
+	if err != nil {
+		log.Println("Cannot update session, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
 
-	// Return the tokens
-	return NewOkResponse(map[string]interface{}{
-		"user":         user,
+	response := map[string]interface{}{
 		"accessTokens": accessTokens,
 		"refreshToken": refreshToken,
-	})
+		"sessionId":    session.ID,
+	}
+	if !is.LegacyPerRoleTokens && len(accessTokens) == 1 {
+		response["accessToken"] = accessTokens[0].Token
+	}
+
+	if is.JWTEnabled {
+		jwt, err := is.generateAccessJWT(user, session)
+		if err != nil {
+			log.Println("Cannot generate JWT, err:", err)
+			return NewErrorResponse(
+				"ServerError",
+				"SVE_06",
+				"Internal server error",
+			), http.StatusInternalServerError, err
+		}
+		response["jwt"] = jwt
+	}
+
+	user.HashedPassword = "hidden"
+	user.TOTP = nil
+	response["user"] = user
+
+	// Return the tokens
+	return NewOkResponse(response)
+}
+
+// authenticatePassword returns the user when the password matches. Legacy or
+// outdated hashes are upgraded while the plain password is known.
+func (is *InternalService) authenticatePassword(login string, password string) (*entities.User, error) {
+	users, err := is.UsersRepository.GetUsersByLogin(login)
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+
+	// The password is checked against every user of the login, not just the
+	// first one the storage returns
+	for i := range users {
+		user := &users[i]
+
+		valid, needsRehash, err := is.verifyPassword(password, user.HashedPassword)
+		if err != nil {
+			log.Println("Cannot verify password, err:", err)
+			continue
+		}
+		if !valid {
+			continue
+		}
+
+		if needsRehash {
+			is.rehashPassword(user, password)
+		}
+
+		return user, nil
+	}
+
+	return nil, errInvalidCredentials
+}
+
+func (is *InternalService) rehashPassword(user *entities.User, password string) {
+	hashedPassword, err := is.hashPassword(password)
+	if err != nil {
+		log.Println("Cannot rehash password, err:", err)
+		return
+	}
+
+	user.HashedPassword = hashedPassword
+
+	err = is.UsersRepository.UpdateUser(user)
+	if err != nil {
+		log.Println("Cannot save rehashed password, err:", err)
+	}
 }
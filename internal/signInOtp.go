@@ -0,0 +1,319 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+	"github.com/saiset-co/sai-storage-mongo/external/adapter"
+)
+
+const (
+	otpPurposeSignIn = "sign_in"
+
+	signInCodeExpiration = 5 * time.Minute
+)
+
+type SignInCodeRequest struct {
+	Phone     string                 `json:"phone"`
+	Email     string                 `json:"email" validate:"required_without=Phone"`
+	Template  string                 `json:"template"`
+	Variables map[string]interface{} `json:"variables"`
+	Fake      string                 `json:"fake"`
+}
+
+type SignInWithOTPRequest struct {
+	Phone   string `json:"phone"`
+	Email   string `json:"email" validate:"required_without=Phone"`
+	OtpCode string `json:"otp_code" validate:"required"`
+}
+
+// generateNumericCode returns a random code of the given number of digits.
+func generateNumericCode(digits int) (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < digits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%0*d", digits, n), nil
+}
+
+// getUserByPhoneOrEmail prefers the phone when both are given. Unlike a
+// single $or query it never matches users on an empty field.
+func (is *InternalService) getUserByPhoneOrEmail(phone, email string) (*entities.User, error) {
+	if phone != "" {
+		return is.UsersRepository.GetUserByPhone(phone)
+	}
+
+	return is.UsersRepository.GetUserByEmail(email)
+}
+
+func (is *InternalService) sendSignInCodeHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	metaMap, _ := meta.(map[string]interface{})
+	ip, _ := metaMap["ip"].(string)
+
+	if is.isFlooder(ip) {
+		log.Println("Flood protection in sendSignInCodeHandler")
+
+		return NewErrorResponse(
+			"FloodError",
+			"DFE_07",
+			"Flood protection",
+		), http.StatusBadRequest, nil
+	}
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Marshal" + err.Error())
+	}
+
+	var request SignInCodeRequest
+	err = json.Unmarshal(jsonData, &request)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Unmarshal" + err.Error())
+	}
+
+	errs := is.Validate.Struct(request)
+	if errs != nil {
+		log.Printf("Validation errors: %v", errs)
+		is.FloodAdd(ip)
+
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"VLE_03",
+			"Validation error.",
+		), http.StatusBadRequest, errs
+	}
+
+	// Unknown users get the same answer, so the method cannot be used to
+	// find out who is registered
+	user, err := is.getUserByPhoneOrEmail(request.Phone, request.Email)
+	if err != nil {
+		is.FloodAdd(ip)
+		return NewOkResponse("Sign in code sent")
+	}
+
+	code, err := generateNumericCode(6)
+	if err != nil {
+		log.Printf("Error generating sign in code: %v", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	fakeMode := is.MasterKey != "" && request.Fake == is.MasterKey
+
+	// If the "fake" key exists and matches the master key, don't send the code and set it to "111111"
+	if fakeMode {
+		code = "111111"
+	}
+
+	otpCode := OTPCode{
+		Code:      code,
+		ExpiredAt: time.Now().Add(signInCodeExpiration),
+		Purpose:   otpPurposeSignIn,
+	}
+	if request.Phone != "" {
+		otpCode.Phone = user.Phone
+	} else {
+		otpCode.Email = user.Email
+	}
+
+	saveReq := adapter.Request{
+		Method: "create",
+		Data: adapter.CreateRequest{
+			Collection: "otpCodes",
+			Documents:  []interface{}{otpCode},
+		},
+	}
+
+	_, err = is.Storage.Send(saveReq)
+	if err != nil {
+		log.Printf("Error saving OTP code to SaiStorage: %v", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	if !fakeMode {
+		if otpCode.Phone != "" {
+			err = is.sendSMS(otpCode.Phone, "Code: "+code, request.Template, request.Variables)
+		} else {
+			err = is.sendEmail(otpCode.Email, "Sign In", "Code: "+code)
+		}
+		if err != nil {
+			log.Printf("Error sending sign in code: %v", err)
+			return NewErrorResponse(
+				"ServerError",
+				"SVE_06",
+				"Internal server error",
+			), http.StatusInternalServerError, err
+		}
+	}
+
+	return NewOkResponse("Sign in code sent")
+}
+
+func (is *InternalService) signInWithOTPHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	metaMap, _ := meta.(map[string]interface{})
+	ip, _ := metaMap["ip"].(string)
+
+	if is.isFlooder(ip) {
+		log.Println("Flood protection in signInWithOTPHandler")
+
+		return NewErrorResponse(
+			"FloodError",
+			"DFE_07",
+			"Flood protection",
+		), http.StatusBadRequest, nil
+	}
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Marshal" + err.Error())
+	}
+
+	var request SignInWithOTPRequest
+	err = json.Unmarshal(jsonData, &request)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Unmarshal" + err.Error())
+	}
+
+	errs := is.Validate.Struct(request)
+	if errs != nil {
+		log.Printf("Validation errors: %v", errs)
+		is.FloodAdd(ip)
+
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"VLE_03",
+			"Validation error.",
+		), http.StatusBadRequest, errs
+	}
+
+	selectData := map[string]interface{}{
+		"code":    request.OtpCode,
+		"purpose": otpPurposeSignIn,
+	}
+	if request.Phone != "" {
+		selectData["phone"] = request.Phone
+	} else {
+		selectData["email"] = request.Email
+	}
+
+	readSelect := copyMap(selectData)
+	readSelect["expired_at"] = map[string]interface{}{
+		"$gte": time.Now(),
+	}
+
+	otpRes, err := is.Storage.Send(adapter.Request{
+		Method: "read",
+		Data: adapter.ReadRequest{
+			Collection: "otpCodes",
+			Select:     readSelect,
+		},
+	})
+	if err != nil || len(otpRes.Result) == 0 {
+		is.FloodAdd(ip)
+		return NewErrorResponse(
+			"OTPError",
+			"OPE_05",
+			"Invalid OTP code",
+		), http.StatusBadRequest, nil
+	}
+
+	var otpCodes []OTPCode
+	jsonData, err = json.Marshal(otpRes.Result)
+	if err == nil {
+		err = json.Unmarshal(jsonData, &otpCodes)
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// Codes are single-use. The code is short and may be sent again, so the
+	// redemption is bound to the login and the expiry of the sent code
+	login := request.Phone
+	if login == "" {
+		login = request.Email
+	}
+	redeemed, err := is.redeem(
+		"sign_in_code",
+		login+":"+request.OtpCode+":"+fmt.Sprint(otpCodes[0].ExpiredAt.UnixNano()),
+		otpCodes[0].ExpiredAt.Unix(),
+	)
+	if err != nil {
+		log.Println("Cannot redeem OTP code, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+	if !redeemed {
+		is.FloodAdd(ip)
+		return NewErrorResponse(
+			"OTPError",
+			"OPE_05",
+			"Invalid OTP code",
+		), http.StatusBadRequest, nil
+	}
+
+	_, err = is.Storage.Send(adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: "otpCodes",
+			Select:     selectData,
+		},
+	})
+	if err != nil {
+		log.Println("Cannot remove OTP code from storage, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	user, err := is.getUserByPhoneOrEmail(request.Phone, request.Email)
+	if err != nil {
+		is.FloodAdd(ip)
+		return NewErrorResponse(
+			"UserNotFoundError",
+			"UNF_01",
+			"User not found",
+		), http.StatusBadRequest, nil
+	}
+
+	return is.completeSignIn(user, meta)
+}
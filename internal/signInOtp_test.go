@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+// sendTestSignInCode sends a sign in code to the email and returns it.
+func sendTestSignInCode(t *testing.T, is *InternalService, mailer *testMailer, email string) string {
+	t.Helper()
+
+	response, _, _ := is.sendSignInCodeHandler(map[string]interface{}{"email": email}, map[string]interface{}{"ip": "203.0.113.5"})
+	if code := errorCode(response); code != "" {
+		t.Fatalf("expected the code to be sent, got %+v", response)
+	}
+
+	return strings.TrimPrefix(mailer.last(t, email).Body, "Code: ")
+}
+
+func signInWithTestOTP(is *InternalService, data map[string]interface{}) interface{} {
+	response, _, _ := is.signInWithOTPHandler(data, map[string]interface{}{"ip": "203.0.113.5"})
+	return response
+}
+
+func TestSignInWithOTP(t *testing.T) {
+	is, storage := newTestService(t)
+	mailer := newTestMailer(t, is)
+	storage.insert("users", entities.User{InternalId: "user", Email: "user@example.com"})
+
+	code := sendTestSignInCode(t, is, mailer, "user@example.com")
+	if len(code) != 6 {
+		t.Fatalf("expected a 6 digit code, got %q", code)
+	}
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	if errCode := errorCode(signInWithTestOTP(is, map[string]interface{}{"email": "user@example.com", "otp_code": wrong})); errCode != "OPE_05" {
+		t.Fatalf("expected OPE_05 for a wrong code, got %s", errCode)
+	}
+	if errCode := errorCode(signInWithTestOTP(is, map[string]interface{}{"email": "other@example.com", "otp_code": code})); errCode != "OPE_05" {
+		t.Fatalf("expected OPE_05 for another email, got %s", errCode)
+	}
+
+	var result testSignIn
+	decodeResult(t, signInWithTestOTP(is, map[string]interface{}{"email": "user@example.com", "otp_code": code}), &result)
+	if result.AccessToken == "" {
+		t.Fatalf("expected an access token, got %+v", result)
+	}
+
+	if errCode := errorCode(signInWithTestOTP(is, map[string]interface{}{"email": "user@example.com", "otp_code": code})); errCode != "OPE_05" {
+		t.Errorf("expected the code to work once, got %s", errCode)
+	}
+}
+
+func TestSignInWithFakeOTP(t *testing.T) {
+	is, storage := newTestService(t)
+	storage.insert("users", entities.User{InternalId: "user", Phone: "+15550100"})
+
+	send := func(fake string) {
+		response, _, _ := is.sendSignInCodeHandler(map[string]interface{}{"phone": "+15550100", "fake": fake}, nil)
+		if code := errorCode(response); code != "" {
+			t.Fatalf("expected the code to be sent, got %+v", response)
+		}
+	}
+
+	// Without a master key nothing enables the fixed code
+	send("")
+	if errCode := errorCode(signInWithTestOTP(is, map[string]interface{}{"phone": "+15550100", "otp_code": "111111"})); errCode != "OPE_05" {
+		t.Fatalf("expected OPE_05 without a master key, got %s", errCode)
+	}
+
+	is.MasterKey = "master"
+	send("other")
+	if errCode := errorCode(signInWithTestOTP(is, map[string]interface{}{"phone": "+15550100", "otp_code": "111111"})); errCode != "OPE_05" {
+		t.Fatalf("expected OPE_05 for another key, got %s", errCode)
+	}
+
+	send("master")
+	var result testSignIn
+	decodeResult(t, signInWithTestOTP(is, map[string]interface{}{"phone": "+15550100", "otp_code": "111111"}), &result)
+	if result.AccessToken == "" {
+		t.Fatalf("expected an access token, got %+v", result)
+	}
+
+	// A fixed code sent again works again
+	send("master")
+	if errCode := errorCode(signInWithTestOTP(is, map[string]interface{}{"phone": "+15550100", "otp_code": "111111"})); errCode != "" {
+		t.Errorf("expected the code sent again to be accepted, got %s", errCode)
+	}
+}
+
+func TestSendSignInCodeToUnknownUser(t *testing.T) {
+	is, _ := newTestService(t)
+	mailer := newTestMailer(t, is)
+
+	response, _, _ := is.sendSignInCodeHandler(map[string]interface{}{"email": "nobody@example.com"}, nil)
+	if code := errorCode(response); code != "" {
+		t.Fatalf("expected the same answer as for known users, got %+v", response)
+	}
+	if mailer.count() != 0 {
+		t.Error("expected no email to an unknown address")
+	}
+
+	response, _, _ = is.sendSignInCodeHandler(map[string]interface{}{}, nil)
+	if code := errorCode(response); code != "VLE_03" {
+		t.Errorf("expected VLE_03 without a phone or email, got %+v", response)
+	}
+}
+
+func TestSignInWithExpiredOTP(t *testing.T) {
+	is, storage := newTestService(t)
+	storage.insert("users", entities.User{InternalId: "user", Email: "user@example.com"})
+	storage.insert("otpCodes", OTPCode{
+		Code:      "123456",
+		Email:     "user@example.com",
+		Purpose:   otpPurposeSignIn,
+		ExpiredAt: time.Now().Add(-time.Minute),
+	})
+
+	if errCode := errorCode(signInWithTestOTP(is, map[string]interface{}{"email": "user@example.com", "otp_code": "123456"})); errCode != "OPE_05" {
+		t.Errorf("expected OPE_05 for an expired code, got %s", errCode)
+	}
+}
+
+func TestSignInWithOTPConcurrently(t *testing.T) {
+	is, storage := newTestService(t)
+	mailer := newTestMailer(t, is)
+	storage.insert("users", entities.User{InternalId: "user", Email: "user@example.com"})
+
+	code := sendTestSignInCode(t, is, mailer, "user@example.com")
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	signedIn := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			response := signInWithTestOTP(is, map[string]interface{}{"email": "user@example.com", "otp_code": code})
+			if _, ok := response.(ResponseOk); ok {
+				mutex.Lock()
+				signedIn++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if signedIn != 1 {
+		t.Errorf("expected exactly one sign in with the code, got %d", signedIn)
+	}
+}
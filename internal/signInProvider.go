@@ -0,0 +1,517 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+	"github.com/saiset-co/sai-storage-mongo/external/adapter"
+)
+
+const providerStateExpiration = 10 * time.Minute
+
+var errProviderStateNotFound = errors.New("provider state not found")
+
+// ProviderState remembers a sign in started with an identity provider until
+// the user comes back with the authorization code. Only the hash of the
+// state is stored. UserID is set when an identity is being linked.
+type ProviderState struct {
+	State        string `json:"state"`
+	Provider     string `json:"provider"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	UserID       string `json:"user_id"`
+	ExpiredAt    int64  `json:"expired_at"`
+}
+
+type ProviderRequest struct {
+	Provider string `json:"provider" validate:"required"`
+}
+
+type ProviderCallbackRequest struct {
+	State string `json:"state" validate:"required"`
+	Code  string `json:"code" validate:"required"`
+}
+
+// startProviderSignIn stores the state of the flow and returns the url of
+// the provider the user has to be sent to.
+func (is *InternalService) startProviderSignIn(provider *IdentityProvider, userID string) (string, error) {
+	state, err := generateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := generateRandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	codeVerifier, err := generateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	req := adapter.Request{
+		Method: "create",
+		Data: adapter.CreateRequest{
+			Collection: "providerStates",
+			Documents: []interface{}{
+				ProviderState{
+					State:        hashToken(state),
+					Provider:     provider.Name,
+					Nonce:        nonce,
+					CodeVerifier: codeVerifier,
+					UserID:       userID,
+					ExpiredAt:    time.Now().Add(providerStateExpiration).Unix(),
+				},
+			},
+		},
+	}
+
+	if _, err := is.Storage.Send(req); err != nil {
+		return "", fmt.Errorf("failed to save provider state: %v", err)
+	}
+
+	digest := sha256.Sum256([]byte(codeVerifier))
+
+	return provider.authorizationURL(state, nonce, base64.RawURLEncoding.EncodeToString(digest[:]))
+}
+
+// redeemProviderState consumes the state, so a callback can be used once,
+// also when it arrives several times at once.
+func (is *InternalService) redeemProviderState(state string) (*ProviderState, error) {
+	selectData := map[string]interface{}{
+		"state": hashToken(state),
+	}
+
+	readSelect := copyMap(selectData)
+	readSelect["expired_at"] = map[string]interface{}{
+		"$gt": time.Now().Unix(),
+	}
+
+	res, err := is.Storage.Send(adapter.Request{
+		Method: "read",
+		Data: adapter.ReadRequest{
+			Collection: "providerStates",
+			Select:     readSelect,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get provider state: %v", err)
+	}
+
+	if len(res.Result) == 0 {
+		return nil, errProviderStateNotFound
+	}
+
+	var states []ProviderState
+	itemBytes, err := json.Marshal(res.Result)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(itemBytes, &states)
+	if err != nil {
+		return nil, err
+	}
+
+	redeemed, err := is.redeem("provider_state", state, states[0].ExpiredAt)
+	if err != nil {
+		return nil, err
+	}
+	if !redeemed {
+		return nil, errProviderStateNotFound
+	}
+
+	_, err = is.Storage.Send(adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: "providerStates",
+			Select:     selectData,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove provider state: %v", err)
+	}
+
+	return &states[0], nil
+}
+
+func (is *InternalService) removeExpiredProviderStates() {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: "providerStates",
+			Select: map[string]interface{}{
+				"expired_at": map[string]interface{}{
+					"$lt": time.Now().Unix(),
+				},
+			},
+		},
+	}
+
+	if _, err := is.Storage.Send(req); err != nil {
+		log.Printf("Error removing expired provider states: %v", err)
+	}
+}
+
+// createProviderUser creates a user just in time for an identity nobody has
+// signed in with yet. The email is only taken over when the provider has
+// verified it. Like users created by sign_up, the user gets the default role.
+func (is *InternalService) createProviderUser(provider *IdentityProvider, identity *ProviderIdentity) (*entities.User, error) {
+	user := &entities.User{
+		Data: map[string]interface{}{},
+	}
+	if identity.EmailVerified {
+		user.Email = identity.Email
+	}
+	user.AddIdentity(entities.Identity{
+		Provider: provider.Name,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+		LinkedAt: time.Now().Unix(),
+	})
+
+	err := is.UsersRepository.CreateUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	// The storage assigns the internal id
+	return is.UsersRepository.GetUserByIdentity(provider.Name, identity.Subject)
+}
+
+func (is *InternalService) parseProviderRequest(data interface{}) (*IdentityProvider, interface{}, int, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return nil, NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Marshal" + err.Error())
+	}
+
+	var request ProviderRequest
+	err = json.Unmarshal(jsonData, &request)
+	if err != nil {
+		return nil, NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Unmarshal" + err.Error())
+	}
+
+	errs := is.Validate.Struct(request)
+	if errs != nil {
+		log.Printf("Validation errors: %v", errs)
+		return nil, NewErrorResponse(
+			"InvalidDataFormatError",
+			"VLE_03",
+			"Validation error.",
+		), http.StatusBadRequest, errs
+	}
+
+	provider, ok := is.IdentityProviders[request.Provider]
+	if !ok {
+		return nil, NewErrorResponse(
+			"ProviderError",
+			"PVE_01",
+			"Unknown identity provider",
+		), http.StatusBadRequest, nil
+	}
+
+	return provider, nil, 0, nil
+}
+
+func (is *InternalService) signInWithProviderHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	metaMap, _ := meta.(map[string]interface{})
+	ip, _ := metaMap["ip"].(string)
+
+	if is.isFlooder(ip) {
+		log.Println("Flood protection in signInWithProviderHandler")
+
+		return NewErrorResponse(
+			"FloodError",
+			"DFE_07",
+			"Flood protection",
+		), http.StatusBadRequest, nil
+	}
+
+	provider, errResp, status, err := is.parseProviderRequest(data)
+	if errResp != nil {
+		is.FloodAdd(ip)
+		return errResp, status, err
+	}
+
+	return is.providerAuthorizationResponse(provider, "")
+}
+
+func (is *InternalService) linkProviderHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	tokenPermission, err := is.getOwnTokenPermission(tokenFromRequest(data, meta))
+	if err != nil {
+		if !errors.Is(err, errTokenNotFound) && !errors.Is(err, errImpersonatedToken) {
+			log.Println("Cannot get token owner, err:", err)
+		}
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	provider, errResp, status, err := is.parseProviderRequest(data)
+	if errResp != nil {
+		return errResp, status, err
+	}
+
+	return is.providerAuthorizationResponse(provider, tokenPermission.UserID)
+}
+
+func (is *InternalService) providerAuthorizationResponse(provider *IdentityProvider, userID string) (interface{}, int, error) {
+	authorizationURL, err := is.startProviderSignIn(provider, userID)
+	if err != nil {
+		log.Println("Cannot start provider sign in, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse(map[string]interface{}{
+		"authorization_url": authorizationURL,
+	})
+}
+
+// providerCallbackHandler finishes the flow on the page the provider
+// redirected to. It signs the user in, creating the user on first sign in,
+// or links the identity when the flow was started by link_provider.
+func (is *InternalService) providerCallbackHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	metaMap, _ := meta.(map[string]interface{})
+	ip, _ := metaMap["ip"].(string)
+
+	if is.isFlooder(ip) {
+		log.Println("Flood protection in providerCallbackHandler")
+
+		return NewErrorResponse(
+			"FloodError",
+			"DFE_07",
+			"Flood protection",
+		), http.StatusBadRequest, nil
+	}
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Marshal" + err.Error())
+	}
+
+	var request ProviderCallbackRequest
+	err = json.Unmarshal(jsonData, &request)
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusInternalServerError, fmt.Errorf("error Unmarshal" + err.Error())
+	}
+
+	errs := is.Validate.Struct(request)
+	if errs != nil {
+		log.Printf("Validation errors: %v", errs)
+		is.FloodAdd(ip)
+
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"VLE_03",
+			"Validation error.",
+		), http.StatusBadRequest, errs
+	}
+
+	state, err := is.redeemProviderState(request.State)
+	if err != nil {
+		if !errors.Is(err, errProviderStateNotFound) {
+			log.Println("Cannot redeem provider state, err:", err)
+		}
+		is.FloodAdd(ip)
+		return NewErrorResponse(
+			"ProviderError",
+			"PVE_02",
+			"Sign in with the identity provider failed",
+		), http.StatusBadRequest, nil
+	}
+
+	provider, ok := is.IdentityProviders[state.Provider]
+	if !ok {
+		return NewErrorResponse(
+			"ProviderError",
+			"PVE_01",
+			"Unknown identity provider",
+		), http.StatusBadRequest, nil
+	}
+
+	identity, err := provider.identity(request.Code, state.CodeVerifier, state.Nonce)
+	if err != nil {
+		log.Println("Cannot verify provider identity, err:", err)
+		is.FloodAdd(ip)
+		return NewErrorResponse(
+			"ProviderError",
+			"PVE_02",
+			"Sign in with the identity provider failed",
+		), http.StatusBadRequest, nil
+	}
+
+	linkedUser, err := is.UsersRepository.GetUserByIdentity(provider.Name, identity.Subject)
+	if err != nil {
+		linkedUser = nil
+	}
+
+	if state.UserID != "" {
+		return is.linkProviderIdentity(provider, identity, state.UserID, linkedUser)
+	}
+
+	if linkedUser != nil {
+		return is.completeSignIn(linkedUser, meta)
+	}
+
+	// A user with the same email must link the provider first, unless the
+	// provider is trusted to verify emails
+	if identity.Email != "" {
+		user, err := is.UsersRepository.GetUserByEmail(identity.Email)
+		if err == nil {
+			if !provider.LinkByEmail || !identity.EmailVerified {
+				return NewErrorResponse(
+					"ProviderError",
+					"PVE_03",
+					"An account with this email already exists, sign in and link the provider",
+				), http.StatusConflict, nil
+			}
+
+			user.AddIdentity(entities.Identity{
+				Provider: provider.Name,
+				Subject:  identity.Subject,
+				Email:    identity.Email,
+				LinkedAt: time.Now().Unix(),
+			})
+			err = is.UsersRepository.UpdateUser(user)
+			if err != nil {
+				log.Println("Cannot update user data, err:", err)
+				return NewErrorResponse(
+					"ServerError",
+					"SVE_06",
+					"Internal server error",
+				), http.StatusInternalServerError, err
+			}
+
+			return is.completeSignIn(user, meta)
+		}
+	}
+
+	user, err := is.createProviderUser(provider, identity)
+	if err != nil {
+		log.Println("Cannot create user, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return is.completeSignIn(user, meta)
+}
+
+func (is *InternalService) linkProviderIdentity(provider *IdentityProvider, identity *ProviderIdentity, userID string, linkedUser *entities.User) (interface{}, int, error) {
+	if linkedUser != nil && linkedUser.InternalId != userID {
+		return NewErrorResponse(
+			"ProviderError",
+			"PVE_05",
+			"The identity is already linked to another account",
+		), http.StatusConflict, nil
+	}
+
+	user, err := is.UsersRepository.GetUserByID(userID)
+	if err != nil {
+		return NewErrorResponse(
+			"UserNotFoundError",
+			"UNF_01",
+			"User not found",
+		), http.StatusBadRequest, nil
+	}
+
+	user.AddIdentity(entities.Identity{
+		Provider: provider.Name,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+		LinkedAt: time.Now().Unix(),
+	})
+
+	err = is.UsersRepository.UpdateUser(user)
+	if err != nil {
+		log.Println("Cannot update user data, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse(map[string]interface{}{
+		"identities": user.Identities,
+	})
+}
+
+func (is *InternalService) unlinkProviderHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	user, err := is.getUserByOwnToken(tokenFromRequest(data, meta))
+	if err != nil {
+		if !errors.Is(err, errTokenNotFound) && !errors.Is(err, errImpersonatedToken) {
+			log.Println("Cannot get token owner, err:", err)
+		}
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	dataMap, _ := data.(map[string]interface{})
+	providerName, _ := dataMap["provider"].(string)
+
+	if user.FindIdentity(providerName) == nil {
+		return NewErrorResponse(
+			"ProviderError",
+			"PVE_01",
+			"Unknown identity provider",
+		), http.StatusBadRequest, nil
+	}
+
+	// The user must keep at least one way to sign in
+	if user.HashedPassword == "" && user.Email == "" && user.Phone == "" && len(user.Identities) == 1 {
+		return NewErrorResponse(
+			"ProviderError",
+			"PVE_04",
+			"The last sign in method cannot be removed",
+		), http.StatusBadRequest, nil
+	}
+
+	user.RemoveIdentity(providerName)
+
+	err = is.UsersRepository.UpdateUser(user)
+	if err != nil {
+		log.Println("Cannot update user data, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse(map[string]interface{}{
+		"identities": user.Identities,
+	})
+}
@@ -0,0 +1,273 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubIdentityProvider is an OpenID Connect provider issuing ID tokens with
+// the claims set by the test.
+type stubIdentityProvider struct {
+	server *httptest.Server
+	signer *InternalService
+
+	mutex  sync.Mutex
+	claims map[string]interface{}
+}
+
+func newStubIdentityProvider(t *testing.T) *stubIdentityProvider {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub := &stubIdentityProvider{
+		signer: &InternalService{SigningKeys: []SigningKey{{ID: "stub", Algorithm: JWTAlgorithmEdDSA, PrivateKey: privateKey}}},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                 stub.server.URL,
+			"authorization_endpoint": stub.server.URL + "/authorize",
+			"token_endpoint":         stub.server.URL + "/token",
+			"jwks_uri":               stub.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, stub.signer.jwks())
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		stub.mutex.Lock()
+		claims := stub.claims
+		stub.mutex.Unlock()
+
+		if r.FormValue("code") != "code" || r.FormValue("code_verifier") == "" {
+			writeJSON(w, http.StatusBadRequest, OAuthError{"invalid_grant", ""})
+			return
+		}
+
+		idToken, err := stub.signer.signJWT(claims)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, OAuthError{"server_error", ""})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"access_token": "stub-access-token",
+			"id_token":     idToken,
+		})
+	})
+
+	stub.server = httptest.NewServer(mux)
+	t.Cleanup(stub.server.Close)
+
+	return stub
+}
+
+func (stub *stubIdentityProvider) provider(t *testing.T, linkByEmail bool) *IdentityProvider {
+	provider, err := NewIdentityProvider(map[string]interface{}{
+		"name":          "stub",
+		"issuer":        stub.server.URL,
+		"client_id":     "client",
+		"redirect_uri":  "https://app.example.com/callback",
+		"link_by_email": linkByEmail,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return provider
+}
+
+// signIn runs the flow of sign_in_with_provider and provider_callback. The
+// ID token carries the claims, and the nonce of the flow unless the claims
+// set one.
+func (stub *stubIdentityProvider) signIn(t *testing.T, is *InternalService, claims map[string]interface{}) (interface{}, string) {
+	t.Helper()
+	meta := map[string]interface{}{"ip": "203.0.113.5"}
+
+	response, _, _ := is.signInWithProviderHandler(map[string]interface{}{"provider": "stub"}, meta)
+	var result struct {
+		AuthorizationURL string `json:"authorization_url"`
+	}
+	decodeResult(t, response, &result)
+
+	link, err := url.Parse(result.AuthorizationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := link.Query()
+
+	idClaims := map[string]interface{}{
+		"iss":   stub.server.URL,
+		"aud":   "client",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for name, value := range claims {
+		idClaims[name] = value
+	}
+
+	stub.mutex.Lock()
+	stub.claims = idClaims
+	stub.mutex.Unlock()
+
+	response, _, _ = is.providerCallbackHandler(map[string]interface{}{
+		"state": query.Get("state"),
+		"code":  "code",
+	}, meta)
+
+	return response, query.Get("state")
+}
+
+func TestProviderSignInCreatesAndReusesUser(t *testing.T) {
+	is, storage := newTestService(t)
+	stub := newStubIdentityProvider(t)
+	is.IdentityProviders = map[string]*IdentityProvider{"stub": stub.provider(t, false)}
+
+	claims := map[string]interface{}{"sub": "subject-1", "email": "New@Example.com", "email_verified": true}
+
+	for i := 0; i < 2; i++ {
+		response, _ := stub.signIn(t, is, claims)
+		var result map[string]interface{}
+		decodeResult(t, response, &result)
+		if result["accessToken"] == "" || result["accessToken"] == nil {
+			t.Fatalf("expected an access token, got %v", result)
+		}
+	}
+
+	users := storage.documents("users")
+	if len(users) != 1 {
+		t.Fatalf("expected one user, got %d", len(users))
+	}
+
+	user, err := is.UsersRepository.GetUserByIdentity("stub", "subject-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "new@example.com" {
+		t.Errorf("expected the verified email to be taken over, got %q", user.Email)
+	}
+}
+
+func TestProviderSignInWithExistingEmail(t *testing.T) {
+	tests := []struct {
+		name          string
+		linkByEmail   bool
+		emailVerified bool
+		expectedCode  string
+	}{
+		{"link by email disabled", false, true, "PVE_03"},
+		{"email not verified", true, false, "PVE_03"},
+		{"verified email linked", true, true, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			is, storage := newTestService(t)
+			stub := newStubIdentityProvider(t)
+			is.IdentityProviders = map[string]*IdentityProvider{"stub": stub.provider(t, test.linkByEmail)}
+			storage.insert("users", map[string]interface{}{"internal_id": "existing", "email": "user@example.com"})
+
+			response, _ := stub.signIn(t, is, map[string]interface{}{
+				"sub":            "subject-1",
+				"email":          "user@example.com",
+				"email_verified": test.emailVerified,
+			})
+
+			if code := errorCode(response); code != test.expectedCode {
+				t.Fatalf("expected error %q, got %+v", test.expectedCode, response)
+			}
+			if test.expectedCode != "" {
+				return
+			}
+
+			user, err := is.UsersRepository.GetUserByIdentity("stub", "subject-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.InternalId != "existing" || len(storage.documents("users")) != 1 {
+				t.Errorf("expected the identity linked to the existing user, got %+v", user)
+			}
+		})
+	}
+}
+
+func TestProviderSignInRejectsInvalidIDTokens(t *testing.T) {
+	tests := map[string]map[string]interface{}{
+		"wrong nonce":    {"sub": "subject-1", "nonce": "other"},
+		"wrong audience": {"sub": "subject-1", "aud": "other-client"},
+		"wrong issuer":   {"sub": "subject-1", "iss": "https://other.example.com"},
+		"expired":        {"sub": "subject-1", "exp": time.Now().Add(-time.Hour).Unix()},
+		"no subject":     {"email": "user@example.com"},
+	}
+
+	for name, claims := range tests {
+		t.Run(name, func(t *testing.T) {
+			is, storage := newTestService(t)
+			stub := newStubIdentityProvider(t)
+			is.IdentityProviders = map[string]*IdentityProvider{"stub": stub.provider(t, false)}
+
+			response, _ := stub.signIn(t, is, claims)
+			if code := errorCode(response); code != "PVE_02" {
+				t.Fatalf("expected PVE_02, got %+v", response)
+			}
+			if len(storage.documents("users")) != 0 {
+				t.Error("expected no user to be created")
+			}
+		})
+	}
+}
+
+func TestProviderStateIsSingleUse(t *testing.T) {
+	is, _ := newTestService(t)
+	stub := newStubIdentityProvider(t)
+	is.IdentityProviders = map[string]*IdentityProvider{"stub": stub.provider(t, false)}
+
+	response, state := stub.signIn(t, is, map[string]interface{}{"sub": "subject-1"})
+	if code := errorCode(response); code != "" {
+		t.Fatalf("expected the first callback to succeed, got %+v", response)
+	}
+
+	response, _, _ = is.providerCallbackHandler(map[string]interface{}{"state": state, "code": "code"}, map[string]interface{}{})
+	if code := errorCode(response); code != "PVE_02" {
+		t.Errorf("expected PVE_02 for a used state, got %+v", response)
+	}
+}
+
+func TestProviderStateRedeemedOnceConcurrently(t *testing.T) {
+	is, storage := newTestService(t)
+	storage.insert("providerStates", ProviderState{
+		State:     hashToken("state"),
+		Provider:  "stub",
+		ExpiredAt: time.Now().Add(time.Minute).Unix(),
+	})
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	redeemed := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, err := is.redeemProviderState("state"); err == nil {
+				mutex.Lock()
+				redeemed++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if redeemed != 1 {
+		t.Errorf("expected exactly one callback to redeem the state, got %d", redeemed)
+	}
+}
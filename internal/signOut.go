@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+var (
+	errTokenNotFound     = errors.New("token not found")
+	errImpersonatedToken = errors.New("token is impersonated")
+)
+
+// tokenFromRequest returns the caller's access token. It is taken from the
+// metadata, the same place the auth middleware reads it from, and falls
+// back to the "token" field of the data.
+func tokenFromRequest(data interface{}, meta interface{}) string {
+	if metaMap, ok := meta.(map[string]interface{}); ok {
+		if token, ok := metaMap["token"].(string); ok && token != "" {
+			return token
+		}
+	}
+
+	if dataMap, ok := data.(map[string]interface{}); ok {
+		if token, ok := dataMap["token"].(string); ok {
+			return token
+		}
+	}
+
+	return ""
+}
+
+// getTokenOwnerID returns the id of the user the access token was issued to.
+func (is InternalService) getTokenOwnerID(token string) (string, error) {
+	tokenPermission, err := is.getTokenPermission(token)
+	if err != nil {
+		return "", err
+	}
+
+	return tokenPermission.UserID, nil
+}
+
+// getUserByToken returns the user the access token was issued to.
+func (is InternalService) getUserByToken(token string) (*entities.User, error) {
+	userID, err := is.getTokenOwnerID(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return is.UsersRepository.GetUserByID(userID)
+}
+
+// getUserByOwnToken is getUserByToken for methods changing the credentials
+// of the user.
+func (is InternalService) getUserByOwnToken(token string) (*entities.User, error) {
+	tokenPermission, err := is.getOwnTokenPermission(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return is.UsersRepository.GetUserByID(tokenPermission.UserID)
+}
+
+// getOwnTokenPermission is getTokenPermission for methods changing the
+// credentials or sessions of the user, which admins impersonating the user
+// cannot call.
+func (is InternalService) getOwnTokenPermission(token string) (*entities.TokenPermission, error) {
+	tokenPermission, err := is.getTokenPermission(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if tokenPermission.ImpersonatorID != "" {
+		return nil, errImpersonatedToken
+	}
+
+	return tokenPermission, nil
+}
+
+// getTokenPermission returns one of the permission rows of the access token,
+// which carries the token owner and session.
+func (is InternalService) getTokenPermission(token string) (*entities.TokenPermission, error) {
+	if token == "" {
+		return nil, errTokenNotFound
+	}
+
+	tokenPermissions, err := is.TokenPermissionsRepository.GetTokenPermissions(token, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokenPermissions) == 0 || tokenPermissions[0].UserID == "" {
+		return nil, errTokenNotFound
+	}
+
+	return &tokenPermissions[0], nil
+}
+
+// signOut revokes the session the access token was issued with. Tokens
+// issued before sessions existed are revoked on their own.
+func (is InternalService) signOut(token string) error {
+	tokenPermissions, err := is.TokenPermissionsRepository.GetTokenPermissions(token, false)
+	if err != nil {
+		return err
+	}
+
+	if len(tokenPermissions) > 0 && tokenPermissions[0].SessionID != "" {
+		return is.revokeSession(tokenPermissions[0].SessionID)
+	}
+
+	err = is.TokenPermissionsRepository.RemoveTokenPermissionsByTokens([]string{token})
+	if err != nil {
+		return err
+	}
+	is.PermissionCache.Invalidate("token", token)
+
+	return nil
+}
+
+// signOutAll revokes every session, access and refresh token of the user.
+func (is InternalService) signOutAll(userID string) error {
+	err := is.removeUserAccessTokens(userID)
+	if err != nil {
+		return err
+	}
+
+	err = is.removeRefreshTokens(map[string]interface{}{"user_id": userID})
+	if err != nil {
+		return err
+	}
+
+	return is.SessionsRepository.RemoveSessions(map[string]interface{}{"user_id": userID})
+}
+
+func (is *InternalService) signOutHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	token := tokenFromRequest(data, meta)
+	if token == "" {
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	err := is.signOut(token)
+	if err != nil {
+		log.Println("Cannot sign out, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse("Signed out successfully")
+}
+
+func (is *InternalService) signOutAllHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	tokenPermission, err := is.getOwnTokenPermission(tokenFromRequest(data, meta))
+	if err != nil {
+		if !errors.Is(err, errTokenNotFound) && !errors.Is(err, errImpersonatedToken) {
+			log.Println("Cannot get token owner, err:", err)
+		}
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	err = is.signOutAll(tokenPermission.UserID)
+	if err != nil {
+		log.Println("Cannot sign out everywhere, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse("Signed out everywhere successfully")
+}
+
+func (is *InternalService) signOutUserHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		log.Println("Invalid data format in signOutUserHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	userID, ok := dataMap["user_id"].(string)
+	if !ok || userID == "" {
+		return NewErrorResponse(
+			"InvalidUserIDError",
+			"IUE_03",
+			"Invalid user ID",
+		), http.StatusBadRequest, nil
+	}
+
+	err := is.signOutAll(userID)
+	if err != nil {
+		log.Println("Cannot sign out user, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse("User signed out successfully")
+}
+
+// removeUserAccessTokens removes the access tokens of the user. Sessions and
+// refresh tokens are kept, so a role change takes effect on the next refresh.
+func (is InternalService) removeUserAccessTokens(userID string) error {
+	err := is.TokenPermissionsRepository.RemoveTokenPermissionsByUserID(userID)
+	if err != nil {
+		return err
+	}
+	is.PermissionCache.Invalidate("user_id", userID)
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+// signInTestDevice signs in the stored user again, as from another device.
+func signInTestDevice(t *testing.T, is *InternalService, login string, password string, userAgent string) testSignIn {
+	t.Helper()
+
+	response, _, _ := is.signInHandler(
+		map[string]interface{}{"login": login, "password": password},
+		map[string]interface{}{"ip": "203.0.113.5", "user_agent": userAgent},
+	)
+
+	var result testSignIn
+	decodeResult(t, response, &result)
+
+	return result
+}
+
+// expectSignedIn checks whether the access and the refresh token of the sign
+// in are still accepted.
+func expectSignedIn(t *testing.T, is *InternalService, signIn testSignIn, expected bool) {
+	t.Helper()
+
+	if allowed := checkAllowed(t, is, Request{Microservice: "crud", Method: "read", Data: map[string]interface{}{"token": signIn.AccessToken}}); allowed != expected {
+		t.Errorf("expected the access token accepted %v, got %v", expected, allowed)
+	}
+
+	response, _ := refreshTestToken(is, signIn.RefreshToken.RefreshToken)
+	if refreshed := errorCode(response) == ""; refreshed != expected {
+		t.Errorf("expected the refresh token accepted %v, got %+v", expected, response)
+	}
+}
+
+func TestSignOut(t *testing.T) {
+	is, storage := newTestService(t)
+	first := signInTestUser(t, is, storage, entities.User{InternalId: "user", Email: "user@example.com"}, "password")
+	second := signInTestDevice(t, is, "user@example.com", "password", "phone")
+
+	response, _, _ := is.signOutHandler(nil, map[string]interface{}{"token": first.AccessToken})
+	if code := errorCode(response); code != "" {
+		t.Fatalf("expected to be signed out, got %+v", response)
+	}
+
+	expectSignedIn(t, is, first, false)
+	expectSignedIn(t, is, second, true)
+
+	response, _, _ = is.signOutHandler(map[string]interface{}{}, nil)
+	if code := errorCode(response); code != "TKE_01" {
+		t.Errorf("expected TKE_01 without a token, got %+v", response)
+	}
+}
+
+func TestSignOutAll(t *testing.T) {
+	is, storage := newTestService(t)
+	first := signInTestUser(t, is, storage, entities.User{InternalId: "user", Email: "user@example.com"}, "password")
+	second := signInTestDevice(t, is, "user@example.com", "password", "phone")
+	other := signInTestUser(t, is, storage, entities.User{InternalId: "other", Email: "other@example.com"}, "password")
+
+	response, _, _ := is.signOutAllHandler(map[string]interface{}{"token": first.AccessToken}, nil)
+	if code := errorCode(response); code != "" {
+		t.Fatalf("expected to be signed out everywhere, got %+v", response)
+	}
+
+	expectSignedIn(t, is, first, false)
+	expectSignedIn(t, is, second, false)
+	expectSignedIn(t, is, other, true)
+
+	response, _, _ = is.signOutAllHandler(map[string]interface{}{"token": first.AccessToken}, nil)
+	if code := errorCode(response); code != "TKE_01" {
+		t.Errorf("expected TKE_01 for a revoked token, got %+v", response)
+	}
+}
+
+func TestSignOutUser(t *testing.T) {
+	is, storage := newTestService(t)
+	signIn := signInTestUser(t, is, storage, entities.User{InternalId: "user", Email: "user@example.com"}, "password")
+	other := signInTestUser(t, is, storage, entities.User{InternalId: "other", Email: "other@example.com"}, "password")
+
+	response, _, _ := is.signOutUserHandler(map[string]interface{}{}, nil)
+	if code := errorCode(response); code != "IUE_03" {
+		t.Fatalf("expected IUE_03 without a user, got %+v", response)
+	}
+
+	response, _, _ = is.signOutUserHandler(map[string]interface{}{"user_id": "user"}, nil)
+	if code := errorCode(response); code != "" {
+		t.Fatalf("expected the user to be signed out, got %+v", response)
+	}
+
+	expectSignedIn(t, is, signIn, false)
+	expectSignedIn(t, is, other, true)
+}
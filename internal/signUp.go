@@ -70,7 +70,15 @@ func (is *InternalService) signUpHandler(data interface{}, meta interface{}) (in
 	}
 
 	userData, _ := dataMap["data"].(interface{})
-	user := is.createUser(email, phone, password, userData)
+	user, err := is.createUser(email, phone, password, userData)
+	if err != nil {
+		log.Println("Cannot hash password, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
 
 	usersMap, _, _ := is.getUsersHandler(map[string]interface{}{"___roles.data.alias": "admin"}, nil)
 	usersOk := usersMap.(ResponseOk)
@@ -79,7 +87,7 @@ func (is *InternalService) signUpHandler(data interface{}, meta interface{}) (in
 		user.AddRole(is.AdminRole)
 	}
 
-	err := is.UsersRepository.CreateUser(user)
+	err = is.UsersRepository.CreateUser(user)
 
 	if err != nil {
 		log.Println("Cannot Save to sai storage, err:", err)
@@ -0,0 +1,371 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/saiset-co/sai-storage-mongo/external/adapter"
+)
+
+var errTestDuplicateKey = errors.New("E11000 duplicate key error")
+
+// testStorage is an in-memory stand-in for sai-storage-mongo. It supports
+// the selectors and update operators the service uses. Like sai-storage, an
+// update finds the documents and updates them in two steps, and a create
+// fails for a duplicate _id.
+type testStorage struct {
+	mutex       sync.Mutex
+	collections map[string][]map[string]interface{}
+	// requests counts the requests per "method collection"
+	requests map[string]int
+	nextID   int
+}
+
+func newTestStorage(t *testing.T) (*adapter.SaiStorage, *testStorage) {
+	storage := &testStorage{
+		collections: map[string][]map[string]interface{}{},
+		requests:    map[string]int{},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(storage.serveHTTP))
+	t.Cleanup(server.Close)
+
+	return &adapter.SaiStorage{Url: server.URL}, storage
+}
+
+// insert stores the documents as the storage would after a create.
+func (s *testStorage) insert(collection string, documents ...interface{}) {
+	for _, document := range documents {
+		s.handle("create", collection, map[string]interface{}{"documents": []interface{}{document}})
+	}
+}
+
+// documents returns the stored documents of the collection.
+func (s *testStorage) documents(collection string) []map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]map[string]interface{}{}, s.collections[collection]...)
+}
+
+func (s *testStorage) requestCount(method string, collection string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.requests[method+" "+collection]
+}
+
+func (s *testStorage) resetRequestCounts() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.requests = map[string]int{}
+}
+
+func (s *testStorage) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Method string                 `json:"method"`
+		Data   map[string]interface{} `json:"data"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	collection, _ := request.Data["collection"].(string)
+	result, err := s.handle(request.Method, collection, request.Data)
+	w.Header().Set("Content-Type", "application/json")
+	if errors.Is(err, errTestDuplicateKey) {
+		// sai-storage answers storage errors with a NOK status
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"Status": "NOK", "Error": err.Error()})
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Status": "OK",
+		"result": result,
+		"count":  len(result),
+	})
+}
+
+func (s *testStorage) handle(method string, collection string, data map[string]interface{}) ([]map[string]interface{}, error) {
+	// Round trip through JSON, as the values would arrive over HTTP
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	data = map[string]interface{}{}
+	err = json.Unmarshal(encoded, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	s.requests[method+" "+collection]++
+	s.mutex.Unlock()
+
+	selectData, _ := data["select"].(map[string]interface{})
+	if method == "update" {
+		// The documents are found before the update, so they can be
+		// changed in between
+		s.mutex.Lock()
+		found := s.find(collection, selectData)
+		s.mutex.Unlock()
+
+		update, _ := data["document"].(map[string]interface{})
+		s.update(collection, selectData, update)
+
+		return found, nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := []map[string]interface{}{}
+	switch method {
+	case "create":
+		documents, _ := data["documents"].([]interface{})
+		for _, item := range documents {
+			document, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid document: %v", item)
+			}
+			if id, ok := document["_id"]; ok {
+				for _, existing := range s.collections[collection] {
+					if reflect.DeepEqual(existing["_id"], id) {
+						return nil, errTestDuplicateKey
+					}
+				}
+			}
+			if id, _ := document["internal_id"].(string); id == "" {
+				s.nextID++
+				document["internal_id"] = fmt.Sprintf("id-%d", s.nextID)
+			}
+			s.collections[collection] = append(s.collections[collection], document)
+			result = append(result, copyDocument(document))
+		}
+	case "read":
+		result = s.find(collection, selectData)
+	case "delete":
+		var kept []map[string]interface{}
+		for _, document := range s.collections[collection] {
+			if !documentMatches(document, selectData) {
+				kept = append(kept, document)
+			}
+		}
+		s.collections[collection] = kept
+	default:
+		return nil, fmt.Errorf("unsupported method: %s", method)
+	}
+
+	return result, nil
+}
+
+// find returns copies of the matching documents. The caller holds the mutex.
+func (s *testStorage) find(collection string, selectData map[string]interface{}) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	for _, document := range s.collections[collection] {
+		if documentMatches(document, selectData) {
+			result = append(result, copyDocument(document))
+		}
+	}
+
+	return result
+}
+
+func (s *testStorage) update(collection string, selectData map[string]interface{}, update map[string]interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, document := range s.collections[collection] {
+		if !documentMatches(document, selectData) {
+			continue
+		}
+		if set, ok := update["$set"].(map[string]interface{}); ok {
+			for path, value := range set {
+				setPath(document, path, value)
+			}
+		}
+		if unset, ok := update["$unset"].(map[string]interface{}); ok {
+			for path := range unset {
+				delete(document, path)
+			}
+		}
+	}
+}
+
+func copyDocument(document map[string]interface{}) map[string]interface{} {
+	encoded, _ := json.Marshal(document)
+	var copied map[string]interface{}
+	json.Unmarshal(encoded, &copied)
+
+	return copied
+}
+
+func setPath(document map[string]interface{}, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := document[part].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			document[part] = next
+		}
+		document = next
+	}
+	document[parts[len(parts)-1]] = value
+}
+
+func documentMatches(document map[string]interface{}, selectData map[string]interface{}) bool {
+	for key, condition := range selectData {
+		switch key {
+		case "$or", "$and":
+			items, _ := condition.([]interface{})
+			any := false
+			all := true
+			for _, item := range items {
+				itemSelect, _ := item.(map[string]interface{})
+				if documentMatches(document, itemSelect) {
+					any = true
+				} else {
+					all = false
+				}
+			}
+			if (key == "$or" && !any) || (key == "$and" && !all) {
+				return false
+			}
+		default:
+			value, exists := lookupPath(document, key)
+			if !valueMatchesCondition(value, exists, condition) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func lookupPath(document map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = document
+	for _, part := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = object[part]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+func valueMatchesCondition(value interface{}, exists bool, condition interface{}) bool {
+	operators, ok := condition.(map[string]interface{})
+	if !ok || !isOperatorMap(operators) {
+		return valueEquals(value, condition)
+	}
+
+	for operator, operand := range operators {
+		var matches bool
+		switch operator {
+		case "$in", "$nin":
+			items, _ := operand.([]interface{})
+			for _, item := range items {
+				matches = matches || valueEquals(value, item)
+			}
+			if operator == "$nin" {
+				matches = !matches
+			}
+		case "$ne":
+			matches = !valueEquals(value, operand)
+		case "$exists":
+			matches = exists == (operand == true)
+		case "$gt", "$gte", "$lt", "$lte":
+			left, leftOK := orderedValue(value)
+			right, rightOK := orderedValue(operand)
+			if !leftOK || !rightOK {
+				return false
+			}
+			matches = map[string]bool{
+				"$gt":  left > right,
+				"$gte": left >= right,
+				"$lt":  left < right,
+				"$lte": left <= right,
+			}[operator]
+		case "$elemMatch":
+			items, _ := value.([]interface{})
+			elementSelect, _ := operand.(map[string]interface{})
+			for _, item := range items {
+				element, ok := item.(map[string]interface{})
+				matches = matches || (ok && documentMatches(element, elementSelect))
+			}
+		default:
+			return false
+		}
+		if !matches {
+			return false
+		}
+	}
+
+	return true
+}
+
+// orderedValue returns numbers as they are and times, which arrive as
+// RFC 3339 strings, as unix nanoseconds.
+func orderedValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return 0, false
+		}
+		return float64(parsed.UnixNano()), true
+	default:
+		return 0, false
+	}
+}
+
+func isOperatorMap(condition map[string]interface{}) bool {
+	for key := range condition {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+
+	return len(condition) > 0
+}
+
+// valueEquals compares like MongoDB: a condition on an array field matches
+// when one of its elements is equal.
+func valueEquals(value interface{}, expected interface{}) bool {
+	if reflect.DeepEqual(value, expected) {
+		return true
+	}
+
+	if items, ok := value.([]interface{}); ok {
+		for _, item := range items {
+			if reflect.DeepEqual(item, expected) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
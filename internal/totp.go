@@ -0,0 +1,568 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+	"github.com/saiset-co/sai-storage-mongo/external/adapter"
+)
+
+// RFC 6238 parameters supported by all common authenticator apps
+const (
+	totpPeriod         = 30
+	totpDigits         = 6
+	totpSkew           = 1
+	totpSecretSize     = 20
+	recoveryCodesCount = 10
+
+	mfaChallengeExpiration = 5 * time.Minute
+)
+
+var errInvalidTOTPCode = errors.New("invalid totp code")
+
+type MFAChallenge struct {
+	Challenge string `json:"challenge"`
+	UserID    string `json:"user_id"`
+	ExpiredAt int64  `json:"expired_at"`
+}
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// totpCode computes the HOTP value (RFC 4226) for the given time step.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits))), nil
+}
+
+// verifyTOTP checks the code against the current time step and its
+// neighbours. Steps up to lastUsedStep are rejected, so a code cannot be
+// replayed. The matched step is returned.
+func verifyTOTP(secret string, code string, lastUsedStep int64) (int64, error) {
+	current := time.Now().Unix() / totpPeriod
+
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastUsedStep {
+			continue
+		}
+
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+
+	return 0, errInvalidTOTPCode
+}
+
+func (is *InternalService) totpURI(user *entities.User, secret string) string {
+	account := user.Email
+	if account == "" {
+		account = user.Phone
+	}
+
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", is.TOTPIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	return "otpauth://totp/" + url.PathEscape(is.TOTPIssuer+":"+account) + "?" + query.Encode()
+}
+
+func generateRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < recoveryCodesCount; i++ {
+		code, err := generateRandomToken(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		code = code[:5] + "-" + code[5:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code
+// and records its use on the user. The caller has to save the user.
+func verifySecondFactor(user *entities.User, code string, recoveryCode string) bool {
+	if user.TOTP == nil || user.TOTP.Secret == "" {
+		return false
+	}
+
+	if code != "" {
+		step, err := verifyTOTP(user.TOTP.Secret, code, user.TOTP.LastUsedStep)
+		if err != nil {
+			return false
+		}
+		user.TOTP.LastUsedStep = step
+		return true
+	}
+
+	if recoveryCode != "" {
+		hash := hashToken(strings.ToLower(strings.TrimSpace(recoveryCode)))
+		for i, stored := range user.TOTP.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+				user.TOTP.RecoveryCodes = append(user.TOTP.RecoveryCodes[:i], user.TOTP.RecoveryCodes[i+1:]...)
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// completeSignIn finishes any sign in flow for an authenticated user. Users
+// with 2FA enabled get a challenge token instead of access tokens.
+func (is *InternalService) completeSignIn(user *entities.User, meta interface{}) (interface{}, int, error) {
+	if user.TOTP != nil && user.TOTP.Enabled {
+		challenge, err := is.createMFAChallenge(user)
+		if err != nil {
+			log.Println("Cannot create 2FA challenge, err:", err)
+			return NewErrorResponse(
+				"ServerError",
+				"SVE_06",
+				"Internal server error",
+			), http.StatusInternalServerError, err
+		}
+
+		return NewOkResponse(map[string]interface{}{
+			"mfa_required":    true,
+			"challenge_token": challenge,
+		})
+	}
+
+	session, err := is.startSession(user, meta, "")
+	if err != nil {
+		log.Println("Cannot start session, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return is.signInResponse(user, session)
+}
+
+func (is *InternalService) createMFAChallenge(user *entities.User) (string, error) {
+	challenge, err := generateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	req := adapter.Request{
+		Method: "create",
+		Data: adapter.CreateRequest{
+			Collection: "mfaChallenges",
+			Documents: []interface{}{
+				MFAChallenge{
+					Challenge: hashToken(challenge),
+					UserID:    user.InternalId,
+					ExpiredAt: time.Now().Add(mfaChallengeExpiration).Unix(),
+				},
+			},
+		},
+	}
+
+	if _, err := is.Storage.Send(req); err != nil {
+		return "", fmt.Errorf("failed to save 2FA challenge: %v", err)
+	}
+
+	return challenge, nil
+}
+
+func (is *InternalService) getMFAChallenge(challenge string) (*MFAChallenge, error) {
+	req := adapter.Request{
+		Method: "read",
+		Data: adapter.ReadRequest{
+			Collection: "mfaChallenges",
+			Select: map[string]interface{}{
+				"challenge": hashToken(challenge),
+				"expired_at": map[string]interface{}{
+					"$gt": time.Now().Unix(),
+				},
+			},
+		},
+	}
+
+	res, err := is.Storage.Send(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get 2FA challenge: %v", err)
+	}
+
+	if len(res.Result) == 0 {
+		return nil, errors.New("2FA challenge not found")
+	}
+
+	var challenges []MFAChallenge
+	itemBytes, err := json.Marshal(res.Result)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(itemBytes, &challenges)
+	if err != nil {
+		return nil, err
+	}
+
+	return &challenges[0], nil
+}
+
+func (is *InternalService) removeMFAChallenge(challenge *MFAChallenge) error {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: "mfaChallenges",
+			Select: map[string]interface{}{
+				"challenge": challenge.Challenge,
+			},
+		},
+	}
+
+	if _, err := is.Storage.Send(req); err != nil {
+		return fmt.Errorf("failed to remove 2FA challenge: %v", err)
+	}
+
+	return nil
+}
+
+func (is *InternalService) removeExpiredMFAChallenges() {
+	req := adapter.Request{
+		Method: "delete",
+		Data: adapter.DeleteRequest{
+			Collection: "mfaChallenges",
+			Select: map[string]interface{}{
+				"expired_at": map[string]interface{}{
+					"$lt": time.Now().Unix(),
+				},
+			},
+		},
+	}
+
+	if _, err := is.Storage.Send(req); err != nil {
+		log.Printf("Error removing expired 2FA challenges: %v", err)
+	}
+}
+
+func (is *InternalService) enrollTOTPHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	user, err := is.getUserByOwnToken(tokenFromRequest(data, meta))
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	if user.TOTP != nil && user.TOTP.Enabled {
+		return NewErrorResponse(
+			"TwoFactorError",
+			"TFE_01",
+			"Two-factor authentication is already enabled",
+		), http.StatusBadRequest, nil
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		log.Println("Cannot generate TOTP secret, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	user.TOTP = &entities.TOTP{
+		Secret: secret,
+	}
+
+	err = is.UsersRepository.UpdateUser(user)
+	if err != nil {
+		log.Println("Cannot update user data, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse(map[string]interface{}{
+		"secret": secret,
+		"uri":    is.totpURI(user, secret),
+	})
+}
+
+func (is *InternalService) confirmTOTPHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		log.Println("Invalid data format in confirmTOTPHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	user, err := is.getUserByOwnToken(tokenFromRequest(data, meta))
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	if user.TOTP == nil || user.TOTP.Secret == "" || user.TOTP.Enabled {
+		return NewErrorResponse(
+			"TwoFactorError",
+			"TFE_02",
+			"Two-factor authentication enrollment is not started",
+		), http.StatusBadRequest, nil
+	}
+
+	code, _ := dataMap["code"].(string)
+	if !verifySecondFactor(user, code, "") {
+		return NewErrorResponse(
+			"TwoFactorError",
+			"TFE_03",
+			"Invalid two-factor authentication code",
+		), http.StatusBadRequest, nil
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Println("Cannot generate recovery codes, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	user.TOTP.Enabled = true
+	user.TOTP.RecoveryCodes = hashes
+
+	err = is.UsersRepository.UpdateUser(user)
+	if err != nil {
+		log.Println("Cannot update user data, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse(map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
+func (is *InternalService) disableTOTPHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		log.Println("Invalid data format in disableTOTPHandler")
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, nil
+	}
+
+	user, err := is.getUserByOwnToken(tokenFromRequest(data, meta))
+	if err != nil {
+		return NewErrorResponse(
+			"InvalidTokenError",
+			"TKE_01",
+			"Token is missing, invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	if user.TOTP == nil || !user.TOTP.Enabled {
+		return NewErrorResponse(
+			"TwoFactorError",
+			"TFE_04",
+			"Two-factor authentication is not enabled",
+		), http.StatusBadRequest, nil
+	}
+
+	code, _ := dataMap["code"].(string)
+	recoveryCode, _ := dataMap["recovery_code"].(string)
+	if !verifySecondFactor(user, code, recoveryCode) {
+		return NewErrorResponse(
+			"TwoFactorError",
+			"TFE_03",
+			"Invalid two-factor authentication code",
+		), http.StatusBadRequest, nil
+	}
+
+	// An empty struct is stored, since $set does not remove omitted fields
+	user.TOTP = &entities.TOTP{}
+
+	err = is.UsersRepository.UpdateUser(user)
+	if err != nil {
+		log.Println("Cannot update user data, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return NewOkResponse("Two-factor authentication disabled")
+}
+
+func (is *InternalService) signInTOTPHandler(data interface{}, meta interface{}) (interface{}, int, error) {
+	metaMap, _ := meta.(map[string]interface{})
+	ip, _ := metaMap["ip"].(string)
+
+	if is.isFlooder(ip) {
+		log.Println("Flood protection in signInTOTPHandler")
+
+		return NewErrorResponse(
+			"FloodError",
+			"DFE_07",
+			"Flood protection",
+		), http.StatusBadRequest, nil
+	}
+
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		log.Println("Invalid data format in signInTOTPHandler")
+		is.FloodAdd(ip)
+
+		return NewErrorResponse(
+			"InvalidDataFormatError",
+			"DFE_01",
+			"Invalid data format",
+		), http.StatusBadRequest, errors.New("invalid data format")
+	}
+
+	rules := map[string]interface{}{
+		"challenge_token": "required",
+	}
+	errs := is.Validate.ValidateMap(dataMap, rules)
+	if len(errs) > 0 {
+		log.Println("Validation error in signInTOTPHandler:", errs)
+		is.FloodAdd(ip)
+
+		return createErrorResponse(errs), http.StatusBadRequest, errors.New("not valid data")
+	}
+
+	challenge, err := is.getMFAChallenge(dataMap["challenge_token"].(string))
+	if err != nil {
+		is.FloodAdd(ip)
+		return NewErrorResponse(
+			"TwoFactorError",
+			"TFE_05",
+			"Two-factor authentication challenge is invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	user, err := is.UsersRepository.GetUserByID(challenge.UserID)
+	if err != nil {
+		is.FloodAdd(ip)
+		return NewErrorResponse(
+			"UserNotFoundError",
+			"UNF_01",
+			"User not found or password is incorrect",
+		), http.StatusBadRequest, nil
+	}
+
+	code, _ := dataMap["code"].(string)
+	recoveryCode, _ := dataMap["recovery_code"].(string)
+	if !verifySecondFactor(user, code, recoveryCode) {
+		is.FloodAdd(ip)
+		return NewErrorResponse(
+			"TwoFactorError",
+			"TFE_03",
+			"Invalid two-factor authentication code",
+		), http.StatusBadRequest, nil
+	}
+
+	// Of concurrent requests with the challenge only the first one signs in
+	redeemed, err := is.redeem("mfa_challenge", dataMap["challenge_token"].(string), challenge.ExpiredAt)
+	if err != nil {
+		log.Println("Cannot redeem 2FA challenge, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+	if !redeemed {
+		is.FloodAdd(ip)
+		return NewErrorResponse(
+			"TwoFactorError",
+			"TFE_05",
+			"Two-factor authentication challenge is invalid or expired",
+		), http.StatusUnauthorized, nil
+	}
+
+	// Persist the used step or recovery code before issuing tokens
+	err = is.UsersRepository.UpdateUser(user)
+	if err != nil {
+		log.Println("Cannot update user data, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	err = is.removeMFAChallenge(challenge)
+	if err != nil {
+		log.Println("Cannot remove 2FA challenge, err:", err)
+	}
+
+	session, err := is.startSession(user, meta, "")
+	if err != nil {
+		log.Println("Cannot start session, err:", err)
+		return NewErrorResponse(
+			"ServerError",
+			"SVE_06",
+			"Internal server error",
+		), http.StatusInternalServerError, err
+	}
+
+	return is.signInResponse(user, session)
+}
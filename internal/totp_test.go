@@ -0,0 +1,265 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Limpid-LLC/go-auth/internal/entities"
+)
+
+// base32 of the RFC 6238 SHA1 test secret "12345678901234567890"
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// The RFC 6238 appendix B vectors, truncated to 6 digits
+	tests := []struct {
+		time     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		code, err := totpCode(rfc6238Secret, test.time/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != test.expected {
+			t.Errorf("%d: expected %s, got %s", test.time, test.expected, code)
+		}
+	}
+}
+
+// currentTOTPCode returns the code of the current step moved by offset.
+func currentTOTPCode(t *testing.T, secret string, offset int64) (string, int64) {
+	t.Helper()
+
+	step := time.Now().Unix()/totpPeriod + offset
+	code, err := totpCode(secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return code, step
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	current := time.Now().Unix() / totpPeriod
+
+	tests := []struct {
+		name         string
+		offset       int64
+		lastUsedStep int64
+		valid        bool
+	}{
+		{"current step", 0, 0, true},
+		{"previous step", -1, 0, true},
+		{"next step", 1, 0, true},
+		{"outside the skew", -2, 0, false},
+		{"outside the skew ahead", 2, 0, false},
+		{"step already used", 0, current, false},
+		{"later step than the used one", 1, current, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, step := currentTOTPCode(t, rfc6238Secret, test.offset)
+
+			matched, err := verifyTOTP(rfc6238Secret, code, test.lastUsedStep)
+			if (err == nil) != test.valid {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+			if test.valid && matched != step {
+				t.Errorf("expected step %d, got %d", step, matched)
+			}
+		})
+	}
+}
+
+func TestVerifySecondFactor(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodesCount || codes[0] == hashes[0] {
+		t.Fatalf("expected %d hashed recovery codes, got %v", recoveryCodesCount, hashes)
+	}
+
+	user := &entities.User{TOTP: &entities.TOTP{Secret: rfc6238Secret, Enabled: true, RecoveryCodes: hashes}}
+
+	code, step := currentTOTPCode(t, rfc6238Secret, 0)
+	if !verifySecondFactor(user, code, "") {
+		t.Fatal("expected the code to be accepted")
+	}
+	if user.TOTP.LastUsedStep != step {
+		t.Errorf("expected the used step %d to be recorded, got %d", step, user.TOTP.LastUsedStep)
+	}
+	if verifySecondFactor(user, code, "") {
+		t.Error("expected a used code to be refused")
+	}
+
+	// Recovery codes are matched case-insensitively and work once
+	if !verifySecondFactor(user, "", " "+codes[3]+" ") {
+		t.Fatal("expected the recovery code to be accepted")
+	}
+	if len(user.TOTP.RecoveryCodes) != recoveryCodesCount-1 {
+		t.Errorf("expected the recovery code to be consumed, got %d left", len(user.TOTP.RecoveryCodes))
+	}
+	if verifySecondFactor(user, "", codes[3]) {
+		t.Error("expected a used recovery code to be refused")
+	}
+	if verifySecondFactor(user, "", "00000-00000") {
+		t.Error("expected an unknown recovery code to be refused")
+	}
+
+	if verifySecondFactor(&entities.User{}, code, "") {
+		t.Error("expected a user without 2FA to be refused")
+	}
+}
+
+type testMFAChallenge struct {
+	MFARequired    bool   `json:"mfa_required"`
+	ChallengeToken string `json:"challenge_token"`
+}
+
+// signInChallenge signs in with the password and returns the 2FA challenge.
+func signInChallenge(t *testing.T, is *InternalService) string {
+	t.Helper()
+
+	response, _, _ := is.signInHandler(
+		map[string]interface{}{"login": "user@example.com", "password": "password"},
+		map[string]interface{}{"ip": "203.0.113.5"},
+	)
+
+	var result testMFAChallenge
+	decodeResult(t, response, &result)
+	if !result.MFARequired || result.ChallengeToken == "" {
+		t.Fatalf("expected a 2FA challenge, got %+v", result)
+	}
+
+	return result.ChallengeToken
+}
+
+func signInTOTP(is *InternalService, challenge string, code string, recoveryCode string) interface{} {
+	response, _, _ := is.signInTOTPHandler(
+		map[string]interface{}{"challenge_token": challenge, "code": code, "recovery_code": recoveryCode},
+		map[string]interface{}{"ip": "203.0.113.5"},
+	)
+
+	return response
+}
+
+func TestTOTPSignIn(t *testing.T) {
+	is, storage := newTestService(t)
+	signIn := signInTestUser(t, is, storage, entities.User{InternalId: "user", Email: "user@example.com"}, "password")
+	meta := map[string]interface{}{"token": signIn.AccessToken}
+
+	response, _, _ := is.enrollTOTPHandler(nil, meta)
+	var enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	decodeResult(t, response, &enrollment)
+
+	// Enrollment is pending until a code is confirmed
+	response, _, _ = is.signInHandler(
+		map[string]interface{}{"login": "user@example.com", "password": "password"},
+		map[string]interface{}{"ip": "203.0.113.5"},
+	)
+	var pending testSignIn
+	decodeResult(t, response, &pending)
+	if pending.AccessToken == "" {
+		t.Fatalf("expected tokens before the enrollment is confirmed, got %+v", response)
+	}
+
+	response, _, _ = is.confirmTOTPHandler(map[string]interface{}{"code": "000000"}, meta)
+	if code := errorCode(response); code != "TFE_03" {
+		t.Fatalf("expected TFE_03 for a wrong code, got %+v", response)
+	}
+
+	code, _ := currentTOTPCode(t, enrollment.Secret, 0)
+	response, _, _ = is.confirmTOTPHandler(map[string]interface{}{"code": code}, meta)
+	var confirmation struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	decodeResult(t, response, &confirmation)
+	if len(confirmation.RecoveryCodes) != recoveryCodesCount {
+		t.Fatalf("expected %d recovery codes, got %+v", recoveryCodesCount, confirmation)
+	}
+
+	// The code used to confirm cannot sign in
+	challenge := signInChallenge(t, is)
+	if code := errorCode(signInTOTP(is, challenge, code, "")); code != "TFE_03" {
+		t.Fatalf("expected TFE_03 for a replayed code, got %s", code)
+	}
+
+	nextCode, _ := currentTOTPCode(t, enrollment.Secret, 1)
+	var result testSignIn
+	decodeResult(t, signInTOTP(is, challenge, nextCode, ""), &result)
+	if result.AccessToken == "" {
+		t.Fatalf("expected an access token, got %+v", result)
+	}
+
+	if code := errorCode(signInTOTP(is, challenge, "", confirmation.RecoveryCodes[0])); code != "TFE_05" {
+		t.Errorf("expected the challenge to work once, got %s", code)
+	}
+
+	challenge = signInChallenge(t, is)
+	decodeResult(t, signInTOTP(is, challenge, "", confirmation.RecoveryCodes[0]), &result)
+	challenge = signInChallenge(t, is)
+	if code := errorCode(signInTOTP(is, challenge, "", confirmation.RecoveryCodes[0])); code != "TFE_03" {
+		t.Errorf("expected the recovery code to work once, got %s", code)
+	}
+
+	if code := errorCode(signInTOTP(is, "unknown", nextCode, "")); code != "TFE_05" {
+		t.Errorf("expected TFE_05 for an unknown challenge, got %s", code)
+	}
+}
+
+func TestTOTPSignInConcurrently(t *testing.T) {
+	is, storage := newTestService(t)
+	hash, err := is.hashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.insert("users", entities.User{
+		InternalId:     "user",
+		Email:          "user@example.com",
+		HashedPassword: hash,
+		TOTP:           &entities.TOTP{Secret: rfc6238Secret, Enabled: true, RecoveryCodes: hashes},
+	})
+
+	challenge := signInChallenge(t, is)
+	code, _ := currentTOTPCode(t, rfc6238Secret, 0)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	signedIn := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, ok := signInTOTP(is, challenge, code, "").(ResponseOk); ok {
+				mutex.Lock()
+				signedIn++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if signedIn != 1 {
+		t.Errorf("expected exactly one sign in with the challenge, got %d", signedIn)
+	}
+}
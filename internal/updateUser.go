@@ -1,12 +1,44 @@
 package internal
 
 import (
+	"errors"
 	"github.com/Limpid-LLC/go-auth/logger"
 	"github.com/saiset-co/sai-storage-mongo/external/adapter"
 	"go.uber.org/zap"
 	"net/http"
+	"strings"
 )
 
+// restrictedUserFields cannot be set through update_user: the password is
+// hashed from "password", the TOTP secret is set by enrollment and the
+// identities by linking, since an identity signs in as the user.
+var restrictedUserFields = []string{"___password", "___totp", "___identities"}
+
+// credentialUserFields are the fields a user signs in with.
+var credentialUserFields = []string{"password", "email", "phone"}
+
+func hasCredentialField(updateData map[string]interface{}) bool {
+	for _, field := range credentialUserFields {
+		if _, ok := updateData[field]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isRestrictedUserField also matches the nested paths of the fields, which
+// would set them in part.
+func isRestrictedUserField(field string) bool {
+	for _, restricted := range restrictedUserFields {
+		if field == restricted || strings.HasPrefix(field, restricted+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (is *InternalService) updateUserHandler(data interface{}, meta interface{}) (interface{}, int, error) {
 	req, ok := data.(map[string]interface{})
 	if !ok {
@@ -42,18 +74,41 @@ func (is *InternalService) updateUserHandler(data interface{}, meta interface{})
 		), http.StatusBadRequest, nil
 	}
 
-	// Restrict "___password" field
-	if _, ok := updateData["___password"]; ok {
-		return NewErrorResponse(
-			"RestrictedFieldError",
-			"RFE_02",
-			"Restricted field",
-		), http.StatusBadRequest, nil
+	// Restrict the fields changed only by their own methods
+	for field := range updateData {
+		if isRestrictedUserField(field) {
+			return NewErrorResponse(
+				"RestrictedFieldError",
+				"RFE_02",
+				"Restricted field",
+			), http.StatusBadRequest, nil
+		}
+	}
+
+	// Admins impersonating the user cannot change how it signs in
+	if hasCredentialField(updateData) {
+		_, err := is.getOwnTokenPermission(tokenFromRequest(nil, meta))
+		if errors.Is(err, errImpersonatedToken) {
+			return NewErrorResponse(
+				"RestrictedFieldError",
+				"RFE_02",
+				"Restricted field",
+			), http.StatusBadRequest, nil
+		}
 	}
 
 	// If password is provided, hash it
 	if password, ok := updateData["password"]; ok {
-		updateData["___password"] = is.hashAndSaltPassword(password.(string))
+		hashedPassword, err := is.hashPassword(password.(string))
+		if err != nil {
+			logger.Logger.Error("Cannot hash password", zap.Error(err))
+			return NewErrorResponse(
+				"ServerError",
+				"SVE_06",
+				"Internal server error",
+			), http.StatusInternalServerError, nil
+		}
+		updateData["___password"] = hashedPassword
 		delete(updateData, "password")
 	}
 
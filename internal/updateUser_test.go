@@ -0,0 +1,42 @@
+package internal
+
+import "testing"
+
+func TestIsRestrictedUserField(t *testing.T) {
+	tests := map[string]bool{
+		"___password":     true,
+		"___totp":         true,
+		"___totp.secret":  true,
+		"___totp.enabled": true,
+		"password":        false,
+		"email":           false,
+		"data.name":       false,
+		"___totp_backup":  false,
+	}
+
+	for field, restricted := range tests {
+		if isRestrictedUserField(field) != restricted {
+			t.Errorf("expected %q restricted=%v", field, restricted)
+		}
+	}
+}
+
+func TestUpdateUserRejectsRestrictedFields(t *testing.T) {
+	is, storage := newTestService(t)
+	storage.insert("users", map[string]interface{}{"internal_id": "user", "email": "user@example.com"})
+
+	for _, field := range []string{"___password", "___totp", "___totp.secret", "___identities"} {
+		response, status, _ := is.updateUserHandler(map[string]interface{}{
+			"Select": map[string]interface{}{"internal_id": "user"},
+			"Data":   map[string]interface{}{field: "value"},
+		}, nil)
+
+		if errorCode(response) != "RFE_02" || status != 400 {
+			t.Errorf("expected %s to be rejected, got %d %+v", field, status, response)
+		}
+	}
+
+	if storage.requestCount("update", "users") != 0 {
+		t.Error("expected no update to be sent")
+	}
+}
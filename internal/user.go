@@ -2,12 +2,17 @@ package internal
 
 import "github.com/Limpid-LLC/go-auth/internal/entities"
 
-func (is InternalService) createUser(email string, phone string, password string, data interface{}) *entities.User {
+func (is InternalService) createUser(email string, phone string, password string, data interface{}) (*entities.User, error) {
+	hashedPassword, err := is.hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
 	return &entities.User{
 		Email:          email,
 		Phone:          phone,
-		HashedPassword: is.hashAndSaltPassword(password),
+		HashedPassword: hashedPassword,
 		Roles:          nil,
 		Data:           data,
-	}
+	}, nil
 }
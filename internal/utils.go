@@ -16,10 +16,11 @@ func generateRandomToken(n int) (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-func (is *InternalService) hashAndSaltPassword(password string) string {
-	saltedPassword := password + is.Salt
-	hashedPassword := sha256.Sum256([]byte(saltedPassword))
-	return hex.EncodeToString(hashedPassword[:])
+// hashToken returns the sha256 hex digest of a high-entropy token. Tokens
+// that are stored only as hashes are looked up by this digest.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
 }
 
 func startCleanupRoutine(ctx context.Context, interval time.Duration, cleanCallback func()) {
@@ -34,3 +35,13 @@ func startCleanupRoutine(ctx context.Context, interval time.Duration, cleanCallb
 		}
 	}
 }
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/saiset-co/sai-storage-mongo/external/adapter"
 	"log"
+	"net/http"
 	_ "net/http/pprof"
 	"time"
 )
@@ -48,12 +49,14 @@ func main() {
 	if err != nil {
 		log.Fatalln(errors.Wrap(err, "Default role un-marshal error"))
 	}
+	role = role.Canonical()
 
 	var aRole entities.Role
 	err = json.Unmarshal([]byte(adminRole), &aRole)
 	if err != nil {
 		log.Fatalln(errors.Wrap(err, "Admin role un-marshal error"))
 	}
+	aRole = aRole.Canonical()
 
 	salt := svc.GetConfig("common.encryption.salt", "").(string)
 
@@ -61,9 +64,110 @@ func main() {
 		log.Fatalln(errors.Wrap(err, "Salt should be define in config"))
 	}
 
+	pepper := svc.GetConfig("common.encryption.pepper", "").(string)
+	passwordAlgorithm := svc.GetConfig("common.encryption.algorithm", internal.PasswordAlgorithmArgon2id).(string)
+
+	if passwordAlgorithm != internal.PasswordAlgorithmArgon2id && passwordAlgorithm != internal.PasswordAlgorithmBcrypt {
+		log.Fatalln("Unsupported password algorithm: " + passwordAlgorithm)
+	}
+
+	jwtEnabled := svc.GetConfig("tokens.jwt.enabled", false).(bool)
+	jwtKeys := svc.GetConfig("tokens.jwt.keys", []interface{}{}).([]interface{})
+
+	var signingKeys []internal.SigningKey
+	for _, item := range jwtKeys {
+		if !jwtEnabled {
+			break
+		}
+
+		keyConfig, ok := item.(map[string]interface{})
+		if !ok {
+			log.Fatalln("JWT key config should be a map")
+		}
+
+		kid, _ := keyConfig["kid"].(string)
+		algorithm, _ := keyConfig["algorithm"].(string)
+		privateKeyFile, _ := keyConfig["private_key_file"].(string)
+
+		signingKey, err := internal.LoadSigningKey(kid, algorithm, privateKeyFile)
+		if err != nil {
+			log.Fatalln(errors.Wrap(err, "JWT key load error"))
+		}
+
+		signingKeys = append(signingKeys, signingKey)
+	}
+
+	if jwtEnabled && len(signingKeys) == 0 {
+		log.Fatalln("JWT signing keys should be defined in config")
+	}
+
+	oidcClaims := map[string]string{}
+	for claim, path := range svc.GetConfig("tokens.oidc.claims", map[string]interface{}{}).(map[string]interface{}) {
+		dataPath, ok := path.(string)
+		if !ok {
+			log.Fatalln("OIDC claim " + claim + " should be a User.Data path")
+		}
+		oidcClaims[claim] = dataPath
+	}
+
+	identityProviders := map[string]*internal.IdentityProvider{}
+	for _, item := range svc.GetConfig("identity_providers", []interface{}{}).([]interface{}) {
+		providerConfig, ok := item.(map[string]interface{})
+		if !ok {
+			log.Fatalln("Identity provider config should be a map")
+		}
+
+		provider, err := internal.NewIdentityProvider(providerConfig)
+		if err != nil {
+			log.Fatalln(errors.Wrap(err, "Identity provider config error"))
+		}
+
+		identityProviders[provider.Name] = provider
+	}
+
+	var serviceTokens []entities.ServiceToken
+	for _, item := range svc.GetConfig("service_tokens", []interface{}{}).([]interface{}) {
+		serviceTokenConfig, ok := item.(map[string]interface{})
+		if !ok {
+			log.Fatalln("Service token config should be a map")
+		}
+
+		configTokens, err := internal.NewServiceTokens(serviceTokenConfig)
+		if err != nil {
+			log.Fatalln(errors.Wrap(err, "Service token config error"))
+		}
+
+		serviceTokens = append(serviceTokens, configTokens...)
+	}
+
+	// The former master token allowed every method, it is not turned into a
+	// service token silently
+	if svc.GetConfig("tokens.token", "").(string) != "" {
+		log.Fatalln("tokens.token is no longer supported, define named tokens with limited permissions in service_tokens")
+	}
+
+	var authenticators []internal.Authenticator
+	if svc.GetConfig("ldap.enabled", false).(bool) {
+		ldapConfig, ok := svc.GetConfig("ldap", map[string]interface{}{}).(map[string]interface{})
+		if !ok {
+			log.Fatalln("LDAP config should be a map")
+		}
+
+		ldapAuthenticator, err := internal.NewLDAPAuthenticator(ldapConfig)
+		if err != nil {
+			log.Fatalln(errors.Wrap(err, "LDAP config error"))
+		}
+
+		authenticators = append(authenticators, ldapAuthenticator)
+	}
+
 	authUrl := svc.GetConfig("common.auth.url", "").(string)
 	authFloodLimit := svc.GetConfig("common.auth.flood_limit", "").(int)
 	authFloodDuration := svc.GetConfig("common.auth.flood_duration", "").(int)
+	trustedProxies, err := internal.ParseTrustedProxies(svc.GetConfig("common.auth.trusted_proxies", []interface{}{}).([]interface{}))
+	if err != nil {
+		log.Fatalln(errors.Wrap(err, "Trusted proxies config error"))
+	}
 
 	usersRepository := &repo.UsersRepository{
 		Storage:    store,
@@ -75,12 +179,51 @@ func main() {
 		Collection: "tokenPermissions",
 	}
 
+	sessionsRepository := &repo.SessionsRepository{
+		Storage:    store,
+		Collection: "sessions",
+	}
+
+	oauthClientsRepository := &repo.OAuthClientsRepository{
+		Storage:    store,
+		Collection: "oauthClients",
+	}
+
+	apiKeysRepository := &repo.APIKeysRepository{
+		Storage:    store,
+		Collection: "apiKeys",
+	}
+
+	serviceTokensRepository := &repo.ServiceTokensRepository{
+		Storage:    store,
+		Collection: "serviceTokens",
+	}
+
+	permissionInvalidationsRepository := &repo.PermissionInvalidationsRepository{
+		Storage:    store,
+		Collection: "permissionInvalidations",
+	}
+
+	cacheConfig, ok := svc.GetConfig("tokens.cache", map[string]interface{}{}).(map[string]interface{})
+	if !ok {
+		log.Fatalln("Token cache config should be a map")
+	}
+	permissionCache, err := internal.NewPermissionCache(cacheConfig, permissionInvalidationsRepository)
+	if err != nil {
+		log.Fatalln(errors.Wrap(err, "Token cache config error"))
+	}
+
 	is := internal.InternalService{
 		Context: svc.Context,
 		Storage: store,
 
 		UsersRepository:            usersRepository,
 		TokenPermissionsRepository: tokenPermissionsRepository,
+		SessionsRepository:         sessionsRepository,
+		OAuthClientsRepository:     oauthClientsRepository,
+		APIKeysRepository:          apiKeysRepository,
+		ServiceTokensRepository:    serviceTokensRepository,
+		PermissionCache:            permissionCache,
 
 		DefaultRole: role,
 		AdminRole:   aRole,
@@ -94,14 +237,19 @@ func main() {
 		EmailServiceUrl: emailServiceUrl,
 		EmailSender:     emailSender,
 
-		Salt: salt,
+		Salt:              salt,
+		Pepper:            pepper,
+		PasswordAlgorithm: passwordAlgorithm,
 
 		TokenExpirations: entities.TokenExpirations{
-			AccessToken:  time.Duration(svc.GetConfig("tokens.expiration.access_token", 0).(int)),
-			RefreshToken: time.Duration(svc.GetConfig("tokens.expiration.refresh_token", 0).(int)),
+			AccessToken:   time.Duration(svc.GetConfig("tokens.expiration.access_token", 0).(int)),
+			RefreshToken:  time.Duration(svc.GetConfig("tokens.expiration.refresh_token", 0).(int)),
+			LinkToken:     time.Duration(svc.GetConfig("tokens.expiration.link_token", int(15*time.Minute)).(int)),
+			Impersonation: time.Duration(svc.GetConfig("tokens.expiration.impersonation", int(15*time.Minute)).(int)),
 		},
+		LegacyPerRoleTokens: svc.GetConfig("tokens.legacy_per_role_tokens", false).(bool),
 
-		MasterToken: svc.GetConfig("tokens.token", "").(string),
+		ServiceTokens: serviceTokens,
 
 		RoutineExecutionPeriods: entities.RoutineExecutionPeriods{
 			Otp:          time.Duration(svc.GetConfig("tokens.routine_execution_period.otp", 0).(int)),
@@ -109,9 +257,22 @@ func main() {
 			RefreshToken: time.Duration(svc.GetConfig("tokens.routine_execution_period.refresh_token", 0).(int)),
 		},
 
+		TOTPIssuer: svc.GetConfig("common.totp.issuer", name).(string),
+
+		JWTEnabled:  jwtEnabled,
+		JWTIssuer:   svc.GetConfig("tokens.jwt.issuer", name).(string),
+		SigningKeys: signingKeys,
+		OIDCClaims:  oidcClaims,
+
+		LinkBaseUrl: svc.GetConfig("common.links.base_url", "").(string),
+
+		IdentityProviders: identityProviders,
+		Authenticators:    authenticators,
+
 		AuthUrl:           authUrl,
 		AuthFloodLimit:    authFloodLimit,
 		AuthFloodDuration: authFloodDuration,
+		TrustedProxies:    trustedProxies,
 		Name:              name,
 	}
 
@@ -119,6 +280,10 @@ func main() {
 		is.NewHandler(),
 	)
 
+	for path, handler := range is.NewHTTPHandlers() {
+		http.HandleFunc(path, handler)
+	}
+
 	svc.RegisterInitTask(is.Init)
 
 	svc.Start()